@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// aggregateFeatureNames are the columns of --aggregate rows, in row order: the
+// bucket start (Unix seconds) and counts over the host pair's packets in it.
+// The origin is the host that sent the bucket's first packet.
+var aggregateFeatureNames = []string{
+	"window_start",
+	"packets",
+	"bytes",        // Sum of the packets' extracted sizes
+	"duration",     // Seconds between the bucket's first and last packet
+	"origin_ports", // Distinct ports used by the origin
+	"peer_ports",   // Distinct ports used by the other host, e.g. a port scan's targets
+	"syn",          // TCP SYN packets without ACK (connection attempts)
+}
+
+// aggregatePacketValues returns what an --aggregate row needs of a packet
+// besides its size and direction: its source and destination ports (-1
+// without TCP, UDP or SCTP) and 1 if it is a SYN without ACK. They are
+// carried as the packet's features until its bucket is aggregated.
+func aggregatePacketValues(packet gopacket.Packet) []float64 {
+	values := []float64{-1, -1, 0}
+	if transport := packet.TransportLayer(); transport != nil {
+		src, dst := transport.TransportFlow().Endpoints()
+		values[0], values[1] = float64(endpointPort(src)), float64(endpointPort(dst))
+	}
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && tcp.SYN && !tcp.ACK {
+		values[2] = 1
+	}
+	return values
+}
+
+// endpointPort returns the port of a transport endpoint (2 bytes, big endian).
+func endpointPort(e gopacket.Endpoint) int {
+	raw := e.Raw()
+	if len(raw) != 2 {
+		return -1
+	}
+	return int(raw[0])<<8 | int(raw[1])
+}
+
+// aggregateFeatures returns the aggregateFeatureNames values of one bucket's
+// packets, given in capture order with their aggregatePacketValues features.
+func aggregateFeatures(packets []PacketResult, period time.Duration) []float64 {
+	first, last := packets[0].Timestamp, packets[len(packets)-1].Timestamp
+	start := time.Unix(0, bucketOf(first, period)*period.Nanoseconds())
+	size, syn := 0, 0.0
+	originPorts, peerPorts := make(map[float64]bool), make(map[float64]bool)
+	for _, p := range packets {
+		size += p.OriginalSize
+		if len(p.Features) < 3 {
+			continue
+		}
+		src, dst := p.Features[0], p.Features[1]
+		if p.Direction == 1 {
+			src, dst = dst, src
+		}
+		if src >= 0 {
+			originPorts[src] = true
+			peerPorts[dst] = true
+		}
+		syn += p.Features[2]
+	}
+	return []float64{
+		float64(start.UnixNano()) / 1e9,
+		float64(len(packets)),
+		float64(size),
+		last.Sub(first).Seconds(),
+		float64(len(originPorts)),
+		float64(len(peerPorts)),
+		syn,
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Anonymization presets for --anon-preset.
+const (
+	AnonOff    = ""       // No preset (default)
+	AnonStrict = "strict" // Every transform below
+)
+
+// IP address anonymization methods for --ip-anon.
+const (
+	IPAnonOff  = ""     // Addresses are kept (default)
+	IPAnonHMAC = "hmac" // Keyed-hash pseudonyms
+)
+
+// MAC address anonymization methods for --mac-anon.
+const (
+	MACAnonOff = ""    // MAC addresses are kept, or zeroed by --anon-preset strict (default)
+	MACAnonOUI = "oui" // Keep the vendor OUI, pseudonymize the device half
+)
+
+// anonKeyMinLen is the --anon-key length below which a run warns: the key is
+// all that keeps IPv4 pseudonyms from being reversed by trying every address.
+const anonKeyMinLen = 16
+
+// strictTimeResolution is the timestamp granularity kept by the strict preset.
+const strictTimeResolution = time.Second
+
+// TimeShiftRandom is the --time-shift value that moves timestamps back by a
+// random offset of up to maxRandomTimeShift, drawn once per run.
+const (
+	TimeShiftRandom    = "random"
+	maxRandomTimeShift = 10 * 365 * 24 * time.Hour
+)
+
+// parseTimeShift returns the offset added to timestamps for --time-shift: a
+// duration such as -8760h, or a random offset (which also moves the time of
+// day) for "random".
+func parseTimeShift(value string) (time.Duration, error) {
+	if value != TimeShiftRandom {
+		return time.ParseDuration(value)
+	}
+	offset, err := rand.Int(rand.Reader, big.NewInt(int64(maxRandomTimeShift)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to draw time offset: %w", err)
+	}
+	return -time.Duration(offset.Int64()) - 1, nil
+}
+
+// emitTime returns a packet timestamp as it is written out: shifted by
+// --time-shift, then coarsened to the timestamp resolution.
+func (o ProcessOptions) emitTime(t time.Time) time.Time {
+	return t.Add(o.TimeShift).Truncate(o.TimeResolution)
+}
+
+// Anonymizer applies the --anon-preset transforms that need per-packet state,
+// or only the IP pseudonyms of --ip-anon hmac and the MAC pseudonyms of
+// --mac-anon, and counts what was removed for the anonymization report. It is
+// safe for concurrent use by packet workers.
+type Anonymizer struct {
+	preset   string // AnonOff for --ip-anon or --mac-anon alone
+	ips      bool   // IP addresses are replaced by pseudonyms
+	macs     string // MACAnonOUI, or MACAnonOff to zero them with the preset
+	key      []byte // HMAC key for IP and MAC pseudonyms, never written out
+	fixedKey bool   // The key came from --anon-key, so pseudonyms match across runs
+
+	packets      atomic.Int64
+	addresses    atomic.Int64 // IP addresses replaced by pseudonyms
+	macHeaders   atomic.Int64 // Ethernet headers whose MAC addresses were zeroed
+	payloadBytes atomic.Int64 // Application bytes zeroed
+	hostnames    atomic.Int64 // Packets that carried DNS names, TLS SNI or HTTP Host headers
+}
+
+// NewAnonymizer creates an anonymizer for preset (AnonOff for the --ip-anon and
+// --mac-anon pseudonyms only). With a nil key the pseudonym key is random, so pseudonyms are
+// consistent within the run but cannot be linked to another run; a given key
+// makes them consistent across runs.
+func NewAnonymizer(preset, ipAnon, macAnon string, key []byte) (*Anonymizer, error) {
+	if preset != AnonOff && preset != AnonStrict {
+		return nil, fmt.Errorf("invalid --anon-preset %q (use strict)", preset)
+	}
+	a := &Anonymizer{
+		preset:   preset,
+		ips:      preset == AnonStrict || ipAnon == IPAnonHMAC,
+		macs:     macAnon,
+		key:      key,
+		fixedKey: key != nil,
+	}
+	if key != nil {
+		return a, nil
+	}
+	a.key = make([]byte, 32)
+	if _, err := rand.Read(a.key); err != nil {
+		return nil, fmt.Errorf("failed to create pseudonym key: %w", err)
+	}
+	return a, nil
+}
+
+// readAnonKey returns the --anon-key value, or the contents of the file it
+// names with a leading @ (without a trailing newline), which keeps the key out
+// of shell history and process lists.
+func readAnonKey(value string) ([]byte, error) {
+	name, isFile := strings.CutPrefix(value, "@")
+	if !isFile {
+		return []byte(value), nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimRight(data, "\r\n")
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s is empty", name)
+	}
+	return key, nil
+}
+
+// forPass returns an anonymizer with the same pseudonyms but its own counters,
+// so a first pass over the inputs does not count packets twice.
+func (a *Anonymizer) forPass() *Anonymizer {
+	if a == nil {
+		return nil
+	}
+	return &Anonymizer{preset: a.preset, ips: a.ips, macs: a.macs, key: a.key, fixedKey: a.fixedKey}
+}
+
+// inspect counts a packet and whether its payload names a host. Hostnames are
+// only found in application payload, which the preset zeroes.
+func (a *Anonymizer) inspect(packet gopacket.Packet) {
+	a.packets.Add(1)
+	if a.preset != AnonStrict {
+		return
+	}
+
+	if dns, ok := packet.Layer(layers.LayerTypeDNS).(*layers.DNS); ok && len(dns.Questions) > 0 {
+		a.hostnames.Add(1)
+		return
+	}
+	payload := l7Payload(packet)
+	switch {
+	case len(payload) > 5 && payload[0] == 0x16 && payload[5] == 0x01: // TLS ClientHello (SNI)
+		a.hostnames.Add(1)
+	case bytes.Contains(payload, []byte("\r\nHost:")): // HTTP request
+		a.hostnames.Add(1)
+	}
+}
+
+// pseudonymizesIPs reports whether the anonymizer replaces IP addresses.
+func (a *Anonymizer) pseudonymizesIPs() bool {
+	return a != nil && a.ips
+}
+
+// pseudonymizeIPs replaces the IPv4/IPv6 source and destination addresses at
+// the start of data with keyed hashes of themselves.
+func (a *Anonymizer) pseudonymizeIPs(data []byte) {
+	if !a.ips || len(data) < 20 {
+		return
+	}
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0F) * 4
+		if ihl < 20 || len(data) < ihl {
+			return
+		}
+		a.pseudonymize(data[12:16])
+		a.pseudonymize(data[16:20])
+	case 6:
+		if len(data) < 40 {
+			return
+		}
+		a.pseudonymize(data[8:24])
+		a.pseudonymize(data[24:40])
+	}
+}
+
+// pseudonymize overwrites addr with the start of HMAC-SHA256(key, addr).
+func (a *Anonymizer) pseudonymize(addr []byte) {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(addr)
+	copy(addr, mac.Sum(nil))
+	a.addresses.Add(1)
+}
+
+// maskMACs zeroes the destination and source MAC addresses of a row that
+// starts with the Ethernet header, or with --mac-anon oui replaces their device
+// half. --ip-anon alone keeps them.
+func (a *Anonymizer) maskMACs(data []byte) {
+	if len(data) < 12 {
+		return
+	}
+	switch {
+	case a.macs == MACAnonOUI:
+		a.pseudonymizeMAC(data[0:6])
+		a.pseudonymizeMAC(data[6:12])
+	case a.preset == AnonStrict:
+		clear(data[:12])
+	default:
+		return
+	}
+	a.macHeaders.Add(1)
+}
+
+// pseudonymizeMAC keeps the OUI (first 3 bytes) of a unicast MAC address and
+// overwrites the device-specific rest with the start of HMAC-SHA256(key, mac),
+// so a device keeps one pseudonym and its vendor. Group addresses (broadcast,
+// multicast) identify no device and are kept.
+func (a *Anonymizer) pseudonymizeMAC(mac []byte) {
+	if mac[0]&0x01 != 0 {
+		return
+	}
+	h := hmac.New(sha256.New, a.key)
+	h.Write([]byte("mac"))
+	h.Write(mac)
+	copy(mac[3:], h.Sum(nil))
+}
+
+// AnonymizationReport is the content of anonymization_report.json.
+type AnonymizationReport struct {
+	Preset                   string `json:"preset,omitempty"` // Empty for --ip-anon alone
+	Packets                  int64  `json:"packets"`
+	IPAddressesPseudonymized int64  `json:"ip_addresses_pseudonymized"`
+	IPPseudonymKey           string `json:"ip_pseudonym_key"`           // "run" (random) or "fixed" (--anon-key)
+	IPAddressesMasked        bool   `json:"ip_addresses_masked"`        // --ipmask zeroed them instead
+	IPv4MaskPrefix           int    `json:"ipv4_mask_prefix,omitempty"` // Network bits kept by --ipmask-mode host-only
+	IPv6MaskPrefix           int    `json:"ipv6_mask_prefix,omitempty"`
+	MACHeadersMasked         int64  `json:"mac_headers_masked"`
+	MACAnon                  string `json:"mac_anon,omitempty"` // "oui": vendor kept, device half pseudonymized
+	PayloadBytesZeroed       int64  `json:"payload_bytes_zeroed"`
+	HostnamePacketsRemoved   int64  `json:"hostname_packets_removed"` // DNS names, TLS SNI, HTTP Host
+	ChecksumsZeroed          bool   `json:"checksums_zeroed"`
+	TimestampsShifted        bool   `json:"timestamps_shifted"` // --time-shift, whose offset is not reported
+	TimestampResolution      string `json:"timestamp_resolution"`
+}
+
+// report describes what the run removed.
+func (a *Anonymizer) report(opts ProcessOptions) AnonymizationReport {
+	return AnonymizationReport{
+		Preset:                   a.preset,
+		Packets:                  a.packets.Load(),
+		IPAddressesPseudonymized: a.addresses.Load(),
+		IPPseudonymKey:           a.keyKind(),
+		IPAddressesMasked:        opts.MaskIP,
+		IPv4MaskPrefix:           opts.MaskPrefix.IPv4,
+		IPv6MaskPrefix:           opts.MaskPrefix.IPv6,
+		MACHeadersMasked:         a.macHeaders.Load(),
+		MACAnon:                  a.macs,
+		PayloadBytesZeroed:       a.payloadBytes.Load(),
+		HostnamePacketsRemoved:   a.hostnames.Load(),
+		ChecksumsZeroed:          opts.Normalize.Checksum,
+		TimestampsShifted:        opts.TimeShift != 0,
+		TimestampResolution:      opts.TimeResolution.String(),
+	}
+}
+
+// keyKind describes the pseudonym key for the report.
+func (a *Anonymizer) keyKind() string {
+	if a.fixedKey {
+		return "fixed"
+	}
+	return "run"
+}
+
+// writeAnonymizationReport logs what the run removed and writes it to filename.
+func writeAnonymizationReport(filename string, report AnonymizationReport) error {
+	slog.Info("anonymization report",
+		"preset", report.Preset,
+		"packets", report.Packets,
+		"ip_addresses_pseudonymized", report.IPAddressesPseudonymized,
+		"ip_pseudonym_key", report.IPPseudonymKey,
+		"ip_addresses_masked", report.IPAddressesMasked,
+		"ipv4_mask_prefix", report.IPv4MaskPrefix,
+		"ipv6_mask_prefix", report.IPv6MaskPrefix,
+		"mac_headers_masked", report.MACHeadersMasked,
+		"mac_anon", report.MACAnon,
+		"payload_bytes_zeroed", report.PayloadBytesZeroed,
+		"hostname_packets_removed", report.HostnamePacketsRemoved,
+		"checksums_zeroed", report.ChecksumsZeroed,
+		"timestamps_shifted", report.TimestampsShifted,
+		"timestamp_resolution", report.TimestampResolution,
+		"report", filename)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveKinds maps the extensions of capture archives read in place, without
+// unpacking them, to their kind.
+var archiveKinds = []struct{ ext, kind string }{
+	{".tar.gz", "tar.gz"}, {".tgz", "tar.gz"}, {".tar.zst", "tar.zst"}, {".tzst", "tar.zst"},
+	{".tar", "tar"}, {".zip", "zip"},
+}
+
+// archiveKind returns the kind of a capture archive, or "" for other files.
+func archiveKind(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, k := range archiveKinds {
+		if strings.HasSuffix(lower, k.ext) {
+			return k.kind
+		}
+	}
+	return ""
+}
+
+// archiveMember is a capture inside an archive.
+type archiveMember struct {
+	index int // Position among the archive's entries
+	size  int64
+}
+
+// captureArchive is a tar or zip archive whose captures are read in place.
+// Compressed tars have no index, so a capture is reached by reading the
+// archive up to it; readers left at the end of a capture are kept to reach
+// the next ones, so inputs read in archive order decompress it about once.
+type captureArchive struct {
+	path    string
+	kind    string
+	names   []string // Files in archive order
+	members map[string]archiveMember
+
+	mutex sync.Mutex
+	idle  []*tarCursor
+}
+
+// maxIdleTarCursors bounds the readers kept open per archive.
+const maxIdleTarCursors = 8
+
+var archives = struct {
+	sync.Mutex
+	byPath map[string]*captureArchive
+}{byPath: make(map[string]*captureArchive)}
+
+// openArchive lists the files of an archive, once per run.
+func openArchive(archivePath string) (*captureArchive, error) {
+	archives.Lock()
+	defer archives.Unlock()
+	if a, ok := archives.byPath[archivePath]; ok {
+		return a, nil
+	}
+	a := &captureArchive{path: archivePath, kind: archiveKind(archivePath), members: make(map[string]archiveMember)}
+	add := func(name string, index int, size int64) {
+		a.names = append(a.names, name)
+		a.members[name] = archiveMember{index: index, size: size}
+	}
+	if a.kind == "zip" {
+		reader, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		for i, f := range reader.File {
+			if f.Mode().IsRegular() {
+				add(f.Name, i, int64(f.UncompressedSize64))
+			}
+		}
+		reader.Close()
+	} else {
+		cursor, err := a.newCursor()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			header, err := cursor.reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				cursor.Close()
+				return nil, err
+			}
+			if header.Typeflag == tar.TypeReg {
+				add(header.Name, cursor.next, header.Size)
+			}
+			cursor.next++
+		}
+		cursor.Close()
+	}
+	archives.byPath[archivePath] = a
+	return a, nil
+}
+
+// archiveJobs returns the captures of an archive, the files with one of the
+// scan's extensions, as inputs named <archive>/<member>, in archive order. In dataset layout, with captures in
+// directories (<class>/<file>.pcap, possibly below a top directory), a
+// capture's directory is its class; captures at the top get the scan's
+// default class, or none.
+func archiveJobs(archivePath string, scan DatasetScan) ([]FileJob, error) {
+	a, err := openArchive(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	var jobs []FileJob
+	for _, name := range a.names {
+		if !scan.isCapture(name) {
+			continue
+		}
+		class := scan.DefaultClass
+		if dir := path.Dir(name); dir != "." {
+			class = path.Base(dir)
+		}
+		jobs = append(jobs, FileJob{FilePath: filepath.Join(archivePath, name), Class: class, Archive: archivePath, Member: name})
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no capture files (%s) found in archive", strings.Join(scan.extensions(), ", "))
+	}
+	slog.Info("found archive", "archive", archivePath, "captures", len(jobs))
+	return jobs, nil
+}
+
+// inputSize returns the size of an input: its file, or its member of an
+// archive uncompressed.
+func inputSize(fileJob FileJob) (int64, error) {
+	if fileJob.Archive == "" {
+		info, err := os.Stat(fileJob.FilePath)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	a, err := openArchive(fileJob.Archive)
+	if err != nil {
+		return 0, err
+	}
+	return a.members[fileJob.Member].size, nil
+}
+
+// openArchiveMember opens a capture inside an archive.
+func openArchiveMember(fileJob FileJob) (packetReader, error) {
+	a, err := openArchive(fileJob.Archive)
+	if err != nil {
+		return nil, err
+	}
+	member, ok := a.members[fileJob.Member]
+	if !ok {
+		return nil, fmt.Errorf("%s: no capture %s", a.path, fileJob.Member)
+	}
+
+	var stream io.Reader
+	var release func(complete bool)
+	if a.kind == "zip" {
+		reader, err := zip.OpenReader(a.path)
+		if err != nil {
+			return nil, err
+		}
+		file, err := reader.File[member.index].Open()
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		stream = file
+		release = func(bool) {
+			file.Close()
+			reader.Close()
+		}
+	} else {
+		cursor, err := a.seek(member.index)
+		if err != nil {
+			return nil, err
+		}
+		stream = cursor.reader
+		release = func(complete bool) { a.release(cursor, complete) }
+	}
+
+	reader, err := newStreamCapture(stream, release)
+	if err != nil {
+		release(false)
+		return nil, err
+	}
+	return reader, nil
+}
+
+// tarCursor reads a tar archive from the start, header by header.
+type tarCursor struct {
+	file   *os.File
+	closer io.Closer // Decompressor, if any
+	reader *tar.Reader
+	next   int // Index of the entry Next returns
+}
+
+func (c *tarCursor) Close() {
+	if c.closer != nil {
+		c.closer.Close()
+	}
+	c.file.Close()
+}
+
+// newCursor opens the archive at its first entry.
+func (a *captureArchive) newCursor() (*tarCursor, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	c := &tarCursor{file: file}
+	var in io.Reader = file // Seekable, so tar skips unread captures without reading them
+	switch a.kind {
+	case "tar.gz":
+		gz, err := gzip.NewReader(bufio.NewReaderSize(file, 1024*1024))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		in, c.closer = gz, gz
+	case "tar.zst":
+		decoder, err := zstd.NewReader(bufio.NewReaderSize(file, 1024*1024))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		in, c.closer = decoder, decoder.IOReadCloser()
+	}
+	c.reader = tar.NewReader(in)
+	return c, nil
+}
+
+// seek returns a reader at the start of entry index: the idle one closest
+// before it, or a new one.
+func (a *captureArchive) seek(index int) (*tarCursor, error) {
+	a.mutex.Lock()
+	best := -1
+	for i, c := range a.idle {
+		if c.next <= index && (best < 0 || c.next > a.idle[best].next) {
+			best = i
+		}
+	}
+	var cursor *tarCursor
+	if best >= 0 {
+		cursor = a.idle[best]
+		a.idle = append(a.idle[:best], a.idle[best+1:]...)
+	}
+	a.mutex.Unlock()
+
+	if cursor == nil {
+		var err error
+		if cursor, err = a.newCursor(); err != nil {
+			return nil, err
+		}
+	}
+	for cursor.next <= index {
+		if _, err := cursor.reader.Next(); err != nil {
+			cursor.Close()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		cursor.next++
+	}
+	return cursor, nil
+}
+
+// release keeps a reader that read its capture without error for the next
+// captures, or closes it.
+func (a *captureArchive) release(cursor *tarCursor, ok bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !ok || len(a.idle) >= maxIdleTarCursors {
+		cursor.Close()
+		return
+	}
+	a.idle = append(a.idle, cursor)
+}
+
+// streamCapture reads a PCAP or PCAPNG capture from a stream, such as an
+// archive member, that libpcap cannot open. It implements packetReader.
+type streamCapture struct {
+	source   gopacket.PacketDataSource
+	linkType layers.LinkType
+	release  func(complete bool)
+	failed   bool
+}
+
+// newStreamCapture reads the capture header of stream. release is called on
+// Close, with whether the capture was read to its end without error.
+func newStreamCapture(stream io.Reader, release func(complete bool)) (*streamCapture, error) {
+	buffered := bufio.NewReaderSize(stream, 1024*1024)
+	magic, err := buffered.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("not a capture: %w", err)
+	}
+	c := &streamCapture{release: release}
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		reader, err := pcapgo.NewNgReader(buffered, pcapgo.NgReaderOptions{WantMixedLinkType: true, SkipUnknownVersion: true})
+		if err != nil {
+			return nil, err
+		}
+		c.source, c.linkType = reader, reader.LinkType()
+	} else {
+		reader, err := pcapgo.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		c.source, c.linkType = reader, reader.LinkType()
+	}
+	return c, nil
+}
+
+func (c *streamCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := c.source.ReadPacketData()
+	if err != nil && err != io.EOF {
+		c.failed = true
+	}
+	return data, ci, err
+}
+
+func (c *streamCapture) LinkType() layers.LinkType {
+	return c.linkType
+}
+
+func (c *streamCapture) Close() {
+	c.release(!c.failed)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+)
+
+// arenaSlabSize is the size of the slabs row buffers are carved from.
+const arenaSlabSize = 64 * 1024
+
+// slabPool recycles slabs between batches so steady-state streaming does not allocate.
+var slabPool = sync.Pool{
+	New: func() any {
+		slab := make([]byte, arenaSlabSize)
+		return &slab
+	},
+}
+
+// byteArena hands out row buffers carved from pooled slabs. A worker uses one arena
+// per batch; the collector releases it once the writer has consumed the batch.
+// A nil arena falls back to ordinary allocation, for modes that keep rows in memory.
+// Buffers are not zeroed.
+type byteArena struct {
+	slabs []*[]byte
+	free  []byte // Unused tail of the current slab
+}
+
+func newByteArena() *byteArena {
+	return &byteArena{}
+}
+
+// alloc returns a buffer of n bytes. Its contents are undefined.
+func (a *byteArena) alloc(n int) []byte {
+	if a == nil || n > arenaSlabSize/4 {
+		return make([]byte, n)
+	}
+	if len(a.free) < n {
+		slab := slabPool.Get().(*[]byte)
+		a.slabs = append(a.slabs, slab)
+		a.free = *slab
+	}
+	buf := a.free[:n:n]
+	a.free = a.free[n:]
+	return buf
+}
+
+// release returns the arena's slabs to the pool. Buffers handed out by alloc
+// must not be used afterwards.
+func (a *byteArena) release() {
+	if a == nil {
+		return
+	}
+	for _, slab := range a.slabs {
+		slabPool.Put(slab)
+	}
+	a.slabs = nil
+	a.free = nil
+}
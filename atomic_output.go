@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// partialSuffix is appended to the name of an output file while it is being
+// written. Writers rename their files to the final names only when they close
+// without error, so a crashed or killed run leaves *.partial files behind
+// rather than a truncated array or table that looks finished.
+const partialSuffix = ".partial"
+
+// partialFile is an output being written: a file under its partial name, or
+// an object store upload that is not complete yet.
+type partialFile struct {
+	path   string
+	upload *objectUpload // nil = a local file
+}
+
+// partialFiles are the outputs a writer created under partial names.
+type partialFiles []partialFile
+
+// create creates path under its partial name, replacing one left by an
+// earlier run.
+func (p *partialFiles) create(path string) (*os.File, error) {
+	file, err := os.Create(path + partialSuffix)
+	if err != nil {
+		return nil, err
+	}
+	*p = append(*p, partialFile{path: path})
+	return file, nil
+}
+
+// createOutput creates a streamed output. With a store, path is an object URL
+// (--output s3://...) whose upload only completes in finish; otherwise it is
+// a file, created as by create.
+func (p *partialFiles) createOutput(path string, store *ObjectStore) (io.WriteCloser, error) {
+	if store == nil {
+		file, err := p.create(path)
+		if err != nil {
+			return nil, err
+		}
+		return file, nil
+	}
+	upload, err := store.create(path)
+	if err != nil {
+		return nil, err
+	}
+	*p = append(*p, partialFile{path: path, upload: upload})
+	return upload, nil
+}
+
+// finish gives the files their final names, or completes their uploads, if
+// err is nil and removes them otherwise. It returns err, or the first rename
+// or upload error. The files must be closed.
+func (p partialFiles) finish(err error) error {
+	for _, f := range p {
+		switch {
+		case f.upload != nil && err != nil:
+			f.upload.abort()
+		case f.upload != nil:
+			err = f.upload.complete() // The uploads after it are aborted
+		case err != nil:
+			os.Remove(f.path + partialSuffix)
+		default:
+			if renameErr := os.Rename(f.path+partialSuffix, f.path); renameErr != nil {
+				err = renameErr // The files after it are removed
+			}
+		}
+	}
+	return err
+}
+
+// discard removes the files, which must be closed, and aborts the uploads.
+func (p partialFiles) discard() {
+	for _, f := range p {
+		if f.upload != nil {
+			f.upload.abort()
+		} else {
+			os.Remove(f.path + partialSuffix)
+		}
+	}
+}
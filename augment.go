@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Ephemeral ports given to augmented copies: the IANA dynamic range.
+const (
+	augmentPortBase  = 49152
+	augmentPortCount = 65536 - augmentPortBase
+)
+
+// AugmentFields selects the header fields --augment randomizes.
+type AugmentFields struct {
+	IPID  bool // IPv4 identification
+	Ports bool // The ephemeral (client) TCP/UDP port
+	Seq   bool // TCP sequence and acknowledgment numbers
+}
+
+// parseAugmentFields parses a comma-separated list such as "ipid,ports,seq".
+func parseAugmentFields(list string) (AugmentFields, error) {
+	var fields AugmentFields
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "":
+		case "ipid":
+			fields.IPID = true
+		case "ports":
+			fields.Ports = true
+		case "seq":
+			fields.Seq = true
+		default:
+			return fields, fmt.Errorf("unknown field %q (use ipid, ports or seq)", name)
+		}
+	}
+	return fields, nil
+}
+
+// any reports whether at least one field is selected.
+func (f AugmentFields) any() bool {
+	return f.IPID || f.Ports || f.Seq
+}
+
+// String returns the fields as --augment-fields takes them.
+func (f AugmentFields) String() string {
+	var names []string
+	if f.IPID {
+		names = append(names, "ipid")
+	}
+	if f.Ports {
+		names = append(names, "ports")
+	}
+	if f.Seq {
+		names = append(names, "seq")
+	}
+	return strings.Join(names, ",")
+}
+
+// Augmenter writes augmented variants of every sample (--augment) with the
+// sample's label, to multiply small classes during conversion rather than in
+// the training loop. In a variant, header fields that carry no meaning for
+// the traffic class are randomized, so models cannot memorize the values of
+// a capture, bytes may be replaced by noise and, for rows of several packets,
+// packets may be lost or duplicated. Values are drawn from the seed per
+// flow, packet or session and variant, so the packets of a flow keep
+// consistent IDs, ports and sequence numbers within each variant, and a run
+// gives the same variants every time. Checksums are updated for the fields.
+type Augmenter struct {
+	Copies  int     // Variants per sample, besides the original row
+	Noise   float64 // Probability of each byte of a variant being replaced by a random byte
+	Drop    float64 // Probability of each packet of a multi-packet variant being lost
+	Dup     float64 // Probability of each packet of a multi-packet variant being sent twice
+	Seed    uint64
+	Fields  AugmentFields
+	Classes map[string]bool // Classes whose samples get variants (nil = all)
+}
+
+// parseAugment parses --augment: a number of variants per sample, or a
+// comma-separated list of noise=P, drop=P, dup=P and factor=F, the number of
+// rows per sample including the original (default 2).
+func parseAugment(spec string) (*Augmenter, error) {
+	if copies, err := strconv.Atoi(spec); err == nil {
+		if copies < 1 {
+			return nil, fmt.Errorf("the number of variants must be at least 1, got %d", copies)
+		}
+		return &Augmenter{Copies: copies}, nil
+	}
+	a := &Augmenter{Copies: 1}
+	for _, item := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid item %q (use noise=P, drop=P, dup=P or factor=F)", item)
+		}
+		switch key = strings.ToLower(strings.TrimSpace(key)); key {
+		case "factor":
+			factor, err := strconv.Atoi(value)
+			if err != nil || factor < 2 {
+				return nil, fmt.Errorf("invalid factor %q (rows per sample, at least 2)", value)
+			}
+			a.Copies = factor - 1
+		case "noise", "drop", "dup":
+			p, err := strconv.ParseFloat(value, 64)
+			if err != nil || p < 0 || p >= 1 {
+				return nil, fmt.Errorf("invalid %s probability %q (use 0 <= P < 1)", key, value)
+			}
+			switch key {
+			case "noise":
+				a.Noise = p
+			case "drop":
+				a.Drop = p
+			case "dup":
+				a.Dup = p
+			}
+		default:
+			return nil, fmt.Errorf("unknown key %q (use noise, drop, dup or factor)", key)
+		}
+	}
+	return a, nil
+}
+
+// flowLevel reports whether variants lose or duplicate packets, which only
+// rows of several packets can show.
+func (a *Augmenter) flowLevel() bool {
+	return a.Drop > 0 || a.Dup > 0
+}
+
+// copiesOf returns the number of variants for a sample of class, 0 if off.
+func (a *Augmenter) copiesOf(class string) int {
+	if a == nil || (a.Classes != nil && !a.Classes[class]) {
+		return 0
+	}
+	return a.Copies
+}
+
+// rng returns the random source of variant n of sample id (a packet index or
+// session ID) of a file, the same in every run with the seed.
+func (a *Augmenter) rng(file string, id, n int) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(file))
+	return rand.New(rand.NewPCG(a.Seed^h.Sum64(), uint64(id)<<16|uint64(n)))
+}
+
+// addNoise replaces each byte of data with a random byte with probability
+// Noise; packet is the index of the packet in file and n the variant.
+func (a *Augmenter) addNoise(data []byte, file string, packet, n int) {
+	if a.Noise == 0 {
+		return
+	}
+	r := a.rng(file, packet, n)
+	for i := range data {
+		if r.Float64() < a.Noise {
+			data[i] = byte(r.Uint32())
+		}
+	}
+}
+
+// perturb returns variant n of the packets of session id, in capture order:
+// each packet is lost with probability Drop or sent twice with probability
+// Dup. At least one packet is kept.
+func (a *Augmenter) perturb(packets []PacketResult, id, n int) []PacketResult {
+	r := a.rng(packets[0].FileName, id, n)
+	variant := make([]PacketResult, 0, len(packets))
+	for _, p := range packets {
+		switch x := r.Float64(); {
+		case x < a.Drop:
+		case x < a.Drop+a.Dup:
+			variant = append(variant, p, p)
+		default:
+			variant = append(variant, p)
+		}
+	}
+	if len(variant) == 0 {
+		variant = append(variant, packets[0])
+	}
+	return variant
+}
+
+// String describes the variants for schema.json.
+func (a *Augmenter) String() string {
+	var changes []string
+	if a.Fields.any() {
+		changes = append(changes, a.Fields.String()+" randomized per flow")
+	}
+	if a.Noise > 0 {
+		changes = append(changes, fmt.Sprintf("%g of bytes replaced by noise", a.Noise))
+	}
+	if a.Drop > 0 {
+		changes = append(changes, fmt.Sprintf("%g of packets lost", a.Drop))
+	}
+	if a.Dup > 0 {
+		changes = append(changes, fmt.Sprintf("%g of packets duplicated", a.Dup))
+	}
+	variants := fmt.Sprintf("%d augmented variants", a.Copies)
+	if a.Copies == 1 {
+		variants = "1 augmented variant"
+	}
+	if len(changes) == 0 {
+		return variants + ", exact copies"
+	}
+	return variants + " with " + strings.Join(changes, ", ")
+}
+
+// apply randomizes the fields of every IP header of the packet for variant n
+// (1 to Copies) and adds noise to its bytes. row holds the packet data from
+// rowStart on.
+func (a *Augmenter) apply(packet gopacket.Packet, file string, index int, row []byte, rowStart, n int) {
+	for _, layer := range packet.Layers() {
+		if !a.Fields.any() {
+			break
+		}
+		if layer.LayerType() != layers.LayerTypeIPv4 && layer.LayerType() != layers.LayerTypeIPv6 {
+			continue
+		}
+		if offset := layerOffset(packet, layer.LayerContents()) - rowStart; offset >= 0 && offset < len(row) {
+			a.randomize(row[offset:], n)
+		}
+	}
+	a.addNoise(row, file, index, n)
+}
+
+// randomize rewrites the fields of the IP packet starting at ip[0]. The
+// transport header is only changed if it directly follows the IP header, in
+// the first fragment.
+func (a *Augmenter) randomize(ip []byte, n int) {
+	var src, dst, transport []byte
+	var protocol byte
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		ihl := int(ip[0]&0x0F) * 4
+		if ihl < 20 || len(ip) < ihl {
+			return
+		}
+		src, dst, protocol = ip[12:16], ip[16:20], ip[9]
+		if ip[6]&0x1F == 0 && ip[7] == 0 {
+			transport = ip[ihl:]
+		}
+	case len(ip) >= 40 && ip[0]>>4 == 6:
+		src, dst, protocol, transport = ip[8:24], ip[24:40], ip[6], ip[40:]
+	default:
+		return
+	}
+
+	var srcPort, dstPort uint16
+	hasPorts := (protocol == byte(layers.IPProtocolTCP) || protocol == byte(layers.IPProtocolUDP)) && len(transport) >= 4
+	if hasPorts {
+		srcPort = binary.BigEndian.Uint16(transport[0:2])
+		dstPort = binary.BigEndian.Uint16(transport[2:4])
+	}
+
+	// Both directions of a flow draw from one hash; forward tells them apart
+	forward := bytes.Compare(src, dst) < 0 || (bytes.Equal(src, dst) && srcPort <= dstPort)
+	low, high, lowPort, highPort := src, dst, srcPort, dstPort
+	if !forward {
+		low, high, lowPort, highPort = dst, src, dstPort, srcPort
+	}
+	buf := make([]byte, 0, 64)
+	buf = binary.BigEndian.AppendUint64(buf, a.Seed)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(n))
+	buf = append(buf, protocol, byte(len(low)))
+	buf = append(buf, low...)
+	buf = append(buf, high...)
+	buf = binary.BigEndian.AppendUint16(buf, lowPort)
+	buf = binary.BigEndian.AppendUint16(buf, highPort)
+	sum := sha256.Sum256(buf)
+	direction := func(offset int, forward bool) []byte {
+		if forward {
+			return sum[offset:]
+		}
+		return sum[offset+8:] // The reverse direction's values
+	}
+
+	if a.Fields.IPID && ip[0]>>4 == 4 {
+		old := binary.BigEndian.Uint16(ip[4:6])
+		id := old + binary.BigEndian.Uint16(direction(0, forward))
+		binary.BigEndian.PutUint16(ip[4:6], id)
+		adjustChecksum(ip[10:12], old, id)
+	}
+	if !hasPorts {
+		return
+	}
+
+	var checksum []byte
+	switch {
+	case protocol == byte(layers.IPProtocolTCP) && len(transport) >= 18:
+		checksum = transport[16:18]
+	case protocol == byte(layers.IPProtocolUDP) && len(transport) >= 8 && (transport[6] != 0 || transport[7] != 0):
+		checksum = transport[6:8] // Zero means no checksum over IPv4
+	}
+	rewrite := func(field []byte, value uint16) {
+		old := binary.BigEndian.Uint16(field)
+		binary.BigEndian.PutUint16(field, value)
+		if checksum != nil {
+			adjustChecksum(checksum, old, value)
+			if protocol == byte(layers.IPProtocolUDP) && checksum[0] == 0 && checksum[1] == 0 {
+				checksum[0], checksum[1] = 0xFF, 0xFF
+			}
+		}
+	}
+
+	// The ephemeral port is the higher one, if it is outside the well-known range
+	if a.Fields.Ports && srcPort != dstPort && max(srcPort, dstPort) >= 1024 {
+		port := uint16(augmentPortBase + int(binary.BigEndian.Uint16(sum[16:18]))%augmentPortCount)
+		if srcPort > dstPort {
+			rewrite(transport[0:2], port)
+		} else {
+			rewrite(transport[2:4], port)
+		}
+	}
+
+	// Sequence numbers move by the sender's offset, acknowledgments by the peer's
+	if a.Fields.Seq && protocol == byte(layers.IPProtocolTCP) && len(transport) >= 14 {
+		addTCPNumber(transport[4:8], binary.BigEndian.Uint32(direction(2, forward)), rewrite)
+		if transport[13]&0x10 != 0 {
+			addTCPNumber(transport[8:12], binary.BigEndian.Uint32(direction(2, !forward)), rewrite)
+		}
+	}
+}
+
+// addTCPNumber adds offset to a 32-bit sequence or acknowledgment number,
+// writing it as two 16-bit words so the checksum follows.
+func addTCPNumber(field []byte, offset uint32, rewrite func([]byte, uint16)) {
+	value := binary.BigEndian.Uint32(field) + offset
+	rewrite(field[0:2], uint16(value>>16))
+	rewrite(field[2:4], uint16(value))
+}
+
+// adjustChecksum updates an Internet checksum for a 16-bit word of the data
+// it covers changing from old to value (RFC 1624).
+func adjustChecksum(checksum []byte, old, value uint16) {
+	sum := uint32(^binary.BigEndian.Uint16(checksum)) + uint32(^old) + uint32(value)
+	sum = (sum & 0xFFFF) + sum>>16
+	sum = (sum & 0xFFFF) + sum>>16
+	binary.BigEndian.PutUint16(checksum, ^uint16(sum))
+}
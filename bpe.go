@@ -0,0 +1,363 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// Token IDs of the BPE vocabulary: 0 pads short sequences, 1-256 are the single
+// bytes 0x00-0xff and every merge adds the next ID.
+const (
+	bpePadID     = 0
+	bpeFirstByte = 1
+	bpeFirstRule = 257
+)
+
+// Training sample limits: BPE training is quadratic-ish in the corpus size, so
+// it runs on a deterministic sample of rows, each cut to its first bytes.
+const (
+	bpeTrainRows     = 4096
+	bpeTrainRowBytes = 1024
+)
+
+// bpePair is two adjacent token IDs.
+type bpePair [2]int32
+
+// BPEVocab is the content of vocab.json. Merges[i] produces token bpeFirstRule+i;
+// Tokens lists the bytes of every token as hex, indexed by ID.
+type BPEVocab struct {
+	PadID  int        `json:"pad_id"`
+	Size   int        `json:"vocab_size"`
+	Merges [][2]int32 `json:"merges"`
+	Tokens []string   `json:"tokens"`
+}
+
+// Tokenizer turns row bytes into a fixed number of BPE token IDs.
+type Tokenizer struct {
+	ranks   map[bpePair]int32 // Merge rank; the merged token is bpeFirstRule+rank
+	columns []string
+}
+
+// NewTokenizer creates a tokenizer that emits length tokens per row.
+func NewTokenizer(vocab *BPEVocab, length int) (*Tokenizer, error) {
+	t := &Tokenizer{ranks: make(map[bpePair]int32, len(vocab.Merges))}
+	for rank, merge := range vocab.Merges {
+		next := int32(bpeFirstRule + rank)
+		if merge[0] <= bpePadID || merge[0] >= next || merge[1] <= bpePadID || merge[1] >= next {
+			return nil, fmt.Errorf("merge %d refers to an unknown token", rank)
+		}
+		t.ranks[bpePair(merge)] = int32(rank)
+	}
+	for i := 0; i < length; i++ {
+		t.columns = append(t.columns, fmt.Sprintf("Token_%d", i))
+	}
+	return t, nil
+}
+
+// apply replaces p's bytes with its first token IDs (padded with bpePadID),
+// followed by p's features.
+func (t *Tokenizer) apply(p *PacketResult) {
+	tokens := t.encode(p.Data)
+	values := make([]float64, len(t.columns), len(t.columns)+len(p.Features))
+	for i := 0; i < len(values) && i < len(tokens); i++ {
+		values[i] = float64(tokens[i])
+	}
+	p.Data = nil
+	p.Features = append(values, p.Features...)
+}
+
+// encode applies the merges to data in rank order, leftmost first, like the
+// training pass did.
+func (t *Tokenizer) encode(data []byte) []int32 {
+	n := len(data)
+	tokens := make([]int32, n)
+	next := make([]int, n) // Index of the next live token, n at the end
+	prev := make([]int, n) // Index of the previous live token, -1 at the start
+	for i, b := range data {
+		tokens[i] = int32(b) + bpeFirstByte
+		next[i] = i + 1
+		prev[i] = i - 1
+	}
+
+	queue := &bpeQueue{}
+	push := func(i int) {
+		if i < 0 || next[i] >= n {
+			return
+		}
+		pair := bpePair{tokens[i], tokens[next[i]]}
+		if rank, ok := t.ranks[pair]; ok {
+			heap.Push(queue, bpeCandidate{rank: rank, pos: i, pair: pair})
+		}
+	}
+	for i := 0; i < n-1; i++ {
+		push(i)
+	}
+
+	for queue.Len() > 0 {
+		c := heap.Pop(queue).(bpeCandidate)
+		// Skip candidates made stale by an earlier merge
+		if tokens[c.pos] < 0 || next[c.pos] >= n || (bpePair{tokens[c.pos], tokens[next[c.pos]]}) != c.pair {
+			continue
+		}
+		right := next[c.pos]
+		tokens[c.pos] = bpeFirstRule + c.rank
+		tokens[right] = -1
+		next[c.pos] = next[right]
+		if next[c.pos] < n {
+			prev[next[c.pos]] = c.pos
+		}
+		push(prev[c.pos])
+		push(c.pos)
+	}
+
+	out := tokens[:0]
+	for i := 0; i < n; i = next[i] {
+		out = append(out, tokens[i])
+	}
+	return out
+}
+
+// bpeCandidate is a mergeable pair starting at token index pos.
+type bpeCandidate struct {
+	rank int32
+	pos  int
+	pair bpePair
+}
+
+// bpeQueue orders candidates by merge rank, then position.
+type bpeQueue []bpeCandidate
+
+func (q bpeQueue) Len() int { return len(q) }
+func (q bpeQueue) Less(i, j int) bool {
+	if q[i].rank != q[j].rank {
+		return q[i].rank < q[j].rank
+	}
+	return q[i].pos < q[j].pos
+}
+func (q bpeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *bpeQueue) Push(x any)   { *q = append(*q, x.(bpeCandidate)) }
+func (q *bpeQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// BPESampler is a StreamWriter that keeps the bpeTrainRows rows with the
+// smallest hash of (class, file, index). The sample does not depend on the
+// order in which workers deliver rows, so training is reproducible.
+type BPESampler struct {
+	rows  bpeSampleHeap
+	mutex sync.Mutex
+}
+
+// bpeSample is one training row.
+type bpeSample struct {
+	key  uint64
+	data []byte
+}
+
+// bpeSampleHeap is a max-heap on key, so the largest kept key is evicted first.
+type bpeSampleHeap []bpeSample
+
+func (h bpeSampleHeap) Len() int           { return len(h) }
+func (h bpeSampleHeap) Less(i, j int) bool { return h[i].key > h[j].key }
+func (h bpeSampleHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *bpeSampleHeap) Push(x any)        { *h = append(*h, x.(bpeSample)) }
+func (h *bpeSampleHeap) Pop() any {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+func (s *BPESampler) WritePacket(p PacketResult) error {
+	return s.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch offers packets to the sample. Kept bytes are copied, since
+// streaming rows are recycled after the write.
+func (s *BPESampler) WriteBatch(packets []PacketResult) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, p := range packets {
+		if len(p.Data) == 0 {
+			continue
+		}
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s/%s", p.Class, p.FileName)
+		binary.Write(h, binary.LittleEndian, int64(p.Index))
+		key := h.Sum64()
+		if len(s.rows) >= bpeTrainRows && key >= s.rows[0].key {
+			continue
+		}
+
+		data := p.Data
+		if len(data) > bpeTrainRowBytes {
+			data = data[:bpeTrainRowBytes]
+		}
+		heap.Push(&s.rows, bpeSample{key: key, data: append([]byte(nil), data...)})
+		if len(s.rows) > bpeTrainRows {
+			heap.Pop(&s.rows)
+		}
+	}
+	return nil
+}
+
+func (s *BPESampler) Close() error {
+	return nil
+}
+
+// trainBPE learns up to vocabSize-bpeFirstRule merges from corpus: each step
+// merges the most frequent adjacent pair (ties go to the smallest pair).
+// Training stops early when no pair occurs twice.
+func trainBPE(corpus [][]byte, vocabSize int) [][2]int32 {
+	seqs := make([][]int32, len(corpus))
+	counts := make(map[bpePair]int)
+	for i, data := range corpus {
+		seq := make([]int32, len(data))
+		for j, b := range data {
+			seq[j] = int32(b) + bpeFirstByte
+			if j > 0 {
+				counts[bpePair{seq[j-1], seq[j]}]++
+			}
+		}
+		seqs[i] = seq
+	}
+
+	var merges [][2]int32
+	for id := int32(bpeFirstRule); int(id) < vocabSize; id++ {
+		best, bestCount := bpePair{}, 1
+		for pair, count := range counts {
+			if count > bestCount || (count == bestCount && count > 1 && pairLess(pair, best)) {
+				best, bestCount = pair, count
+			}
+		}
+		if bestCount < 2 {
+			break
+		}
+		merges = append(merges, best)
+
+		// Merge left to right, keeping the pair counts up to date
+		a, b := best[0], best[1]
+		for s, seq := range seqs {
+			w := 0
+			for i := 0; i < len(seq); i++ {
+				if i+1 < len(seq) && seq[i] == a && seq[i+1] == b {
+					if w > 0 {
+						decrementPair(counts, bpePair{seq[w-1], a})
+						counts[bpePair{seq[w-1], id}]++
+					}
+					if i+2 < len(seq) {
+						decrementPair(counts, bpePair{b, seq[i+2]})
+						counts[bpePair{id, seq[i+2]}]++
+					}
+					decrementPair(counts, best)
+					seq[w] = id
+					i++
+				} else {
+					seq[w] = seq[i]
+				}
+				w++
+			}
+			seqs[s] = seq[:w]
+		}
+	}
+	return merges
+}
+
+// pairLess orders pairs by first, then second token.
+func pairLess(x, y bpePair) bool {
+	if x[0] != y[0] {
+		return x[0] < y[0]
+	}
+	return x[1] < y[1]
+}
+
+// decrementPair lowers a pair count, dropping pairs that no longer occur.
+func decrementPair(counts map[bpePair]int, pair bpePair) {
+	if counts[pair] <= 1 {
+		delete(counts, pair)
+		return
+	}
+	counts[pair]--
+}
+
+// newBPEVocab describes merges as a vocabulary file.
+func newBPEVocab(merges [][2]int32) *BPEVocab {
+	tokenBytes := make([][]byte, bpeFirstRule, bpeFirstRule+len(merges))
+	for b := 0; b < 256; b++ {
+		tokenBytes[bpeFirstByte+b] = []byte{byte(b)}
+	}
+	for _, m := range merges {
+		tokenBytes = append(tokenBytes, append(append([]byte(nil), tokenBytes[m[0]]...), tokenBytes[m[1]]...))
+	}
+
+	vocab := &BPEVocab{
+		PadID:  bpePadID,
+		Size:   len(tokenBytes),
+		Merges: merges,
+		Tokens: make([]string, len(tokenBytes)),
+	}
+	vocab.Tokens[bpePadID] = "<pad>"
+	for id := bpeFirstByte; id < len(tokenBytes); id++ {
+		vocab.Tokens[id] = hex.EncodeToString(tokenBytes[id])
+	}
+	return vocab
+}
+
+// trainBPEVocab runs a first pass over fileJobs that samples rows and learns a
+// vocabulary of vocabSize tokens from them.
+func trainBPEVocab(ctx context.Context, fileJobs []FileJob, vocabSize int, opts ProcessOptions, maxConcurrentFiles int) (*BPEVocab, error) {
+	// Train on the untruncated rows
+	opts.OutputLength = 0
+	opts, closePass, err := firstPassOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closePass()
+
+	sampler := &BPESampler{}
+	if _, err := processFilesStreamingSingleOutput(ctx, fileJobs, sampler, opts, maxConcurrentFiles, NewRunManifest("", "")); err != nil {
+		return nil, err
+	}
+	if len(sampler.rows) == 0 {
+		return nil, fmt.Errorf("no rows to train the BPE vocabulary on")
+	}
+
+	corpus := make([][]byte, len(sampler.rows))
+	for i, row := range sampler.rows {
+		corpus[i] = row.data
+	}
+	return newBPEVocab(trainBPE(corpus, vocabSize)), nil
+}
+
+// readBPEVocab loads a vocab.json written by an earlier run.
+func readBPEVocab(filename string) (*BPEVocab, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var vocab BPEVocab
+	if err := json.Unmarshal(data, &vocab); err != nil {
+		return nil, fmt.Errorf("invalid vocab file %s: %w", filename, err)
+	}
+	return &vocab, nil
+}
+
+// writeBPEVocab writes vocab as indented JSON.
+func writeBPEVocab(filename string, vocab *BPEVocab) error {
+	data, err := json.MarshalIndent(vocab, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
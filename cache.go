@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// cacheNeutralFlags do not change the rows of a single input file, so runs
+// that only differ in them share cache entries. Class weights, the split
+// fractions and --max-packets are applied to the cached rows.
+var cacheNeutralFlags = map[string]bool{
+	"dataset": true, "input": true, "classes": true, "exclude-classes": true, "class-collision": true,
+	"class-weights": true, "split": true, "max-packets": true, "duplicates-report": true, "class-stats": true,
+	"format": true, "parquet-compression": true, "parquet-zstd-level": true, "parquet-encoders": true, "byte-repr": true,
+	"output": true, "output-dir": true, "output-template": true, "per-file": true, "incremental": true,
+	"flight-addr": true, "clickhouse": true, "clickhouse-table": true,
+	"sort": true, "concurrent": true, "streaming": true, "on-error": true,
+	"log-level": true, "log-json": true, "quiet": true, "cache-dir": true,
+}
+
+// rowCacheKey hashes everything else that shapes the rows of an input file:
+// the values of all other flags, the contents of contentFiles (scaling
+// statistics, BPE vocabulary) and the size and mtime of the files under
+// stampPaths (Zeek logs, Suricata alerts).
+func rowCacheKey(flags *flag.FlagSet, contentFiles, stampPaths []string) (string, error) {
+	h := sha256.New()
+	flags.VisitAll(func(f *flag.Flag) {
+		if !cacheNeutralFlags[f.Name] {
+			fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value.String())
+		}
+	})
+	for _, path := range contentFiles {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, root := range stampPaths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// outputCacheFlags are the cache-neutral flags that still change a per-file
+// output: its encoding and the rows the class weights keep.
+var outputCacheFlags = []string{"format", "parquet-compression", "parquet-zstd-level", "parquet-encoders", "byte-repr", "npy-order", "class-weights"}
+
+// RowCache stores the rows of each input file under --cache-dir, keyed by the
+// file's content hash and the row options, so runs that only change the split,
+// class weights or output format skip decoding.
+type RowCache struct {
+	dir     string
+	key     string // rowCacheKey of the run
+	splitBy string // Split groups of the cached rows' split points
+	hits    atomic.Int64
+	misses  atomic.Int64
+
+	outputKey  string // Output options of cached --per-file outputs ("" = not cached)
+	outputHits atomic.Int64
+}
+
+// NewRowCache opens (and creates) a cache directory.
+func NewRowCache(dir, key, splitBy string) (*RowCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &RowCache{dir: dir, key: key, splitBy: splitBy}, nil
+}
+
+// rows returns the rows of a file after class weights, split and --max-packets,
+// decoding the file only when the cache has no entry for it.
+func (c *RowCache) rows(ctx context.Context, fileJob FileJob, opts ProcessOptions, workersPerFile int) ([]PacketResult, error) {
+	f, err := identifyFile(fileJob.FilePath, stateFile{})
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", errCannotOpen, fileJob.FilePath, err)
+	}
+	// Rows carry the class and file name, which also seeds the split and sampling hashes
+	entry := sha256.Sum256([]byte(c.key + "\n" + f.SHA256 + "\n" + fileJob.Class + "\n" + fileJob.name()))
+	path := filepath.Join(c.dir, hex.EncodeToString(entry[:])+".gob")
+
+	rows, err := readCachedRows(path)
+	switch {
+	case err == nil:
+		c.hits.Add(1)
+	case errors.Is(err, fs.ErrNotExist):
+		c.misses.Add(1)
+		rows, err = c.decode(ctx, fileJob, opts, workersPerFile)
+		if err != nil {
+			return nil, err
+		}
+		// A file cut short by Ctrl-C must not be cached
+		if ctx.Err() == nil {
+			if err := writeCachedRows(path, rows); err != nil {
+				slog.Warn("failed to write cache entry", "file", fileJob.FilePath, "error", err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("cache entry of %s: %w", fileJob.FilePath, err)
+	}
+
+	kept := rows[:0]
+	for _, row := range rows {
+		if opts.ClassWeights != nil && !opts.ClassWeights.keep(row.Class, row.FileName, row.Index) {
+			continue
+		}
+		if opts.Split != nil {
+			row.Split = opts.Split.pick(row.SplitPoint)
+		}
+		kept = append(kept, row)
+	}
+	return opts.finishRows(kept), nil
+}
+
+// cacheOutputs also caches --per-file outputs under outputs/, keyed like rows
+// plus the output flags, the contents of the class weights file and the
+// output name, so reconverting a corpus copies the outputs of unchanged files
+// instead of decoding and writing them again.
+func (c *RowCache) cacheOutputs(flags *flag.FlagSet, classWeightsFile string) error {
+	h := sha256.New()
+	fmt.Fprintln(h, c.key)
+	for _, name := range outputCacheFlags {
+		fmt.Fprintf(h, "%s=%s\n", name, flags.Lookup(name).Value.String())
+	}
+	if classWeightsFile != "" {
+		data, err := os.ReadFile(classWeightsFile)
+		if err != nil {
+			return err
+		}
+		h.Write(data)
+	}
+	if err := os.MkdirAll(filepath.Join(c.dir, "outputs"), 0755); err != nil {
+		return err
+	}
+	c.outputKey = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// cachedOutput is the output.json of a cached per-file output. Its files are
+// under files/, with the names they were written with, since bin sidecars
+// refer to them by name.
+type cachedOutput struct {
+	Rows    int              `json:"rows"`
+	Classes map[string]int64 `json:"classes"` // Rows per class, for the class imbalance check
+}
+
+// outputEntry returns the cache directory of the per-file output of fileJob
+// named outputFile, or "" if outputs are not cached or the file cannot be
+// hashed. Label IDs are part of the key, since NumPy and bin outputs number
+// classes across all inputs.
+func (c *RowCache) outputEntry(fileJob FileJob, outputFile string, classIDs map[string]byte) string {
+	if c.outputKey == "" {
+		return ""
+	}
+	f, err := identifyFile(fileJob.FilePath, stateFile{})
+	if err != nil {
+		return "" // Processing reports the error
+	}
+	ids, err := json.Marshal(classIDs)
+	if err != nil {
+		return ""
+	}
+	entry := sha256.Sum256([]byte(c.outputKey + "\n" + f.SHA256 + "\n" + fileJob.Class + "\n" + fileJob.name() + "\n" + filepath.Base(outputFile) + "\n" + string(ids)))
+	return filepath.Join(c.dir, "outputs", hex.EncodeToString(entry[:]))
+}
+
+// restoreOutput copies a cached output to outputFile. It returns an error
+// wrapping fs.ErrNotExist if the cache has no entry for it.
+func (c *RowCache) restoreOutput(entry, format, outputFile string) (cachedOutput, error) {
+	var cached cachedOutput
+	data, err := os.ReadFile(filepath.Join(entry, "output.json"))
+	if err != nil {
+		return cached, err
+	}
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return cached, fmt.Errorf("invalid cache entry %s: %w", entry, err)
+	}
+	var partial partialFiles
+	for _, path := range outputArtifacts(format, outputFile) {
+		src := filepath.Join(entry, "files", filepath.Base(path))
+		if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := copyToPartial(&partial, src, path); err != nil {
+			partial.discard()
+			return cached, err
+		}
+	}
+	if err := partial.finish(nil); err != nil {
+		return cached, err
+	}
+	c.outputHits.Add(1)
+	return cached, nil
+}
+
+// storeOutput copies the files of a finished per-file output to its cache
+// entry. Like row entries, it is written under a temporary name and renamed.
+func (c *RowCache) storeOutput(entry, format, outputFile string, cached cachedOutput) error {
+	tmp, err := os.MkdirTemp(filepath.Dir(entry), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(filepath.Join(tmp, "files"), 0755)
+	for _, path := range outputArtifacts(format, outputFile) {
+		if err != nil {
+			break
+		}
+		if info, statErr := os.Stat(path); statErr != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		err = copyFile(path, filepath.Join(tmp, "files", filepath.Base(path)))
+	}
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(cached); err == nil {
+			err = os.WriteFile(filepath.Join(tmp, "output.json"), data, 0644)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, entry)
+		if _, statErr := os.Stat(filepath.Join(entry, "output.json")); err != nil && statErr == nil {
+			err = nil // Stored by a concurrent run
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+	}
+	return err
+}
+
+// copyFile copies src to a new file dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyToPartial copies src to dst under its partial name.
+func copyToPartial(partial *partialFiles, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := partial.create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// classCountingWriter counts the rows of each class passed to a writer, for
+// the output.json of a cache entry.
+type classCountingWriter struct {
+	StreamWriter
+	counts map[string]int64
+}
+
+func (w *classCountingWriter) WritePacket(p PacketResult) error {
+	w.counts[p.Class]++
+	return w.StreamWriter.WritePacket(p)
+}
+
+func (w *classCountingWriter) WriteBatch(packets []PacketResult) error {
+	for _, p := range packets {
+		w.counts[p.Class]++
+	}
+	return w.StreamWriter.WriteBatch(packets)
+}
+
+// decode processes a file into cacheable rows: every row with its split point,
+// before class weights, the class quota and the row limit.
+func (c *RowCache) decode(ctx context.Context, fileJob FileJob, opts ProcessOptions, workersPerFile int) ([]PacketResult, error) {
+	opts.Cache = nil
+	opts.ClassWeights = nil
+	opts.Split = &Split{By: c.splitBy, Fractions: []float64{1}}
+	opts.Limit = nil
+	opts.Quota = nil
+	opts.Duplicates = nil
+	opts.Stats = nil
+	opts.Classes = nil
+	return processFile(ctx, fileJob, opts, true, workersPerFile)
+}
+
+// readCachedRows loads a cache entry.
+func readCachedRows(path string) ([]PacketResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rows []PacketResult
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// writeCachedRows stores a cache entry. It is written under a temporary name
+// and renamed, so concurrent or interrupted runs never see half an entry.
+func writeCachedRows(path string, rows []PacketResult) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(tmp)
+	err = gob.NewEncoder(buf).Encode(rows)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// logStats reports how many files came from the cache.
+func (c *RowCache) logStats() {
+	if c.outputKey != "" {
+		slog.Info("row cache", "dir", c.dir, "hits", c.hits.Load(), "misses", c.misses.Load(), "output_hits", c.outputHits.Load())
+		return
+	}
+	slog.Info("row cache", "dir", c.dir, "hits", c.hits.Load(), "misses", c.misses.Load())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Live capture (--live): packets are read from a network interface through
+// libpcap, or Npcap's wpcap.dll on Windows, until Ctrl-C or --max-packets.
+const (
+	liveSnapLen     = 262144                 // Whole frames, as tcpdump captures them
+	liveReadTimeout = 250 * time.Millisecond // Longest wait before read packets are handed to the workers
+)
+
+// errReadTimeout is returned by a live capture when no packet arrived within
+// liveReadTimeout; reading goes on.
+var errReadTimeout = errors.New("read timeout")
+
+// errNoLiveCapture is returned by builds without libpcap (cgo disabled
+// outside Windows), which read capture files only.
+var errNoLiveCapture = errors.New("live capture needs libpcap: build with cgo (CGO_ENABLED=1) and the libpcap headers")
+
+// liveInterface is a network interface --live can capture from.
+type liveInterface struct {
+	Name        string
+	Description string
+	Addresses   []string
+}
+
+// openCaptureFile opens a PCAP or PCAPNG file with the pure Go reader, which
+// needs neither cgo nor libpcap.
+func openCaptureFile(filePath string) (packetReader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	capture, err := newStreamCapture(file, func(bool) { file.Close() })
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return capture, nil
+}
+
+// captureFileSnapLen returns the snap length in the header of a PCAP file, or
+// of the first interface of a PCAPNG file.
+func captureFileSnapLen(filePath string) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if ng, err := isPcapng(filePath); err != nil {
+		return 0, err
+	} else if ng {
+		reader, err := newNgReader(file)
+		if err != nil {
+			return 0, err
+		}
+		iface, err := reader.Interface(0)
+		if err != nil {
+			return 0, err
+		}
+		return int(iface.SnapLength), nil
+	}
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	return int(reader.Snaplen()), nil
+}
+
+// isETL reports whether a capture is a Windows event trace (.etl), as written
+// by pktmon and netsh trace.
+func isETL(filePath string) bool {
+	return strings.EqualFold(filepath.Ext(filePath), ".etl")
+}
+
+// etlCapture is the PCAPNG conversion of an .etl capture, removed on Close.
+type etlCapture struct {
+	packetReader
+	dir string
+}
+
+func (c *etlCapture) Close() {
+	c.packetReader.Close()
+	os.RemoveAll(c.dir)
+}
+
+// openETL converts an .etl capture to a temporary PCAPNG file with pktmon
+// (Windows 10 2004 or later) and opens it.
+func openETL(filePath string) (packetReader, error) {
+	pktmon, err := exec.LookPath("pktmon")
+	if err != nil {
+		return nil, fmt.Errorf("reading .etl captures needs pktmon (Windows 10 2004 or later): %w", err)
+	}
+	dir, err := os.MkdirTemp("", "gobyte-etl-")
+	if err != nil {
+		return nil, err
+	}
+	converted := filepath.Join(dir, strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))+".pcapng")
+	output, err := exec.Command(pktmon, "etl2pcap", filePath, "--out", converted).CombinedOutput()
+	if err == nil {
+		_, err = os.Stat(converted) // pktmon reports some failures with exit status 0
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("pktmon etl2pcap failed: %w: %s", err, bytes.TrimSpace(output))
+	}
+	reader, err := openOffline(converted)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &etlCapture{packetReader: reader, dir: dir}, nil
+}
+
+// runInterfaces is the `gobyte interfaces` subcommand: it lists the network
+// interfaces --live can capture from, whose names on Windows are Npcap device
+// names such as \Device\NPF_{...}.
+func runInterfaces(args []string) {
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s interfaces\n\nLists the network interfaces --live can capture from.\n", os.Args[0])
+		os.Exit(2)
+	}
+	interfaces, err := captureInterfaces()
+	if err != nil {
+		fatal("failed to list network interfaces", "error", err)
+	}
+	for _, iface := range interfaces {
+		fmt.Println(iface.Name)
+		if iface.Description != "" {
+			fmt.Printf("    %s\n", iface.Description)
+		}
+		if len(iface.Addresses) > 0 {
+			fmt.Printf("    %s\n", strings.Join(iface.Addresses, ", "))
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build cgo && !windows
+
+package main
+
+import "github.com/google/gopacket/pcap"
+
+// openOffline opens a PCAP/PCAPNG file with libpcap.
+func openOffline(filePath string) (packetReader, error) {
+	handle, err := pcap.OpenOffline(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+// offlineSnapLen returns the snap length libpcap reads from a capture.
+func offlineSnapLen(filePath string) (int, error) {
+	handle, err := pcap.OpenOffline(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer handle.Close()
+	return handle.SnapLen(), nil
+}
+
+// loadPcap has nothing to do: libpcap is linked into cgo builds.
+func loadPcap() error {
+	return nil
+}
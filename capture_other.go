@@ -0,0 +1,14 @@
+//go:build !cgo || windows
+
+package main
+
+// openOffline opens a PCAP/PCAPNG file with the pure Go reader: builds without
+// cgo have no libpcap, and on Windows capture files are read without Npcap.
+func openOffline(filePath string) (packetReader, error) {
+	return openCaptureFile(filePath)
+}
+
+// offlineSnapLen returns the snap length in a capture's header.
+func offlineSnapLen(filePath string) (int, error) {
+	return captureFileSnapLen(filePath)
+}
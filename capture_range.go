@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// captureRange selects the packets of one file that are processed:
+// --skip-packets and --skip-seconds drop the start of the capture, then
+// --max-packets-per-file caps the packets that follow. Packets must be fed in
+// capture order.
+type captureRange struct {
+	skipPackets int
+	skipTime    time.Duration
+	maxPackets  int
+	start       time.Time // Timestamp of the file's first packet
+	seen        int       // Packets fed so far
+	taken       int       // Packets past the skipped start
+}
+
+func newCaptureRange(opts ProcessOptions) *captureRange {
+	return &captureRange{
+		skipPackets: opts.SkipPackets,
+		skipTime:    opts.SkipTime,
+		maxPackets:  opts.MaxPerFile,
+	}
+}
+
+// next reports whether a packet is processed, and done once the file's
+// packet cap is reached and reading can stop.
+func (r *captureRange) next(packet gopacket.Packet) (keep, done bool) {
+	timestamp := packet.Metadata().Timestamp
+	if r.seen == 0 {
+		r.start = timestamp
+	}
+	r.seen++
+
+	if r.seen <= r.skipPackets || (r.skipTime > 0 && timestamp.Sub(r.start) < r.skipTime) {
+		return false, false
+	}
+	if r.maxPackets > 0 && r.taken == r.maxPackets {
+		return false, true
+	}
+	r.taken++
+	return true, false
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// loadPcap loads Npcap's wpcap.dll, which gopacket calls without cgo; capture
+// files are read without it.
+func loadPcap() error {
+	if err := pcap.LoadWinPCAP(); err != nil {
+		return fmt.Errorf("%w: live capture on Windows needs Npcap (https://npcap.com)", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ClassStats are the --class-stats numbers of one class (or of all rows).
+type ClassStats struct {
+	Rows       int64                 `json:"rows"`
+	Bytes      int64                 `json:"bytes"`       // Sum of the original packet sizes
+	MeanSize   float64               `json:"mean_size"`   // Original size before padding/truncation
+	MedianSize float64               `json:"median_size"` // Original size before padding/truncation
+	Files      map[string]*FileStats `json:"files,omitempty"`
+
+	sizes map[int]int64 // Rows per original size, for the median
+}
+
+// FileStats is the contribution of one input file to a class.
+type FileStats struct {
+	Rows  int64 `json:"rows"`
+	Bytes int64 `json:"bytes"`
+}
+
+// add counts a row of the given original size.
+func (s *ClassStats) add(size int) {
+	s.Rows++
+	s.Bytes += int64(size)
+	s.sizes[size]++
+}
+
+// finish computes the mean and median sizes.
+func (s *ClassStats) finish() {
+	if s.Rows == 0 {
+		return
+	}
+	s.MeanSize = float64(s.Bytes) / float64(s.Rows)
+
+	sizes := make([]int, 0, len(s.sizes))
+	for size := range s.sizes {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	// The median is the middle row, or the mean of the two middle rows
+	lower, upper := (s.Rows-1)/2, s.Rows/2
+	var seen int64
+	lowerSize := -1
+	for _, size := range sizes {
+		seen += s.sizes[size]
+		if lowerSize < 0 && seen > lower {
+			lowerSize = size
+		}
+		if seen > upper {
+			s.MedianSize = float64(lowerSize+size) / 2
+			return
+		}
+	}
+}
+
+// ClassStatsReport collects per-class row statistics and writes them to
+// class_stats.json, the numbers of a dataset's summary table. It is safe for
+// concurrent use by workers.
+type ClassStatsReport struct {
+	filename string
+	total    *ClassStats
+	classes  map[string]*ClassStats
+	mutex    sync.Mutex
+}
+
+// NewClassStatsReport creates a report written to filename on Close.
+func NewClassStatsReport(filename string) *ClassStatsReport {
+	return &ClassStatsReport{
+		filename: filename,
+		total:    &ClassStats{sizes: make(map[int]int64)},
+		classes:  make(map[string]*ClassStats),
+	}
+}
+
+// add counts finished rows.
+func (r *ClassStatsReport) add(rows []PacketResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, row := range rows {
+		class, ok := r.classes[row.Class]
+		if !ok {
+			class = &ClassStats{Files: make(map[string]*FileStats), sizes: make(map[int]int64)}
+			r.classes[row.Class] = class
+		}
+		class.add(row.OriginalSize)
+		r.total.add(row.OriginalSize)
+
+		file, ok := class.Files[row.FileName]
+		if !ok {
+			file = &FileStats{}
+			class.Files[row.FileName] = file
+		}
+		file.Rows++
+		file.Bytes += int64(row.OriginalSize)
+	}
+}
+
+// classStatsFile is the layout of class_stats.json.
+type classStatsFile struct {
+	Total   *ClassStats            `json:"total"`
+	Classes map[string]*ClassStats `json:"classes"` // Unlabeled rows are listed under ""
+}
+
+// Close writes the report and logs the totals.
+func (r *ClassStatsReport) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.total.finish()
+	for _, s := range r.classes {
+		s.finish()
+	}
+
+	data, err := json.MarshalIndent(classStatsFile{Total: r.total, Classes: r.classes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.filename, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write class statistics: %w", err)
+	}
+
+	slog.Info("class statistics",
+		"classes", len(r.classes),
+		"rows", r.total.Rows,
+		"mean_size", r.total.MeanSize,
+		"median_size", r.total.MedianSize,
+		"report", r.filename)
+	return nil
+}
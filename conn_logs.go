@@ -0,0 +1,99 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// endpointKey identifies a connection of an external log (Zeek, Suricata) by
+// its endpoints and transport (tcp, udp or icmp) in canonical order, so both
+// directions of a conversation map to the same key. ICMP connections are
+// keyed by their addresses only.
+type endpointKey struct {
+	a, b  netip.AddrPort
+	proto string
+}
+
+// newEndpointKey returns the key of a connection between two endpoints.
+func newEndpointKey(src, dst netip.AddrPort, proto string) endpointKey {
+	if proto == "icmp" {
+		src, dst = netip.AddrPortFrom(src.Addr(), 0), netip.AddrPortFrom(dst.Addr(), 0)
+	}
+	if dst.Compare(src) < 0 {
+		src, dst = dst, src
+	}
+	return endpointKey{a: src, b: dst, proto: proto}
+}
+
+// packetAddrs returns the source and destination addresses of a packet's
+// network layer, whatever it carries (fragments, GRE, ESP, ...).
+func packetAddrs(packet gopacket.Packet) (src, dst netip.Addr, ok bool) {
+	network := packet.NetworkLayer()
+	if network == nil {
+		return src, dst, false
+	}
+	src, ok1 := netip.AddrFromSlice(network.NetworkFlow().Src().Raw())
+	dst, ok2 := netip.AddrFromSlice(network.NetworkFlow().Dst().Raw())
+	if !ok1 || !ok2 {
+		return src, dst, false
+	}
+	return src.Unmap(), dst.Unmap(), true
+}
+
+// packetEndpoints returns the source and destination of a packet and its
+// transport name as logged by Zeek (tcp, udp or icmp).
+func packetEndpoints(packet gopacket.Packet) (src, dst netip.AddrPort, proto string, ok bool) {
+	srcAddr, dstAddr, ok := packetAddrs(packet)
+	if !ok {
+		return src, dst, "", false
+	}
+
+	var srcPort, dstPort uint16
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		proto, srcPort, dstPort = "tcp", uint16(transport.SrcPort), uint16(transport.DstPort)
+	case *layers.UDP:
+		proto, srcPort, dstPort = "udp", uint16(transport.SrcPort), uint16(transport.DstPort)
+	default:
+		if packet.Layer(layers.LayerTypeICMPv4) == nil && packet.Layer(layers.LayerTypeICMPv6) == nil {
+			return src, dst, "", false
+		}
+		proto = "icmp"
+	}
+	return netip.AddrPortFrom(srcAddr, srcPort), netip.AddrPortFrom(dstAddr, dstPort), proto, true
+}
+
+// gzipFile closes both the decompressor and the file beneath it.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f gzipFile) Close() error {
+	f.Reader.Close()
+	return f.file.Close()
+}
+
+// openLogFile opens a log file, decompressing rotated .gz archives.
+func openLogFile(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return file, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return gzipFile{Reader: gz, file: file}, nil
+}
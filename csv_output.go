@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CSV compression of --csv-compression.
+const (
+	CSVCompressionNone = "none"
+	CSVCompressionZstd = "zstd"
+)
+
+// csvZstdExt is appended to the names of zstd-compressed CSV files.
+const csvZstdExt = ".zst"
+
+// csvOutputPath returns the file a CSV writer creates for an output name:
+// the name itself, or with csvZstdExt when compressed (stdout keeps "-").
+func csvOutputPath(filename string, wopts WriterOptions) string {
+	if wopts.CSVCompression != CSVCompressionZstd || filename == stdoutOutput || strings.HasSuffix(filename, csvZstdExt) {
+		return filename
+	}
+	return filename + csvZstdExt
+}
+
+// csvOutput is a CSV file, or stdout, with an optional zstd layer. A file is
+// written under its partial name until Close.
+type csvOutput struct {
+	file    io.WriteCloser
+	zstd    *zstd.Encoder // nil = uncompressed
+	partial partialFiles  // Empty for stdout
+}
+
+// createCSVOutput creates the file of a CSV output, compressed if wopts say so.
+func createCSVOutput(filename string, wopts WriterOptions) (*csvOutput, error) {
+	out := &csvOutput{file: os.Stdout}
+	var err error
+	if path := csvOutputPath(filename, wopts); path != stdoutOutput {
+		if out.file, err = out.partial.createOutput(path, wopts.Store); err != nil {
+			return nil, err
+		}
+	}
+	if wopts.CSVCompression == CSVCompressionZstd {
+		if out.zstd, err = zstd.NewWriter(out.file); err != nil {
+			out.abort()
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (o *csvOutput) Write(p []byte) (int, error) {
+	if o.zstd != nil {
+		return o.zstd.Write(p)
+	}
+	return o.file.Write(p)
+}
+
+// Flush ends the current zstd block, so readers of the file (zstdcat, tail)
+// see every row written so far.
+func (o *csvOutput) Flush() error {
+	if o.zstd != nil {
+		return o.zstd.Flush()
+	}
+	return nil
+}
+
+// Close finishes the zstd frame, closes the file and gives it its final name.
+func (o *csvOutput) Close() error {
+	var err error
+	if o.zstd != nil {
+		err = o.zstd.Close()
+	}
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+	return o.partial.finish(err)
+}
+
+// abort closes and removes a file whose rows could not all be written.
+func (o *csvOutput) abort() {
+	o.file.Close()
+	o.partial.discard()
+}
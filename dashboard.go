@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressLogMessage is the per-file progress log that --tui replaces with its
+// file progress bars.
+const progressLogMessage = "processed file"
+
+// Dashboard layout: redraw interval, width of the bars and number of
+// throughput samples in the sparkline.
+const (
+	dashboardInterval  = 250 * time.Millisecond
+	dashboardBarWidth  = 24
+	dashboardSparkline = 48
+)
+
+// sparkBlocks are the levels of the throughput sparkline, lowest first.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// Dashboard is the --tui terminal view of a run: one progress bar per file
+// being read, a memory gauge and a packets/s sparkline, redrawn in place at
+// the bottom of stderr. Logs are printed above it. A nil Dashboard shows
+// nothing.
+type Dashboard struct {
+	out         io.Writer
+	progress    *Progress
+	memoryLimit uint64 // --max-memory (0 = none, the gauge shows the heap against the OS memory)
+
+	mutex       sync.Mutex
+	rates       []float64 // Packets/s of the last samples, oldest first
+	lastPackets int64
+	lastSample  time.Time
+	lines       int // Lines of the last frame, erased before the next
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+// stderrIsTerminal reports whether stderr is an interactive terminal that
+// --tui can redraw.
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// NewDashboard starts drawing the progress of a run on stderr and routes the
+// default logger's records above it. The per-file progress logs are dropped
+// while it is shown.
+func NewDashboard(progress *Progress, memoryLimit uint64) *Dashboard {
+	d := &Dashboard{
+		out:         os.Stderr,
+		progress:    progress,
+		memoryLimit: memoryLimit,
+		lastSample:  time.Now(),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	slog.SetDefault(slog.New(&dashboardHandler{handler: slog.Default().Handler(), dashboard: d}))
+	go d.run()
+	return d
+}
+
+// run redraws the dashboard until Close.
+func (d *Dashboard) run() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(dashboardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.mutex.Lock()
+			d.sample()
+			d.erase()
+			d.draw()
+			d.mutex.Unlock()
+		}
+	}
+}
+
+// Close draws the final frame and stops redrawing. Later logs follow it.
+func (d *Dashboard) Close() {
+	if d == nil {
+		return
+	}
+	close(d.stop)
+	<-d.stopped
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.sample()
+	d.erase()
+	d.draw()
+	d.lines = 0
+	if h, ok := slog.Default().Handler().(*dashboardHandler); ok && h.dashboard == d {
+		slog.SetDefault(slog.New(h.handler))
+	}
+}
+
+// sample adds the packets/s since the last sample to the sparkline.
+func (d *Dashboard) sample() {
+	now := time.Now()
+	packets := d.progress.packets.Load()
+	d.rates = append(d.rates, perSecond(float64(packets-d.lastPackets), now.Sub(d.lastSample)))
+	if len(d.rates) > dashboardSparkline {
+		d.rates = d.rates[len(d.rates)-dashboardSparkline:]
+	}
+	d.lastPackets, d.lastSample = packets, now
+}
+
+// erase moves the cursor to the start of the last frame and clears it. The
+// caller holds the mutex.
+func (d *Dashboard) erase() {
+	if d.lines > 0 {
+		fmt.Fprintf(d.out, "\x1b[%dA\x1b[J", d.lines)
+	}
+	d.lines = 0
+}
+
+// draw prints a frame below the cursor. The caller holds the mutex.
+func (d *Dashboard) draw() {
+	var frame strings.Builder
+	p := d.progress
+	elapsed := time.Since(p.start).Truncate(time.Second)
+	rate := 0.0
+	if len(d.rates) > 0 {
+		rate = d.rates[len(d.rates)-1]
+	}
+	fmt.Fprintf(&frame, "gobyte %s  files %d/%d  packets %s  %s pkt/s\n",
+		elapsed, p.done.Load(), p.files, groupDigits(p.packets.Load()), groupDigits(int64(rate)))
+	fmt.Fprintf(&frame, "throughput %s\n", sparkline(d.rates))
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	limit, limitName := d.memoryLimit, "max-memory"
+	if limit == 0 {
+		limit, limitName = stats.Sys, "from OS"
+	}
+	fmt.Fprintf(&frame, "memory     %s %d / %d MB %s\n",
+		bar(float64(stats.HeapAlloc)/float64(max(limit, 1))), stats.HeapAlloc>>20, limit>>20, limitName)
+
+	for _, file := range p.reading() {
+		fmt.Fprintf(&frame, "file %-3d   %s %3.0f%%  %s\n", file.Slot, bar(file.Share), 100*file.Share, shortName(file.Name, 40))
+	}
+
+	fmt.Fprint(d.out, frame.String())
+	d.lines = strings.Count(frame.String(), "\n")
+}
+
+// bar renders a share between 0 and 1 as a bar of dashboardBarWidth cells.
+func bar(share float64) string {
+	filled := int(min(max(share, 0), 1) * dashboardBarWidth)
+	return "[" + strings.Repeat("█", filled) + strings.Repeat("░", dashboardBarWidth-filled) + "]"
+}
+
+// sparkline renders rates relative to their maximum.
+func sparkline(rates []float64) string {
+	peak := 0.0
+	for _, rate := range rates {
+		peak = max(peak, rate)
+	}
+	var line strings.Builder
+	for _, rate := range rates {
+		level := 0
+		if peak > 0 {
+			level = int(rate / peak * float64(len(sparkBlocks)-1))
+		}
+		line.WriteRune(sparkBlocks[level])
+	}
+	return line.String()
+}
+
+// groupDigits renders n with thousands separators, e.g. 1,234,567.
+func groupDigits(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	var grouped strings.Builder
+	for i, c := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(c)
+	}
+	return grouped.String()
+}
+
+// shortName keeps the end of a long file name, which tells inputs apart.
+func shortName(name string, width int) string {
+	if len(name) <= width {
+		return name
+	}
+	return "…" + name[len(name)-width+1:]
+}
+
+// dashboardHandler prints log records above the dashboard and drops the
+// per-file progress logs its bars replace.
+type dashboardHandler struct {
+	handler   slog.Handler
+	dashboard *Dashboard
+}
+
+func (h *dashboardHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *dashboardHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Message == progressLogMessage {
+		return nil
+	}
+	d := h.dashboard
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.erase()
+	err := h.handler.Handle(ctx, record)
+	d.draw()
+	return err
+}
+
+func (h *dashboardHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &dashboardHandler{handler: h.handler.WithAttrs(attrs), dashboard: h.dashboard}
+}
+
+func (h *dashboardHandler) WithGroup(name string) slog.Handler {
+	return &dashboardHandler{handler: h.handler.WithGroup(name), dashboard: h.dashboard}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Class collision policies for --class-collision, applied when the same class
+// name appears in more than one --dataset directory.
+const (
+	CollisionMerge  = "merge"  // Treat them as one class (default)
+	CollisionRename = "rename" // Prefix colliding classes with their dataset directory name
+	CollisionError  = "error"  // Refuse to combine the datasets
+)
+
+// defaultCaptureExtensions are the file name extensions of captures found in
+// dataset directories and archives unless --extensions says otherwise.
+var defaultCaptureExtensions = []string{"pcap", "pcapng"}
+
+// DatasetScan controls how dataset directories are searched for captures.
+type DatasetScan struct {
+	Depth          int      // Levels of subdirectories searched below each class directory (0 = none, -1 = all)
+	FollowSymlinks bool     // Treat symlinks to directories as directories (--follow-symlinks)
+	Extensions     []string // Extensions of capture files, without the dot (nil = defaultCaptureExtensions)
+	DefaultClass   string   // Class of captures outside class directories (--default-class, "" = skip them)
+}
+
+// extensions returns the extensions of capture files.
+func (s DatasetScan) extensions() []string {
+	if len(s.Extensions) == 0 {
+		return defaultCaptureExtensions
+	}
+	return s.Extensions
+}
+
+// isCapture reports whether a file name has one of the capture extensions.
+func (s DatasetScan) isCapture(name string) bool {
+	return slices.Contains(s.extensions(), strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+// parseExtensions parses the comma-separated --extensions list, with or
+// without dots: "pcap,pcapng,.cap".
+func parseExtensions(list string) ([]string, error) {
+	var extensions []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.TrimPrefix(strings.TrimSpace(ext), ".")
+		if ext == "" || strings.ContainsAny(ext, `*?[\/`) {
+			return nil, fmt.Errorf("invalid extension %q in %q", ext, list)
+		}
+		if !slices.Contains(extensions, ext) {
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions, nil
+}
+
+// discoverDatasetFiles scans the dataset directory and returns all PCAP/PCAPNG files with their classes
+func discoverDatasetFiles(datasetDir string, scan DatasetScan) ([]FileJob, error) {
+	if archiveKind(datasetDir) != "" {
+		return discoverArchiveFiles(datasetDir, scan)
+	}
+	entries, err := os.ReadDir(datasetDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dataset directory: %w", err)
+	}
+
+	var fileJobs []FileJob
+	var unlabeled []string // Captures next to the class directories
+
+	// Scan each class directory
+	for _, entry := range entries {
+		className := entry.Name()
+		classPath := filepath.Join(datasetDir, className)
+		if !isDir(entry, classPath, scan.FollowSymlinks) {
+			if scan.DefaultClass != "" && scan.isCapture(className) {
+				unlabeled = append(unlabeled, classPath)
+			}
+			continue
+		}
+
+		var allFiles []string
+		if scan.Depth != 0 {
+			allFiles, err = findCaptures(classPath, scan)
+			if err != nil {
+				slog.Warn("error scanning class directory", "dir", classPath, "error", err)
+				continue
+			}
+		} else {
+			// Find all capture files in this class, one extension after the other
+			for _, ext := range scan.extensions() {
+				files, err := filepath.Glob(filepath.Join(classPath, "*."+ext))
+				if err != nil {
+					slog.Warn("error scanning class directory", "dir", classPath, "error", err)
+					continue
+				}
+				allFiles = append(allFiles, files...)
+			}
+			if subdirs := countSubdirs(classPath); subdirs > 0 {
+				slog.Warn("class directory has subdirectories that are not scanned, use --recursive to include their files", "dir", classPath, "subdirs", subdirs)
+			}
+		}
+		slog.Info("found class", "dataset", datasetDir, "class", className, "files", len(allFiles))
+
+		for _, file := range allFiles {
+			fileJobs = append(fileJobs, FileJob{
+				FilePath: file,
+				Class:    className,
+			})
+		}
+	}
+	if len(unlabeled) > 0 {
+		slog.Info("found captures outside class directories", "dataset", datasetDir, "class", scan.DefaultClass, "files", len(unlabeled))
+		for _, file := range unlabeled {
+			fileJobs = append(fileJobs, FileJob{FilePath: file, Class: scan.DefaultClass})
+		}
+	}
+
+	if len(fileJobs) == 0 {
+		return nil, fmt.Errorf("no capture files (%s) found in dataset directory", strings.Join(scan.extensions(), ", "))
+	}
+
+	return fileJobs, nil
+}
+
+// isDir reports whether a directory entry is a directory. A symlink to a
+// directory is one if followSymlinks is set, and skipped with a warning
+// otherwise.
+func isDir(entry fs.DirEntry, path string, followSymlinks bool) bool {
+	if entry.Type()&fs.ModeSymlink == 0 {
+		return entry.IsDir()
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		slog.Warn("skipping broken symlink", "path", path, "error", err)
+		return false
+	}
+	if info.IsDir() && !followSymlinks {
+		slog.Warn("skipping symlink to a directory, use --follow-symlinks to include it", "path", path)
+		return false
+	}
+	return info.IsDir()
+}
+
+// findCaptures returns the PCAP/PCAPNG files in dir and in its subdirectories
+// up to scan.Depth levels below it, in lexical order. A symlink that leads back
+// to a directory being searched is skipped, so symlink cycles end.
+func findCaptures(dir string, scan DatasetScan) ([]string, error) {
+	var files []string
+	ancestors := make(map[string]bool) // Real paths of the directories being searched
+	var walk func(dir string, level int) error
+	walk = func(dir string, level int) error {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			real, err = filepath.Abs(real)
+		}
+		if err != nil {
+			return err
+		}
+		if ancestors[real] {
+			slog.Warn("skipping symlink cycle", "dir", dir, "target", real)
+			return nil
+		}
+		ancestors[real] = true
+		defer delete(ancestors, real)
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if entry.IsDir() || entry.Type()&fs.ModeSymlink != 0 && isDir(entry, path, scan.FollowSymlinks) {
+				if scan.Depth < 0 || level < scan.Depth {
+					if err := walk(path, level+1); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if scan.isCapture(path) {
+				files = append(files, path)
+			}
+		}
+		return nil
+	}
+	return files, walk(dir, 0)
+}
+
+// countSubdirs returns the number of subdirectories of dir.
+func countSubdirs(dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			n++
+		}
+	}
+	return n
+}
+
+// discoverArchiveFiles returns the captures of a dataset archive whose
+// directories are their classes. Captures at the top of the archive have no
+// class and are ignored, like files next to the class directories, unless
+// the scan gives them a default class.
+func discoverArchiveFiles(archivePath string, scan DatasetScan) ([]FileJob, error) {
+	jobs, err := archiveJobs(archivePath, scan)
+	if err != nil {
+		return nil, err
+	}
+	labeled := jobs[:0]
+	files := make(map[string]int)
+	for _, job := range jobs {
+		if job.Class != "" {
+			labeled = append(labeled, job)
+			files[job.Class]++
+		}
+	}
+	if len(labeled) == 0 {
+		return nil, fmt.Errorf("no capture files (%s) in class directories of the archive", strings.Join(scan.extensions(), ", "))
+	}
+	classes := make([]string, 0, len(files))
+	for class := range files {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		slog.Info("found class", "dataset", archivePath, "class", class, "files", files[class])
+	}
+	return labeled, nil
+}
+
+// discoverDatasets scans several dataset directories and combines their files.
+// Classes that appear in more than one directory are merged, renamed to
+// <dataset>_<class>, or rejected depending on the collision policy.
+func discoverDatasets(datasetDirs []string, collision string, scan DatasetScan) ([]FileJob, error) {
+	switch collision {
+	case CollisionMerge, CollisionRename, CollisionError:
+	default:
+		return nil, fmt.Errorf("invalid class collision policy %q (use merge, rename or error)", collision)
+	}
+
+	perDir := make([][]FileJob, len(datasetDirs))
+	classDirs := make(map[string][]string) // class name -> dataset dirs containing it
+
+	for i, dir := range datasetDirs {
+		jobs, err := discoverDatasetFiles(dir, scan)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		perDir[i] = jobs
+
+		seen := make(map[string]bool)
+		for _, job := range jobs {
+			if !seen[job.Class] {
+				seen[job.Class] = true
+				classDirs[job.Class] = append(classDirs[job.Class], dir)
+			}
+		}
+	}
+
+	// Report collisions in a stable order
+	var collisions []string
+	for className, dirs := range classDirs {
+		if len(dirs) > 1 {
+			collisions = append(collisions, className)
+		}
+	}
+	sort.Strings(collisions)
+
+	for _, className := range collisions {
+		dirs := classDirs[className]
+		switch collision {
+		case CollisionError:
+			return nil, fmt.Errorf("class %q exists in multiple datasets (%s); use --class-collision merge or rename",
+				className, strings.Join(dirs, ", "))
+		case CollisionMerge:
+			slog.Info("merging class across datasets", "class", className, "datasets", dirs)
+		case CollisionRename:
+			slog.Info("renaming colliding class", "class", className, "datasets", dirs)
+		}
+	}
+
+	var fileJobs []FileJob
+	renamed := make(map[string]string) // new class name -> dataset dir, to detect clashes after renaming
+	for i, dir := range datasetDirs {
+		prefix := filepath.Base(filepath.Clean(dir))
+		for _, job := range perDir[i] {
+			if collision == CollisionRename && len(classDirs[job.Class]) > 1 {
+				job.Class = prefix + "_" + job.Class
+				if other, exists := renamed[job.Class]; exists && other != dir {
+					return nil, fmt.Errorf("renamed class %q is still ambiguous (%s and %s have the same directory name)",
+						job.Class, other, dir)
+				}
+				renamed[job.Class] = dir
+			}
+			fileJobs = append(fileJobs, job)
+		}
+	}
+
+	return fileJobs, nil
+}
+
+// filterClasses keeps the files of the classes in include (all classes if
+// empty) that are not in exclude. Both are comma-separated class names as they
+// appear in the output, i.e. after --class-collision renaming. Unknown names
+// are rejected, so a typo cannot silently drop a class.
+func filterClasses(fileJobs []FileJob, include, exclude string) ([]FileJob, error) {
+	known := make(map[string]bool)
+	for _, job := range fileJobs {
+		known[job.Class] = true
+	}
+	parse := func(flagName, list string) (map[string]bool, error) {
+		classes := make(map[string]bool)
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !known[name] {
+				return nil, fmt.Errorf("%s: unknown class %q", flagName, name)
+			}
+			classes[name] = true
+		}
+		return classes, nil
+	}
+
+	included, err := parse("--classes", include)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := parse("--exclude-classes", exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []FileJob
+	for _, job := range fileJobs {
+		if (len(included) == 0 || included[job.Class]) && !excluded[job.Class] {
+			kept = append(kept, job)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("no files left after --classes/--exclude-classes")
+	}
+	return kept, nil
+}
+
+// expandInputPattern expands an --input value containing glob characters
+// (e.g. "captures/2024-*/*.pcap") into the matching files, in lexical order.
+// A value without glob characters is returned unchanged.
+func expandInputPattern(pattern string) ([]string, error) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input pattern %q: %w", pattern, err)
+	}
+
+	files := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && !info.IsDir() {
+			files = append(files, match)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files match input pattern %q", pattern)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// Flow deduplication modes for --dedup-flows.
+const (
+	DedupOff    = ""       // No deduplication (default)
+	DedupDrop   = "drop"   // Keep only the first occurrence of each flow
+	DedupReport = "report" // Keep every flow but list duplicates
+)
+
+// DuplicateFlow is one line of duplicate_flows.jsonl.
+type DuplicateFlow struct {
+	Flow             string `json:"flow"`
+	File             string `json:"file"`
+	Class            string `json:"class,omitempty"`
+	Packets          int    `json:"packets"`
+	DuplicateOf      string `json:"duplicate_of"`
+	DuplicateOfClass string `json:"duplicate_of_class,omitempty"`
+	CrossClass       bool   `json:"cross_class"`
+	Dropped          bool   `json:"dropped"`
+}
+
+// flowOrigin is where a flow's content was first seen.
+type flowOrigin struct {
+	File  string
+	Class string
+}
+
+// FlowDeduplicator finds flows whose packet bytes are identical to a flow already
+// seen in this run. It is safe for concurrent use by file processors.
+type FlowDeduplicator struct {
+	mode       string
+	seen       map[[sha256.Size]byte]flowOrigin
+	reportFile *os.File
+	encoder    *json.Encoder
+	duplicates int
+	crossClass int
+	mutex      sync.Mutex
+}
+
+// NewFlowDeduplicator creates a deduplicator for the given mode, writing the
+// duplicate list to reportPath. It returns nil when mode is DedupOff.
+func NewFlowDeduplicator(mode, reportPath string) (*FlowDeduplicator, error) {
+	switch mode {
+	case DedupOff:
+		return nil, nil
+	case DedupDrop, DedupReport:
+	default:
+		return nil, fmt.Errorf("invalid --dedup-flows mode %q (use drop or report)", mode)
+	}
+
+	file, err := os.Create(reportPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create duplicate flow report: %w", err)
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetEscapeHTML(false) // Keep "->" readable in flow names
+
+	return &FlowDeduplicator{
+		mode:       mode,
+		seen:       make(map[[sha256.Size]byte]flowOrigin),
+		reportFile: file,
+		encoder:    encoder,
+	}, nil
+}
+
+// flowDigest accumulates the content hash of one flow.
+type flowDigest struct {
+	hash    hash.Hash
+	packets int
+	order   int // Position of the flow's first packet, for stable registration order
+}
+
+// scan reads a capture once, hashing the bytes of every flow, and registers the
+// flows with the run. It returns the flows of this file that must be dropped.
+func (d *FlowDeduplicator) scan(ctx context.Context, fileJob FileJob, opts ProcessOptions) (map[FlowKey]bool, error) {
+	handle, err := openInput(fileJob, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+
+	flows := make(map[FlowKey]*flowDigest)
+	var length [4]byte
+	captured := newCaptureRange(opts)
+	for ctx.Err() == nil {
+		packet, err := packetSource.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The processing pass reports read errors
+			break
+		}
+
+		// Only the packets the processing pass reads count
+		keep, done := captured.next(packet)
+		if done {
+			break
+		}
+		if !keep {
+			continue
+		}
+		if opts.GTPDecap || opts.IPDecap > 0 {
+			packet, _ = opts.decapsulate(packet)
+		}
+
+		key, ok := flowKeyOf(packet)
+		if !ok {
+			continue
+		}
+		digest, exists := flows[key]
+		if !exists {
+			digest = &flowDigest{hash: sha256.New(), order: len(flows)}
+			flows[key] = digest
+		}
+
+		// Length-prefix each packet so packet boundaries are part of the content
+		binary.BigEndian.PutUint32(length[:], uint32(len(packet.Data())))
+		digest.hash.Write(length[:])
+		digest.hash.Write(packet.Data())
+		digest.packets++
+	}
+
+	// Register in first-appearance order so "first occurrence" is well defined within a file
+	keys := make([]FlowKey, len(flows))
+	for key, digest := range flows {
+		keys[digest.order] = key
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var drop map[FlowKey]bool
+	for _, key := range keys {
+		digest := flows[key]
+		var sum [sha256.Size]byte
+		digest.hash.Sum(sum[:0])
+
+		origin, duplicate := d.seen[sum]
+		if !duplicate {
+			d.seen[sum] = flowOrigin{File: fileJob.key(), Class: fileJob.Class}
+			continue
+		}
+
+		item := DuplicateFlow{
+			Flow:             key.String(),
+			File:             fileJob.key(),
+			Class:            fileJob.Class,
+			Packets:          digest.packets,
+			DuplicateOf:      origin.File,
+			DuplicateOfClass: origin.Class,
+			CrossClass:       origin.Class != fileJob.Class,
+			Dropped:          d.mode == DedupDrop,
+		}
+		d.duplicates++
+		if item.CrossClass {
+			d.crossClass++
+		}
+		if err := d.encoder.Encode(item); err != nil {
+			slog.Warn("failed to write duplicate flow report entry", "error", err)
+		}
+
+		if d.mode == DedupDrop {
+			if drop == nil {
+				drop = make(map[FlowKey]bool)
+			}
+			drop[key] = true
+		}
+	}
+
+	return drop, nil
+}
+
+// Close finishes the report and logs how many duplicate flows were found.
+func (d *FlowDeduplicator) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.duplicates > 0 {
+		slog.Warn("duplicate flows found",
+			"mode", d.mode,
+			"flows", d.duplicates,
+			"cross_class", d.crossClass,
+			"report", d.reportFile.Name())
+	}
+	return d.reportFile.Close()
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// diffMaxDistinct caps the values counted per non-numeric column, so a column
+// of unique values (file names, flow IDs) does not hold every row.
+const diffMaxDistinct = 100000
+
+// outputSummary is what `gobyte diff` compares of an output: its schema, the
+// rows of each class, a hash of every row and the distribution of each column.
+type outputSummary struct {
+	name    string
+	format  string
+	schema  []string // Columns with their types, runs of Byte_N collapsed
+	rows    int64
+	classes map[string]int64
+
+	hashes  map[uint64]int32 // Row hash -> rows with it
+	ordered maphash.Hash     // Hash of the row hashes in file order
+	row     maphash.Hash
+
+	rawData string       // dtype of NumPy data that is not bytes ("" = bytes)
+	lengths diffStats    // Bytes per row
+	offsets []*diffStats // Byte values at each offset
+	columns map[string]*diffStats
+	names   []string // Columns in order of appearance
+	ignore  map[string]bool
+}
+
+// diffStats summarizes the values of a column: numbers by their moments
+// and range, other values by how many distinct ones there are.
+type diffStats struct {
+	count     int64
+	numeric   int64
+	sum       float64
+	squares   float64
+	min, max  float64
+	distinct  map[string]struct{}
+	saturated bool // More than diffMaxDistinct distinct values
+}
+
+func (s *diffStats) addNumber(v float64) {
+	if s.numeric == 0 || v < s.min {
+		s.min = v
+	}
+	if s.numeric == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.numeric++
+	s.sum += v
+	s.squares += v * v
+}
+
+func (s *diffStats) addValue(value string) {
+	if v, err := strconv.ParseFloat(value, 64); err == nil {
+		s.addNumber(v)
+		return
+	}
+	s.count++
+	if s.distinct == nil {
+		s.distinct = make(map[string]struct{})
+	}
+	if len(s.distinct) < diffMaxDistinct {
+		s.distinct[value] = struct{}{}
+	} else if _, seen := s.distinct[value]; !seen {
+		s.saturated = true
+	}
+}
+
+func (s *diffStats) mean() float64 {
+	if s.numeric == 0 {
+		return 0
+	}
+	return s.sum / float64(s.numeric)
+}
+
+func (s *diffStats) std() float64 {
+	if s.numeric == 0 {
+		return 0
+	}
+	mean := s.mean()
+	return math.Sqrt(max(0, s.squares/float64(s.numeric)-mean*mean))
+}
+
+// distinctCount renders the number of distinct non-numeric values.
+func (s *diffStats) distinctCount() string {
+	if s.saturated {
+		return fmt.Sprintf("over %d", diffMaxDistinct)
+	}
+	return strconv.Itoa(len(s.distinct))
+}
+
+// runDiff is the `gobyte diff` subcommand: it compares two outputs (Parquet,
+// CSV or NumPy) and reports how their schemas, class counts, rows and column
+// distributions differ, so a tool upgrade or flag change that alters a
+// dataset does not go unnoticed. Like diff(1), it exits with 0 if the outputs
+// are the same, 1 if they differ and 2 on errors.
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	byteRepr := flags.String("byte-repr", ByteReprDec, "How CSV files render byte cells: dec, hex or float (as written with --byte-repr)")
+	ignoreColumns := flags.String("ignore-columns", "", "Comma-separated columns left out of the comparison, e.g. filename,timestamp for outputs of moved or time-shifted captures")
+	ignoreOrder := flags.Bool("ignore-order", false, "Count the same rows in another order as no difference, e.g. for outputs written with --sort=false")
+	tolerance := flags.Float64("tolerance", 1e-9, "Relative change of a column statistic reported as a difference")
+	maxLines := flags.Int("max-lines", 10, "Byte offsets and classes listed at most per section")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [options] a.parquet|a.csv|a.npy b.parquet|b.csv|b.npy\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Compares two GoByte outputs: schema, rows per class, row contents and column distributions.\nExits with 0 if they are the same, 1 if they differ and 2 on errors.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 || *tolerance < 0 || *maxLines <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	switch *byteRepr {
+	case ByteReprDec, ByteReprHex, ByteReprFloat:
+	default:
+		slog.Error("invalid --byte-repr (use dec, hex or float)", "byte_repr", *byteRepr)
+		os.Exit(2)
+	}
+	ignore := make(map[string]bool)
+	for _, name := range strings.Split(*ignoreColumns, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ignore[name] = true
+		}
+	}
+
+	seed := maphash.MakeSeed()
+	summaries := make([]*outputSummary, 2)
+	for i, name := range flags.Args() {
+		summary, err := summarizeOutput(name, *byteRepr, ignore, seed)
+		if err != nil {
+			slog.Error("failed to read output", "file", name, "error", err)
+			os.Exit(2)
+		}
+		summaries[i] = summary
+	}
+
+	d := outputDiff{a: summaries[0], b: summaries[1], tolerance: *tolerance, maxLines: *maxLines, ignoreOrder: *ignoreOrder, w: bufio.NewWriter(os.Stdout)}
+	same := d.report()
+	d.w.Flush()
+	if !same {
+		os.Exit(1)
+	}
+}
+
+// summarizeOutput reads every row of an output.
+func summarizeOutput(name, byteRepr string, ignore map[string]bool, seed maphash.Seed) (*outputSummary, error) {
+	s := &outputSummary{
+		name:    name,
+		classes: make(map[string]int64),
+		hashes:  make(map[uint64]int32),
+		columns: make(map[string]*diffStats),
+		ignore:  ignore,
+	}
+	s.ordered.SetSeed(seed)
+	s.row.SetSeed(seed)
+
+	var err error
+	switch ext := strings.ToLower(filepath.Ext(strings.TrimSuffix(name, csvZstdExt))); ext {
+	case ".parquet":
+		s.format = "parquet"
+		err = s.readParquet()
+	case ".csv":
+		s.format = "csv"
+		err = s.readCSV(byteRepr)
+	case ".npy":
+		s.format = "numpy"
+		err = s.readNumpy()
+	default:
+		return nil, fmt.Errorf("unsupported output %q (use .parquet, .csv, .csv.zst or .npy)", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.schema = collapseByteColumns(s.schema)
+	return s, nil
+}
+
+// addColumn adds a column to the schema unless it is ignored.
+func (s *outputSummary) addColumn(name, kind string) {
+	if s.ignore[name] {
+		return
+	}
+	if kind != "" {
+		name += " " + kind
+	}
+	s.schema = append(s.schema, name)
+}
+
+// add summarizes a row.
+func (s *outputSummary) add(row inspectRow) {
+	s.rows++
+	s.classes[row.class]++
+
+	s.row.Reset()
+	s.row.WriteString(row.class)
+	s.row.WriteByte(0)
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len(row.data)))
+	s.row.Write(length[:])
+	s.row.Write(row.data)
+	for _, column := range row.columns {
+		name, value := column[0], column[1]
+		if s.ignore[name] {
+			continue
+		}
+		// Numbers hash alike whichever format rendered them
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		s.row.WriteString(name)
+		s.row.WriteByte('=')
+		s.row.WriteString(value)
+		s.row.WriteByte(0)
+
+		stats, ok := s.columns[name]
+		if !ok {
+			stats = &diffStats{}
+			s.columns[name] = stats
+			s.names = append(s.names, name)
+		}
+		stats.addValue(value)
+	}
+	h := s.row.Sum64()
+	s.hashes[h]++
+	binary.LittleEndian.PutUint64(length[:], h)
+	s.ordered.Write(length[:])
+
+	s.lengths.addNumber(float64(len(row.data)))
+	if s.rawData != "" {
+		return
+	}
+	for len(s.offsets) < len(row.data) {
+		s.offsets = append(s.offsets, &diffStats{})
+	}
+	for i, b := range row.data {
+		s.offsets[i].addNumber(float64(b))
+	}
+}
+
+// readParquet reads the rows of a Parquet output.
+func (s *outputSummary) readParquet() error {
+	file, err := os.Open(s.name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	pf, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		return err
+	}
+	columns := pf.Schema().Columns()
+	for _, path := range columns {
+		kind := ""
+		if leaf, ok := pf.Schema().Lookup(path...); ok {
+			kind = leaf.Node.Type().String()
+		}
+		s.addColumn(strings.Join(path, "."), kind)
+	}
+
+	reader := parquet.NewReader(pf)
+	defer reader.Close()
+	buffer := make([]parquet.Row, 1024)
+	for number := 0; ; {
+		count, err := reader.ReadRows(buffer)
+		for _, values := range buffer[:count] {
+			s.add(parquetInspectRow(number, values, columns))
+			number++
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readCSV reads the rows of a CSV output, whose Byte_N cells are rendered as
+// byteRepr.
+func (s *outputSummary) readCSV(byteRepr string) error {
+	reader, closer, err := openCSVFile(s.name)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	for _, name := range header {
+		s.addColumn(name, "")
+	}
+	for number := 0; ; number++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row, err := csvInspectRow(number, header, record, byteRepr)
+		if err != nil {
+			return err
+		}
+		s.add(row)
+	}
+}
+
+// numpyArray is an array of a NumPy output being read row by row.
+type numpyArray struct {
+	file    *os.File
+	reader  *bufio.Reader
+	descr   string
+	rows    int64
+	cols    int
+	rowSize int
+}
+
+// openNumpyArray opens an array and reads its header.
+func openNumpyArray(filename string) (*numpyArray, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	a := &numpyArray{file: file, reader: bufio.NewReaderSize(file, 1024*1024)}
+	// The buffered reader is left at the first row
+	if a.descr, a.rows, a.cols, _, err = readNumpyHeader(a.reader); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", filepath.Base(filename), err)
+	}
+	elemSize, err := strconv.Atoi(a.descr[2:])
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: unsupported dtype %s", filepath.Base(filename), a.descr)
+	}
+	a.rowSize = max(a.cols, 1) * elemSize
+	return a, nil
+}
+
+// readNumpy reads the rows of a NumPy output: <base>_data.npy and, if the
+// output has them, its labels and features, given the name of the run's
+// --output or of its data array.
+func (s *outputSummary) readNumpy() error {
+	base := numpyBaseName(s.name)
+	if _, err := os.Stat(base + "_data.npy"); err != nil {
+		base = strings.TrimSuffix(base, "_data")
+	}
+	data, err := openNumpyArray(base + "_data.npy")
+	if err != nil {
+		return err
+	}
+	defer data.file.Close()
+	if data.descr != numpyDescrUint8 {
+		s.rawData = data.descr
+	}
+	s.addColumn("data", fmt.Sprintf("%s x %d", data.descr, data.cols))
+
+	var labels, features *numpyArray
+	names := make(map[byte]string)
+	if labels, err = openNumpyArray(base + "_labels.npy"); err == nil {
+		defer labels.file.Close()
+		classes, err := readClassMappingFile(base + "_classes.json")
+		if err != nil {
+			return err
+		}
+		for class, id := range classes {
+			names[id] = class
+		}
+		s.addColumn("labels", labels.descr)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var featureNames []string
+	if features, err = openNumpyArray(base + "_features.npy"); err == nil {
+		defer features.file.Close()
+		if featureNames, err = readFeatureNamesFile(base + "_features.json"); err != nil {
+			return err
+		}
+		for _, name := range featureNames {
+			s.addColumn(name, features.descr)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, array := range []*numpyArray{labels, features} {
+		if array != nil && array.rows != data.rows {
+			return fmt.Errorf("%s has %d rows, the data array %d", filepath.Base(array.file.Name()), array.rows, data.rows)
+		}
+	}
+
+	buf := make([]byte, data.rowSize)
+	var label [1]byte
+	var values []byte
+	if features != nil {
+		values = make([]byte, features.rowSize)
+	}
+	for number := int64(0); number < data.rows; number++ {
+		if _, err := io.ReadFull(data.reader, buf); err != nil {
+			return err
+		}
+		row := inspectRow{number: int(number), data: buf}
+		if labels != nil {
+			if _, err := io.ReadFull(labels.reader, label[:]); err != nil {
+				return err
+			}
+			row.class = names[label[0]]
+			if row.class == "" {
+				row.class = strconv.Itoa(int(label[0]))
+			}
+		}
+		if features != nil {
+			if _, err := io.ReadFull(features.reader, values); err != nil {
+				return err
+			}
+			for i, name := range featureNames {
+				v := math.Float64frombits(binary.LittleEndian.Uint64(values[8*i:]))
+				row.columns = append(row.columns, [2]string{name, strconv.FormatFloat(v, 'g', -1, 64)})
+			}
+		}
+		s.add(row)
+	}
+	return nil
+}
+
+// collapseByteColumns replaces runs of Byte_N columns of one type with one
+// entry, so a schema of 1500 byte columns reads as one line.
+func collapseByteColumns(schema []string) []string {
+	var collapsed []string
+	for i := 0; i < len(schema); {
+		name, kind, _ := strings.Cut(schema[i], " ")
+		if !strings.HasPrefix(name, "Byte_") {
+			collapsed = append(collapsed, schema[i])
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(schema) {
+			next, nextKind, _ := strings.Cut(schema[j], " ")
+			if !strings.HasPrefix(next, "Byte_") || nextKind != kind {
+				break
+			}
+			j++
+		}
+		last, _, _ := strings.Cut(schema[j-1], " ")
+		entry := fmt.Sprintf("%s..%s (%d columns)", name, last, j-i)
+		if kind != "" {
+			entry = fmt.Sprintf("%s..%s %s (%d columns)", name, last, kind, j-i)
+		}
+		collapsed = append(collapsed, entry)
+		i = j
+	}
+	return collapsed
+}
+
+// outputDiff writes the comparison of two outputs.
+type outputDiff struct {
+	a, b        *outputSummary
+	tolerance   float64
+	maxLines    int
+	ignoreOrder bool
+	w           *bufio.Writer
+}
+
+// differs reports whether two statistics differ by more than the tolerance.
+func (d *outputDiff) differs(x, y float64) bool {
+	return math.Abs(x-y) > d.tolerance*max(1, math.Abs(x), math.Abs(y))
+}
+
+// report writes the differences and reports whether the outputs are the same.
+func (d *outputDiff) report() bool {
+	fmt.Fprintf(d.w, "--- %s (%s, %d rows)\n", d.a.name, d.a.format, d.a.rows)
+	fmt.Fprintf(d.w, "+++ %s (%s, %d rows)\n", d.b.name, d.b.format, d.b.rows)
+
+	same := d.schema()
+	same = d.classes() && same
+	same = d.content() && same
+	same = d.distributions() && same
+	if same {
+		fmt.Fprintln(d.w, "\noutputs are the same")
+	} else {
+		fmt.Fprintln(d.w, "\noutputs differ")
+	}
+	return same
+}
+
+// schema compares the columns of the outputs.
+func (d *outputDiff) schema() bool {
+	if slices.Equal(d.a.schema, d.b.schema) {
+		fmt.Fprintf(d.w, "\nschema: same (%d columns)\n", len(d.a.schema))
+		return true
+	}
+	fmt.Fprintln(d.w, "\nschema: differs")
+	if d.a.format != d.b.format {
+		fmt.Fprintf(d.w, "  (%s and %s outputs name their columns differently)\n", d.a.format, d.b.format)
+	}
+	for _, column := range d.a.schema {
+		if !slices.Contains(d.b.schema, column) {
+			fmt.Fprintf(d.w, "  - %s\n", column)
+		}
+	}
+	for _, column := range d.b.schema {
+		if !slices.Contains(d.a.schema, column) {
+			fmt.Fprintf(d.w, "  + %s\n", column)
+		}
+	}
+	if a, b := slices.Sorted(slices.Values(d.a.schema)), slices.Sorted(slices.Values(d.b.schema)); slices.Equal(a, b) {
+		fmt.Fprintln(d.w, "  (same columns in another order)")
+	}
+	return false
+}
+
+// classes compares the rows of each class.
+func (d *outputDiff) classes() bool {
+	var names []string
+	for class := range d.a.classes {
+		names = append(names, class)
+	}
+	for class := range d.b.classes {
+		if _, ok := d.a.classes[class]; !ok {
+			names = append(names, class)
+		}
+	}
+	// The largest changes first
+	slices.SortFunc(names, func(x, y string) int {
+		dx, dy := d.b.classes[x]-d.a.classes[x], d.b.classes[y]-d.a.classes[y]
+		return cmp.Or(cmp.Compare(abs(dy), abs(dx)), strings.Compare(x, y))
+	})
+	changed := slices.IndexFunc(names, func(class string) bool { return d.a.classes[class] == d.b.classes[class] })
+	if changed < 0 {
+		changed = len(names)
+	}
+	if changed == 0 && d.a.rows == d.b.rows {
+		fmt.Fprintf(d.w, "\nrows: same (%d in %d %s)\n", d.a.rows, len(names), plural(len(names), "class", "classes"))
+		return true
+	}
+
+	fmt.Fprintf(d.w, "\nrows: %d -> %d (%+d), %d of %d classes changed\n", d.a.rows, d.b.rows, d.b.rows-d.a.rows, changed, len(names))
+	for i, class := range names[:changed] {
+		if i == d.maxLines {
+			fmt.Fprintf(d.w, "  ... %d more classes\n", changed-i)
+			break
+		}
+		label := class
+		if label == "" {
+			label = "(no class)"
+		}
+		fmt.Fprintf(d.w, "  %-24s %10d -> %-10d (%+d)\n", label, d.a.classes[class], d.b.classes[class], d.b.classes[class]-d.a.classes[class])
+	}
+	return false
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// content compares the rows themselves, by their hashes.
+func (d *outputDiff) content() bool {
+	var onlyA, onlyB int64
+	for h, n := range d.a.hashes {
+		onlyA += int64(max(0, n-d.b.hashes[h]))
+	}
+	for h, n := range d.b.hashes {
+		onlyB += int64(max(0, n-d.a.hashes[h]))
+	}
+	switch {
+	case onlyA > 0 || onlyB > 0:
+		fmt.Fprintf(d.w, "\ncontent: %d rows only in %s, %d rows only in %s\n", onlyA, d.a.name, onlyB, d.b.name)
+		return false
+	case d.a.ordered.Sum64() != d.b.ordered.Sum64():
+		fmt.Fprintln(d.w, "\ncontent: same rows in another order")
+		return d.ignoreOrder
+	}
+	fmt.Fprintln(d.w, "\ncontent: same rows in the same order")
+	return true
+}
+
+// distributions compares row lengths, the values at each byte offset and
+// the other columns.
+func (d *outputDiff) distributions() bool {
+	var lines []string
+	la, lb := &d.a.lengths, &d.b.lengths
+	if d.differs(la.mean(), lb.mean()) || la.min != lb.min || la.max != lb.max {
+		lines = append(lines, fmt.Sprintf("row bytes: mean %.2f -> %.2f, min %g -> %g, max %g -> %g", la.mean(), lb.mean(), la.min, lb.min, la.max, lb.max))
+	}
+
+	// Byte offsets whose mean value moved the most
+	if d.a.rawData == "" && d.b.rawData == "" {
+		type offsetChange struct {
+			offset int
+			a, b   float64
+		}
+		var changes []offsetChange
+		// Offsets beyond the shorter rows show in the row bytes
+		for i := range min(len(d.a.offsets), len(d.b.offsets)) {
+			a, b := d.a.offsets[i], d.b.offsets[i]
+			if d.differs(a.mean(), b.mean()) {
+				changes = append(changes, offsetChange{i, a.mean(), b.mean()})
+			}
+		}
+		slices.SortStableFunc(changes, func(x, y offsetChange) int {
+			return cmp.Compare(math.Abs(y.b-y.a), math.Abs(x.b-x.a))
+		})
+		for i, c := range changes {
+			if i == d.maxLines {
+				lines = append(lines, fmt.Sprintf("... %d more byte offsets", len(changes)-i))
+				break
+			}
+			lines = append(lines, fmt.Sprintf("byte %d: mean %.2f -> %.2f", c.offset, c.a, c.b))
+		}
+	} else if d.a.rawData != d.b.rawData {
+		lines = append(lines, fmt.Sprintf("data dtype: %s -> %s, byte offsets not compared", cmp.Or(d.a.rawData, numpyDescrUint8), cmp.Or(d.b.rawData, numpyDescrUint8)))
+	}
+
+	// Columns of one output only show in the schema
+	for _, name := range d.a.names {
+		a, b := d.a.columns[name], d.b.columns[name]
+		if b == nil {
+			continue
+		}
+		if a.numeric > 0 || b.numeric > 0 {
+			if d.differs(a.mean(), b.mean()) || d.differs(a.std(), b.std()) || a.min != b.min || a.max != b.max || a.numeric != b.numeric {
+				lines = append(lines, fmt.Sprintf("%s: mean %.6g -> %.6g, std %.6g -> %.6g, min %g -> %g, max %g -> %g",
+					name, a.mean(), b.mean(), a.std(), b.std(), a.min, b.min, a.max, b.max))
+			}
+		}
+		if a.count-a.numeric > 0 || b.count-b.numeric > 0 {
+			if len(a.distinct) != len(b.distinct) || a.saturated != b.saturated || a.count-a.numeric != b.count-b.numeric {
+				lines = append(lines, fmt.Sprintf("%s: %s -> %s distinct values", name, a.distinctCount(), b.distinctCount()))
+			}
+		}
+	}
+
+	if len(lines) == 0 {
+		fmt.Fprintln(d.w, "\ncolumns: same distributions")
+		return true
+	}
+	fmt.Fprintln(d.w, "\ncolumns: distributions differ")
+	for _, line := range lines {
+		fmt.Fprintf(d.w, "  %s\n", line)
+	}
+	return false
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// freeDiskSpace is not implemented on this platform; the output estimate is
+// still printed, without the free space check.
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Timings of coordinator/worker runs. Workers report on their task every
+// workerHeartbeat; a task whose worker is silent for workerLeaseTimeout is
+// handed to another worker.
+const (
+	workerHeartbeat    = 10 * time.Second
+	workerLeaseTimeout = time.Minute
+	workerPoll         = 2 * time.Second // Wait before asking again when every task is handed out
+	workerJoinTimeout  = time.Minute     // How long a worker keeps trying to reach its coordinator
+	taskAttempts       = 3               // Tries of a task before its file counts as skipped
+)
+
+// clusterTokenEnv names the environment variable with the shared secret that
+// workers present to their coordinator.
+const clusterTokenEnv = "GOBYTE_CLUSTER_TOKEN"
+
+// coordinatorOnlyFlags are flags of the coordinator's run that its workers'
+// runs must not get.
+var coordinatorOnlyFlags = []string{"coordinator", "web", "tui"}
+
+// workerTask is an input file that a coordinator hands to a worker, with the
+// arguments of the coordinator's run and the settings derived from all of its
+// inputs, so every worker converts its files alike. Secret flags
+// (provenanceSecretFlags) are not sent: each worker is given them itself, and
+// checks them against the coordinator's digests.
+type workerTask struct {
+	ID            int               `json:"id"`
+	Args          []string          `json:"args"`
+	Job           FileJob           `json:"job"`
+	OutputDir     string            `json:"output_dir"` // The coordinator's per-file directory
+	ClassIDs      map[string]byte   `json:"class_ids"`
+	AssumedLength int               `json:"assumed_length"`
+	SecretDigests map[string]string `json:"secret_digests,omitempty"` // Secret flag -> secretDigest of its value
+	Secrets       map[string]string `json:"secrets,omitempty"`        // Secret flag -> value, added by the worker to its task file
+}
+
+// secretDigest returns an HMAC of the value of a secret flag under the
+// cluster token, which tells whether a worker has the coordinator's value
+// without revealing it. --anon-key @file is read, so the key itself counts.
+func secretDigest(token, name, value string) (string, error) {
+	if name == "anon-key" {
+		key, err := readAnonKey(value)
+		if err != nil {
+			return "", err
+		}
+		value = string(key)
+	}
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(name + "=" + value))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// workerResult is what a worker reports for a task: the outcome of the file in
+// the run report of its run, or why the run failed.
+type workerResult struct {
+	Task   int            `json:"task"`
+	Worker string         `json:"worker"`
+	File   *RunReportFile `json:"file,omitempty"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// readWorkerTask reads the task file of a --worker-task run.
+func readWorkerTask(filename string) (*workerTask, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var task workerTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// absoluteJobs makes the paths of the inputs absolute, so workers started in
+// other directories find them.
+func absoluteJobs(fileJobs []FileJob) ([]FileJob, error) {
+	jobs := make([]FileJob, len(fileJobs))
+	for i, job := range fileJobs {
+		var err error
+		if job.FilePath, err = filepath.Abs(job.FilePath); err != nil {
+			return nil, err
+		}
+		if job.Archive != "" {
+			if job.Archive, err = filepath.Abs(job.Archive); err != nil {
+				return nil, err
+			}
+		}
+		jobs[i] = job
+	}
+	return jobs, nil
+}
+
+// withoutFlags returns the command-line arguments without the named flags of
+// flag.CommandLine and their values.
+func withoutFlags(args []string, names ...string) []string {
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || !slices.Contains(names, name) {
+			kept = append(kept, args[i])
+			continue
+		}
+		if f := flag.CommandLine.Lookup(name); f != nil && !hasValue && !isBoolFlag(f) {
+			i++ // The value is the next argument
+		}
+	}
+	return kept
+}
+
+// isBoolFlag reports whether a flag takes no value, like --per-file.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// workerLease is a task handed to a worker.
+type workerLease struct {
+	worker string
+	heard  time.Time // Last request of the worker about the task
+}
+
+// Coordinator hands the input files of a --per-file run to gobyte worker
+// processes on other machines and records their outcomes in the run's
+// manifest, as if the files had been converted here. Inputs and the per-file
+// directory must be reachable under the same paths from every worker, e.g.
+// on a shared file system.
+type Coordinator struct {
+	tasks    []workerTask
+	token    string
+	manifest *RunManifest
+	errors   *ErrorHandler
+
+	mutex    sync.Mutex
+	queue    []int // Tasks waiting for a worker
+	leases   map[int]workerLease
+	attempts map[int]int
+	finished map[int]bool
+	workers  map[string]bool
+	stopping bool
+	done     chan struct{} // Closed when every task is finished
+}
+
+// coordinateDataset serves the files of fileJobs to workers on addr until
+// every one is converted into outputDir, or ctx ends. args are the
+// coordinator's command-line arguments, which the workers run with.
+func coordinateDataset(ctx context.Context, addr string, args []string, fileJobs []FileJob, outputDir, outputFormat, outputTemplate string, opts ProcessOptions, manifest *RunManifest) error {
+	slog.Info("mode: coordinator (per-file output by workers)", "format", outputFormat, "files", len(fileJobs))
+	t0 := time.Now()
+	manifest.Output = outputDir
+
+	// Collisions fail before any worker starts
+	if _, err := perFileOutputNames(fileJobs, outputDir, outputFormat, outputTemplate, opts.OutputLength); err != nil {
+		return err
+	}
+	c := &Coordinator{
+		token:    os.Getenv(clusterTokenEnv),
+		manifest: manifest,
+		errors:   opts.Errors,
+		leases:   make(map[int]workerLease),
+		attempts: make(map[int]int),
+		finished: make(map[int]bool),
+		workers:  make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+	if c.token == "" {
+		return errors.New(clusterTokenEnv + " is not set; workers need a shared secret to join")
+	}
+	workerArgs := withoutFlags(args, append(slices.Clone(coordinatorOnlyFlags), provenanceSecretFlags...)...)
+	digests := make(map[string]string)
+	for _, name := range provenanceSecretFlags {
+		if value := flag.CommandLine.Lookup(name).Value.String(); value != "" {
+			digest, err := secretDigest(c.token, name, value)
+			if err != nil {
+				return fmt.Errorf("--%s: %w", name, err)
+			}
+			digests[name] = digest
+		}
+	}
+	classIDs := opts.classIDs(fileJobs)
+	for i, job := range fileJobs {
+		c.tasks = append(c.tasks, workerTask{
+			ID:            i,
+			Args:          workerArgs,
+			Job:           job,
+			OutputDir:     outputDir,
+			ClassIDs:      classIDs,
+			AssumedLength: opts.AssumedLength,
+			SecretDigests: digests,
+		})
+		c.queue = append(c.queue, i)
+	}
+	if len(c.tasks) == 0 {
+		return errors.New("no input files to hand out")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /task", c.serveTask)
+	mux.HandleFunc("POST /heartbeat", c.serveHeartbeat)
+	mux.HandleFunc("POST /result", c.serveResult)
+	server := &http.Server{Handler: c.authorize(mux), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("coordinator stopped", "error", err)
+		}
+	}()
+	defer server.Close()
+	slog.Info("waiting for workers", "addr", listener.Addr().String(), "join", "gobyte worker --join "+webURLHost(listener.Addr()))
+
+	ticker := time.NewTicker(workerHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			slog.Info("coordinator completed", "files", len(c.tasks), "workers", len(c.workers), "duration", time.Since(t0), "output_dir", outputDir)
+			time.Sleep(2 * workerPoll) // Waiting workers hear that the run is done
+			return nil
+		case <-ctx.Done():
+			c.mutex.Lock()
+			c.stopping = true
+			running := len(c.leases)
+			c.mutex.Unlock()
+			slog.Warn("coordinator stopped, files being converted by workers are not recorded", "running", running)
+			return nil
+		case <-ticker.C:
+			c.expireLeases()
+		}
+	}
+}
+
+// authorize rejects requests without the cluster token.
+func (c *Coordinator) authorize(next http.Handler) http.Handler {
+	want := []byte("Bearer " + c.token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(rw, "invalid or missing "+clusterTokenEnv, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// serveTask hands the next waiting task to a worker: 204 if every task is
+// handed out but some are not finished, 410 once there is nothing left to do.
+func (c *Coordinator) serveTask(rw http.ResponseWriter, r *http.Request) {
+	var req workerResult
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Worker == "" {
+		http.Error(rw, "invalid task request", http.StatusBadRequest)
+		return
+	}
+	c.mutex.Lock()
+	if !c.workers[req.Worker] {
+		c.workers[req.Worker] = true
+		slog.Info("worker joined", "worker", req.Worker, "workers", len(c.workers))
+	}
+	if c.stopping || len(c.finished) == len(c.tasks) {
+		c.mutex.Unlock()
+		rw.WriteHeader(http.StatusGone)
+		return
+	}
+	if len(c.queue) == 0 {
+		c.mutex.Unlock()
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id := c.queue[0]
+	c.queue = c.queue[1:]
+	c.leases[id] = workerLease{worker: req.Worker, heard: time.Now()}
+	c.attempts[id]++
+	task := c.tasks[id]
+	c.mutex.Unlock()
+
+	slog.Debug("handed out file", "worker", req.Worker, "file", task.Job.FilePath, "attempt", c.attempts[id])
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(task)
+}
+
+// serveHeartbeat renews the lease of a task, or answers 410 if the task was
+// handed to another worker in the meantime.
+func (c *Coordinator) serveHeartbeat(rw http.ResponseWriter, r *http.Request) {
+	var req workerResult
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "invalid heartbeat", http.StatusBadRequest)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lease, ok := c.leases[req.Task]
+	if !ok || lease.worker != req.Worker {
+		rw.WriteHeader(http.StatusGone)
+		return
+	}
+	lease.heard = time.Now()
+	c.leases[req.Task] = lease
+}
+
+// serveResult records the outcome of a task.
+func (c *Coordinator) serveResult(rw http.ResponseWriter, r *http.Request) {
+	var result workerResult
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil || result.Task < 0 || result.Task >= len(c.tasks) {
+		http.Error(rw, "invalid result", http.StatusBadRequest)
+		return
+	}
+	c.record(result)
+}
+
+// record adds the outcome of a task to the manifest, or hands the task out
+// again if its worker's run failed and it has attempts left. Results of
+// tasks that were handed to another worker since are ignored.
+func (c *Coordinator) record(result workerResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lease, ok := c.leases[result.Task]
+	if !ok || lease.worker != result.Worker || c.stopping {
+		slog.Debug("ignoring result of a task handed out again", "worker", result.Worker, "task", result.Task)
+		return
+	}
+	delete(c.leases, result.Task)
+	job := c.tasks[result.Task].Job
+
+	file := result.File
+	if file == nil || file.Outcome == OutcomeNotProcessed {
+		reason := result.Error
+		if reason == "" {
+			reason = "the worker's run did not reach the file"
+		}
+		if c.attempts[result.Task] < taskAttempts {
+			slog.Warn("worker failed to convert file, handing it out again", "worker", result.Worker, "file", job.FilePath, "error", reason)
+			c.queue = append(c.queue, result.Task)
+			return
+		}
+		file = &RunReportFile{Outcome: OutcomeSkipped, Error: fmt.Sprintf("failed on %d workers, last: %s", taskAttempts, reason)}
+	}
+
+	switch file.Outcome {
+	case OutcomeSkipped:
+		c.errors.FileError(job, errors.New(file.Error))
+	default:
+		c.manifest.RecordFile(ManifestFile{
+			Path:            job.FilePath,
+			Interface:       job.Interface,
+			Class:           job.Class,
+			Packets:         file.Rows,
+			Complete:        file.Outcome == OutcomeComplete,
+			Output:          file.Output,
+			DurationSeconds: file.DurationSeconds,
+		})
+		c.errors.addDecodeErrors(job, file.DecodeErrors)
+	}
+	c.finished[result.Task] = true
+	slog.Info(progressLogMessage, "worker", result.Worker, "file", job.FilePath, "class", job.Class, "packets", file.Rows,
+		"outcome", file.Outcome, "files_done", len(c.finished), "total_files", len(c.tasks))
+	if len(c.finished) == len(c.tasks) {
+		close(c.done)
+	}
+}
+
+// expireLeases hands out again the tasks of workers that went silent.
+func (c *Coordinator) expireLeases() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, lease := range c.leases {
+		if time.Since(lease.heard) < workerLeaseTimeout {
+			continue
+		}
+		delete(c.leases, id)
+		slog.Warn("worker went silent, handing its file out again", "worker", lease.worker, "file", c.tasks[id].Job.FilePath)
+		if c.attempts[id] < taskAttempts {
+			c.queue = append(c.queue, id)
+			continue
+		}
+		c.errors.FileError(c.tasks[id].Job, fmt.Errorf("no worker finished it in %d attempts", taskAttempts))
+		c.finished[id] = true
+		if len(c.finished) == len(c.tasks) {
+			close(c.done)
+		}
+	}
+}
+
+// runWorker is the worker subcommand: it converts the files a coordinator
+// hands out, one run of gobyte per file, until the coordinator has none left.
+func runWorker(args []string) {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	join := flags.String("join", "", "Address of the coordinator, host:port (a gobyte run with --coordinator)")
+	hostname, _ := os.Hostname()
+	name := flags.String("name", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "Name of this worker in the coordinator's logs")
+	tasks := flags.Int("tasks", 1, "Files converted at once; each conversion uses every CPU, so more only helps with small files")
+	workDir := flags.String("work-dir", os.TempDir(), "Directory for the task files and reports of the conversions, removed after each file unless it failed")
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	secrets := make(map[string]*string)
+	secrets["anon-key"] = flags.String("anon-key", "", "The coordinator's --anon-key, which it does not send to workers; @file reads it from a file")
+	secrets["tuple-hash-salt"] = flags.String("tuple-hash-salt", "", "The coordinator's --tuple-hash-salt, which it does not send to workers")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s worker --join host:port [--tasks N]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Converts the input files handed out by a gobyte --coordinator run, with its options.\nSet %s to the coordinator's shared secret. Secret options of the\ncoordinator's run are not sent to workers and must be given here.\n\nOptions:\n", clusterTokenEnv)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if err := setupLogger(*logLevel, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if *join == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *tasks < 1 {
+		fatal("--tasks must be at least 1", "tasks", *tasks)
+	}
+	token := os.Getenv(clusterTokenEnv)
+	if token == "" {
+		fatal(clusterTokenEnv + " is not set; set it to the coordinator's shared secret")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		fatal("failed to find the gobyte executable", "error", err)
+	}
+
+	// Ctrl-C lets the running conversions finish and report, then stops
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w := &clusterWorker{
+		base:       "http://" + strings.TrimPrefix(*join, "http://"),
+		name:       *name,
+		token:      token,
+		secrets:    make(map[string]string),
+		executable: executable,
+		workDir:    *workDir,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+	for name, value := range secrets {
+		if *value != "" {
+			w.secrets[name] = *value
+		}
+	}
+	slog.Info("joining coordinator", "coordinator", *join, "worker", *name, "tasks", *tasks)
+	var wg sync.WaitGroup
+	var failure error
+	var failureOnce sync.Once
+	for i := 0; i < *tasks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.run(ctx); err != nil {
+				failureOnce.Do(func() { failure = err })
+			}
+		}()
+	}
+	wg.Wait()
+	if failure != nil {
+		fatal("worker stopped", "coordinator", *join, "error", failure)
+	}
+	slog.Info("worker finished", "files", w.converted())
+}
+
+// clusterWorker asks a coordinator for tasks and runs them.
+type clusterWorker struct {
+	base       string // URL of the coordinator
+	name       string
+	token      string
+	secrets    map[string]string // Secret flags of the coordinator's run, given to the worker
+	executable string
+	workDir    string
+	client     *http.Client
+	joined     atomic.Bool // The coordinator answered once
+
+	mutex sync.Mutex
+	files int
+}
+
+// converted returns how many files the worker converted.
+func (w *clusterWorker) converted() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.files
+}
+
+// run converts tasks until the coordinator has none left or ctx ends.
+func (w *clusterWorker) run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		task, err := w.next(ctx)
+		if err != nil || task == nil {
+			return err
+		}
+		// Without the coordinator's secrets the task is left to expire and go to another worker
+		if err := w.addSecrets(task); err != nil {
+			return err
+		}
+		result := w.convert(ctx, task)
+		if err := w.post("/result", result, nil); err != nil {
+			return fmt.Errorf("failed to report %s: %w", task.Job.FilePath, err)
+		}
+		if result.File != nil && result.File.Outcome != OutcomeNotProcessed {
+			w.mutex.Lock()
+			w.files++
+			w.mutex.Unlock()
+		}
+	}
+	return nil
+}
+
+// addSecrets adds the values of the secret flags of the coordinator's run to
+// a task, failing unless the worker was given the same ones.
+func (w *clusterWorker) addSecrets(task *workerTask) error {
+	task.Secrets = make(map[string]string)
+	for name, want := range task.SecretDigests {
+		value, ok := w.secrets[name]
+		if !ok {
+			return fmt.Errorf("the coordinator's run sets --%s, which is not sent to workers; give the worker the same --%s", name, name)
+		}
+		digest, err := secretDigest(w.token, name, value)
+		if err != nil {
+			return fmt.Errorf("--%s: %w", name, err)
+		}
+		if !hmac.Equal([]byte(digest), []byte(want)) {
+			return fmt.Errorf("--%s differs from the coordinator's", name)
+		}
+		task.Secrets[name] = value
+	}
+	return nil
+}
+
+// next returns the next task, waiting while the coordinator has none to hand
+// out yet, or nil once it is done.
+func (w *clusterWorker) next(ctx context.Context) (*workerTask, error) {
+	unreachable := time.Time{}
+	for {
+		var task workerTask
+		status, err := w.request("/task", workerResult{Worker: w.name}, &task)
+		switch {
+		case status == http.StatusUnauthorized:
+			return nil, err
+		case err != nil && unreachable.IsZero():
+			unreachable = time.Now()
+			slog.Warn("cannot reach the coordinator, retrying", "error", err)
+		case err != nil && time.Since(unreachable) > workerJoinTimeout && w.joined.Load():
+			slog.Warn("lost the coordinator, stopping", "error", err)
+			return nil, nil
+		case err != nil && time.Since(unreachable) > workerJoinTimeout:
+			return nil, err
+		case err != nil:
+		case status == http.StatusGone:
+			return nil, nil
+		case status == http.StatusOK:
+			return &task, nil
+		default:
+			unreachable = time.Time{}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-time.After(workerPoll):
+		}
+	}
+}
+
+// convert runs gobyte on a task with the coordinator's arguments and returns
+// the outcome of the file in the run report of that run.
+func (w *clusterWorker) convert(ctx context.Context, task *workerTask) workerResult {
+	result := workerResult{Task: task.ID, Worker: w.name}
+	dir, err := os.MkdirTemp(w.workDir, "gobyte-task-*")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	taskFile := filepath.Join(dir, "task.json")
+	data, err := json.Marshal(task)
+	if err == nil {
+		err = os.WriteFile(taskFile, data, 0600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		result.Error = err.Error()
+		return result
+	}
+
+	slog.Info("converting file", "file", task.Job.FilePath, "class", task.Job.Class)
+	cmd := exec.Command(w.executable, append(append([]string{}, task.Args...), "--worker-task", taskFile)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr // Progress logs of the file's run
+
+	// Heartbeats keep the task leased while the file is converted
+	stopBeats := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(workerHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopBeats:
+				return
+			case <-ticker.C:
+				if err := w.post("/heartbeat", workerResult{Task: task.ID, Worker: w.name}, nil); err != nil {
+					slog.Debug("heartbeat failed", "file", task.Job.FilePath, "error", err)
+				}
+			}
+		}
+	}()
+	runErr := cmd.Run()
+	close(stopBeats)
+
+	var report RunReport
+	data, err = os.ReadFile(filepath.Join(dir, runReportName))
+	if err == nil {
+		err = json.Unmarshal(data, &report)
+	}
+	for i := range report.FileResults {
+		if report.FileResults[i].Path == task.Job.FilePath && report.FileResults[i].Interface == task.Job.Interface {
+			result.File = &report.FileResults[i]
+		}
+	}
+	switch {
+	case runErr != nil && report.Error != "":
+		result.Error = report.Error
+	case runErr != nil:
+		result.Error = runErr.Error()
+	case err != nil:
+		result.Error = fmt.Sprintf("no run report: %v", err)
+	}
+	if runErr != nil || result.File == nil || ctx.Err() != nil {
+		slog.Warn("conversion failed, keeping its reports", "file", task.Job.FilePath, "dir", dir, "error", result.Error)
+		return result
+	}
+	os.RemoveAll(dir)
+	return result
+}
+
+// post sends a request to the coordinator and fails unless it succeeds.
+func (w *clusterWorker) post(path string, body any, response any) error {
+	status, err := w.request(path, body, response)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("coordinator answered %d", status)
+	}
+	return err
+}
+
+// request sends a JSON request to the coordinator and decodes a 200 answer
+// into response.
+func (w *clusterWorker) request(path string, body any, response any) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.base+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return resp.StatusCode, fmt.Errorf("the coordinator rejected the worker, check %s", clusterTokenEnv)
+	}
+	w.joined.Store(true)
+	if resp.StatusCode == http.StatusOK && response != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(response)
+	}
+	return resp.StatusCode, nil
+}
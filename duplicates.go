@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// sampleDigest identifies row content. Half a SHA-256 keeps the table small;
+// accidental collisions are out of reach at dataset sizes.
+type sampleDigest [16]byte
+
+// sampleClass counts the rows of one class with a given content.
+type sampleClass struct {
+	class string
+	file  string // First file the content was seen in under this class
+	rows  int
+}
+
+// DuplicateReport finds byte-identical rows labeled with more than one class
+// (--duplicates-report) and lists them in duplicates.csv. Such samples cannot
+// be classified correctly and usually mean the same capture was filed under
+// several classes. It is safe for concurrent use by workers.
+type DuplicateReport struct {
+	filename string
+	samples  map[sampleDigest][]sampleClass
+	mutex    sync.Mutex
+}
+
+// NewDuplicateReport creates a report written to filename on Close.
+func NewDuplicateReport(filename string) *DuplicateReport {
+	return &DuplicateReport{
+		filename: filename,
+		samples:  make(map[sampleDigest][]sampleClass),
+	}
+}
+
+// add records the content of finished rows: their bytes and feature values,
+// i.e. exactly what a model is trained on.
+func (r *DuplicateReport) add(rows []PacketResult) {
+	digests := make([]sampleDigest, len(rows))
+	var buf [8]byte
+	for i, row := range rows {
+		h := sha256.New()
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(row.Data)))
+		h.Write(buf[:])
+		h.Write(row.Data)
+		for _, f := range row.Features {
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+			h.Write(buf[:])
+		}
+		copy(digests[i][:], h.Sum(nil))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, row := range rows {
+		classes := r.samples[digests[i]]
+		found := false
+		for j := range classes {
+			if classes[j].class == row.Class {
+				classes[j].rows++
+				found = true
+				break
+			}
+		}
+		if !found {
+			r.samples[digests[i]] = append(classes, sampleClass{class: row.Class, file: row.FileName, rows: 1})
+		}
+	}
+}
+
+// Close writes one line per class of every cross-class sample, sorted by
+// sample and class, and logs how many samples and rows are affected.
+func (r *DuplicateReport) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var digests []sampleDigest
+	for digest, classes := range r.samples {
+		if len(classes) > 1 {
+			digests = append(digests, digest)
+		}
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return string(digests[i][:]) < string(digests[j][:])
+	})
+
+	file, err := os.Create(r.filename)
+	if err != nil {
+		return fmt.Errorf("failed to create duplicate report: %w", err)
+	}
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"sample", "class", "rows", "file"})
+	rows := 0
+	for _, digest := range digests {
+		classes := r.samples[digest]
+		sort.Slice(classes, func(i, j int) bool {
+			return classes[i].class < classes[j].class
+		})
+		sample := hex.EncodeToString(digest[:8])
+		for _, c := range classes {
+			w.Write([]string{sample, c.class, strconv.Itoa(c.rows), c.file})
+			rows += c.rows
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if len(digests) > 0 {
+		slog.Warn("identical rows found under several classes",
+			"samples", len(digests),
+			"rows", rows,
+			"report", r.filename)
+	}
+	return nil
+}
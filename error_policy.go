@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Error policies for files that cannot be opened and packets that fail to decode.
+const (
+	OnErrorSkip   = "skip"   // Log and drop the item (default)
+	OnErrorFail   = "fail"   // Abort the run on the first error
+	OnErrorReport = "report" // Drop the item and list it in errors.jsonl
+)
+
+// errCannotOpen marks errors returned when a capture file cannot be opened.
+var errCannotOpen = errors.New("cannot open file")
+
+// skippedFilesName is the file, in the report directory, that lists the
+// files a run skipped and why, whatever the policy.
+const skippedFilesName = "skipped_files.csv"
+
+// ErrorItem is one skipped file or packet, written as a line of errors.jsonl.
+type ErrorItem struct {
+	Stage        string `json:"stage"` // "open", "decode" or "salvage"
+	File         string `json:"file"`
+	Class        string `json:"class,omitempty"`
+	Packet       *int   `json:"packet,omitempty"`        // Packet index within the file (decode errors only)
+	SkippedBytes int64  `json:"skipped_bytes,omitempty"` // Damaged bytes skipped (salvage only)
+	Error        string `json:"error"`
+}
+
+// ErrorHandler applies the --on-error policy. It is safe for concurrent use by workers.
+type ErrorHandler struct {
+	policy         string
+	cancel         context.CancelCauseFunc
+	reportDir      string // Where errors.jsonl and skipped_files.csv go ("" = nowhere)
+	reportFile     *os.File
+	encoder        *json.Encoder
+	skippedFiles   int
+	skippedPackets int
+	decodeFailed   map[string]int    // Packets with a layer that failed to decode, by input key
+	fileErrs       map[string]string // Error of each skipped file, by path
+	fileItems      []ErrorItem       // The skipped files, for the summary on Close
+	mutex          sync.Mutex
+}
+
+// NewErrorHandler creates a handler for the given policy.
+// cancel is called with the error in fail mode to stop the run.
+// In report mode, skipped items are written to errors.jsonl in reportDir.
+// Skipped files are listed in skipped_files.csv there under every policy.
+func NewErrorHandler(policy, reportDir string, cancel context.CancelCauseFunc) (*ErrorHandler, error) {
+	h := &ErrorHandler{
+		policy:    policy,
+		cancel:    cancel,
+		reportDir: reportDir,
+	}
+
+	switch policy {
+	case OnErrorSkip, OnErrorFail:
+	case OnErrorReport:
+		file, err := os.Create(filepath.Join(reportDir, "errors.jsonl"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create error report: %w", err)
+		}
+		h.reportFile = file
+		h.encoder = json.NewEncoder(file)
+	default:
+		return nil, fmt.Errorf("invalid --on-error policy %q (use skip, fail or report)", policy)
+	}
+
+	return h, nil
+}
+
+// FileError handles a file that could not be opened or read.
+func (h *ErrorHandler) FileError(fileJob FileJob, err error) {
+	slog.Warn("skipping file", "file", fileJob.FilePath, "class", fileJob.Class, "error", err)
+
+	h.handle(ErrorItem{
+		Stage: "open",
+		File:  fileJob.FilePath,
+		Class: fileJob.Class,
+		Error: err.Error(),
+	}, true)
+}
+
+// PacketError handles a packet that could not be decoded.
+func (h *ErrorHandler) PacketError(job PacketJob, filePath string, err error) {
+	slog.Debug("skipping packet", "file", filePath, "packet", job.Index, "error", err)
+
+	index := job.Index
+	h.handle(ErrorItem{
+		Stage:  "decode",
+		File:   filePath,
+		Class:  job.Class,
+		Packet: &index,
+		Error:  err.Error(),
+	}, false)
+}
+
+// DecodeFailed counts a packet of an input with a layer that failed to
+// decode. Such packets are not errors: if their link layer was decoded
+// they still become rows, otherwise PacketError skips them.
+func (h *ErrorHandler) DecodeFailed(fileJob FileJob) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.decodeFailed == nil {
+		h.decodeFailed = make(map[string]int)
+	}
+	h.decodeFailed[fileJob.key()]++
+}
+
+// addDecodeErrors adds the packets of an input that failed to decode in part,
+// counted by the worker that converted it (--coordinator).
+func (h *ErrorHandler) addDecodeErrors(fileJob FileJob, n int) {
+	if n == 0 {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.decodeFailed == nil {
+		h.decodeFailed = make(map[string]int)
+	}
+	h.decodeFailed[fileJob.key()] += n
+}
+
+// Salvaged records damaged regions skipped by salvage mode. The packets around them
+// were recovered, so this never counts as a failure, even under the fail policy.
+func (h *ErrorHandler) Salvaged(fileJob FileJob, skippedBytes int64, resyncs int) {
+	slog.Warn("skipped damaged records",
+		"file", fileJob.FilePath,
+		"skipped_bytes", skippedBytes,
+		"resyncs", resyncs)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.policy == OnErrorReport {
+		item := ErrorItem{
+			Stage:        "salvage",
+			File:         fileJob.FilePath,
+			Class:        fileJob.Class,
+			SkippedBytes: skippedBytes,
+			Error:        fmt.Sprintf("resynchronized %d times", resyncs),
+		}
+		if err := h.encoder.Encode(item); err != nil {
+			slog.Warn("failed to write error report entry", "error", err)
+		}
+	}
+}
+
+func (h *ErrorHandler) handle(item ErrorItem, wholeFile bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if wholeFile {
+		h.skippedFiles++
+		if h.fileErrs == nil {
+			h.fileErrs = make(map[string]string)
+		}
+		h.fileErrs[item.File] = item.Error
+		h.fileItems = append(h.fileItems, item)
+	} else {
+		h.skippedPackets++
+	}
+
+	switch h.policy {
+	case OnErrorFail:
+		h.cancel(fmt.Errorf("%s error in %s: %s", item.Stage, item.File, item.Error))
+	case OnErrorReport:
+		if err := h.encoder.Encode(item); err != nil {
+			slog.Warn("failed to write error report entry", "error", err)
+		}
+	}
+}
+
+// Close finishes the error report, logs how many items were skipped and
+// lists the skipped files, so they are not lost among the progress logs.
+func (h *ErrorHandler) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.skippedFiles > 0 || h.skippedPackets > 0 {
+		slog.Warn("skipped items due to errors",
+			"policy", h.policy,
+			"files", h.skippedFiles,
+			"packets", h.skippedPackets)
+	}
+	h.summarizeFiles()
+	if len(h.decodeFailed) > 0 {
+		total := 0
+		for _, n := range h.decodeFailed {
+			total += n
+		}
+		slog.Warn("packets failed to decode in part, see decode_errors in run_report.json",
+			"packets", total,
+			"files", len(h.decodeFailed))
+	}
+
+	if h.reportFile == nil {
+		return nil
+	}
+	slog.Info("error report written", "report", h.reportFile.Name())
+	return h.reportFile.Close()
+}
+
+// summarizeFiles logs the skipped files in path order and writes them to
+// skipped_files.csv, or removes the list an earlier run left if none were.
+// The caller holds the mutex.
+func (h *ErrorHandler) summarizeFiles() {
+	var summaryFile string
+	if h.reportDir != "" {
+		summaryFile = filepath.Join(h.reportDir, skippedFilesName)
+	}
+	if len(h.fileItems) == 0 {
+		if summaryFile != "" {
+			os.Remove(summaryFile)
+		}
+		return
+	}
+
+	sort.SliceStable(h.fileItems, func(i, j int) bool { return h.fileItems[i].File < h.fileItems[j].File })
+	for _, item := range h.fileItems {
+		slog.Warn("skipped file", "file", item.File, "class", item.Class, "error", item.Error)
+	}
+	if summaryFile == "" {
+		return
+	}
+	if err := writeSkippedFiles(summaryFile, h.fileItems); err != nil {
+		slog.Warn("failed to write skipped file list", "list", summaryFile, "error", err)
+		return
+	}
+	slog.Info("skipped file list written", "list", summaryFile, "files", len(h.fileItems))
+}
+
+// writeSkippedFiles writes skipped_files.csv: one file,class,error line per skipped file.
+func writeSkippedFiles(filename string, items []ErrorItem) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	w.Write([]string{"file", "class", "error"})
+	for _, item := range items {
+		w.Write([]string{item.File, item.Class, item.Error})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// skipped returns the numbers of files and packets skipped so far.
+func (h *ErrorHandler) skipped() (files, packets int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.skippedFiles, h.skippedPackets
+}
+
+// decodeErrors returns the number of packets of each input, by key, with a
+// layer that failed to decode so far.
+func (h *ErrorHandler) decodeErrors() map[string]int {
+	counts := make(map[string]int)
+	if h == nil {
+		return counts
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for key, n := range h.decodeFailed {
+		counts[key] = n
+	}
+	return counts
+}
+
+// fileErrors returns the error of each file skipped so far, by path.
+func (h *ErrorHandler) fileErrors() map[string]string {
+	errs := make(map[string]string)
+	if h == nil {
+		return errs
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for file, err := range h.fileErrs {
+		errs[file] = err
+	}
+	return errs
+}
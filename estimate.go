@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/google/gopacket"
+)
+
+// The output estimate decodes the first estimateSamplePackets packets of up to
+// estimateSampleFiles input files, spread over the input.
+const (
+	estimateSampleFiles   = 4
+	estimateSamplePackets = 2000
+)
+
+// outputEstimate is the projected output of a run.
+type outputEstimate struct {
+	Rows  int64
+	Bytes int64
+}
+
+// estimateOutput projects the rows and bytes a run writes. A sample of the
+// input is processed and written in format to a temporary directory; its rows
+// per packet and bytes per row are scaled to the packets of all files, counted
+// from their size and the sample's average packet record. --skip-seconds is not
+// projected, so the estimate errs on the large side.
+func estimateOutput(ctx context.Context, fileJobs []FileJob, format string, opts ProcessOptions, maxRows int) (outputEstimate, error) {
+	// The interfaces of a --split-by-interface file share its size
+	inputs := make(map[string]int64)
+	for _, job := range fileJobs {
+		inputs[job.FilePath]++
+	}
+	sizes := make([]int64, len(fileJobs))
+	for i, job := range fileJobs {
+		size, err := inputSize(job)
+		if err != nil {
+			return outputEstimate{}, err
+		}
+		sizes[i] = size / inputs[job.FilePath]
+	}
+
+	// The sample must not touch the run's reports, cache or row limit
+	opts.Dedup = nil
+	opts.Cache = nil
+	opts.Limit = nil
+	opts.Quota = nil
+	opts.Memory = nil
+	opts.Duplicates = nil
+	opts.Quality = nil
+	opts.Stats = nil
+	opts.Classes = nil
+	opts.Export = nil
+	sampleOpts, release, err := firstPassOptions(opts)
+	if err != nil {
+		return outputEstimate{}, err
+	}
+	defer release()
+	sampleOpts.MaxPerFile = estimateSamplePackets
+	sampleOpts.Readers = 1 // Indexing would read whole files
+	if opts.MaxPerFile > 0 {
+		sampleOpts.MaxPerFile = min(opts.MaxPerFile, estimateSamplePackets)
+	}
+
+	var records, taken int
+	var recordBytes int64
+	var rows []PacketResult
+	samples := min(len(fileJobs), estimateSampleFiles)
+	for i := range samples {
+		job := fileJobs[i*len(fileJobs)/samples]
+		fileRecords, fileBytes, fileTaken, err := sampleCapture(job, sampleOpts)
+		if err != nil {
+			return outputEstimate{}, fmt.Errorf("%s: %w", job.FilePath, err)
+		}
+		fileRows, err := processFile(ctx, job, sampleOpts, false, runtime.NumCPU())
+		if err != nil {
+			return outputEstimate{}, fmt.Errorf("%s: %w", job.FilePath, err)
+		}
+		records += fileRecords
+		recordBytes += fileBytes
+		taken += fileTaken
+		rows = append(rows, fileRows...)
+	}
+	if records == 0 || taken == 0 || len(rows) == 0 {
+		return outputEstimate{}, nil
+	}
+
+	sampleBytes, err := sampleOutputSize(rows, format, fileJobs, opts)
+	if err != nil {
+		return outputEstimate{}, err
+	}
+
+	recordSize := float64(recordBytes) / float64(records)
+	rowsPerPacket := float64(len(rows)) / float64(taken)
+	var totalRows float64
+	for _, size := range sizes {
+		packets := max(float64(size-pcapGlobalHeaderLen)/recordSize-float64(opts.SkipPackets), 0)
+		if opts.MaxPerFile > 0 {
+			packets = min(packets, float64(opts.MaxPerFile))
+		}
+		totalRows += packets * rowsPerPacket
+	}
+	if maxRows > 0 {
+		totalRows = min(totalRows, float64(maxRows))
+	}
+	return outputEstimate{
+		Rows:  int64(totalRows),
+		Bytes: int64(totalRows * float64(sampleBytes) / float64(len(rows))),
+	}, nil
+}
+
+// sampleCapture reads the packets of a file that processFile decodes with
+// opts, returning the records read, their size in the file and the packets
+// kept by the capture range.
+func sampleCapture(fileJob FileJob, opts ProcessOptions) (records int, recordBytes int64, taken int, err error) {
+	reader, err := openInput(fileJob, opts)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer reader.Close()
+
+	captureRange := newCaptureRange(opts)
+	packetSource := gopacket.NewPacketSource(reader, reader.LinkType())
+	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	for {
+		packet, err := packetSource.NextPacket()
+		if err != nil {
+			// End of file, or a damaged tail the run reports
+			break
+		}
+		keep, done := captureRange.next(packet)
+		if done {
+			break
+		}
+		records++
+		recordBytes += int64(packet.Metadata().CaptureLength) + pcapRecordHeaderLen // PCAPNG blocks are larger, so fewer packets are projected
+		if keep {
+			taken++
+		}
+	}
+	return records, recordBytes, taken, nil
+}
+
+// sampleOutputSize writes rows in format to a temporary directory and returns
+// the size of the files written.
+func sampleOutputSize(rows []PacketResult, format string, fileJobs []FileJob, opts ProcessOptions) (int64, error) {
+	dir, err := os.MkdirTemp("", "gobyte-estimate-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	wopts := opts.Writer
+	wopts.Store = nil // The sample is a local file even when the output is uploaded
+	writer, err := NewStreamWriter(format, filepath.Join(dir, "sample."+formatExtension(format)), opts.writerPacketSize(), opts.hasClass(fileJobs), opts.FeatureNames(), wopts)
+	if err != nil {
+		return 0, err
+	}
+	if err := writer.WriteBatch(rows); err != nil {
+		writer.Close()
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+
+	var size int64
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// checkOutputSpace logs the projected output of a run and warns when the volume
+// of dir has less space free, before hours of processing end in ENOSPC.
+func checkOutputSpace(ctx context.Context, fileJobs []FileJob, dir, format string, opts ProcessOptions, maxRows int) {
+	estimate, err := estimateOutput(ctx, fileJobs, format, opts, maxRows)
+	if err != nil {
+		slog.Warn("failed to estimate output size", "error", err)
+		return
+	}
+	sizeMB := float64(estimate.Bytes) / (1024 * 1024)
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		slog.Info("estimated output size", "rows", estimate.Rows, "size_mb", sizeMB)
+		return
+	}
+	freeMB := float64(free) / (1024 * 1024)
+	slog.Info("estimated output size", "rows", estimate.Rows, "size_mb", sizeMB, "dir", dir, "free_mb", freeMB)
+	if uint64(estimate.Bytes) > free {
+		slog.Warn("the output may not fit on its volume", "size_mb", sizeMB, "dir", dir, "free_mb", freeMB)
+	}
+}
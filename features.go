@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Feature groups of --features, each a set of per-packet feature columns.
+const (
+	FeatureTCPMeta = "tcpmeta" // TTL, window and TCP option columns (--tcp-features)
+	FeatureICMP    = "icmp"    // icmp_type and icmp_code (--icmp-features)
+	FeatureQUIC    = "quic"    // QUIC header columns (--quic-features)
+)
+
+// parseFeatures parses a comma-separated --features list. The columns of each
+// group keep their fixed place in the row whatever the order of the list.
+func parseFeatures(spec string) ([]string, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var features []string
+	for _, part := range strings.Split(spec, ",") {
+		feature := strings.TrimSpace(part)
+		switch feature {
+		case FeatureTCPMeta, FeatureICMP, FeatureQUIC:
+		default:
+			return nil, fmt.Errorf("unknown feature group %q (use tcpmeta, icmp or quic)", feature)
+		}
+		features = append(features, feature)
+	}
+	return features, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// FileRetry retries dataset inputs that fail to open with an I/O error, such
+// as a network file system timing out (--retries, --retry-delay).
+type FileRetry struct {
+	Retries int           // Attempts after the first
+	Delay   time.Duration // Wait before the first retry, doubled before each next one
+}
+
+// retryable reports whether err is an I/O error opening an input, which may
+// pass, rather than a missing or unreadable file or one that is not a capture.
+func retryable(err error) bool {
+	var pathErr *fs.PathError
+	return errors.Is(err, errCannotOpen) && errors.As(err, &pathErr) &&
+		!errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission)
+}
+
+// run calls process until it succeeds or fails with an error that is not
+// retryable, at most r.Retries times more. An input fails to open before any
+// of its rows are written, so running it again does not duplicate rows. A nil
+// FileRetry runs process once.
+func (r *FileRetry) run(ctx context.Context, fileJob FileJob, process func() error) error {
+	err := process()
+	if r == nil {
+		return err
+	}
+	delay, retries := r.Delay, 0
+	for retries < r.Retries && err != nil && retryable(err) {
+		retries++
+		slog.Warn("retrying file", "file", fileJob.FilePath, "retry", retries, "of", r.Retries, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		err = process()
+	}
+	if err != nil && retries > 0 {
+		return fmt.Errorf("%w (after %d attempts)", err, retries+1)
+	}
+	return err
+}
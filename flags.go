@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// stringListFlag is a repeatable string flag (e.g. --dataset a --dataset b).
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseArgs parses a subcommand's flags wherever they sit among its file
+// arguments (e.g. `gobyte inspect out.parquet --rows 5`), unlike
+// flag.FlagSet.Parse, which stops at the first file. Arguments after "--" are
+// always files; flags.Args() returns the files in order.
+func parseArgs(flags *flag.FlagSet, args []string) {
+	var files []string
+	for len(args) > 0 {
+		flags.Parse(args)
+		rest := flags.Args()
+		if used := len(args) - len(rest); used > 0 && args[used-1] == "--" {
+			files = append(files, rest...)
+			break
+		}
+		if len(rest) > 0 {
+			files = append(files, rest[0])
+			rest = rest[1:]
+		}
+		args = rest
+	}
+	flags.Parse(append([]string{"--"}, files...))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"testing"
+)
+
+// TestParseArgsInterspersed checks that subcommand flags are parsed before,
+// between and after file arguments, and that "--" ends flag parsing.
+func TestParseArgsInterspersed(t *testing.T) {
+	tests := []struct {
+		args  []string
+		rows  int
+		files []string
+	}{
+		{[]string{"--rows", "3", "a.parquet"}, 3, []string{"a.parquet"}},
+		{[]string{"a.parquet", "--rows", "3"}, 3, []string{"a.parquet"}},
+		{[]string{"a.parquet", "--rows=3", "b.csv"}, 3, []string{"a.parquet", "b.csv"}},
+		{[]string{"a.parquet", "--", "--rows", "b.csv"}, 5, []string{"a.parquet", "--rows", "b.csv"}},
+		{[]string{"--rows", "2"}, 2, nil},
+	}
+	for _, tt := range tests {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		rows := flags.Int("rows", 5, "")
+		parseArgs(flags, tt.args)
+		if *rows != tt.rows || !slices.Equal(flags.Args(), tt.files) {
+			t.Errorf("%q: rows %d files %q, want rows %d files %q", tt.args, *rows, flags.Args(), tt.rows, tt.files)
+		}
+	}
+}
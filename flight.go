@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/flight"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flightBatchRows is the number of rows per Arrow record batch sent to the client.
+const flightBatchRows = 4096
+
+// errFlightClientGone is returned by writes after the Flight client stopped reading.
+var errFlightClientGone = errors.New("flight client disconnected")
+
+// FlightStreamWriter sends rows to an Arrow Flight client as record batches
+// instead of writing a file. Writes block while the client is not reading,
+// so a slow training job throttles packet processing.
+type FlightStreamWriter struct {
+	schema       *arrow.Schema
+	builder      *array.RecordBuilder
+	featureNames []string
+	fixedLength  bool // data is fixed_size_binary(--length) rather than binary
+	hasClass     bool
+	pending      int                    // Rows in builder
+	records      chan arrow.RecordBatch // Consumed by the DoGet stream
+	done         chan struct{}          // Closed when the DoGet stream ends
+	closed       bool
+	mutex        sync.Mutex
+}
+
+// NewFlightStreamWriter creates a writer whose schema is data (fixed_size_binary
+// when outputLength > 0, else binary), one float64 column per feature and an
+// optional class string.
+func NewFlightStreamWriter(outputLength int, hasClass bool, featureNames []string) *FlightStreamWriter {
+	var dataType arrow.DataType = arrow.BinaryTypes.Binary
+	if outputLength > 0 {
+		dataType = &arrow.FixedSizeBinaryType{ByteWidth: outputLength}
+	}
+
+	fields := []arrow.Field{{Name: "data", Type: dataType}}
+	for _, name := range featureNames {
+		fields = append(fields, arrow.Field{Name: name, Type: arrow.PrimitiveTypes.Float64})
+	}
+	if hasClass {
+		fields = append(fields, arrow.Field{Name: "class", Type: arrow.BinaryTypes.String})
+	}
+	schema := arrow.NewSchema(fields, nil)
+
+	return &FlightStreamWriter{
+		schema:       schema,
+		builder:      array.NewRecordBuilder(memory.DefaultAllocator, schema),
+		featureNames: featureNames,
+		fixedLength:  outputLength > 0,
+		hasClass:     hasClass,
+		records:      make(chan arrow.RecordBatch, 2),
+		done:         make(chan struct{}),
+	}
+}
+
+func (w *FlightStreamWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch appends packets to the current record batch, sending it to the
+// client once it holds flightBatchRows rows.
+func (w *FlightStreamWriter) WriteBatch(packets []PacketResult) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, p := range packets {
+		if w.fixedLength {
+			w.builder.Field(0).(*array.FixedSizeBinaryBuilder).Append(p.Data)
+		} else {
+			w.builder.Field(0).(*array.BinaryBuilder).Append(p.Data)
+		}
+		for i := range w.featureNames {
+			value := 0.0
+			if i < len(p.Features) {
+				value = p.Features[i]
+			}
+			w.builder.Field(1 + i).(*array.Float64Builder).Append(value)
+		}
+		if w.hasClass {
+			w.builder.Field(1 + len(w.featureNames)).(*array.StringBuilder).Append(p.Class)
+		}
+		w.pending++
+
+		if w.pending >= flightBatchRows {
+			if err := w.sendRecord(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendRecord hands the rows built so far to the stream. The caller holds the mutex.
+func (w *FlightStreamWriter) sendRecord() error {
+	record := w.builder.NewRecordBatch()
+	w.pending = 0
+	select {
+	case w.records <- record:
+		return nil
+	case <-w.done:
+		record.Release()
+		return errFlightClientGone
+	}
+}
+
+// Close sends the remaining rows and ends the stream.
+func (w *FlightStreamWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	var err error
+	if w.pending > 0 {
+		err = w.sendRecord()
+	}
+	close(w.records)
+	w.builder.Release()
+	return err
+}
+
+// flightService serves one run's rows to a single DoGet caller; the ticket is ignored.
+type flightService struct {
+	flight.BaseFlightServer
+	writer   *FlightStreamWriter
+	claimed  atomic.Bool
+	started  chan struct{} // Closed when a client starts reading
+	finished chan error    // Result of the DoGet stream
+}
+
+func (s *flightService) DoGet(_ *flight.Ticket, stream flight.FlightService_DoGetServer) error {
+	if !s.claimed.CompareAndSwap(false, true) {
+		return status.Error(codes.FailedPrecondition, "the rows of this run are already being streamed to another client")
+	}
+	close(s.started)
+
+	err := s.stream(stream)
+	close(s.writer.done)
+	// Let processing finish so the writer's channel is closed
+	for record := range s.writer.records {
+		record.Release()
+	}
+	s.finished <- err
+	return err
+}
+
+// stream sends record batches until the writer is closed or the client goes away.
+func (s *flightService) stream(stream flight.FlightService_DoGetServer) error {
+	writer := flight.NewRecordWriter(stream, ipc.WithSchema(s.writer.schema))
+	defer writer.Close()
+
+	for record := range s.writer.records {
+		err := writer.Write(record)
+		record.Release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveFlight processes fileJobs and streams the rows to the first Arrow Flight
+// client that calls DoGet on addr. Processing starts when the client connects
+// and the server stops once the stream is complete.
+func serveFlight(ctx context.Context, fileJobs []FileJob, addr string, opts ProcessOptions, maxConcurrentFiles int, manifest *RunManifest) {
+	slog.Info("mode: Arrow Flight", "address", addr)
+
+	dataLength := opts.OutputLength
+	if opts.bytesAsFeatures() {
+		dataLength = 0 // Bytes are sent as float columns
+	}
+	service := &flightService{
+		writer:   NewFlightStreamWriter(dataLength, opts.hasClass(fileJobs), opts.FeatureNames()),
+		started:  make(chan struct{}),
+		finished: make(chan error, 1),
+	}
+
+	server := flight.NewServerWithMiddleware(nil)
+	if err := server.Init(addr); err != nil {
+		fatal("failed to listen for Flight clients", "address", addr, "error", err)
+	}
+	server.RegisterFlightService(service)
+	go server.Serve()
+	defer server.Shutdown()
+
+	manifest.Output = "grpc://" + server.Addr().String()
+	slog.Info("waiting for a Flight client to call DoGet", "address", server.Addr().String())
+	select {
+	case <-service.started:
+	case <-ctx.Done():
+		return
+	}
+
+	t0 := time.Now()
+	totalPackets, err := processFilesStreamingSingleOutput(ctx, fileJobs, service.writer, opts, maxConcurrentFiles, manifest)
+	if closeErr := service.writer.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	streamErr := <-service.finished
+
+	if streamErr != nil {
+		fatal("flight stream failed", "error", streamErr)
+	}
+	if err != nil {
+		fatal("error during processing", "error", err)
+	}
+
+	slog.Info("flight stream completed",
+		"packets", totalPackets,
+		"duration", time.Since(t0),
+		"address", server.Addr().String())
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// FlowKey identifies a bidirectional flow by its network and transport endpoints.
+// Both directions of a conversation map to the same key.
+type FlowKey struct {
+	Network   gopacket.Flow
+	Transport gopacket.Flow
+}
+
+// flowKeyOf returns the canonical flow key of a packet, or false if the packet
+// has no network layer. Packets without a transport layer (e.g. ICMP) are keyed
+// by their addresses only.
+func flowKeyOf(packet gopacket.Packet) (FlowKey, bool) {
+	network := packet.NetworkLayer()
+	if network == nil {
+		return FlowKey{}, false
+	}
+
+	networkFlow := network.NetworkFlow()
+	var transportFlow gopacket.Flow
+	if transport := packet.TransportLayer(); transport != nil {
+		transportFlow = transport.TransportFlow()
+	}
+
+	// Order endpoints so that A->B and B->A produce the same key
+	src, dst := networkFlow.Endpoints()
+	if dst.LessThan(src) || (src == dst && transportFlow.Dst().LessThan(transportFlow.Src())) {
+		networkFlow = networkFlow.Reverse()
+		transportFlow = transportFlow.Reverse()
+	}
+
+	return FlowKey{Network: networkFlow, Transport: transportFlow}, true
+}
+
+// Flow directions for --flow-direction.
+const (
+	FlowBidirectional  = "bi"  // Both directions of a conversation are one flow (default)
+	FlowUnidirectional = "uni" // Each direction is a flow of its own
+)
+
+// flowKeyIn returns the flow key of a packet for the given direction
+// convention, or false if the packet has no network layer.
+func flowKeyIn(packet gopacket.Packet, direction string) (FlowKey, bool) {
+	if direction != FlowUnidirectional {
+		return flowKeyOf(packet)
+	}
+	network := packet.NetworkLayer()
+	if network == nil {
+		return FlowKey{}, false
+	}
+	key := FlowKey{Network: network.NetworkFlow()}
+	if transport := packet.TransportLayer(); transport != nil {
+		key.Transport = transport.TransportFlow()
+	}
+	return key, true
+}
+
+// FlowTimeouts end a flow so that later packets with the same key start a new
+// one, like CICFlowMeter and other flow exporters do (--flow-timeout,
+// --flow-activity-timeout). Zero values never end a flow.
+type FlowTimeouts struct {
+	Active time.Duration // Maximum flow duration, measured from its first packet
+	Idle   time.Duration // Maximum gap between two packets of the flow
+}
+
+// flowSpan is the current instance of a flow key.
+type flowSpan struct {
+	generation int // Number of earlier flows with the same key
+	start      time.Time
+	last       time.Time
+}
+
+// flowTracker numbers the successive flows that share a key when timeouts
+// split them. Packets must be fed in capture order.
+type flowTracker struct {
+	timeouts FlowTimeouts
+	flows    map[FlowKey]*flowSpan
+}
+
+// newFlowTracker returns a tracker, or nil if no timeout is set (every key is
+// a single flow).
+func newFlowTracker(timeouts FlowTimeouts) *flowTracker {
+	if timeouts.Active == 0 && timeouts.Idle == 0 {
+		return nil
+	}
+	return &flowTracker{
+		timeouts: timeouts,
+		flows:    make(map[FlowKey]*flowSpan),
+	}
+}
+
+// generation returns which flow of its key a packet seen at ts belongs to: 0
+// for the first, 1 once a timeout has ended that one, and so on. A nil
+// tracker always returns 0.
+func (t *flowTracker) generation(key FlowKey, ts time.Time) int {
+	if t == nil {
+		return 0
+	}
+
+	span, exists := t.flows[key]
+	if !exists {
+		t.flows[key] = &flowSpan{start: ts, last: ts}
+		return 0
+	}
+	if (t.timeouts.Idle > 0 && ts.Sub(span.last) > t.timeouts.Idle) ||
+		(t.timeouts.Active > 0 && ts.Sub(span.start) > t.timeouts.Active) {
+		span.generation++
+		span.start = ts
+	}
+	span.last = ts
+	return span.generation
+}
+
+// retransmissionTracker detects TCP segments whose payload was already seen in
+// the same direction of a connection (retransmissions and duplicates).
+type retransmissionTracker struct {
+	seen map[FlowKey]*seqRanges // Directional flow -> sequence ranges seen
+}
+
+func newRetransmissionTracker() *retransmissionTracker {
+	return &retransmissionTracker{
+		seen: make(map[FlowKey]*seqRanges),
+	}
+}
+
+// maxSeqRanges bounds the holes tracked per direction; beyond it the lowest
+// hole is taken as seen.
+const maxSeqRanges = 64
+
+// seqRanges are the sequence ranges of one direction of a connection whose
+// payload was seen, as sorted, disjoint [start, end) offsets from its first
+// sequence number. Offsets grow past 2^32, so long connections that wrap
+// around keep their order.
+type seqRanges struct {
+	base   uint32     // Sequence number of offset 0
+	high   int64      // Highest end offset seen
+	ranges [][2]int64 // Seen ranges
+}
+
+// offset unwraps a sequence number to an offset, taking the one nearest to
+// the highest seen.
+func (s *seqRanges) offset(seq uint32) int64 {
+	return s.high + int64(int32(seq-(s.base+uint32(s.high))))
+}
+
+// covered reports whether [start, end) lies within one seen range.
+func (s *seqRanges) covered(start, end int64) bool {
+	for _, r := range s.ranges {
+		if r[0] <= start && end <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// add marks [start, end) as seen, merging it with the ranges it touches.
+func (s *seqRanges) add(start, end int64) {
+	merged := [2]int64{start, end}
+	kept := make([][2]int64, 0, len(s.ranges)+1)
+	inserted := false
+	for _, r := range s.ranges {
+		switch {
+		case r[1] < merged[0]:
+			kept = append(kept, r)
+		case merged[1] < r[0]:
+			if !inserted {
+				kept = append(kept, merged)
+				inserted = true
+			}
+			kept = append(kept, r)
+		default:
+			merged = [2]int64{min(r[0], merged[0]), max(r[1], merged[1])}
+		}
+	}
+	if !inserted {
+		kept = append(kept, merged)
+	}
+	if len(kept) > maxSeqRanges {
+		kept[1][0] = kept[0][0]
+		kept = kept[1:]
+	}
+	s.ranges = kept
+	s.high = max(s.high, end)
+}
+
+// isRetransmission reports whether the packet is a TCP segment carrying only
+// payload bytes that were already seen. Segments arriving out of order or
+// filling a gap carry new bytes and are kept. Packets without TCP payload are
+// never dropped.
+func (t *retransmissionTracker) isRetransmission(packet gopacket.Packet) bool {
+	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return false
+	}
+	tcp, _ := tcpLayer.(*layers.TCP)
+	if len(tcp.Payload) == 0 || packet.NetworkLayer() == nil {
+		return false
+	}
+
+	// Directional key: the two halves of a connection have separate sequence spaces
+	key := FlowKey{Network: packet.NetworkLayer().NetworkFlow(), Transport: tcp.TransportFlow()}
+	seen, ok := t.seen[key]
+	if !ok {
+		seen = &seqRanges{base: tcp.Seq}
+		t.seen[key] = seen
+	}
+	start := seen.offset(tcp.Seq)
+	end := start + int64(len(tcp.Payload))
+	if seen.covered(start, end) {
+		return true
+	}
+	seen.add(start, end)
+	return false
+}
+
+// flowID returns a stable 64-bit ID of a flow: an FNV-1a hash of its key and,
+// for flows split by timeouts, its generation, hashed like Split.assign so the
+// first flow of a 5-tuple has the same ID with and without timeouts. Packets
+// without a flow key get 0.
+func flowID(key FlowKey, hasKey bool, generation int) uint64 {
+	if !hasKey {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key.String()))
+	if generation > 0 {
+		binary.Write(h, binary.LittleEndian, int64(generation))
+	}
+	return h.Sum64()
+}
+
+// String renders the flow as "addr->addr port->port".
+func (k FlowKey) String() string {
+	if k.Transport == (gopacket.Flow{}) {
+		return k.Network.String()
+	}
+	return k.Network.String() + " " + k.Transport.String()
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// genProtocols are the protocols `gobyte gen` generates traffic of, in sorted
+// order. tcp and udp are random payloads to a port of the class.
+var genProtocols = []string{"dns", "http", "icmp", "ntp", "ssh", "tcp", "tls", "udp"}
+
+// genSnapLen is the snap length written to the generated captures' headers.
+const genSnapLen = 65535
+
+// Header lengths of the generated frames.
+const (
+	genEthernetLen = 14
+	genIPv4Len     = 20
+	genTCPLen      = 20
+	genUDPLen      = 8
+	genICMPLen     = 8
+)
+
+// genClass is a class of a generated dataset.
+type genClass struct {
+	name     string
+	protocol string
+	port     uint16 // Server port
+	packets  int
+
+	// Packets carrying data have frame sizes around center, at most spread
+	// away from it, within [minSize, maxSize]
+	minSize, maxSize int
+	center, spread   int
+}
+
+// genPacket is a generated frame with its timestamp.
+type genPacket struct {
+	timestamp time.Time
+	data      []byte
+}
+
+// runGen is the `gobyte gen` subcommand: it writes a dataset of synthetic
+// labeled captures, one class directory per class, so pipelines can be
+// benchmarked and tested without real captures. The same options and seed
+// give the same captures byte for byte.
+func runGen(args []string) {
+	flags := flag.NewFlagSet("gen", flag.ExitOnError)
+	packets := flags.Int("packets", 10000, "Packets in total, shared evenly by the classes")
+	classCount := flags.Int("classes", 3, "Number of classes")
+	protocols := flags.String("protocols", "dns,http,tls,ssh,ntp,icmp", "Comma-separated protocols the classes are given in turn: "+strings.Join(genProtocols, ", "))
+	sizes := flags.String("sizes", "64-1500", "Frame sizes of the packets carrying data, MIN-MAX bytes; each class has its own typical size in the range")
+	flowPackets := flags.Int("flow-packets", 20, "Average packets per flow; flows have between half and one and a half times as many")
+	files := flags.Int("files", 1, "Capture files per class")
+	duration := flags.Duration("duration", time.Hour, "Time span of each class's traffic; the files of a class follow each other in it")
+	start := flags.String("start", "2024-01-01T00:00:00Z", "Time of the start of the traffic, RFC 3339")
+	seed := flags.Uint64("seed", 1, "Random seed; the same options and seed give the same captures")
+	outputDir := flags.String("output-dir", "synthetic", "Dataset directory for <class>/<class>_0001.pcap, ... (a --dataset)")
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s gen [--packets 10000] [--classes 3] [--protocols dns,http,tls] [--sizes 64-1500] [--seed 1] [--output-dir synthetic]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Writes a dataset of synthetic labeled pcap captures.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if err := setupLogger(*logLevel, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *classCount <= 0 {
+		fatal("--classes must be positive", "classes", *classCount)
+	}
+	if *files <= 0 {
+		fatal("--files must be positive", "files", *files)
+	}
+	if *packets < *classCount**files {
+		fatal("--packets must be at least one per file of each class", "packets", *packets, "classes", *classCount, "files", *files)
+	}
+	if *flowPackets <= 0 {
+		fatal("--flow-packets must be positive", "flow_packets", *flowPackets)
+	}
+	if *duration <= 0 {
+		fatal("--duration must be positive", "duration", *duration)
+	}
+	startTime, err := time.Parse(time.RFC3339, *start)
+	if err != nil {
+		fatal("invalid --start", "error", err)
+	}
+	minSize, maxSize, err := parseGenSizes(*sizes)
+	if err != nil {
+		fatal("invalid --sizes", "error", err)
+	}
+	var protocolList []string
+	for _, protocol := range strings.Split(*protocols, ",") {
+		protocol = strings.TrimSpace(protocol)
+		if !slices.Contains(genProtocols, protocol) {
+			fatal("unknown protocol in --protocols", "protocol", protocol, "supported", strings.Join(genProtocols, ","))
+		}
+		protocolList = append(protocolList, protocol)
+	}
+
+	t0 := time.Now()
+	classes := newGenClasses(*classCount, protocolList, *packets, minSize, maxSize, *seed)
+	for i, class := range classes {
+		// Each class draws from its own source, so its captures do not
+		// depend on how many files the classes before it have
+		rng := rand.New(rand.NewPCG(*seed, uint64(i)))
+		dir := filepath.Join(*outputDir, class.name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fatal("failed to create output directory", "dir", dir, "error", err)
+		}
+		span := *duration / time.Duration(*files)
+		for n := range *files {
+			count := class.packets / *files
+			if n < class.packets%*files {
+				count++
+			}
+			path := filepath.Join(dir, fmt.Sprintf("%s_%04d.pcap", class.name, n+1))
+			frames, flows := class.generate(rng, count, *flowPackets, startTime.Add(time.Duration(n)*span), span)
+			if err := writeGenCapture(path, frames); err != nil {
+				fatal("failed to write capture", "file", path, "error", err)
+			}
+			slog.Debug("generated capture", "class", class.name, "file", path, "packets", len(frames), "flows", flows)
+		}
+		slog.Info("generated class", "class", class.name, "protocol", class.protocol, "packets", class.packets, "files", *files)
+	}
+	slog.Info("generated dataset", "output_dir", *outputDir, "classes", len(classes), "packets", *packets, "seed", *seed, "duration", time.Since(t0))
+}
+
+// parseGenSizes parses --sizes, MIN-MAX frame sizes in bytes.
+func parseGenSizes(s string) (int, int, error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	minSize, minErr := strconv.Atoi(strings.TrimSpace(lo))
+	maxSize, maxErr := strconv.Atoi(strings.TrimSpace(hi))
+	if !ok || minErr != nil || maxErr != nil {
+		return 0, 0, fmt.Errorf("sizes must be MIN-MAX, e.g. 64-1500: %q", s)
+	}
+	if minSize < 60 || maxSize > 9014 || minSize > maxSize {
+		return 0, 0, fmt.Errorf("sizes must be within 60-9014 bytes with MIN at most MAX: %q", s)
+	}
+	return minSize, maxSize, nil
+}
+
+// newGenClasses makes the classes of a dataset. Class i has protocol i of the
+// list, taken in turn; classes sharing a protocol are numbered after the
+// first, e.g. dns, dns_2. Typical sizes are spread evenly over the range.
+func newGenClasses(count int, protocols []string, packets, minSize, maxSize int, seed uint64) []*genClass {
+	rng := rand.New(rand.NewPCG(seed, uint64(count)))
+	classes := make([]*genClass, count)
+	width := maxSize - minSize
+	for i := range classes {
+		protocol := protocols[i%len(protocols)]
+		class := &genClass{
+			name:     protocol,
+			protocol: protocol,
+			packets:  packets / count,
+			minSize:  minSize,
+			maxSize:  maxSize,
+			center:   minSize + width*(2*i+1)/(2*count),
+			spread:   max(width/count, 1),
+		}
+		if i >= len(protocols) {
+			class.name = fmt.Sprintf("%s_%d", protocol, i/len(protocols)+1)
+		}
+		if i < packets%count {
+			class.packets++
+		}
+		switch protocol {
+		case "dns":
+			class.port = 53
+		case "http":
+			class.port = 80
+		case "ntp":
+			class.port = 123
+		case "ssh":
+			class.port = 22
+		case "tls":
+			class.port = 443
+		case "tcp", "udp":
+			class.port = uint16(10000 + rng.IntN(50000))
+		}
+		classes[i] = class
+	}
+	return classes
+}
+
+// generate returns count packets of flows starting within span of start, in
+// time order, and the number of flows.
+func (c *genClass) generate(rng *rand.Rand, count, flowPackets int, start time.Time, span time.Duration) ([]genPacket, int) {
+	var packets []genPacket
+	flows := 0
+	for len(packets) < count {
+		n := flowPackets/2 + rng.IntN(flowPackets+1)
+		n = min(max(n, 1), count-len(packets))
+		flow := newGenFlow(rng, c, start.Add(time.Duration(rng.Int64N(int64(span)))))
+		switch c.protocol {
+		case "dns", "ntp", "udp":
+			flow.udp(n)
+		case "icmp":
+			flow.icmp(n)
+		default:
+			flow.tcp(n)
+		}
+		packets = append(packets, flow.packets...)
+		flows++
+	}
+	slices.SortStableFunc(packets, func(a, b genPacket) int { return a.timestamp.Compare(b.timestamp) })
+	return packets, flows
+}
+
+// genFlow builds the packets of one bidirectional flow between a client in
+// 10.0.0.0/8 and a server in the 198.18.0.0/15 benchmarking range.
+type genFlow struct {
+	rng   *rand.Rand
+	class *genClass
+
+	client, server         net.IP
+	clientMAC, serverMAC   net.HardwareAddr
+	clientPort, serverPort uint16
+	clientTTL, serverTTL   uint8
+	clientID, serverID     uint16 // Next IP IDs
+	clientSeq, serverSeq   uint32 // Next TCP sequence numbers
+
+	at         time.Time
+	rtt        time.Duration
+	lastClient bool // Direction of the last packet
+	packets    []genPacket
+}
+
+func newGenFlow(rng *rand.Rand, class *genClass, start time.Time) *genFlow {
+	f := &genFlow{
+		rng:        rng,
+		class:      class,
+		client:     net.IPv4(10, byte(rng.IntN(256)), byte(rng.IntN(256)), byte(1+rng.IntN(254))).To4(),
+		server:     net.IPv4(198, byte(18+rng.IntN(2)), byte(rng.IntN(256)), byte(1+rng.IntN(254))).To4(),
+		clientPort: uint16(32768 + rng.IntN(28232)),
+		serverPort: class.port,
+		clientTTL:  64,
+		serverTTL:  []uint8{64, 128, 255}[rng.IntN(3)],
+		clientID:   uint16(rng.Uint32()),
+		serverID:   uint16(rng.Uint32()),
+		clientSeq:  rng.Uint32(),
+		serverSeq:  rng.Uint32(),
+		at:         start,
+		rtt:        time.Millisecond + time.Duration(rng.Int64N(int64(100*time.Millisecond))),
+		lastClient: true,
+	}
+	// Locally administered MACs made from the addresses
+	f.clientMAC = net.HardwareAddr{0x02, 0x00, f.client[0], f.client[1], f.client[2], f.client[3]}
+	f.serverMAC = net.HardwareAddr{0x02, 0x00, f.server[0], f.server[1], f.server[2], f.server[3]}
+	return f
+}
+
+// size returns the frame size of a packet carrying data, drawn from a
+// triangular distribution around the class's typical size.
+func (f *genFlow) size() int {
+	c := f.class
+	size := c.center + int((f.rng.Float64()+f.rng.Float64()-1)*float64(c.spread))
+	return min(max(size, c.minSize), c.maxSize)
+}
+
+// payloadLen returns the payload length that gives a frame of size with
+// headers of headerLen after the Ethernet and IPv4 headers.
+func payloadLen(size, headerLen int) int {
+	return max(size-genEthernetLen-genIPv4Len-headerLen, 0)
+}
+
+// randomBytes returns n bytes from rng.
+func randomBytes(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rng.Uint32())
+	}
+	return b
+}
+
+// emit appends a packet in one direction, half a round trip after a packet
+// in the other direction or shortly after one in the same direction.
+func (f *genFlow) emit(fromClient bool, protocol layers.IPProtocol, transport ...gopacket.SerializableLayer) {
+	if len(f.packets) > 0 {
+		if fromClient != f.lastClient {
+			f.at = f.at.Add(f.rtt/2 + time.Duration(f.rng.Int64N(int64(f.rtt/10)+1)))
+		} else {
+			f.at = f.at.Add(50*time.Microsecond + time.Duration(f.rng.Int64N(int64(500*time.Microsecond))))
+		}
+	}
+	f.lastClient = fromClient
+
+	eth := &layers.Ethernet{SrcMAC: f.clientMAC, DstMAC: f.serverMAC, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: f.clientTTL, Id: f.clientID, Flags: layers.IPv4DontFragment, Protocol: protocol, SrcIP: f.client, DstIP: f.server}
+	if fromClient {
+		f.clientID++
+	} else {
+		eth.SrcMAC, eth.DstMAC = f.serverMAC, f.clientMAC
+		ip.SrcIP, ip.DstIP, ip.TTL, ip.Id = f.server, f.client, f.serverTTL, f.serverID
+		f.serverID++
+	}
+	for _, layer := range transport {
+		switch l := layer.(type) {
+		case *layers.TCP:
+			l.SetNetworkLayerForChecksum(ip)
+		case *layers.UDP:
+			l.SetNetworkLayerForChecksum(ip)
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	serialize := append([]gopacket.SerializableLayer{eth, ip}, transport...)
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, serialize...); err != nil {
+		// The layers are built here, so this is a bug
+		panic(fmt.Sprintf("failed to serialize generated packet: %v", err))
+	}
+	f.packets = append(f.packets, genPacket{timestamp: f.at, data: buffer.Bytes()})
+}
+
+// tcp appends a TCP connection of n packets: the handshake, data both ways
+// (the server sending twice as often) and, with room for it, the teardown.
+func (f *genFlow) tcp(n int) {
+	segment := func(fromClient bool, flags string, payload []byte) {
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(f.clientPort), DstPort: layers.TCPPort(f.serverPort), Window: 64240}
+		seq, ack := &f.clientSeq, f.serverSeq
+		if !fromClient {
+			tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+			seq, ack = &f.serverSeq, f.clientSeq
+		}
+		tcp.Seq = *seq
+		tcp.SYN = strings.Contains(flags, "S")
+		tcp.FIN = strings.Contains(flags, "F")
+		tcp.PSH = len(payload) > 0
+		if !(tcp.SYN && fromClient) {
+			tcp.ACK = true
+			tcp.Ack = ack
+		}
+		*seq += uint32(len(payload))
+		if tcp.SYN || tcp.FIN {
+			*seq++
+		}
+		f.emit(fromClient, layers.IPProtocolTCP, tcp, gopacket.Payload(payload))
+	}
+
+	handshake := min(n, 3)
+	teardown := 0
+	if n > 6 {
+		teardown = 3
+	}
+	for i := range handshake {
+		segment(i != 1, []string{"S", "S", ""}[i], nil)
+	}
+	prevClient := false
+	for j := range n - handshake - teardown {
+		fromClient := j%3 == 0
+		payload := f.tcpPayload(j, fromClient, prevClient, payloadLen(f.size(), genTCPLen))
+		segment(fromClient, "", payload)
+		prevClient = fromClient
+	}
+	if teardown > 0 {
+		segment(true, "F", nil)
+		segment(false, "F", nil)
+		segment(true, "", nil)
+	}
+}
+
+// tcpPayload returns data packet j of a TCP connection; prevClient says
+// whether the client sent the one before.
+func (f *genFlow) tcpPayload(j int, fromClient, prevClient bool, length int) []byte {
+	switch f.class.protocol {
+	case "http":
+		switch {
+		case fromClient:
+			request := fmt.Sprintf("GET /%x HTTP/1.1\r\nHost: www%d.example.com\r\nUser-Agent: gobyte-gen\r\nAccept: */*\r\n", f.rng.Uint32(), f.rng.IntN(100))
+			if pad := length - len(request) - len("X-Padding: \r\n\r\n"); pad > 0 {
+				request += "X-Padding: " + strings.Repeat("a", pad) + "\r\n"
+			}
+			return []byte(request + "\r\n")
+		case prevClient:
+			header := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", 4*length)
+			return append([]byte(header), randomBytes(f.rng, max(length-len(header), 0))...)
+		}
+	case "tls":
+		// Records of 5 header bytes: handshake (ClientHello, ServerHello)
+		// or application data
+		record := randomBytes(f.rng, max(length, 9))
+		record[0], record[1], record[2] = 0x17, 0x03, 0x03
+		if j < 2 {
+			record[0], record[2] = 0x16, 0x01
+			record[5] = 1 // client_hello
+			if !fromClient {
+				record[2], record[5] = 0x03, 2 // server_hello
+			}
+		}
+		record[3], record[4] = byte((len(record)-5)>>8), byte(len(record)-5)
+		return record
+	case "ssh":
+		if j < 2 {
+			if fromClient {
+				return []byte("SSH-2.0-OpenSSH_9.6\r\n")
+			}
+			return []byte("SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.10\r\n")
+		}
+		// Binary packet: length, then encrypted padding length and data
+		packet := randomBytes(f.rng, max(length, 8))
+		packet[0], packet[1], packet[2], packet[3] = byte((len(packet)-4)>>24), byte((len(packet)-4)>>16), byte((len(packet)-4)>>8), byte(len(packet)-4)
+		return packet
+	}
+	return randomBytes(f.rng, length)
+}
+
+// udp appends n datagrams of request and response pairs.
+func (f *genFlow) udp(n int) {
+	var query *layers.DNS
+	for i := range n {
+		fromClient := i%2 == 0
+		udp := &layers.UDP{SrcPort: layers.UDPPort(f.clientPort), DstPort: layers.UDPPort(f.serverPort)}
+		if !fromClient {
+			udp.SrcPort, udp.DstPort = udp.DstPort, udp.SrcPort
+		}
+		var payload gopacket.SerializableLayer
+		switch f.class.protocol {
+		case "dns":
+			if fromClient {
+				query = f.dnsQuery()
+				payload = query
+			} else {
+				payload = f.dnsResponse(query)
+			}
+		case "ntp":
+			// NTPv4, mode 3 (client) or 4 (server), and random timestamps
+			ntp := randomBytes(f.rng, 48)
+			ntp[0] = 0x23
+			if !fromClient {
+				ntp[0] = 0x24
+			}
+			payload = gopacket.Payload(ntp)
+		default:
+			payload = gopacket.Payload(randomBytes(f.rng, payloadLen(f.size(), genUDPLen)))
+		}
+		f.emit(fromClient, layers.IPProtocolUDP, udp, payload)
+	}
+}
+
+// dnsQuery returns an A query for a random name.
+func (f *genFlow) dnsQuery() *layers.DNS {
+	name := fmt.Sprintf("host%d.example%d.com", f.rng.IntN(10000), f.rng.IntN(100))
+	return &layers.DNS{
+		ID:        uint16(f.rng.Uint32()),
+		OpCode:    layers.DNSOpCodeQuery,
+		RD:        true,
+		QDCount:   1,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	}
+}
+
+// dnsResponse answers a query with as many A records as bring the frame
+// close to a data packet size.
+func (f *genFlow) dnsResponse(query *layers.DNS) *layers.DNS {
+	question := query.Questions[0]
+	response := *query
+	response.QR, response.RA = true, true
+	response.ResponseCode = layers.DNSResponseCodeNoErr
+	recordLen := len(question.Name) + 2 + 10 + 4 // Name, fixed fields, IPv4 address
+	queryLen := 12 + len(question.Name) + 2 + 4
+	answers := min(max((payloadLen(f.size(), genUDPLen)-queryLen)/recordLen, 1), 50)
+	for range answers {
+		response.Answers = append(response.Answers, layers.DNSResourceRecord{
+			Name:  question.Name,
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   uint32(60 + f.rng.IntN(3600)),
+			IP:    net.IPv4(198, byte(18+f.rng.IntN(2)), byte(f.rng.IntN(256)), byte(1+f.rng.IntN(254))).To4(),
+		})
+	}
+	response.ANCount = uint16(answers)
+	return &response
+}
+
+// icmp appends n packets of echo requests and replies.
+func (f *genFlow) icmp(n int) {
+	id := uint16(f.rng.Uint32())
+	var data []byte
+	for i := range n {
+		fromClient := i%2 == 0
+		icmp := &layers.ICMPv4{Id: id, Seq: uint16(i/2 + 1)}
+		if fromClient {
+			icmp.TypeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)
+			data = randomBytes(f.rng, payloadLen(f.size(), genICMPLen))
+		} else {
+			icmp.TypeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0)
+		}
+		f.emit(fromClient, layers.IPProtocolICMPv4, icmp, gopacket.Payload(data))
+	}
+}
+
+// writeGenCapture writes generated packets as an Ethernet pcap file with
+// nanosecond timestamps.
+func writeGenCapture(path string, packets []genPacket) error {
+	var partial partialFiles
+	file, err := partial.create(path)
+	if err != nil {
+		return err
+	}
+	buffer := bufio.NewWriterSize(file, 1024*1024)
+	writer := pcapgo.NewWriterNanos(buffer)
+	err = writer.WriteFileHeader(genSnapLen, layers.LinkTypeEthernet)
+	for _, p := range packets {
+		if err != nil {
+			break
+		}
+		info := gopacket.CaptureInfo{Timestamp: p.timestamp, CaptureLength: len(p.data), Length: len(p.data)}
+		err = writer.WritePacket(info, p.data)
+	}
+	if err == nil {
+		err = buffer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return partial.finish(err)
+}
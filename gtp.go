@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// GTP signalling handling modes for --gtp-c.
+const (
+	GTPCKeep = "keep" // GTP signalling packets are rows like any other (default)
+	GTPCDrop = "drop" // Exclude GTP signalling packets
+	GTPCOnly = "only" // Keep only GTP signalling packets
+)
+
+// gtpCPort is the UDP port of GTP-C (3GPP TS 29.274), the session management
+// between core network nodes. The decoder finds GTP-U tunnels on port 2152.
+const gtpCPort = 2123
+
+// gtpMessageTPDU is the GTP-U message type of a tunnelled user packet; the
+// others (echo, error indication, end marker, ...) are path signalling.
+const gtpMessageTPDU = 255
+
+// decapsulateGTP returns the subscriber packet carried by a GTP-U user packet
+// (--gtp-decap) as a frame of its own (see innerFrame), with the outer IP, UDP and
+// GTP headers removed, so flows, filters, labels, masking and rows see the
+// subscriber traffic. Other packets, including GTP signalling and PDU
+// sessions of PPP or Ethernet, are returned unchanged.
+func decapsulateGTP(packet gopacket.Packet) (gopacket.Packet, bool) {
+	gtp, ok := packet.Layer(layers.LayerTypeGTPv1U).(*layers.GTPv1U)
+	if !ok || gtp.MessageType != gtpMessageTPDU {
+		return packet, false
+	}
+	return innerFrame(packet, gtp.LayerPayload())
+}
+
+// gtpControlOf reports whether a packet is GTP signalling rather than
+// subscriber traffic (--gtp-c): GTPv1-C or GTPv2-C on UDP port 2123, or a
+// GTP-U message other than a user packet (echo, error indication, end marker).
+func gtpControlOf(packet gopacket.Packet) bool {
+	if gtp, ok := packet.Layer(layers.LayerTypeGTPv1U).(*layers.GTPv1U); ok {
+		return gtp.MessageType != gtpMessageTPDU
+	}
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || (udp.SrcPort != gtpCPort && udp.DstPort != gtpCPort) {
+		return false
+	}
+	return parseGTPCHeader(udp.Payload)
+}
+
+// keepGTPControl reports whether the packet passes the --gtp-c mode.
+func keepGTPControl(packet gopacket.Packet, mode string) bool {
+	isControl := gtpControlOf(packet)
+	switch mode {
+	case GTPCDrop:
+		return !isControl
+	case GTPCOnly:
+		return isControl
+	}
+	return true
+}
+
+// parseGTPCHeader checks whether a UDP payload starts with a GTPv1-C or
+// GTPv2-C header whose length field fits the payload.
+func parseGTPCHeader(b []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	switch b[0] >> 5 {
+	case 1:
+		return b[0]&0x10 != 0 && 8+length <= len(b) // Protocol type 1 is GTP, 0 is GTP'
+	case 2:
+		return 4+length <= len(b)
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// huggingFaceMetadataKey is the Parquet key-value metadata the datasets
+// library reads the features of a file from.
+const huggingFaceMetadataKey = "huggingface"
+
+// hfFeature is a column of a huggingface layout output as a datasets feature:
+// a Value, a Sequence of Values or a ClassLabel.
+type hfFeature struct {
+	name     string
+	dtype    string   // Value dtype, of the elements for a Sequence
+	sequence bool     // Sequence(Value(dtype))
+	names    []string // ClassLabel names by ID (nil = not a ClassLabel)
+}
+
+// huggingFaceFeatures describes the columns of the huggingface layout in file
+// order: data as Sequence(uint8), the features, the source columns and, if
+// classNames is non-nil, label as a ClassLabel.
+func huggingFaceFeatures(featureNames, columns, classNames []string) []hfFeature {
+	features := []hfFeature{{name: "data", dtype: "uint8", sequence: true}}
+	for _, name := range featureNames {
+		features = append(features, hfFeature{name: name, dtype: "float64"})
+	}
+	for _, column := range columns {
+		dtype := "int64"
+		switch column {
+		case ColumnFilename:
+			dtype = "string"
+		case ColumnFlowID:
+			dtype = "uint64"
+		case ColumnTimestamp:
+			dtype = "timestamp[ns, tz=UTC]" // TIMESTAMP(NANOS) adjusted to UTC
+		case ColumnDecodeOK, ColumnDecrypted:
+			dtype = "bool"
+		}
+		features = append(features, hfFeature{name: column, dtype: dtype})
+	}
+	if classNames != nil {
+		features = append(features, hfFeature{name: "label", names: classNames})
+	}
+	return features
+}
+
+// huggingFaceInfo renders features as the metadata datasets expects,
+// {"info": {"features": {...}}}, keeping the column order.
+func huggingFaceInfo(features []hfFeature) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"info":{"features":{`)
+	for i, f := range features {
+		var value any
+		switch {
+		case f.names != nil:
+			value = map[string]any{"names": f.names, "_type": "ClassLabel"}
+		case f.sequence:
+			value = map[string]any{"feature": map[string]any{"dtype": f.dtype, "_type": "Value"}, "_type": "Sequence"}
+		default:
+			value = map[string]any{"dtype": f.dtype, "_type": "Value"}
+		}
+		name, err := json.Marshal(f.name)
+		if err != nil {
+			return "", err
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(encoded)
+	}
+	buf.WriteString(`}}}`)
+	return buf.String(), nil
+}
+
+// classNamesByID lists the classes of a class to ID mapping by ID.
+func classNamesByID(classToInt map[string]byte) []string {
+	names := make([]string, len(classToInt))
+	for class, id := range classToInt {
+		if int(id) >= len(names) {
+			names = append(names, make([]string, int(id)+1-len(names))...)
+		}
+		names[id] = class
+	}
+	return names
+}
+
+// parquetHuggingFaceRowType builds the row struct of the huggingface layout:
+// data as a LIST of UINT_8 (Arrow list<uint8>, unlike the binary column of
+// the binary layout), one float64 per feature, the source columns and, if
+// hasClass, the class ID as an int64 label.
+func parquetHuggingFaceRowType(featureNames, columns []string, hasClass bool) reflect.Type {
+	fields := make([]reflect.StructField, 0, len(featureNames)+len(columns)+2)
+	fields = append(fields, reflect.StructField{
+		Name: "Data",
+		Type: reflect.TypeOf([]uint8{}),
+		Tag:  `parquet:"data,list"`,
+	})
+	for i, name := range featureNames {
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("Feature_%d", i),
+			Type: reflect.TypeOf(float64(0)),
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, name)),
+		})
+	}
+	fields = append(fields, metadataFields(columns)...)
+	if hasClass {
+		fields = append(fields, reflect.StructField{
+			Name: "Label",
+			Type: reflect.TypeOf(int64(0)),
+			Tag:  `parquet:"label"`,
+		})
+	}
+	return reflect.StructOf(fields)
+}
+
+// readHuggingFaceClassNames returns the label names a huggingface layout
+// output was written with, or nil if it has no label column.
+func readHuggingFaceClassNames(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	pf, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	value, ok := pf.Lookup(huggingFaceMetadataKey)
+	if !ok {
+		return nil, fmt.Errorf("%s has no %q metadata", filename, huggingFaceMetadataKey)
+	}
+	var metadata struct {
+		Info struct {
+			Features map[string]struct {
+				Names []string `json:"names"`
+			} `json:"features"`
+		} `json:"info"`
+	}
+	if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+		return nil, fmt.Errorf("invalid %q metadata: %w", huggingFaceMetadataKey, err)
+	}
+	return metadata.Info.Features["label"].Names, nil
+}
+
+// datasetCardSplits maps the Hub split names of a dataset card to the output
+// files of a run: train for a single output, or one per --split.
+func datasetCardSplits(split *Split, filename string) [][2]string {
+	if split == nil {
+		return [][2]string{{"train", filename}}
+	}
+	var splits [][2]string
+	for _, name := range split.names() {
+		hubName := name
+		if name == "val" {
+			hubName = "validation"
+		}
+		splits = append(splits, [2]string{hubName, splitOutputPath(filename, name)})
+	}
+	return splits
+}
+
+// writeDatasetCard writes a README.md dataset card next to the huggingface
+// layout outputs of a run, whose YAML header lets load_dataset() on the
+// directory (or a Hub repository it is uploaded to) find the splits and type
+// the features without reading the files.
+func writeDatasetCard(split *Split, filename string, featureNames, columns []string) (string, error) {
+	splits := datasetCardSplits(split, filename)
+	classNames, err := readHuggingFaceClassNames(splits[0][1])
+	if err != nil {
+		return "", err
+	}
+	features := huggingFaceFeatures(featureNames, columns, classNames)
+
+	var card strings.Builder
+	card.WriteString("---\nconfigs:\n- config_name: default\n  data_files:\n")
+	for _, s := range splits {
+		fmt.Fprintf(&card, "  - split: %s\n    path: %s\n", s[0], strconv.Quote(filepath.Base(s[1])))
+	}
+	card.WriteString("dataset_info:\n  features:\n")
+	for _, f := range features {
+		fmt.Fprintf(&card, "  - name: %s\n", strconv.Quote(f.name))
+		switch {
+		case f.names != nil:
+			card.WriteString("    dtype:\n      class_label:\n        names:\n")
+			for id, name := range f.names {
+				fmt.Fprintf(&card, "          '%d': %s\n", id, strconv.Quote(name))
+			}
+		case f.sequence:
+			fmt.Fprintf(&card, "    sequence: %s\n", f.dtype)
+		default:
+			fmt.Fprintf(&card, "    dtype: %s\n", f.dtype)
+		}
+	}
+	card.WriteString("---\n\n")
+
+	title := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	fmt.Fprintf(&card, "# %s\n\n", title)
+	card.WriteString("Network packets extracted from packet captures by GoByte. Each row is one packet: `data` holds its bytes")
+	if classNames != nil {
+		fmt.Fprintf(&card, " and `label` its class (%d classes)", len(classNames))
+	}
+	dir := filepath.Dir(filename)
+	card.WriteString(".\n\n```python\nfrom datasets import load_dataset\n\n")
+	fmt.Fprintf(&card, "dataset = load_dataset(%s)  # This directory\n```\n", strconv.Quote(dir))
+
+	path := filepath.Join(dir, "README.md")
+	return path, os.WriteFile(path, []byte(card.String()), 0644)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ICMP handling modes for --icmp.
+const (
+	ICMPKeep = "keep" // ICMP packets are rows like any other (default)
+	ICMPDrop = "drop" // Exclude ICMP and ICMPv6 packets
+	ICMPOnly = "only" // Keep only ICMP and ICMPv6 packets
+)
+
+// icmpFeatureNames are the feature columns added by --icmp-features, in row
+// order. Packets without an ICMP layer get -1 in both.
+var icmpFeatureNames = []string{
+	"icmp_type",
+	"icmp_code",
+}
+
+// icmpMessage is the ICMPv4 or ICMPv6 message of a packet.
+type icmpMessage struct {
+	v6   bool
+	typ  uint8
+	code uint8
+	body []byte // Bytes after the 8-byte header (type, code, checksum and 4 message-specific bytes)
+}
+
+// icmpOf returns the packet's ICMP message, or false if it has none.
+func icmpOf(packet gopacket.Packet) (icmpMessage, bool) {
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		return icmpMessage{typ: icmp.TypeCode.Type(), code: icmp.TypeCode.Code(), body: icmp.LayerPayload()}, true
+	}
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+		// gopacket splits the ICMPv6 header after 4 bytes; the rest of the 8 belong to the message
+		m := icmpMessage{v6: true, typ: icmp.TypeCode.Type(), code: icmp.TypeCode.Code()}
+		if payload := icmp.LayerPayload(); len(payload) >= 4 {
+			m.body = payload[4:]
+		}
+		return m, true
+	}
+	return icmpMessage{}, false
+}
+
+// quoted returns the original datagram quoted by an ICMP error message
+// (destination unreachable, time exceeded, ...), starting with its IP header,
+// or nil for other messages.
+func (m icmpMessage) quoted() []byte {
+	var version byte
+	switch {
+	case m.v6:
+		if m.typ >= layers.ICMPv6TypeDestinationUnreachable && m.typ <= layers.ICMPv6TypeParameterProblem {
+			version = 6
+		}
+	case m.typ == layers.ICMPv4TypeDestinationUnreachable, m.typ == layers.ICMPv4TypeSourceQuench,
+		m.typ == layers.ICMPv4TypeRedirect, m.typ == layers.ICMPv4TypeTimeExceeded,
+		m.typ == layers.ICMPv4TypeParameterProblem:
+		version = 4
+	}
+	if version == 0 || len(m.body) == 0 || m.body[0]>>4 != version {
+		return nil
+	}
+	return m.body
+}
+
+// keepICMP reports whether the packet passes the --icmp mode.
+func keepICMP(packet gopacket.Packet, mode string) bool {
+	_, isICMP := icmpOf(packet)
+	switch mode {
+	case ICMPDrop:
+		return !isICMP
+	case ICMPOnly:
+		return isICMP
+	}
+	return true
+}
+
+// icmpFeatures returns the icmp_type and icmp_code values of a packet.
+func icmpFeatures(packet gopacket.Packet) []float64 {
+	m, ok := icmpOf(packet)
+	if !ok {
+		return []float64{-1, -1}
+	}
+	return []float64{float64(m.typ), float64(m.code)}
+}
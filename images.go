@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// What one image of `gobyte images` shows.
+const (
+	ImagesByPacket = "packet" // The bytes of one packet
+	ImagesByFlow   = "flow"   // The first bytes of a bidirectional flow, its packets concatenated
+)
+
+// imageGridGap is the white border between the images of a class grid.
+const imageGridGap = 2
+
+// parseImageSize parses a --size value such as 32x32 (or just 32 for a square).
+func parseImageSize(size string) (int, int, error) {
+	w, h, found := strings.Cut(size, "x")
+	if !found {
+		h = w
+	}
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid --size %q (use WIDTHxHEIGHT, e.g. 32x32)", size)
+	}
+	return width, height, nil
+}
+
+// runImages is the `gobyte images` subcommand: it draws packets or flows as
+// grayscale PNGs, one byte per pixel, so classes can be compared by eye before
+// training a CNN on them, or shown in a paper.
+func runImages(args []string) {
+	flags := flag.NewFlagSet("images", flag.ExitOnError)
+	dataset := flags.String("dataset", "", "Dataset directory with one subdirectory per class")
+	input := flags.String("input", "", "Input PCAP file path or glob pattern (unlabeled)")
+	size := flags.String("size", "32x32", "Image size in pixels, WIDTHxHEIGHT; each pixel is one byte from the IP header on, zero-padded")
+	limit := flags.Int("limit", 100, "Images per class")
+	by := flags.String("by", ImagesByPacket, "What an image shows: packet or flow (the first bytes of a bidirectional flow)")
+	ipMask := flags.Bool("ipmask", false, "Mask source and destination IP addresses, e.g. for published figures")
+	outputDir := flags.String("output-dir", "images", "Directory for <class>/<file>_<n>.png and the <class>.png grid of each class")
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s images (--dataset dir | --input capture.pcap | capture.pcap...) [--size 32x32] [--limit 100] [--by packet|flow] [--output-dir images]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Draws packets or flows as grayscale PNG images, one byte per pixel.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+
+	if err := setupLogger(*logLevel, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	// Captures named after the flags are unlabeled inputs like --input
+	patterns := flags.Args()
+	if *input != "" {
+		patterns = append([]string{*input}, patterns...)
+	}
+	if (*dataset == "") == (len(patterns) == 0) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	width, height, err := parseImageSize(*size)
+	if err != nil {
+		fatal("invalid --size", "error", err)
+	}
+	if *limit <= 0 {
+		fatal("--limit must be positive", "limit", *limit)
+	}
+	if *by != ImagesByPacket && *by != ImagesByFlow {
+		fatal("invalid --by (use packet or flow)", "by", *by)
+	}
+
+	var fileJobs []FileJob
+	if *dataset != "" {
+		fileJobs, err = discoverDatasetFiles(*dataset, DatasetScan{})
+		if err != nil {
+			fatal("failed to scan dataset", "error", err)
+		}
+	} else {
+		for _, pattern := range patterns {
+			files, err := expandInputPattern(pattern)
+			if err != nil {
+				fatal("invalid --input", "input", pattern, "error", err)
+			}
+			for _, file := range files {
+				fileJobs = append(fileJobs, FileJob{FilePath: file})
+			}
+		}
+	}
+
+	t0 := time.Now()
+	drawer := &imageDrawer{
+		width:     width,
+		height:    height,
+		limit:     *limit,
+		byFlow:    *by == ImagesByFlow,
+		maskIP:    *ipMask,
+		outputDir: *outputDir,
+		drawn:     make(map[string][]*image.Gray),
+	}
+	var classes []string
+	for _, job := range fileJobs {
+		if _, seen := drawer.drawn[job.Class]; !seen {
+			classes = append(classes, job.Class)
+			drawer.drawn[job.Class] = nil
+		}
+		if err := drawer.drawFile(job); err != nil {
+			fatal("failed to draw file", "file", job.FilePath, "error", err)
+		}
+	}
+	for _, class := range classes {
+		if err := drawer.writeGrid(class); err != nil {
+			fatal("failed to write class grid", "class", class, "error", err)
+		}
+		slog.Info("drew class", "class", class, "images", len(drawer.drawn[class]))
+	}
+	slog.Info("images completed", "files", len(fileJobs), "output_dir", *outputDir, "duration", time.Since(t0))
+}
+
+// imageDrawer draws the images of `gobyte images` and keeps them per class
+// for the class grids.
+type imageDrawer struct {
+	width, height int
+	limit         int
+	byFlow        bool
+	maskIP        bool
+	outputDir     string
+	drawn         map[string][]*image.Gray
+}
+
+// classDir is the directory of a class's images; unlabeled input is drawn
+// into the output directory itself.
+func (d *imageDrawer) classDir(class string) string {
+	return filepath.Join(d.outputDir, class)
+}
+
+// drawFile draws the packets or flows of one file until its class has
+// --limit images.
+func (d *imageDrawer) drawFile(job FileJob) error {
+	if len(d.drawn[job.Class]) >= d.limit {
+		return nil
+	}
+	handle, err := openInput(job, ProcessOptions{})
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := os.MkdirAll(d.classDir(job.Class), 0755); err != nil {
+		return err
+	}
+	stem := strings.TrimSuffix(filepath.Base(job.FilePath), filepath.Ext(job.FilePath))
+
+	size := d.width * d.height
+	flows := make(map[FlowKey]int) // Flow number of each key
+	var buffers [][]byte           // Bytes of each unfinished flow, nil once drawn
+	var skipped int                // Packets of unsupported link types or undecodable
+	var skipErr error              // Why the first of them was skipped
+	for n := 0; len(d.drawn[job.Class]) < d.limit; n++ {
+		data, _, err := handle.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			slog.Warn("stopped reading file", "file", job.FilePath, "packets", n, "error", err)
+			break
+		}
+		packet := gopacket.NewPacket(data, handle.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		link, err := linkLayerOf(packet, false)
+		if err != nil {
+			if skipped == 0 {
+				skipErr = err
+			}
+			skipped++
+			continue
+		}
+		payload, rowStart := linkPayload(packet, link)
+		row := append([]byte(nil), payload...)
+		if d.maskIP {
+			for _, header := range ipHeaders(packet, row, rowStart) {
+				maskIPAddresses(header, IPMaskPrefix{})
+			}
+		}
+
+		if !d.byFlow {
+			if err := d.draw(job.Class, fmt.Sprintf("%s_%06d", stem, n), row); err != nil {
+				return err
+			}
+			continue
+		}
+		key, ok := flowKeyOf(packet)
+		if !ok {
+			continue
+		}
+		id, seen := flows[key]
+		if !seen {
+			id = len(buffers)
+			flows[key] = id
+			buffers = append(buffers, make([]byte, 0, size))
+		}
+		if buffers[id] == nil {
+			continue
+		}
+		buffers[id] = append(buffers[id], row[:min(len(row), size-len(buffers[id]))]...)
+		if len(buffers[id]) == size {
+			if err := d.draw(job.Class, fmt.Sprintf("%s_flow%06d", stem, id), buffers[id]); err != nil {
+				return err
+			}
+			buffers[id] = nil
+		}
+	}
+
+	if skipped > 0 {
+		slog.Warn("skipped packets that cannot be drawn", "file", job.FilePath, "packets", skipped, "error", skipErr)
+	}
+
+	// Flows shorter than an image are drawn zero-padded, in order of their first packet
+	for id, buffer := range buffers {
+		if buffer == nil || len(d.drawn[job.Class]) >= d.limit {
+			continue
+		}
+		if err := d.draw(job.Class, fmt.Sprintf("%s_flow%06d", stem, id), buffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// draw writes the bytes of a packet or flow as <class>/<name>.png, one byte
+// per pixel in row-major order, truncated or zero-padded to the image size.
+func (d *imageDrawer) draw(class, name string, data []byte) error {
+	img := image.NewGray(image.Rect(0, 0, d.width, d.height))
+	copy(img.Pix, data)
+	if err := writePNG(filepath.Join(d.classDir(class), name+".png"), img); err != nil {
+		return err
+	}
+	d.drawn[class] = append(d.drawn[class], img)
+	return nil
+}
+
+// writeGrid writes all images of a class side by side as <class>.png (grid.png
+// for unlabeled input) in a near-square grid with white gaps.
+func (d *imageDrawer) writeGrid(class string) error {
+	images := d.drawn[class]
+	if len(images) == 0 {
+		slog.Warn("no packets to draw", "class", class)
+		return nil
+	}
+	cols := int(math.Ceil(math.Sqrt(float64(len(images)))))
+	rows := (len(images) + cols - 1) / cols
+	grid := image.NewGray(image.Rect(0, 0,
+		cols*(d.width+imageGridGap)-imageGridGap,
+		rows*(d.height+imageGridGap)-imageGridGap))
+	for i := range grid.Pix {
+		grid.Pix[i] = 255
+	}
+	for i, img := range images {
+		x0 := (i % cols) * (d.width + imageGridGap)
+		y0 := (i / cols) * (d.height + imageGridGap)
+		for y := 0; y < d.height; y++ {
+			copy(grid.Pix[(y0+y)*grid.Stride+x0:], img.Pix[y*img.Stride:y*img.Stride+d.width])
+		}
+	}
+	name := class
+	if name == "" {
+		name = "grid"
+	}
+	return writePNG(filepath.Join(d.outputDir, name+".png"), grid)
+}
+
+// writePNG encodes img to filename.
+func writePNG(filename string, img image.Image) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+)
+
+// imbalanceWarningRatio is the ratio of the largest to the smallest class at
+// which a run warns about class imbalance.
+const imbalanceWarningRatio = 100
+
+// imbalanceTargetRatio is the largest-to-smallest ratio the suggested class
+// weights bring a dataset to.
+const imbalanceTargetRatio = 10
+
+// ClassCounter counts the rows written per class, for the imbalance warning at
+// the end of a run. It is safe for concurrent use by workers.
+type ClassCounter struct {
+	counts map[string]int64
+	mutex  sync.Mutex
+}
+
+// NewClassCounter creates an empty counter.
+func NewClassCounter() *ClassCounter {
+	return &ClassCounter{counts: make(map[string]int64)}
+}
+
+// add counts finished rows.
+func (c *ClassCounter) add(rows []PacketResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, row := range rows {
+		c.counts[row.Class]++
+	}
+}
+
+// addCounts adds rows counted per class elsewhere, e.g. those of an output
+// reused from --cache-dir.
+func (c *ClassCounter) addCounts(counts map[string]int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for class, n := range counts {
+		c.counts[class] += n
+	}
+}
+
+// classImbalance returns the largest and smallest of the labeled classes in
+// counts and the ratio between them. Unlabeled and empty classes are left out;
+// ok is false with fewer than two classes.
+func classImbalance(counts map[string]int64) (largest, smallest string, ratio float64, ok bool) {
+	for class, n := range counts {
+		if class == "" || n == 0 {
+			continue
+		}
+		if largest == "" || n > counts[largest] || (n == counts[largest] && class < largest) {
+			largest = class
+		}
+		if smallest == "" || n < counts[smallest] || (n == counts[smallest] && class < smallest) {
+			smallest = class
+		}
+	}
+	if largest == "" || largest == smallest {
+		return "", "", 0, false
+	}
+	return largest, smallest, float64(counts[largest]) / float64(counts[smallest]), true
+}
+
+// warnInputImbalance warns right after discovery when the capture bytes of the
+// classes are severely imbalanced, before hours are spent on the dataset.
+func warnInputImbalance(fileJobs []FileJob) {
+	bytes := make(map[string]int64)
+	for _, job := range fileJobs {
+		if size, err := inputSize(job); err == nil {
+			bytes[job.Class] += size
+		}
+	}
+	largest, smallest, ratio, ok := classImbalance(bytes)
+	if !ok || ratio < imbalanceWarningRatio {
+		return
+	}
+	slog.Warn("severe class imbalance in the input files: the rows will be similarly skewed",
+		"largest", largest, "largest_mb", float64(bytes[largest])/(1024*1024),
+		"smallest", smallest, "smallest_mb", float64(bytes[smallest])/(1024*1024),
+		"ratio", fmt.Sprintf("%.0f:1", ratio))
+}
+
+// checkClassImbalance warns when the rows written per class are severely
+// imbalanced, suggests --max-per-class values, and writes to filename the
+// --class-weights that bring the classes to at most imbalanceTargetRatio:1. Weights of the current run are
+// folded in, so the file applies to the same inputs.
+func (c *ClassCounter) checkClassImbalance(current ClassWeights, filename string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	largest, smallest, ratio, ok := classImbalance(c.counts)
+	if !ok || ratio < imbalanceWarningRatio {
+		return
+	}
+	slog.Warn("severe class imbalance: a model can score well on this data by ignoring the small classes",
+		"largest", largest, "largest_rows", c.counts[largest],
+		"smallest", smallest, "smallest_rows", c.counts[smallest],
+		"ratio", fmt.Sprintf("%.0f:1", ratio))
+
+	limit := float64(imbalanceTargetRatio * c.counts[smallest])
+	suggested := make(ClassWeights)
+	for class, n := range c.counts {
+		if class == "" || float64(n) <= limit {
+			continue
+		}
+		weight := limit / float64(n)
+		if w, ok := current[class]; ok {
+			weight *= w
+		}
+		// Four significant digits are plenty for a keep probability
+		scale := math.Pow(10, 3-math.Floor(math.Log10(weight)))
+		suggested[class] = math.Round(weight*scale) / scale
+	}
+
+	data, err := json.MarshalIndent(suggested, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filename, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		slog.Warn("failed to write suggested class weights", "error", err)
+		return
+	}
+	// --max-per-class stops reading a class at its quota, so it is the cheaper rerun
+	compact, _ := json.Marshal(suggested)
+	slog.Warn(fmt.Sprintf("to cap the classes at %d:1, rerun with --max-per-class %d (--max-per-class %d for balanced classes), or with --class-weights %s to sample across each class's packets",
+		imbalanceTargetRatio, imbalanceTargetRatio*c.counts[smallest], c.counts[smallest], filename),
+		"weights", string(compact))
+}
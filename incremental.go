@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// datasetState is the .gobyte-state file of an --incremental output. It lists
+// the input files already in the output and the shards holding their rows, so
+// later runs only process new captures.
+type datasetState struct {
+	Format   string          `json:"format"`
+	Length   int             `json:"length"`
+	Features []string        `json:"features,omitempty"`
+	Classes  map[string]byte `json:"classes,omitempty"` // Label IDs, kept stable across shards
+	Shards   []string        `json:"shards"`            // Output files; the first is --output
+	Files    []stateFile     `json:"files"`
+}
+
+// stateFile identifies a processed input file. Size and mtime are checked
+// first; the hash decides when they changed (e.g. after a copy).
+type stateFile struct {
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	MTime  time.Time `json:"mtime"`
+	SHA256 string    `json:"sha256"`
+}
+
+// statePath returns the state file next to an output, e.g.
+// output/dataset.parquet -> output/dataset.gobyte-state.
+func statePath(outputFile string) string {
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".gobyte-state"
+}
+
+// shardPath returns the output file of the nth shard (0 = --output itself).
+func shardPath(outputFile string, n int) string {
+	if n == 0 {
+		return outputFile
+	}
+	return splitOutputPath(outputFile, strconv.Itoa(n))
+}
+
+// incrementalRun is the plan of an --incremental run.
+type incrementalRun struct {
+	Jobs     []FileJob       // New input files (all files on a rebuild)
+	Output   string          // File this run writes
+	ClassIDs map[string]byte // Label IDs of old and new classes
+	Rebuild  bool            // Existing shards are replaced
+
+	statePath string
+	state     datasetState
+	hashes    map[string]stateFile // Identity of the files in Jobs
+}
+
+// planIncremental compares the input files with the state of outputFile. New
+// files are appended as a new shard. A changed or deleted file, or different
+// output settings, rebuilds the output from all files, since rows cannot be
+// removed from the existing shards.
+func planIncremental(outputFile, format string, fileJobs []FileJob, opts ProcessOptions) (*incrementalRun, error) {
+	run := &incrementalRun{
+		statePath: statePath(outputFile),
+		hashes:    make(map[string]stateFile),
+	}
+	current := datasetState{Format: format, Length: opts.OutputLength, Features: opts.FeatureNames()}
+
+	data, err := os.ReadFile(run.statePath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		run.Rebuild = true
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &run.state); err != nil {
+			return nil, fmt.Errorf("%s: %w", run.statePath, err)
+		}
+		if run.state.Format != current.Format || run.state.Length != current.Length || !slices.Equal(run.state.Features, current.Features) {
+			slog.Warn("output settings changed since the last run, rebuilding", "state", run.statePath)
+			run.Rebuild = true
+		}
+	}
+
+	known := make(map[string]stateFile, len(run.state.Files))
+	for _, f := range run.state.Files {
+		known[f.Path] = f
+	}
+	present := make(map[string]bool, len(fileJobs))
+	var newJobs []FileJob
+	for _, job := range fileJobs {
+		present[job.FilePath] = true
+		f, err := identifyFile(job.FilePath, known[job.FilePath])
+		if err != nil {
+			return nil, err
+		}
+		old, ok := known[job.FilePath]
+		switch {
+		case !ok:
+			newJobs = append(newJobs, job)
+		case f.SHA256 != old.SHA256:
+			slog.Warn("input file changed since the last run, rebuilding", "file", job.FilePath)
+			run.Rebuild = true
+		}
+		run.hashes[job.FilePath] = f
+	}
+	for path := range known {
+		if !present[path] {
+			slog.Warn("input file removed since the last run, rebuilding", "file", path)
+			run.Rebuild = true
+		}
+	}
+
+	classIDs := opts.classIDs(fileJobs)
+	if run.Rebuild {
+		for _, shard := range run.state.Shards {
+			removeOutput(run.state.Format, shard)
+		}
+		run.state = current
+		run.Jobs = fileJobs
+		run.Output = outputFile
+		run.ClassIDs = classIDs
+		return run, nil
+	}
+
+	// Files whose mtime changed but not their content keep their new identity
+	for i, f := range run.state.Files {
+		run.state.Files[i] = run.hashes[f.Path]
+	}
+	run.Jobs = newJobs
+	run.Output = shardPath(outputFile, len(run.state.Shards))
+	run.ClassIDs = mergeClassIDs(run.state.Classes, classIDs)
+	return run, nil
+}
+
+// identifyFile returns the size, mtime and hash of an input file. The hash of
+// known is reused when size and mtime are unchanged.
+func identifyFile(path string, known stateFile) (stateFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return stateFile{}, err
+	}
+	f := stateFile{Path: path, Size: info.Size(), MTime: info.ModTime().UTC()}
+	if known.SHA256 != "" && known.Size == f.Size && known.MTime.Equal(f.MTime) {
+		f.SHA256 = known.SHA256
+		return f, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return stateFile{}, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return stateFile{}, fmt.Errorf("%s: %w", path, err)
+	}
+	f.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return f, nil
+}
+
+// discard removes the shard of a run whose files are not recorded, such as an
+// interrupted one, so its rows do not stay next to those of the run that
+// processes the files again. After a rebuild, which removed the old shards,
+// the state is removed as well, so the next run rebuilds.
+func (r *incrementalRun) discard() {
+	removeOutput(r.state.Format, r.Output)
+	if r.Rebuild {
+		os.Remove(r.statePath)
+	}
+}
+
+// mergeClassIDs keeps the label IDs of earlier shards and numbers classes first
+// seen in this run after them, in sorted order.
+func mergeClassIDs(old, current map[string]byte) map[string]byte {
+	if len(old) == 0 {
+		return current
+	}
+	ids := make(map[string]byte, len(old)+len(current))
+	next := 0
+	for class, id := range old {
+		ids[class] = id
+		next = max(next, int(id)+1)
+	}
+	var added []string
+	for class := range current {
+		if _, ok := ids[class]; !ok {
+			added = append(added, class)
+		}
+	}
+	sort.Strings(added)
+	for _, class := range added {
+		ids[class] = byte(next)
+		next++
+	}
+	return ids
+}
+
+// save records the completed files of this run and its shard in the state file.
+// Files that were not processed are left out, so the next run processes them.
+// A file cut short after writing rows would be processed again too, with its
+// rows in the dataset twice, so the shard is dropped instead. Without new
+// files it only updates the identity of touched files.
+func (r *incrementalRun) save(manifest *RunManifest) error {
+	manifest.mutex.Lock()
+	// A file split by interface is complete once all its interfaces are
+	complete := make(map[string]bool, len(manifest.Files))
+	cutShort := ""
+	for _, f := range manifest.Files {
+		if done, ok := complete[f.Path]; !ok || done {
+			complete[f.Path] = f.Complete
+		}
+		if !f.Complete && f.Packets > 0 {
+			cutShort = f.Path
+		}
+	}
+	manifest.mutex.Unlock()
+	if cutShort != "" {
+		slog.Warn("a file was cut short, dropping this run's shard so the next run processes its files again", "file", cutShort, "shard", r.Output)
+		r.discard()
+		return nil
+	}
+
+	state := r.state
+	state.Classes = r.ClassIDs
+	if len(r.Jobs) > 0 {
+		state.Shards = append(slices.Clone(state.Shards), r.Output)
+	}
+	saved := make(map[string]bool, len(r.Jobs))
+	for _, job := range r.Jobs {
+		if complete[job.FilePath] && !saved[job.FilePath] {
+			state.Files = append(state.Files, r.hashes[job.FilePath])
+			saved[job.FilePath] = true
+		}
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.statePath, append(data, '\n'), 0644)
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/parquet-go/parquet-go"
+)
+
+// inspectRow is one row shown by `gobyte inspect`: its bytes and the other
+// columns (features, --with-columns, class) in file order.
+type inspectRow struct {
+	number  int
+	data    []byte
+	columns [][2]string // Name and value
+	class   string
+	first   gopacket.LayerType // Layer the data starts with (0 = guess from the bytes)
+}
+
+// column returns the value of a named column, or "" if the row has none.
+func (r inspectRow) column(name string) string {
+	for _, c := range r.columns {
+		if c[0] == name {
+			return c[1]
+		}
+	}
+	return ""
+}
+
+// runInspect is the `gobyte inspect` subcommand: it prints sample rows of
+// output files (Parquet, CSV) or packets of captures as annotated hexdumps, to
+// check masking, truncation and padding without loading the output in Python.
+func runInspect(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	rows := flags.Int("rows", 5, "Number of rows (or packets) to show per file")
+	skip := flags.Int("skip", 0, "Rows (or packets) to skip first")
+	byteRepr := flags.String("byte-repr", ByteReprDec, "How the CSV file renders byte cells: dec, hex or float (as written with --byte-repr)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s inspect [--rows 5] [--skip 0] output.parquet|output.csv|capture.pcap...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints rows of GoByte outputs or packets of captures as annotated hexdumps.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+
+	if flags.NArg() == 0 || *rows <= 0 || *skip < 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	switch *byteRepr {
+	case ByteReprDec, ByteReprHex, ByteReprFloat:
+	default:
+		fatal("invalid --byte-repr (use dec, hex or float)", "byte_repr", *byteRepr)
+	}
+
+	for _, name := range flags.Args() {
+		var sample []inspectRow
+		var err error
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".parquet":
+			sample, err = inspectParquet(name, *skip, *rows)
+		case ".csv":
+			sample, err = inspectCSV(name, *skip, *rows, *byteRepr)
+		default:
+			sample, err = inspectCapture(name, *skip, *rows)
+		}
+		if err != nil {
+			fatal("failed to inspect file", "file", name, "error", err)
+		}
+		noun := "rows"
+		if len(sample) == 1 {
+			noun = "row"
+		}
+		fmt.Printf("==> %s (%d %s from row %d)\n", name, len(sample), noun, *skip)
+		for _, row := range sample {
+			printInspectRow(os.Stdout, row)
+		}
+	}
+}
+
+// inspectParquet reads rows of a Parquet output: the Byte_N columns of batch
+// outputs or the data column of streaming outputs, and all other columns.
+func inspectParquet(filename string, skip, n int) ([]inspectRow, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	pf, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	reader := parquet.NewReader(pf)
+	defer reader.Close()
+	columns := pf.Schema().Columns()
+	if err := reader.SeekToRow(int64(skip)); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]parquet.Row, n)
+	count, err := reader.ReadRows(buffer)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	sample := make([]inspectRow, count)
+	for i, values := range buffer[:count] {
+		sample[i] = parquetInspectRow(skip+i, values, columns)
+	}
+	return sample, nil
+}
+
+// parquetInspectRow converts a row of a Parquet output, whose leaf columns
+// have the paths columns.
+func parquetInspectRow(number int, values parquet.Row, columns [][]string) inspectRow {
+	row := inspectRow{number: number}
+	for _, v := range values {
+		name := strings.Join(columns[v.Column()], ".")
+		switch {
+		case name == "data" || name == "packets.list.element.bytes":
+			row.data = append(row.data, v.ByteArray()...)
+		case strings.HasPrefix(name, "Byte_") || name == "data.list.element":
+			row.data = append(row.data, byte(v.Int32()))
+		case name == "class" || name == "Class":
+			row.class = string(v.ByteArray())
+		case v.IsNull():
+			row.columns = append(row.columns, [2]string{name, ""})
+		case v.Kind() == parquet.ByteArray:
+			row.columns = append(row.columns, [2]string{name, string(v.ByteArray())})
+		default:
+			row.columns = append(row.columns, [2]string{name, v.String()})
+		}
+	}
+	return row
+}
+
+// inspectCSV reads rows of a CSV output, whose Byte_N cells are rendered as
+// byteRepr.
+func inspectCSV(filename string, skip, n int, byteRepr string) ([]inspectRow, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	var sample []inspectRow
+	for number := 0; len(sample) < n; number++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if number < skip {
+			continue
+		}
+		row, err := csvInspectRow(number, header, record, byteRepr)
+		if err != nil {
+			return nil, err
+		}
+		sample = append(sample, row)
+	}
+	return sample, nil
+}
+
+// csvInspectRow converts a record of a CSV output with this header. Rows of
+// --length 0 outputs keep their own width, so the columns after the Byte_N
+// cells are matched from the end of the record.
+func csvInspectRow(number int, header, record []string, byteRepr string) (inspectRow, error) {
+	row := inspectRow{number: number}
+	trailing := 0 // Columns after the last Byte_N one
+	for trailing < len(header) && !strings.HasPrefix(header[len(header)-1-trailing], "Byte_") {
+		trailing++
+	}
+	for i, cell := range record {
+		var name string
+		switch {
+		case i >= len(record)-trailing:
+			name = header[len(header)-(len(record)-i)]
+		case i < len(header):
+			name = header[i]
+		default:
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name, "Byte_"):
+			if cell == "" {
+				continue
+			}
+			b, err := parseByteCell(cell, byteRepr)
+			if err != nil {
+				return row, fmt.Errorf("row %d, %s: %w", number, name, err)
+			}
+			row.data = append(row.data, b)
+		case name == "Class":
+			row.class = cell
+		default:
+			row.columns = append(row.columns, [2]string{name, cell})
+		}
+	}
+	return row, nil
+}
+
+// parseByteCell parses a CSV byte cell written with --byte-repr byteRepr.
+func parseByteCell(cell, byteRepr string) (byte, error) {
+	switch byteRepr {
+	case ByteReprHex:
+		v, err := strconv.ParseUint(cell, 16, 8)
+		return byte(v), err
+	case ByteReprFloat:
+		v, err := strconv.ParseFloat(cell, 64)
+		if err != nil || v < 0 || v > 1 {
+			return 0, fmt.Errorf("invalid float byte %q", cell)
+		}
+		return byte(v*255 + 0.5), nil
+	}
+	v, err := strconv.ParseUint(cell, 10, 8)
+	return byte(v), err
+}
+
+// inspectCapture reads packets of a PCAP/PCAPNG file as they were captured.
+func inspectCapture(filename string, skip, n int) ([]inspectRow, error) {
+	handle, err := openCapture(filename, ProcessOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	var sample []inspectRow
+	for number := 0; len(sample) < n; number++ {
+		data, ci, err := handle.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return sample, fmt.Errorf("after %d packets: %w", number, err)
+		}
+		if number < skip {
+			continue
+		}
+		sample = append(sample, inspectRow{
+			number: number,
+			data:   append([]byte(nil), data...),
+			columns: [][2]string{
+				{"timestamp", ci.Timestamp.UTC().Format("2006-01-02T15:04:05.000000000Z")},
+				{"caplen", strconv.Itoa(ci.CaptureLength)},
+				{"len", strconv.Itoa(ci.Length)},
+			},
+			first: handle.LinkType().LayerType(),
+		})
+	}
+	return sample, nil
+}
+
+// printInspectRow prints a row's class and columns, a hexdump of its bytes and
+// the layers decoded from them with their byte ranges.
+func printInspectRow(w io.Writer, row inspectRow) {
+	fmt.Fprintf(w, "\n-- row %d", row.number)
+	if row.class != "" {
+		fmt.Fprintf(w, "  class=%s", row.class)
+	}
+	for _, c := range row.columns {
+		fmt.Fprintf(w, "  %s=%s", c[0], c[1])
+	}
+	fmt.Fprintf(w, "  (%d bytes)\n", len(row.data))
+
+	for offset := 0; offset < len(row.data); offset += 16 {
+		line := row.data[offset:min(offset+16, len(row.data))]
+		var hex, ascii strings.Builder
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				hex.WriteByte(' ')
+			}
+			if i >= len(line) {
+				hex.WriteString("   ")
+				continue
+			}
+			fmt.Fprintf(&hex, "%02x ", line[i])
+			if line[i] >= 0x20 && line[i] < 0x7f {
+				ascii.WriteByte(line[i])
+			} else {
+				ascii.WriteByte('.')
+			}
+		}
+		fmt.Fprintf(w, "%04x  %s |%s|\n", offset, hex.String(), ascii.String())
+	}
+
+	for _, note := range annotateRow(row) {
+		fmt.Fprintf(w, "  %s\n", note)
+	}
+}
+
+// annotateRow describes the layers of a row with their byte ranges, and its
+// padding or truncation when the orig_size column is present.
+func annotateRow(row inspectRow) []string {
+	first := row.first
+	if first == 0 {
+		first = guessFirstLayer(row.data)
+	}
+	if first == 0 {
+		return []string{"no IP header at the start (an --extract l7 row, a non-IP packet or a fully masked row)"}
+	}
+
+	size := len(row.data)
+	orig, origErr := strconv.Atoi(row.column(ColumnOrigSize))
+	if origErr == nil && orig < size {
+		size = orig
+	}
+	packet := gopacket.NewPacket(row.data[:size], first, gopacket.Default)
+	var notes []string
+	offset := 0
+	for _, layer := range packet.Layers() {
+		if failure, ok := layer.(*gopacket.DecodeFailure); ok {
+			// A header cut by --length fails to decode, at worst with a
+			// recovered decoder panic (Dump holds its stack)
+			if packet.Metadata().Truncated || failure.Dump() != "" || (origErr == nil && orig > len(row.data)) {
+				notes = append(notes, fmt.Sprintf("[%4d-%4d] truncated: the row ends inside this header", offset, size-1))
+			} else {
+				notes = append(notes, fmt.Sprintf("[%4d-%4d] undecodable: %v", offset, size-1, failure.Error()))
+			}
+			break
+		}
+		n := len(layer.LayerContents())
+		if _, ok := layer.(*gopacket.Payload); ok {
+			n = len(layer.LayerPayload())
+		}
+		if n == 0 {
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("[%4d-%4d] %s", offset, offset+n-1, describeLayer(layer)))
+		offset += n
+	}
+
+	if origErr == nil {
+		switch {
+		case orig < len(row.data):
+			notes = append(notes, fmt.Sprintf("[%4d-%4d] padding (orig_size %d)", orig, len(row.data)-1, orig))
+		case orig > len(row.data):
+			notes = append(notes, fmt.Sprintf("truncated: %d of %d bytes kept", len(row.data), orig))
+		}
+	}
+	return notes
+}
+
+// guessFirstLayer returns the layer an output row starts with: an IP header
+// (the default), an Ethernet header (--include-l2), or 0 if it is neither.
+func guessFirstLayer(data []byte) gopacket.LayerType {
+	if len(data) >= 20 && data[0]>>4 == 4 && data[0]&0x0F >= 5 {
+		return layers.LayerTypeIPv4
+	}
+	if len(data) >= 40 && data[0]>>4 == 6 {
+		return layers.LayerTypeIPv6
+	}
+	if len(data) >= 14 {
+		switch layers.EthernetType(uint16(data[12])<<8 | uint16(data[13])) {
+		case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6, layers.EthernetTypeDot1Q, layers.EthernetTypeQinQ, layers.EthernetTypeARP, layers.EthernetTypePPPoESession:
+			return layers.LayerTypeEthernet
+		}
+	}
+	return 0
+}
+
+// describeLayer summarizes the fields of a layer that masking, normalization
+// and anonymization change.
+func describeLayer(layer gopacket.Layer) string {
+	switch l := layer.(type) {
+	case *layers.Ethernet:
+		return fmt.Sprintf("Ethernet  %s -> %s  type=%s", net.HardwareAddr(l.SrcMAC), net.HardwareAddr(l.DstMAC), l.EthernetType)
+	case *layers.Dot1Q:
+		return fmt.Sprintf("VLAN  id=%d  type=%s", l.VLANIdentifier, l.Type)
+	case *layers.PPPoE:
+		return fmt.Sprintf("PPPoE  session=0x%04x  len=%d", l.SessionId, l.Length)
+	case *layers.PPP:
+		return fmt.Sprintf("PPP  type=%s", l.PPPType)
+	case *layers.IPv4:
+		return fmt.Sprintf("IPv4  %s -> %s  ttl=%d  id=%d  proto=%s  len=%d  checksum=0x%04x", l.SrcIP, l.DstIP, l.TTL, l.Id, l.Protocol, l.Length, l.Checksum)
+	case *layers.IPv6:
+		return fmt.Sprintf("IPv6  %s -> %s  hop_limit=%d  next=%s  payload_len=%d", l.SrcIP, l.DstIP, l.HopLimit, l.NextHeader, l.Length)
+	case *layers.TCP:
+		return fmt.Sprintf("TCP  %d -> %d  flags=%s  seq=%d  win=%d  checksum=0x%04x", l.SrcPort, l.DstPort, tcpFlagString(l), l.Seq, l.Window, l.Checksum)
+	case *layers.UDP:
+		return fmt.Sprintf("UDP  %d -> %d  len=%d  checksum=0x%04x", l.SrcPort, l.DstPort, l.Length, l.Checksum)
+	case *layers.ICMPv4:
+		return fmt.Sprintf("ICMPv4  %s", l.TypeCode)
+	case *layers.ICMPv6:
+		return fmt.Sprintf("ICMPv6  %s", l.TypeCode)
+	case *gopacket.Payload:
+		zero := true
+		for _, b := range l.LayerPayload() {
+			zero = zero && b == 0
+		}
+		if zero {
+			return "payload (all zero)"
+		}
+		return "payload"
+	}
+	return layer.LayerType().String()
+}
+
+// tcpFlagString lists the flags set in a TCP header, e.g. SYN,ACK.
+func tcpFlagString(tcp *layers.TCP) string {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{tcp.FIN, "FIN"}, {tcp.SYN, "SYN"}, {tcp.RST, "RST"}, {tcp.PSH, "PSH"},
+		{tcp.ACK, "ACK"}, {tcp.URG, "URG"}, {tcp.ECE, "ECE"}, {tcp.CWR, "CWR"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	if len(flags) == 0 {
+		return "none"
+	}
+	return strings.Join(flags, ",")
+}
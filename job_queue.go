@@ -0,0 +1,876 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Timings of gobyte queue: how long a poll of the broker blocks, and the
+// waits before reconnecting to a broker that went away, doubled up to the
+// maximum.
+const (
+	queuePoll         = 5 * time.Second
+	queueDialTimeout  = 10 * time.Second
+	queueRetryDelay   = time.Second
+	queueMaxRetryWait = 30 * time.Second
+)
+
+// queueForbiddenFlags are flags that jobs must not set: they belong to the
+// service or to runs started by other subcommands.
+var queueForbiddenFlags = []string{"run-report", "coordinator", "worker-task", "web", "tui"}
+
+// queueJob is a conversion job read from the broker: the inputs and output
+// of a run and its options as command-line arguments, which follow the
+// service's own.
+type queueJob struct {
+	ID      string   `json:"id"`
+	Input   string   `json:"input,omitempty"`   // As --input
+	Dataset []string `json:"dataset,omitempty"` // As --dataset, repeatable
+	Output  string   `json:"output,omitempty"`  // As --output
+	Args    []string `json:"args,omitempty"`
+}
+
+// queueEvent is published when a job ends: how its run ended and, if the
+// run got far enough to write one, its run report.
+type queueEvent struct {
+	ID              string     `json:"id"`
+	Status          string     `json:"status"` // "ok", "failed" or "interrupted", as in run_report.json
+	Worker          string     `json:"worker"`
+	Output          string     `json:"output,omitempty"`
+	Rows            int        `json:"rows"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      time.Time  `json:"finished_at"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Error           string     `json:"error,omitempty"`
+	Report          *RunReport `json:"report,omitempty"`
+}
+
+// queueMessage is a job as the broker delivered it.
+type queueMessage struct {
+	data  []byte
+	reply string // NATS reply subject of a request, which gets the event too
+}
+
+// jobQueue is a connection to a broker that jobs are read from and events
+// published to.
+type jobQueue interface {
+	// next waits for the next job, returning nil once ctx ends.
+	next(ctx context.Context) (*queueMessage, error)
+	// finish publishes the event of a job and removes the job from the broker.
+	finish(msg *queueMessage, event []byte) error
+	// pending returns the jobs delivered but not handed out by next, when the
+	// service stops.
+	pending() []*queueMessage
+	Close() error
+}
+
+// queueConfig is where gobyte queue finds its broker.
+type queueConfig struct {
+	broker *url.URL
+	jobs   string // Redis list or NATS subject of the jobs
+	events string // Redis list or NATS subject of the events
+	group  string // NATS queue group
+	name   string // Name of this service, in the events and the broker
+}
+
+// dialQueue connects to the broker of cfg.
+func dialQueue(cfg queueConfig) (jobQueue, error) {
+	switch cfg.broker.Scheme {
+	case "redis", "rediss":
+		return dialRedisQueue(cfg)
+	case "nats", "tls":
+		return dialNATSQueue(cfg)
+	}
+	return nil, fmt.Errorf("unsupported broker %q: use redis://, rediss:// or nats://", cfg.broker.Scheme)
+}
+
+// dialBroker opens a TCP connection to the broker, with TLS if useTLS.
+func dialBroker(u *url.URL, defaultPort string, useTLS bool) (net.Conn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	dialer := &net.Dialer{Timeout: queueDialTimeout, KeepAlive: 30 * time.Second}
+	if useTLS {
+		return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: u.Hostname()})
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// runQueue is the queue subcommand: a long-lived service that converts the
+// jobs of a Redis list or NATS subject, one run of gobyte per job, and
+// publishes an event when each ends.
+func runQueue(args []string) {
+	flags := flag.NewFlagSet("queue", flag.ExitOnError)
+	broker := flags.String("broker", "", "Broker URL: redis://[user:password@]host:6379[/db] (rediss:// for TLS) or nats://[user:password@ or token@]host:4222 (tls:// for TLS)")
+	jobs := flags.String("jobs", "gobyte.jobs", "Redis list or NATS subject that jobs are read from")
+	events := flags.String("events", "gobyte.events", "Redis list or NATS subject that an event is published to when a job ends")
+	group := flags.String("group", "gobyte", "NATS queue group, so each job goes to one of the services subscribed with it")
+	hostname, _ := os.Hostname()
+	name := flags.String("name", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "Name of this service in events and in the Redis list of its running jobs")
+	concurrent := flags.Int("concurrent", 1, "Jobs converted at once; each conversion uses every CPU, so more only helps with small inputs")
+	workDir := flags.String("work-dir", os.TempDir(), "Directory for the run reports of the jobs, removed after each job")
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s queue --broker URL [options] [-- gobyte options for every job]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Converts the JSON jobs of a Redis list or NATS subject, e.g.\n")
+		fmt.Fprintf(os.Stderr, "  {\"id\": \"42\", \"input\": \"/data/a.pcap\", \"output\": \"/data/a.parquet\", \"args\": [\"--length\", \"1500\"]}\n")
+		fmt.Fprintf(os.Stderr, "and publishes an event with the run report of each when it ends.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if err := setupLogger(*logLevel, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if *broker == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	brokerURL, err := url.Parse(*broker)
+	if err != nil || brokerURL.Host == "" {
+		fatal("invalid --broker", "broker", *broker, "error", err)
+	}
+	if *concurrent < 1 {
+		fatal("--concurrent must be at least 1", "concurrent", *concurrent)
+	}
+	if *jobs == "" || *events == "" || *jobs == *events {
+		fatal("--jobs and --events must be different, non-empty names", "jobs", *jobs, "events", *events)
+	}
+	baseArgs := flags.Args()
+	if err := checkJobArgs(baseArgs); err != nil {
+		fatal("invalid gobyte options after --", "error", err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		fatal("failed to find the gobyte executable", "error", err)
+	}
+
+	cfg := queueConfig{broker: brokerURL, jobs: *jobs, events: *events, group: *group, name: *name}
+	queue, err := dialQueue(cfg)
+	if err != nil {
+		fatal("failed to connect to the broker", "broker", redactBroker(brokerURL), "error", err)
+	}
+
+	// Ctrl-C stops taking jobs and lets the running ones finish and report
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &queueService{
+		cfg:        cfg,
+		queue:      queue,
+		baseArgs:   baseArgs,
+		executable: executable,
+		workDir:    *workDir,
+	}
+	slog.Info("waiting for jobs", "broker", redactBroker(brokerURL), "jobs", *jobs, "events", *events, "service", *name, "concurrent", *concurrent)
+	s.serve(ctx, *concurrent)
+	slog.Info("queue service stopped", "jobs", s.converted())
+}
+
+// redactBroker returns the broker URL without its credentials, for logs; a
+// NATS token is in the user name.
+func redactBroker(u *url.URL) string {
+	redacted := *u
+	if redacted.User != nil {
+		redacted.User = url.User("xxxxx")
+	}
+	return redacted.String()
+}
+
+// checkJobArgs rejects the flags of queueForbiddenFlags in the options of a
+// job or of the service.
+func checkJobArgs(args []string) error {
+	for _, arg := range args {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && slices.Contains(queueForbiddenFlags, name) {
+			return fmt.Errorf("--%s cannot be set for a job", name)
+		}
+	}
+	return nil
+}
+
+// queueService hands the jobs of the broker to runs of gobyte.
+type queueService struct {
+	cfg        queueConfig
+	baseArgs   []string // Options after -- on the service's command line
+	executable string
+	workDir    string
+
+	mutex sync.Mutex
+	queue jobQueue // Replaced when the broker connection is lost
+	jobs  int
+}
+
+// converted returns how many jobs the service ran.
+func (s *queueService) converted() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.jobs
+}
+
+// current returns the connection to the broker.
+func (s *queueService) current() jobQueue {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queue
+}
+
+// serve takes jobs while fewer than concurrent run, until ctx ends, then
+// waits for the running ones.
+func (s *queueService) serve(ctx context.Context, concurrent int) {
+	slots := make(chan struct{}, concurrent)
+	var wg sync.WaitGroup
+	for ctx.Err() == nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		msg, err := s.current().next(ctx)
+		if err != nil {
+			<-slots
+			s.reconnect(ctx, err)
+			continue
+		}
+		if msg == nil {
+			<-slots
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			s.handle(msg)
+		}()
+	}
+
+	queue := s.current()
+	for _, msg := range queue.pending() {
+		event := queueEvent{Status: "failed", Worker: s.cfg.name, StartedAt: time.Now(), FinishedAt: time.Now(),
+			Error: "the service stopped before the job started"}
+		var job queueJob
+		if json.Unmarshal(msg.data, &job) == nil {
+			event.ID = job.ID
+		}
+		s.publish(msg, event)
+	}
+	if running := len(slots); running > 0 {
+		slog.Info("stopping after the running jobs", "running", running)
+	}
+	wg.Wait()
+	queue.Close()
+}
+
+// reconnect replaces a broker connection that failed with a new one, waiting
+// longer after each failed attempt, until it succeeds or ctx ends.
+func (s *queueService) reconnect(ctx context.Context, cause error) {
+	slog.Warn("lost the broker, reconnecting", "broker", redactBroker(s.cfg.broker), "error", cause)
+	s.current().Close()
+	wait := queueRetryDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		queue, err := dialQueue(s.cfg)
+		if err == nil {
+			s.mutex.Lock()
+			s.queue = queue
+			s.mutex.Unlock()
+			slog.Info("reconnected to the broker", "broker", redactBroker(s.cfg.broker))
+			return
+		}
+		slog.Warn("failed to reconnect to the broker", "error", err, "retry_in", wait)
+		wait = min(2*wait, queueMaxRetryWait)
+	}
+}
+
+// handle runs a job and publishes its event.
+func (s *queueService) handle(msg *queueMessage) {
+	event := s.run(msg)
+	s.publish(msg, event)
+	s.mutex.Lock()
+	s.jobs++
+	s.mutex.Unlock()
+}
+
+// publish sends the event of a job and removes the job from the broker.
+func (s *queueService) publish(msg *queueMessage, event queueEvent) {
+	data, err := json.Marshal(event)
+	if err == nil {
+		err = s.current().finish(msg, data)
+	}
+	if err != nil {
+		slog.Error("failed to publish the event of a job", "job", event.ID, "status", event.Status, "error", err)
+	}
+}
+
+// run converts the inputs of a job with a run of gobyte and returns its event.
+func (s *queueService) run(msg *queueMessage) (event queueEvent) {
+	event = queueEvent{Status: "failed", Worker: s.cfg.name, StartedAt: time.Now()}
+	defer func() {
+		event.FinishedAt = time.Now()
+		event.DurationSeconds = event.FinishedAt.Sub(event.StartedAt).Seconds()
+	}()
+
+	var job queueJob
+	decoder := json.NewDecoder(bytes.NewReader(msg.data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&job); err != nil {
+		event.Error = fmt.Sprintf("invalid job: %v", err)
+		slog.Warn("ignoring invalid job", "error", err)
+		return event
+	}
+	event.ID = job.ID
+	if err := checkJobArgs(job.Args); err != nil {
+		event.Error = err.Error()
+		slog.Warn("ignoring invalid job", "job", job.ID, "error", err)
+		return event
+	}
+
+	dir, err := os.MkdirTemp(s.workDir, "gobyte-job-*")
+	if err != nil {
+		event.Error = err.Error()
+		return event
+	}
+	defer os.RemoveAll(dir)
+	reportFile := filepath.Join(dir, runReportName)
+
+	// The service's options come first, so those of the job override them
+	args := append([]string{"--run-report", reportFile}, s.baseArgs...)
+	args = append(args, job.Args...)
+	if job.Input != "" {
+		args = append(args, "--input", job.Input)
+	}
+	for _, d := range job.Dataset {
+		args = append(args, "--dataset", d)
+	}
+	if job.Output != "" {
+		args = append(args, "--output", job.Output)
+	}
+
+	slog.Info("converting job", "job", job.ID, "input", job.Input, "dataset", strings.Join(job.Dataset, ","), "output", job.Output)
+	logs := &logEnds{}
+	cmd := exec.Command(s.executable, args...)
+	cmd.Stdout = os.Stderr // Progress logs of the job's run
+	cmd.Stderr = io.MultiWriter(os.Stderr, logs)
+	runErr := cmd.Run()
+
+	var report RunReport
+	data, err := os.ReadFile(reportFile)
+	if err == nil {
+		err = json.Unmarshal(data, &report)
+	}
+	switch {
+	case err == nil:
+		event.Report = &report
+		event.Status, event.Output, event.Rows, event.Error = report.Status, report.Output, report.Rows, report.Error
+	case runErr != nil:
+		// Failed before it had a report: an invalid flag is printed before
+		// the usage, other failures log their reason last
+		reason := logs.last()
+		if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == 2 {
+			reason = logs.first()
+		}
+		event.Error = fmt.Sprintf("%v: %s", runErr, reason)
+	default:
+		event.Error = fmt.Sprintf("no run report: %v", err)
+	}
+	if event.Status == "ok" {
+		slog.Info("job done", "job", job.ID, "rows", event.Rows, "output", event.Output, "duration", time.Since(event.StartedAt))
+	} else {
+		slog.Warn("job failed", "job", job.ID, "status", event.Status, "error", event.Error)
+	}
+	return event
+}
+
+// logEnds keeps the first and the last non-empty line written to it.
+type logEnds struct {
+	mutex      sync.Mutex
+	start, end []byte
+	unfinished []byte // Last line, without its newline yet
+}
+
+func (l *logEnds) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.unfinished = append(l.unfinished, p...)
+	for {
+		i := bytes.IndexByte(l.unfinished, '\n')
+		if i < 0 {
+			break
+		}
+		if line := bytes.TrimSpace(l.unfinished[:i]); len(line) > 0 {
+			if l.start == nil {
+				l.start = bytes.Clone(line)
+			}
+			l.end = append(l.end[:0], line...)
+		}
+		l.unfinished = l.unfinished[i+1:]
+	}
+	return len(p), nil
+}
+
+// first returns the first line.
+func (l *logEnds) first() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.start == nil {
+		return string(bytes.TrimSpace(l.unfinished))
+	}
+	return string(l.start)
+}
+
+// last returns the last line.
+func (l *logEnds) last() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if line := bytes.TrimSpace(l.unfinished); len(line) > 0 {
+		return string(line)
+	}
+	return string(l.end)
+}
+
+// --- Redis ---
+
+// redisQueue reads jobs from a Redis list and appends events to another.
+// A job is moved atomically to the service's own list of running jobs while
+// it runs, and moved back to the jobs on the next start if the service
+// died with it, so no job is lost.
+type redisQueue struct {
+	cfg     queueConfig
+	running string     // List of the jobs this service runs
+	poll    *redisConn // Blocks in BLMOVE
+	mutex   sync.Mutex
+	cmds    *redisConn // Everything else
+}
+
+// redisConn is a connection speaking RESP, the Redis protocol.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// dialRedisQueue connects to the Redis server of cfg and requeues the jobs
+// left running by an earlier service of the same name.
+func dialRedisQueue(cfg queueConfig) (*redisQueue, error) {
+	q := &redisQueue{cfg: cfg, running: cfg.jobs + ":running:" + cfg.name}
+	var err error
+	if q.poll, err = dialRedis(cfg.broker); err != nil {
+		return nil, err
+	}
+	if q.cmds, err = dialRedis(cfg.broker); err != nil {
+		q.poll.Close()
+		return nil, err
+	}
+	requeued := 0
+	for {
+		reply, err := q.cmds.do(0, "LMOVE", q.running, cfg.jobs, "RIGHT", "LEFT")
+		if err != nil {
+			q.Close()
+			return nil, err
+		}
+		if reply == nil {
+			break
+		}
+		requeued++
+	}
+	if requeued > 0 {
+		slog.Warn("requeued jobs left running by an earlier run of this service", "jobs", requeued, "list", cfg.jobs)
+	}
+	return q, nil
+}
+
+// dialRedis connects and authenticates to a Redis server and selects the
+// database of the URL's path.
+func dialRedis(u *url.URL) (*redisConn, error) {
+	conn, err := dialBroker(u, "6379", u.Scheme == "rediss")
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if u.User != nil {
+		password, hasPassword := u.User.Password()
+		var err error
+		switch {
+		case hasPassword && u.User.Username() != "":
+			_, err = c.do(0, "AUTH", u.User.Username(), password)
+		case hasPassword:
+			_, err = c.do(0, "AUTH", password)
+		default:
+			_, err = c.do(0, "AUTH", u.User.Username())
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+		if _, err := c.do(0, "SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and returns its reply: a string, an int64, nil or a
+// []any. block is how long the server may take to answer beyond the usual.
+func (c *redisConn) do(block time.Duration, args ...string) (any, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(queueDialTimeout + block))
+	if _, err := c.conn.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// reply reads one reply of the server.
+func (c *redisConn) reply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.reply(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *redisConn) Close() error { return c.conn.Close() }
+
+func (q *redisQueue) next(ctx context.Context) (*queueMessage, error) {
+	for ctx.Err() == nil {
+		reply, err := q.poll.do(queuePoll, "BLMOVE", q.cfg.jobs, q.running, "LEFT", "RIGHT", strconv.Itoa(int(queuePoll/time.Second)))
+		if err != nil {
+			return nil, err
+		}
+		if job, ok := reply.(string); ok {
+			return &queueMessage{data: []byte(job)}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (q *redisQueue) finish(msg *queueMessage, event []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, err := q.cmds.do(0, "RPUSH", q.cfg.events, string(event)); err != nil {
+		return err
+	}
+	_, err := q.cmds.do(0, "LREM", q.running, "1", string(msg.data))
+	return err
+}
+
+// pending is empty: a job is only taken from the list when a run is free.
+func (q *redisQueue) pending() []*queueMessage { return nil }
+
+func (q *redisQueue) Close() error {
+	q.poll.Close()
+	return q.cmds.Close()
+}
+
+// --- NATS ---
+
+// natsQueue subscribes to the jobs subject in a queue group and publishes
+// events to the events subject and to the reply subject of jobs sent as
+// requests. Core NATS delivers a job at most once: jobs published while no
+// service is subscribed, or delivered to a service that dies, are lost.
+type natsQueue struct {
+	cfg  queueConfig
+	conn net.Conn
+
+	writeMutex sync.Mutex
+	w          *bufio.Writer
+
+	msgs chan *queueMessage
+	pong chan struct{}
+	err  error // Why the connection ended, once msgs is closed
+}
+
+// natsInfo is the part of the server's INFO that matters here.
+type natsInfo struct {
+	TLSRequired  bool `json:"tls_required"`
+	AuthRequired bool `json:"auth_required"`
+}
+
+// natsConnect is the CONNECT message of the client.
+type natsConnect struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	Name        string `json:"name"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	Protocol    int    `json:"protocol"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+	AuthToken   string `json:"auth_token,omitempty"`
+}
+
+// natsMaxPending bounds the jobs delivered to the service but not running.
+const natsMaxPending = 64
+
+// dialNATSQueue connects to the NATS server of cfg and subscribes to the
+// jobs subject.
+func dialNATSQueue(cfg queueConfig) (*natsQueue, error) {
+	u := cfg.broker
+	conn, err := dialBroker(u, "4222", u.Scheme == "tls")
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(queueDialTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	infoJSON, ok := strings.CutPrefix(strings.TrimSpace(line), "INFO ")
+	var info natsInfo
+	if !ok || json.Unmarshal([]byte(infoJSON), &info) != nil {
+		conn.Close()
+		return nil, fmt.Errorf("not a NATS server: %q", strings.TrimSpace(line))
+	}
+	if info.TLSRequired {
+		if _, isTLS := conn.(*tls.Conn); !isTLS {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn, r = tlsConn, bufio.NewReader(tlsConn)
+		}
+	}
+
+	connect := natsConnect{Name: "gobyte-queue-" + cfg.name, Lang: "go", Version: "gobyte", Protocol: 1, TLSRequired: info.TLSRequired}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			connect.User, connect.Pass = u.User.Username(), password
+		} else {
+			connect.AuthToken = u.User.Username()
+		}
+	}
+	connectJSON, _ := json.Marshal(connect)
+	q := &natsQueue{
+		cfg:  cfg,
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+		msgs: make(chan *queueMessage, natsMaxPending),
+		pong: make(chan struct{}, 1),
+	}
+	fmt.Fprintf(q.w, "CONNECT %s\r\nPING\r\n", connectJSON)
+	if err := q.w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The server answers PING once it accepted CONNECT, or fails it first
+	line, err = r.ReadString('\n')
+	if err == nil && !strings.HasPrefix(line, "PONG") {
+		err = fmt.Errorf("server refused the connection: %s", strings.TrimSpace(line))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if err := q.send(fmt.Sprintf("SUB %s %s 1\r\n", cfg.jobs, cfg.group)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go q.read(r)
+	return q, nil
+}
+
+// send writes protocol lines to the server.
+func (q *natsQueue) send(lines string) error {
+	q.writeMutex.Lock()
+	defer q.writeMutex.Unlock()
+	q.conn.SetWriteDeadline(time.Now().Add(queueDialTimeout))
+	if _, err := q.w.WriteString(lines); err != nil {
+		return err
+	}
+	return q.w.Flush()
+}
+
+// publish sends a message to a subject.
+func (q *natsQueue) publish(subject string, data []byte) error {
+	return q.send(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(data), data))
+}
+
+// read handles what the server sends until the connection ends: jobs go to
+// msgs, pings are answered.
+func (q *natsQueue) read(r *bufio.Reader) {
+	defer close(q.msgs)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			q.err = err
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			if err := q.send("PONG\r\n"); err != nil {
+				q.err = err
+				return
+			}
+		case "PONG":
+			select {
+			case q.pong <- struct{}{}:
+			default:
+			}
+		case "-ERR":
+			slog.Warn("NATS server error", "error", strings.TrimSpace(strings.TrimPrefix(line, fields[0])))
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <size>
+			if len(fields) < 4 || len(fields) > 5 {
+				q.err = fmt.Errorf("malformed message header %q", strings.TrimSpace(line))
+				return
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				q.err = fmt.Errorf("malformed message header %q", strings.TrimSpace(line))
+				return
+			}
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				q.err = err
+				return
+			}
+			msg := &queueMessage{data: data[:size]}
+			if len(fields) == 5 {
+				msg.reply = fields[3]
+			}
+			q.msgs <- msg
+		}
+	}
+}
+
+func (q *natsQueue) next(ctx context.Context) (*queueMessage, error) {
+	select {
+	case <-ctx.Done():
+		return nil, nil
+	case msg, ok := <-q.msgs:
+		if !ok {
+			if q.err == nil {
+				q.err = io.EOF
+			}
+			return nil, q.err
+		}
+		return msg, nil
+	}
+}
+
+func (q *natsQueue) finish(msg *queueMessage, event []byte) error {
+	if err := q.publish(q.cfg.events, event); err != nil {
+		return err
+	}
+	if msg.reply != "" {
+		return q.publish(msg.reply, event)
+	}
+	return nil
+}
+
+// pending unsubscribes and returns the jobs delivered up to then.
+func (q *natsQueue) pending() []*queueMessage {
+	if q.send("UNSUB 1\r\nPING\r\n") == nil {
+		// Jobs the server sent before the UNSUB arrive before the PONG
+		select {
+		case <-q.pong:
+		case <-time.After(queueDialTimeout):
+		}
+	}
+	var msgs []*queueMessage
+	for {
+		select {
+		case msg, ok := <-q.msgs:
+			if !ok {
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func (q *natsQueue) Close() error {
+	q.writeMutex.Lock()
+	q.w.Flush()
+	q.writeMutex.Unlock()
+	return q.conn.Close()
+}
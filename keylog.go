@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Record content types of TLS.
+const (
+	tlsChangeCipherSpec = 20
+	tlsHandshake        = 22
+	tlsApplicationData  = 23
+)
+
+// tlsHelloRetryRandom is the ServerHello random of a TLS 1.3 HelloRetryRequest.
+var tlsHelloRetryRandom, _ = hex.DecodeString("cf21ad74e59a6111be1d8c021e65b891c2a211167abb8c5e079e09e2c8a8339c")
+
+// tlsSuite is an AEAD cipher suite that --keylog can decrypt.
+type tlsSuite struct {
+	keyLen int
+	hash   func() hash.Hash
+}
+
+// tlsSuites are the AES-GCM suites of TLS 1.2 and 1.3. ChaCha20-Poly1305 and
+// CBC suites are not decrypted.
+var tlsSuites = map[uint16]tlsSuite{
+	0x009c: {16, sha256.New}, // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {32, sha512.New384},
+	0x009e: {16, sha256.New}, // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009f: {32, sha512.New384},
+	0xc02b: {16, sha256.New}, // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {32, sha512.New384},
+	0xc02f: {16, sha256.New}, // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: {32, sha512.New384},
+	0x1301: {16, sha256.New}, // TLS_AES_128_GCM_SHA256 (TLS 1.3)
+	0x1302: {32, sha512.New384},
+}
+
+// tlsSecrets are the secrets of a key log: client random (hex) -> label -> secret.
+type tlsSecrets map[string]map[string][]byte
+
+// KeyLog holds the secrets of an SSLKEYLOGFILE (--keylog), as written by
+// browsers and curl with SSLKEYLOGFILE set, to decrypt the TLS sessions of
+// --messages rows. It is shared by every file. PCAPNG files may add their own
+// secrets in Decryption Secrets Blocks.
+type KeyLog struct {
+	secrets tlsSecrets // From --keylog (empty without it)
+
+	embedded    atomic.Int64 // Files with secrets of their own
+	sessions    atomic.Int64 // TLS sessions seen
+	decrypted   atomic.Int64 // Sessions with decrypted records
+	noKeys      atomic.Int64 // Sessions whose client random is not in the key log
+	unsupported atomic.Int64 // Sessions with a cipher suite that is not decrypted
+	records     atomic.Int64 // Application data records decrypted
+}
+
+// readKeyLog reads an SSLKEYLOGFILE.
+func readKeyLog(filename string) (*KeyLog, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	secrets, err := parseKeyLog(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("no secrets in key log")
+	}
+	return &KeyLog{secrets: secrets}, nil
+}
+
+// parseKeyLog parses key log lines of "<label> <client random> <secret>" in
+// hex, such as CLIENT_RANDOM (TLS 1.2) or CLIENT_TRAFFIC_SECRET_0 (TLS 1.3).
+// Comments and blank lines are skipped.
+func parseKeyLog(r io.Reader) (tlsSecrets, error) {
+	secrets := make(tlsSecrets)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want <label> <client random> <secret>", line)
+		}
+		random, err := hex.DecodeString(fields[1])
+		if err != nil || len(random) != 32 {
+			return nil, fmt.Errorf("line %d: invalid client random %q", line, fields[1])
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("line %d: invalid secret", line)
+		}
+		key := strings.ToLower(fields[1])
+		if secrets[key] == nil {
+			secrets[key] = make(map[string][]byte)
+		}
+		secrets[key][fields[0]] = secret
+	}
+	return secrets, scanner.Err()
+}
+
+// PCAPNG blocks read for embedded secrets.
+const (
+	pcapngDSB         = 0x0000000a // Decryption Secrets Block
+	pcapngTLSKeyLog   = 0x544c534b // DSB secrets type "TLSK": key log lines
+	pcapngByteOrder   = 0x1a2b3c4d // Byte-order magic of a Section Header Block
+	pcapngMaxBlockLen = 64 << 20
+)
+
+// embeddedSecrets returns the TLS secrets that the Decryption Secrets Blocks
+// of a PCAPNG input carry, as written by editcap --inject-secrets, or nil.
+// Secrets precede the packets they decrypt, so blocks are read up to the
+// first packet. Archive members and pcap files have none. Each file with
+// secrets is counted and logged.
+func (k *KeyLog) embeddedSecrets(fileJob FileJob) tlsSecrets {
+	if fileJob.Archive != "" {
+		return nil
+	}
+	if ok, err := isPcapng(fileJob.FilePath); err != nil || !ok {
+		return nil
+	}
+	secrets, err := readPcapngSecrets(fileJob.FilePath)
+	if err != nil {
+		slog.Warn("failed to read embedded TLS secrets", "file", fileJob.FilePath, "error", err)
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	k.embedded.Add(1)
+	slog.Debug("using embedded TLS secrets", "file", fileJob.FilePath, "sessions", len(secrets))
+	return secrets
+}
+
+// readPcapngSecrets reads the TLS key log DSBs of a PCAPNG file before its
+// first packet block.
+func readPcapngSecrets(filePath string) (tlsSecrets, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var order binary.ByteOrder = binary.LittleEndian
+	secrets := make(tlsSecrets)
+	header := make([]byte, 12)
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			if err == io.EOF {
+				return secrets, nil
+			}
+			return secrets, err
+		}
+		if binary.LittleEndian.Uint32(header) == pcapngMagic {
+			// A new section may change the byte order
+			if _, err := io.ReadFull(r, header[8:12]); err != nil {
+				return secrets, err
+			}
+			order = binary.LittleEndian
+			if binary.BigEndian.Uint32(header[8:]) == pcapngByteOrder {
+				order = binary.BigEndian
+			}
+			if _, err := r.Discard(int(order.Uint32(header[4:])) - 12); err != nil {
+				return secrets, err
+			}
+			continue
+		}
+		blockType, length := order.Uint32(header), int(order.Uint32(header[4:]))
+		if length < 12 || length%4 != 0 || length > pcapngMaxBlockLen {
+			return secrets, fmt.Errorf("invalid block length %d", length)
+		}
+		switch blockType {
+		case 2, 3, 6: // Packet, Simple Packet and Enhanced Packet Blocks
+			return secrets, nil
+		case pcapngDSB:
+			body := make([]byte, length-8)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return secrets, err
+			}
+			if len(body) < 12 || order.Uint32(body) != pcapngTLSKeyLog {
+				continue
+			}
+			size := int(order.Uint32(body[4:]))
+			if size > len(body)-12 {
+				return secrets, fmt.Errorf("invalid secrets length %d", size)
+			}
+			found, err := parseKeyLog(bytes.NewReader(body[8 : 8+size]))
+			if err != nil {
+				return secrets, err
+			}
+			for random, labels := range found {
+				secrets[random] = labels
+			}
+		default:
+			if _, err := r.Discard(length - 8); err != nil {
+				return secrets, err
+			}
+		}
+	}
+}
+
+// forPass returns a key log with the same secrets and its own counts, for a
+// first pass that must not count sessions twice.
+func (k *KeyLog) forPass() *KeyLog {
+	if k == nil {
+		return nil
+	}
+	return &KeyLog{secrets: k.secrets}
+}
+
+// lookup returns the secrets of a client random, from the file's embedded
+// secrets or the key log.
+func (k *KeyLog) lookup(clientRandom []byte, embedded tlsSecrets) map[string][]byte {
+	random := hex.EncodeToString(clientRandom)
+	if secrets, ok := embedded[random]; ok {
+		return secrets
+	}
+	return k.secrets[random]
+}
+
+// logStats logs how many TLS sessions were decrypted, warning when none was.
+// Runs without --keylog log nothing unless a file had embedded secrets.
+func (k *KeyLog) logStats() {
+	if len(k.secrets) == 0 && k.embedded.Load() == 0 {
+		return
+	}
+	sessions, decrypted := k.sessions.Load(), k.decrypted.Load()
+	args := []any{"sessions", sessions, "decrypted", decrypted, "records", k.records.Load(),
+		"no_keys", k.noKeys.Load(), "unsupported_suite", k.unsupported.Load(), "files_with_secrets", k.embedded.Load()}
+	if sessions > 0 && decrypted == 0 {
+		slog.Warn("no TLS session was decrypted, check that the key log belongs to the captures", args...)
+		return
+	}
+	slog.Info("decrypted TLS sessions", args...)
+}
+
+// tlsHello is what a session's ClientHello and ServerHello tell about its keys.
+type tlsHello struct {
+	client       int // Direction of the client's messages
+	clientRandom []byte
+	serverRandom []byte
+	suite        uint16
+	tls13        bool
+}
+
+// decrypt replaces the application data records among the messages of a
+// session, one list per direction, by their plaintext and marks them
+// decrypted, with the secrets embedded in its file or those of the key log.
+// Other records, and those that fail to decrypt, are kept as captured.
+// Messages of sessions without a ClientHello are left alone.
+func (k *KeyLog) decrypt(directions *[2][]messageSpan, embedded tlsSecrets) {
+	if len(k.secrets) == 0 && embedded == nil {
+		return // No secrets for any session of the file
+	}
+	hello, ok := findTLSHello(directions)
+	if !ok {
+		return
+	}
+	k.sessions.Add(1)
+	secrets := k.lookup(hello.clientRandom, embedded)
+	if secrets == nil {
+		k.noKeys.Add(1)
+		return
+	}
+	suite, ok := tlsSuites[hello.suite]
+	if !ok {
+		k.unsupported.Add(1)
+		return
+	}
+
+	records := int64(0)
+	for d := range directions {
+		side := "SERVER"
+		if d == hello.client {
+			side = "CLIENT"
+		}
+		if hello.tls13 {
+			records += decryptTLS13(directions[d], suite, secrets[side+"_HANDSHAKE_TRAFFIC_SECRET"], secrets[side+"_TRAFFIC_SECRET_0"])
+		} else if master := secrets["CLIENT_RANDOM"]; master != nil {
+			records += decryptTLS12(directions[d], suite, master, hello, d == hello.client)
+		}
+	}
+	if records > 0 {
+		k.decrypted.Add(1)
+		k.records.Add(records)
+	}
+}
+
+// findTLSHello finds the ClientHello in either direction and the ServerHello
+// that answers it, skipping a HelloRetryRequest.
+func findTLSHello(directions *[2][]messageSpan) (tlsHello, bool) {
+	hello := tlsHello{client: -1}
+	for d, messages := range directions {
+		for _, m := range messages {
+			if body, ok := tlsHandshakeMessage(m.data, 1); ok && len(body) >= 34 {
+				hello.client, hello.clientRandom = d, body[2:34]
+				break
+			}
+		}
+		if hello.client >= 0 {
+			break
+		}
+	}
+	if hello.client < 0 {
+		return hello, false
+	}
+	for _, m := range directions[1-hello.client] {
+		body, ok := tlsHandshakeMessage(m.data, 2)
+		if !ok || len(body) < 35 || string(body[2:34]) == string(tlsHelloRetryRandom) {
+			continue
+		}
+		hello.serverRandom = body[2:34]
+		// The cipher suite and compression method follow the session ID
+		sessionEnd := 35 + int(body[34])
+		if sessionEnd+3 > len(body) {
+			return hello, false
+		}
+		rest := body[sessionEnd:]
+		hello.suite = binary.BigEndian.Uint16(rest)
+		hello.tls13 = serverHelloVersion(rest[3:]) == 0x0304
+		return hello, true
+	}
+	return hello, false
+}
+
+// tlsHandshakeMessage returns the body of a handshake record that starts with
+// a handshake message of type msgType.
+func tlsHandshakeMessage(record []byte, msgType byte) ([]byte, bool) {
+	if len(record) < 9 || record[0] != tlsHandshake || record[5] != msgType {
+		return nil, false
+	}
+	return record[9:], true
+}
+
+// serverHelloVersion returns the version of a ServerHello's supported_versions
+// extension, or 0 without one. exts starts at the extensions length.
+func serverHelloVersion(exts []byte) uint16 {
+	if len(exts) < 2 {
+		return 0
+	}
+	exts = exts[2:min(len(exts), 2+int(binary.BigEndian.Uint16(exts)))]
+	for len(exts) >= 4 {
+		extType, extLen := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+extLen {
+			return 0
+		}
+		if extType == 0x002b && extLen == 2 {
+			return binary.BigEndian.Uint16(exts[4:])
+		}
+		exts = exts[4+extLen:]
+	}
+	return 0
+}
+
+// decryptTLS12 decrypts the records one side of a TLS 1.2 session sent after
+// its ChangeCipherSpec, with keys expanded from the master secret. It returns
+// the number of application data records decrypted.
+func decryptTLS12(messages []messageSpan, suite tlsSuite, master []byte, hello tlsHello, client bool) int64 {
+	keyBlock := tls12PRF(suite.hash, master, "key expansion", append(append([]byte(nil), hello.serverRandom...), hello.clientRandom...), 2*suite.keyLen+8)
+	key, salt := keyBlock[suite.keyLen:2*suite.keyLen], keyBlock[2*suite.keyLen+4:]
+	if client {
+		key, salt = keyBlock[:suite.keyLen], keyBlock[2*suite.keyLen:2*suite.keyLen+4]
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0
+	}
+
+	decrypted := int64(0)
+	encrypted := false
+	seq := uint64(0)
+	for i := range messages {
+		record := messages[i].data
+		if len(record) < 5 {
+			continue
+		}
+		if !encrypted {
+			encrypted = record[0] == tlsChangeCipherSpec
+			continue
+		}
+		payload := record[5:]
+		if len(payload) < 8+aead.Overhead() {
+			seq++
+			continue
+		}
+		nonce := append(append([]byte(nil), salt...), payload[:8]...)
+		aad := binary.BigEndian.AppendUint64(nil, seq)
+		aad = append(aad, record[:3]...)
+		aad = binary.BigEndian.AppendUint16(aad, uint16(len(payload)-8-aead.Overhead()))
+		seq++
+		plaintext, err := aead.Open(nil, nonce, payload[8:], aad)
+		if err == nil && record[0] == tlsApplicationData {
+			messages[i].data, messages[i].decrypted = plaintext, true
+			decrypted++
+		}
+	}
+	return decrypted
+}
+
+// decryptTLS13 decrypts the records one side of a TLS 1.3 session sent with
+// its handshake and then its application traffic secret. A record that fails
+// with the current keys is tried with the next ones from sequence number 0,
+// so a key log without handshake secrets still decrypts the application data.
+// It returns the number of application data records decrypted.
+func decryptTLS13(messages []messageSpan, suite tlsSuite, secrets ...[]byte) int64 {
+	type phase struct {
+		aead cipher.AEAD
+		iv   []byte
+	}
+	var phases []*phase
+	for _, secret := range secrets {
+		if secret == nil {
+			phases = append(phases, nil)
+			continue
+		}
+		aead, err := newGCM(hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen))
+		if err != nil {
+			return 0
+		}
+		phases = append(phases, &phase{aead: aead, iv: hkdfExpandLabel(suite.hash, secret, "iv", 12)})
+	}
+	open := func(p *phase, seq uint64, record []byte) ([]byte, bool) {
+		if p == nil {
+			return nil, false
+		}
+		nonce := append([]byte(nil), p.iv...)
+		for i := range 8 {
+			nonce[4+i] ^= byte(seq >> (56 - 8*i))
+		}
+		plaintext, err := p.aead.Open(nil, nonce, record[5:], record[:5])
+		return plaintext, err == nil
+	}
+
+	decrypted := int64(0)
+	current, seq := 0, uint64(0)
+	for i := range messages {
+		record := messages[i].data
+		if len(record) < 5 || record[0] != tlsApplicationData {
+			continue // ClientHello, ServerHello and compatibility ChangeCipherSpec
+		}
+		plaintext, ok := open(phases[current], seq, record)
+		for next := current + 1; !ok && next < len(phases); next++ {
+			if plaintext, ok = open(phases[next], 0, record); ok {
+				current, seq = next, 0
+			}
+		}
+		if phases[current] != nil {
+			seq++
+		}
+		if !ok {
+			continue
+		}
+		// The inner content type follows the content, then zero padding
+		end := len(plaintext)
+		for end > 0 && plaintext[end-1] == 0 {
+			end--
+		}
+		if end > 0 && plaintext[end-1] == tlsApplicationData {
+			messages[i].data, messages[i].decrypted = plaintext[:end-1], true
+			decrypted++
+		}
+	}
+	return decrypted
+}
+
+// newGCM returns AES-GCM with key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tls12PRF is the TLS 1.2 pseudorandom function P_hash(secret, label + seed),
+// cut to n bytes.
+func tls12PRF(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	a := seed
+	var out []byte
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	full := "tls13 " + label
+	info := []byte{byte(n >> 8), byte(n), byte(len(full))}
+	info = append(info, full...)
+	info = append(info, 0)
+	key, _ := hkdf.Expand(h, secret, string(info), n)
+	return key
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// unhex decodes a hex test vector.
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestTLS12PRF checks the TLS 1.2 PRF with SHA-256 against the known-answer
+// vector circulated on the IETF TLS list (secret, seed and "test label").
+func TestTLS12PRF(t *testing.T) {
+	secret := unhex(t, "9bbe436ba940f017b17652849a71db35")
+	seed := unhex(t, "a0ba9f936cda311827a6f796ffd5198c")
+	want := "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a" +
+		"6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab" +
+		"4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701" +
+		"87347b66"
+	if got := hex.EncodeToString(tls12PRF(sha256.New, secret, "test label", seed, 100)); got != want {
+		t.Errorf("tls12PRF = %s, want %s", got, want)
+	}
+}
+
+// TestHKDFExpandLabel checks the TLS 1.3 record keys derived from the
+// handshake traffic secrets of the simple 1-RTT handshake of RFC 8448.
+func TestHKDFExpandLabel(t *testing.T) {
+	tests := []struct {
+		name, secret, key, iv string
+	}{
+		{"server handshake", "b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38", "3fce516009c21727d0f2e4e86ee403bc", "5d313eb2671276ee13000b30"},
+		{"client handshake", "b3eddb126e067f35a780b3abf45e2d8f3b1a950738f52e9600746a0e27a55a21", "dbfaa693d1762c5b666af5d950258d01", "5bd3c71b836e0b76bb73265f"},
+	}
+	for _, tt := range tests {
+		secret := unhex(t, tt.secret)
+		if got := hex.EncodeToString(hkdfExpandLabel(sha256.New, secret, "key", 16)); got != tt.key {
+			t.Errorf("%s key = %s, want %s", tt.name, got, tt.key)
+		}
+		if got := hex.EncodeToString(hkdfExpandLabel(sha256.New, secret, "iv", 12)); got != tt.iv {
+			t.Errorf("%s iv = %s, want %s", tt.name, got, tt.iv)
+		}
+	}
+}
+
+// sealTLS13 returns a TLS 1.3 application data record holding content, sealed
+// with the record key and IV for sequence number seq.
+func sealTLS13(t *testing.T, key, iv []byte, seq uint64, content []byte) []byte {
+	t.Helper()
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := append(append([]byte(nil), content...), tlsApplicationData, 0, 0)
+	header := []byte{tlsApplicationData, 3, 3, 0, 0}
+	binary.BigEndian.PutUint16(header[3:], uint16(len(inner)+aead.Overhead()))
+	nonce := append([]byte(nil), iv...)
+	for i := range 8 {
+		nonce[4+i] ^= byte(seq >> (56 - 8*i))
+	}
+	return aead.Seal(header, nonce, inner, header)
+}
+
+// TestDecryptTLS13 decrypts records sealed with the RFC 8448 server handshake
+// key and IV from the traffic secret they derive from.
+func TestDecryptTLS13(t *testing.T) {
+	secret := unhex(t, "b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38")
+	key, iv := unhex(t, "3fce516009c21727d0f2e4e86ee403bc"), unhex(t, "5d313eb2671276ee13000b30")
+	contents := [][]byte{[]byte("GET / HTTP/1.1\r\n\r\n"), []byte("second record")}
+	messages := []messageSpan{{data: []byte{tlsChangeCipherSpec, 3, 3, 0, 1, 1}}}
+	for seq, content := range contents {
+		messages = append(messages, messageSpan{data: sealTLS13(t, key, iv, uint64(seq), content)})
+	}
+
+	if n := decryptTLS13(messages, tlsSuites[0x1301], secret); n != 2 {
+		t.Fatalf("decrypted %d records, want 2", n)
+	}
+	for i, content := range contents {
+		if m := messages[i+1]; !m.decrypted || !bytes.Equal(m.data, content) {
+			t.Errorf("record %d = %q (decrypted %v), want %q", i, m.data, m.decrypted, content)
+		}
+	}
+}
+
+// TestDecryptTLS12 decrypts a client record sent after ChangeCipherSpec with
+// the key expanded from the master secret and the hello randoms.
+func TestDecryptTLS12(t *testing.T) {
+	suite := tlsSuites[0xc02f]
+	master := bytes.Repeat([]byte{0x42}, 48)
+	hello := tlsHello{clientRandom: bytes.Repeat([]byte{1}, 32), serverRandom: bytes.Repeat([]byte{2}, 32), suite: 0xc02f}
+	keyBlock := tls12PRF(suite.hash, master, "key expansion", append(append([]byte(nil), hello.serverRandom...), hello.clientRandom...), 2*suite.keyLen+8)
+	aead, err := newGCM(keyBlock[:suite.keyLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicit := []byte{0, 0, 0, 0, 0, 0, 0, 7}
+	nonce := append(append([]byte(nil), keyBlock[2*suite.keyLen:2*suite.keyLen+4]...), explicit...)
+	content := []byte("hello over TLS 1.2")
+	aad := []byte{0, 0, 0, 0, 0, 0, 0, 0, tlsApplicationData, 3, 3, 0, byte(len(content))}
+	header := []byte{tlsApplicationData, 3, 3, 0, 0}
+	binary.BigEndian.PutUint16(header[3:], uint16(8+len(content)+aead.Overhead()))
+	record := aead.Seal(append(header, explicit...), nonce, content, aad)
+
+	messages := []messageSpan{{data: []byte{tlsChangeCipherSpec, 3, 3, 0, 1, 1}}, {data: record}}
+	if n := decryptTLS12(messages, suite, master, hello, true); n != 1 {
+		t.Fatalf("decrypted %d records, want 1", n)
+	}
+	if !bytes.Equal(messages[1].data, content) {
+		t.Errorf("record = %q, want %q", messages[1].data, content)
+	}
+}
+
+// TestParseKeyLog reads TLS 1.2 and 1.3 labels, skips comments and rejects
+// malformed lines.
+func TestParseKeyLog(t *testing.T) {
+	random := strings.Repeat("ab", 32)
+	secrets, err := parseKeyLog(strings.NewReader("# SSL/TLS secrets log file\n\nCLIENT_RANDOM " + random + " " + strings.Repeat("01", 48) + "\n" +
+		"CLIENT_TRAFFIC_SECRET_0 " + strings.ToUpper(random) + " " + strings.Repeat("02", 32) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 || len(secrets[random]["CLIENT_RANDOM"]) != 48 || len(secrets[random]["CLIENT_TRAFFIC_SECRET_0"]) != 32 {
+		t.Errorf("secrets = %v", secrets)
+	}
+	for _, line := range []string{"CLIENT_RANDOM " + random, "CLIENT_RANDOM abcd 0102", "CLIENT_RANDOM " + random + " zz"} {
+		if _, err := parseKeyLog(strings.NewReader(line)); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"go.yaml.in/yaml/v3"
+)
+
+// rulesUnmatched labels packets no --label-rules rule matches, unless the
+// rules file sets a default.
+const rulesUnmatched = "unmatched"
+
+// labelRulesFile is the YAML layout of a --label-rules file.
+type labelRulesFile struct {
+	Default       string          `yaml:"default"`
+	DefaultWeight *float64        `yaml:"default_weight"` // Weight of packets no rule matches
+	Rules         []labelRuleSpec `yaml:"rules"`
+}
+
+// labelRuleSpec is a rule as written in the file. Conditions left out match
+// any packet; a list matches if any of its values does.
+type labelRuleSpec struct {
+	Class   string   `yaml:"class"`
+	Weight  *float64 `yaml:"weight"`   // Weight of the rows it labels (--label-weights column)
+	Src     yamlList `yaml:"src"`      // Source addresses or CIDR prefixes
+	Dst     yamlList `yaml:"dst"`      // Destination addresses or prefixes
+	Host    yamlList `yaml:"host"`     // Either end
+	SrcPort yamlList `yaml:"src_port"` // Ports or ranges such as 1024-65535
+	DstPort yamlList `yaml:"dst_port"`
+	Port    yamlList `yaml:"port"` // Either end
+	Proto   yamlList `yaml:"proto"`
+	From    string   `yaml:"from"`  // RFC 3339 time, inclusive
+	Until   string   `yaml:"until"` // RFC 3339 time, exclusive
+}
+
+// yamlList is a YAML sequence of scalars, or a single scalar.
+type yamlList []string
+
+func (l *yamlList) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		*l = yamlList{node.Value}
+		return nil
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: expected a value, not a %s", item.Line, yamlKind(item))
+			}
+			*l = append(*l, item.Value)
+		}
+		return nil
+	}
+	return fmt.Errorf("line %d: expected a value or a list of values", node.Line)
+}
+
+// yamlKind names the kind of a YAML node for error messages.
+func yamlKind(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "mapping"
+	case yaml.SequenceNode:
+		return "list"
+	}
+	return "value"
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct{ lo, hi uint16 }
+
+// labelRule is a compiled rule.
+type labelRule struct {
+	class                  string
+	weight                 *float64 // nil = the weight of the class
+	src, dst, host         []netip.Prefix
+	srcPort, dstPort, port []portRange
+	protos                 []string
+	from, until            time.Time // Zero = unbounded
+	needsAddrs             bool      // The rule has an address condition
+	needsTransport         bool      // The rule has a port or protocol condition
+}
+
+// LabelRules labels packets by the first rule of a --label-rules file they
+// match, on addresses, ports, transport and time. It is safe for concurrent
+// use by readers.
+type LabelRules struct {
+	rules         []labelRule
+	defaultClass  string
+	defaultWeight *float64        // nil = the weight of the class
+	classes       map[string]byte // Rule classes and the default in sorted order
+
+	matched   atomic.Int64
+	unmatched atomic.Int64
+}
+
+// NewLabelRules reads and compiles a --label-rules YAML file.
+func NewLabelRules(filename string) (*LabelRules, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file labelRulesFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid rules file: %w", err)
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("%s has no rules", filename)
+	}
+
+	r := &LabelRules{defaultClass: file.Default, defaultWeight: file.DefaultWeight, classes: make(map[string]byte)}
+	if r.defaultClass == "" {
+		r.defaultClass = rulesUnmatched
+	}
+	if w := r.defaultWeight; w != nil && (*w < 0 || math.IsInf(*w, 0) || math.IsNaN(*w)) {
+		return nil, fmt.Errorf("invalid default_weight %g (use a number, at least 0)", *w)
+	}
+	labels := map[string]bool{r.defaultClass: true}
+	for i, spec := range file.Rules {
+		rule, err := spec.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		r.rules = append(r.rules, rule)
+		labels[rule.class] = true
+	}
+
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	for i, label := range names {
+		r.classes[label] = byte(i)
+	}
+
+	slog.Info("loaded label rules", "file", filename, "rules", len(r.rules), "labels", len(labels))
+	return r, nil
+}
+
+// compile parses the conditions of a rule.
+func (s labelRuleSpec) compile() (labelRule, error) {
+	rule := labelRule{class: s.Class, weight: s.Weight}
+	if rule.class == "" {
+		return rule, fmt.Errorf("no class")
+	}
+	if w := rule.weight; w != nil && (*w < 0 || math.IsInf(*w, 0) || math.IsNaN(*w)) {
+		return rule, fmt.Errorf("invalid weight %g (use a number, at least 0)", *w)
+	}
+	var err error
+	for _, addrs := range []struct {
+		values yamlList
+		out    *[]netip.Prefix
+	}{{s.Src, &rule.src}, {s.Dst, &rule.dst}, {s.Host, &rule.host}} {
+		for _, value := range addrs.values {
+			prefix, err := parseWherePrefix(value)
+			if err != nil {
+				return rule, fmt.Errorf("invalid address %q", value)
+			}
+			*addrs.out = append(*addrs.out, prefix)
+		}
+	}
+	for _, ports := range []struct {
+		values yamlList
+		out    *[]portRange
+	}{{s.SrcPort, &rule.srcPort}, {s.DstPort, &rule.dstPort}, {s.Port, &rule.port}} {
+		for _, value := range ports.values {
+			r, err := parsePortRange(value)
+			if err != nil {
+				return rule, err
+			}
+			*ports.out = append(*ports.out, r)
+		}
+	}
+	for _, proto := range s.Proto {
+		proto = strings.ToLower(proto)
+		switch proto {
+		case "tcp", "udp", "icmp":
+		default:
+			return rule, fmt.Errorf("invalid proto %q (use tcp, udp or icmp)", proto)
+		}
+		rule.protos = append(rule.protos, proto)
+	}
+	if s.From != "" {
+		if rule.from, err = time.Parse(time.RFC3339Nano, s.From); err != nil {
+			return rule, fmt.Errorf("invalid from time %q (use RFC 3339, e.g. 2024-03-01T12:00:00Z)", s.From)
+		}
+	}
+	if s.Until != "" {
+		if rule.until, err = time.Parse(time.RFC3339Nano, s.Until); err != nil {
+			return rule, fmt.Errorf("invalid until time %q (use RFC 3339, e.g. 2024-03-01T12:00:00Z)", s.Until)
+		}
+	}
+	rule.needsAddrs = len(rule.src)+len(rule.dst)+len(rule.host) > 0
+	rule.needsTransport = len(rule.srcPort)+len(rule.dstPort)+len(rule.port)+len(rule.protos) > 0
+	return rule, nil
+}
+
+// parsePortRange parses a port (443) or an inclusive range (1024-65535).
+func parsePortRange(s string) (portRange, error) {
+	loStr, hiStr, isRange := strings.Cut(s, "-")
+	lo, err := strconv.ParseUint(strings.TrimSpace(loStr), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = strconv.ParseUint(strings.TrimSpace(hiStr), 10, 16); err != nil || hi < lo {
+			return portRange{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return portRange{uint16(lo), uint16(hi)}, nil
+}
+
+// forPass returns rules with the same conditions but their own counters, so a
+// first pass over the inputs does not count packets twice.
+func (r *LabelRules) forPass() *LabelRules {
+	if r == nil {
+		return nil
+	}
+	return &LabelRules{rules: r.rules, defaultClass: r.defaultClass, defaultWeight: r.defaultWeight, classes: r.classes}
+}
+
+// classIDs numbers the rule classes and the default class in sorted order.
+func (r *LabelRules) classIDs() map[string]byte {
+	return r.classes
+}
+
+// weighted reports whether the file gives rows weights.
+func (r *LabelRules) weighted() bool {
+	return r.defaultWeight != nil || slices.ContainsFunc(r.rules, func(rule labelRule) bool { return rule.weight != nil })
+}
+
+// label returns the class of the first rule the packet matches, or the
+// default class, and the weight the rule or the default gives it, if any.
+func (r *LabelRules) label(packet gopacket.Packet) (string, *float64) {
+	// IP packets without TCP, UDP or ICMP still match on their addresses
+	src, dst, proto, hasTransport := packetEndpoints(packet)
+	hasAddrs := hasTransport
+	if !hasTransport {
+		var srcAddr, dstAddr netip.Addr
+		srcAddr, dstAddr, hasAddrs = packetAddrs(packet)
+		src, dst = netip.AddrPortFrom(srcAddr, 0), netip.AddrPortFrom(dstAddr, 0)
+	}
+	ts := packet.Metadata().Timestamp
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.needsAddrs && !hasAddrs || rule.needsTransport && !hasTransport {
+			continue
+		}
+		if rule.matches(src, dst, proto, ts) {
+			r.matched.Add(1)
+			return rule.class, rule.weight
+		}
+	}
+	r.unmatched.Add(1)
+	return r.defaultClass, r.defaultWeight
+}
+
+// matches reports whether a packet with these endpoints and timestamp meets
+// every condition of the rule.
+func (rule *labelRule) matches(src, dst netip.AddrPort, proto string, ts time.Time) bool {
+	if !rule.from.IsZero() && ts.Before(rule.from) || !rule.until.IsZero() && !ts.Before(rule.until) {
+		return false
+	}
+	if len(rule.protos) > 0 && !slices.Contains(rule.protos, proto) {
+		return false
+	}
+	if len(rule.src) > 0 && !prefixesContain(rule.src, src.Addr()) ||
+		len(rule.dst) > 0 && !prefixesContain(rule.dst, dst.Addr()) ||
+		len(rule.host) > 0 && !prefixesContain(rule.host, src.Addr()) && !prefixesContain(rule.host, dst.Addr()) {
+		return false
+	}
+	if len(rule.srcPort) > 0 && !portsContain(rule.srcPort, src.Port()) ||
+		len(rule.dstPort) > 0 && !portsContain(rule.dstPort, dst.Port()) ||
+		len(rule.port) > 0 && !portsContain(rule.port, src.Port()) && !portsContain(rule.port, dst.Port()) {
+		return false
+	}
+	return true
+}
+
+// logMatches logs how many packets a rule labeled, warning when none did.
+func (r *LabelRules) logMatches() {
+	matched, unmatched := r.matched.Load(), r.unmatched.Load()
+	if matched == 0 {
+		slog.Warn("no packet matched a label rule, check the addresses, ports and times of the rules", "packets", unmatched, "default", r.defaultClass)
+		return
+	}
+	slog.Info("labeled packets by rules", "matched", matched, "default", unmatched)
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func portsContain(ranges []portRange, port uint16) bool {
+	for _, r := range ranges {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
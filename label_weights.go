@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// labelWeightFeatureNames is the feature column added by --label-weights or a
+// --label-rules file with weights.
+var labelWeightFeatureNames = []string{
+	"label_weight",
+}
+
+// LabelWeights gives each row a weight for weighted losses, e.g. lower for
+// labels from heuristics: the weight of the --label-rules rule that labeled
+// its packet, else the --label-weights weight of its class, else 1.
+type LabelWeights struct {
+	classes map[string]float64
+}
+
+// parseLabelWeights parses a comma-separated list of class=weight pairs such
+// as "benign=1,tcp=0.3". An empty list gives every class weight 1.
+func parseLabelWeights(list string) (*LabelWeights, error) {
+	w := &LabelWeights{classes: make(map[string]float64)}
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		class, value, ok := strings.Cut(item, "=")
+		class = strings.TrimSpace(class)
+		if !ok || class == "" {
+			return nil, fmt.Errorf("invalid item %q (use class=weight)", item)
+		}
+		weight, err := parseWeight(value)
+		if err != nil {
+			return nil, fmt.Errorf("class %s: %w", class, err)
+		}
+		w.classes[class] = weight
+	}
+	return w, nil
+}
+
+// parseWeight parses a weight: a finite number, at least 0.
+func parseWeight(s string) (float64, error) {
+	weight, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || weight < 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+		return 0, fmt.Errorf("invalid weight %q (use a number, at least 0)", s)
+	}
+	return weight, nil
+}
+
+// of returns the weight of a class.
+func (w *LabelWeights) of(class string) float64 {
+	if weight, ok := w.classes[class]; ok {
+		return weight
+	}
+	return 1
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// lengthScanner is a StreamWriter that only records the longest row, for the
+// --scan-length first pass.
+type lengthScanner struct {
+	mutex   sync.Mutex
+	longest int
+}
+
+func (s *lengthScanner) WritePacket(p PacketResult) error {
+	return s.WriteBatch([]PacketResult{p})
+}
+
+func (s *lengthScanner) WriteBatch(packets []PacketResult) error {
+	longest := 0
+	for _, p := range packets {
+		longest = max(longest, len(p.Data))
+	}
+	s.mutex.Lock()
+	s.longest = max(s.longest, longest)
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *lengthScanner) Close() error {
+	return nil
+}
+
+// scanRowLength runs a first pass over fileJobs that returns the length of the
+// longest row, so variable-length streaming outputs can be sized for it.
+func scanRowLength(ctx context.Context, fileJobs []FileJob, opts ProcessOptions, maxConcurrentFiles int) (int, error) {
+	opts, closePass, err := firstPassOptions(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer closePass()
+
+	scanner := &lengthScanner{}
+	if _, err := processFilesStreamingSingleOutput(ctx, fileJobs, scanner, opts, maxConcurrentFiles, NewRunManifest("", "")); err != nil {
+		return 0, err
+	}
+	return scanner.longest, nil
+}
+
+// jumboFrameLen is the longest frame assumed of inputs that capture whole
+// packets: a 9000-byte jumbo MTU plus the Ethernet header and a VLAN tag.
+const jumboFrameLen = 9000 + ethernetHeaderLen + 4
+
+// ethernetHeaderLen is the Ethernet header stripped from rows without --include-l2.
+const ethernetHeaderLen = 14
+
+// assumedRowLength returns the byte columns of variable-length streamed rows
+// (--length 0 without --scan-length): the longest frame the snap lengths of
+// the inputs let through, at most a jumbo frame, less the Ethernet header
+// unless includeL2 keeps it. Captures of standard or jumbo frames thus fit
+// without a first pass, and captures cut at a short snap length get narrow
+// rows. Archive members, --live interfaces and inputs that cannot be opened
+// are assumed to hold jumbo frames.
+func assumedRowLength(fileJobs []FileJob, includeL2 bool) int {
+	longest := 0
+	probed := make(map[string]bool)
+	for _, job := range fileJobs {
+		if probed[job.FilePath] {
+			continue // Another interface of a --split-by-interface file
+		}
+		probed[job.FilePath] = true
+		if job.Archive != "" || job.Live {
+			longest = jumboFrameLen
+			break
+		}
+		snapLen, err := offlineSnapLen(job.FilePath)
+		if err != nil || snapLen <= 0 || snapLen >= jumboFrameLen {
+			longest = jumboFrameLen
+			break
+		}
+		longest = max(longest, snapLen)
+	}
+	if longest == 0 {
+		longest = jumboFrameLen
+	}
+	if !includeL2 {
+		longest = max(longest-ethernetHeaderLen, 1)
+	}
+	return longest
+}
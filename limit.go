@@ -0,0 +1,103 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// RowLimit caps the rows of a whole run (--max-packets). Rows are granted in
+// the order workers finish them, so which rows make the cut can vary between
+// runs with more than one worker; the count is exact. It is safe for
+// concurrent use and a nil limit grants everything.
+type RowLimit struct {
+	max   int64
+	taken atomic.Int64
+}
+
+// NewRowLimit returns a limit of n rows, or nil for n == 0 (no limit).
+func NewRowLimit(n int) *RowLimit {
+	if n == 0 {
+		return nil
+	}
+	return &RowLimit{max: int64(n)}
+}
+
+// take claims up to n rows and returns how many of them may be written.
+func (l *RowLimit) take(n int) int {
+	if l == nil {
+		return n
+	}
+	before := l.taken.Add(int64(n)) - int64(n)
+	return int(max(0, min(int64(n), l.max-before)))
+}
+
+// reached reports whether every row of the limit has been granted, so readers
+// can stop early.
+func (l *RowLimit) reached() bool {
+	return l != nil && l.taken.Load() >= l.max
+}
+
+// ClassQuota caps the rows of each class (--max-per-class). Like RowLimit, it
+// grants rows in the order workers finish them, with exact counts. Once a
+// class has all its rows, readers skip its packets and, when rows carry the
+// class of their file, the rest of its files. It is safe for concurrent use
+// and a nil quota grants everything.
+type ClassQuota struct {
+	max   int64
+	mutex sync.Mutex
+	taken map[string]int64
+	done  sync.Map // Classes with every row granted, read without the mutex
+}
+
+// NewClassQuota returns a quota of n rows per class, or nil for n == 0 (no
+// quota).
+func NewClassQuota(n int) *ClassQuota {
+	if n == 0 {
+		return nil
+	}
+	return &ClassQuota{max: int64(n), taken: make(map[string]int64)}
+}
+
+// take keeps the rows whose class has quota left, in place.
+func (q *ClassQuota) take(rows []PacketResult) []PacketResult {
+	if q == nil {
+		return rows
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	kept := rows[:0]
+	for _, row := range rows {
+		if q.taken[row.Class] >= q.max {
+			continue
+		}
+		if q.taken[row.Class]++; q.taken[row.Class] == q.max {
+			q.done.Store(row.Class, true)
+		}
+		kept = append(kept, row)
+	}
+	return kept
+}
+
+// full reports whether every row of a class's quota has been granted.
+func (q *ClassQuota) full(class string) bool {
+	if q == nil {
+		return false
+	}
+	_, done := q.done.Load(class)
+	return done
+}
+
+// fullClasses returns the classes that reached the quota, sorted.
+func (q *ClassQuota) fullClasses() []string {
+	var classes []string
+	if q != nil {
+		q.done.Range(func(class, _ any) bool {
+			classes = append(classes, class.(string))
+			return true
+		})
+	}
+	slices.Sort(classes)
+	return classes
+}
@@ -0,0 +1,13 @@
+//go:build !cgo && !windows
+
+package main
+
+// openLive is not available without libpcap; --live is rejected.
+func openLive(device string) (packetReader, error) {
+	return nil, errNoLiveCapture
+}
+
+// captureInterfaces is not available without libpcap.
+func captureInterfaces() ([]liveInterface, error) {
+	return nil, errNoLiveCapture
+}
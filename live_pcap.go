@@ -0,0 +1,56 @@
+//go:build cgo || windows
+
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// liveCapture reads packets from a network interface (--live). On Windows
+// gopacket loads Npcap's wpcap.dll at run time, without cgo.
+type liveCapture struct {
+	*pcap.Handle
+}
+
+// openLive starts capturing on a network interface in promiscuous mode.
+func openLive(device string) (packetReader, error) {
+	if err := loadPcap(); err != nil {
+		return nil, err
+	}
+	handle, err := pcap.OpenLive(device, liveSnapLen, true, liveReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return liveCapture{handle}, nil
+}
+
+// ReadPacketData reads the next packet, or returns errReadTimeout if none
+// arrived within liveReadTimeout.
+func (c liveCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := c.Handle.ReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		err = errReadTimeout
+	}
+	return data, ci, err
+}
+
+// captureInterfaces lists the interfaces libpcap (or Npcap) can capture from.
+func captureInterfaces() ([]liveInterface, error) {
+	if err := loadPcap(); err != nil {
+		return nil, err
+	}
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+	interfaces := make([]liveInterface, 0, len(devices))
+	for _, device := range devices {
+		iface := liveInterface{Name: device.Name, Description: device.Description}
+		for _, address := range device.Addresses {
+			iface.Addresses = append(iface.Addresses, address.IP.String())
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogger installs the default structured logger.
+// Logs go to stderr so stdout stays free for data and summaries.
+// level is one of debug, info, warn or error; jsonOutput selects JSON lines instead of key=value text.
+func setupLogger(level string, jsonOutput bool) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(strings.ToLower(level))); err != nil {
+		return fmt.Errorf("invalid log level %q (use debug, info, warn or error)", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	if jsonOutput {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// atFatal, if set, runs before fatal exits, to record the failure of a run.
+var atFatal func(msg string, args ...any)
+
+// fatal logs an error with structured attributes and exits with status 1.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	if hook := atFatal; hook != nil {
+		atFatal = nil
+		hook(msg, args...)
+	}
+	os.Exit(1)
+}
+
+// fileSizeMB returns the size of a file in megabytes, or 0 if it cannot be stat'ed.
+func fileSizeMB(path string) float64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return float64(info.Size()) / (1024 * 1024)
+}
+
+// outputSizeMB returns the size of an output in megabytes. For NumPy this is
+// the size of the <base>_data.npy array, or of <base>_features.npy with --scale.
+// With several formats it is the sum over their outputs.
+func outputSizeMB(outputFile, format string) float64 {
+	if outputs := formatOutputs(format, outputFile); len(outputs) > 1 {
+		total := 0.0
+		for _, output := range outputs {
+			total += outputSizeMB(output.filename, output.format)
+		}
+		return total
+	}
+	if format == "numpy" {
+		base := numpyBaseName(outputFile)
+		if _, err := os.Stat(base + "_data.npy"); err != nil {
+			if _, err := os.Stat(base + ".npz"); err == nil {
+				return fileSizeMB(base + ".npz") // --npz archive
+			}
+			return fileSizeMB(base + "_features.npy") // --scale writes every column as a feature
+		}
+		return fileSizeMB(base + "_data.npy")
+	}
+	if format == "bin" {
+		base := binBaseName(outputFile)
+		if _, err := os.Stat(base + ".bin"); err != nil {
+			return fileSizeMB(base + "_features.bin")
+		}
+		return fileSizeMB(base + ".bin")
+	}
+	for _, path := range []string{outputFile, outputFile + csvZstdExt} { // --csv-compression zstd
+		if _, err := os.Stat(path); err == nil {
+			return fileSizeMB(path)
+		}
+	}
+	dataPath, labelsPath, _ := separateLabelsPaths(outputFile) // --separate-labels
+	if _, err := os.Stat(dataPath); err != nil {
+		dataPath += csvZstdExt
+	}
+	return fileSizeMB(dataPath) + fileSizeMB(labelsPath)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunManifest records which input files made it into the output of a run.
+// It is written when a run is interrupted so partial outputs can be audited.
+type RunManifest struct {
+	Interrupted  bool           `json:"interrupted"`
+	StartedAt    time.Time      `json:"started_at"`
+	FinishedAt   time.Time      `json:"finished_at"`
+	Format       string         `json:"format"`
+	Output       string         `json:"output"`
+	TotalPackets int            `json:"total_packets"`
+	Files        []ManifestFile `json:"files"`
+	mutex        sync.Mutex
+}
+
+// ManifestFile describes the contribution of a single input file.
+// Complete is false when the file was cut short by an interruption.
+type ManifestFile struct {
+	Path      string `json:"path"`
+	Interface string `json:"interface,omitempty"` // PCAPNG interface with --split-by-interface
+	Class     string `json:"class,omitempty"`
+	Packets   int    `json:"packets"`
+	Complete  bool   `json:"complete"`
+	Output    string `json:"output,omitempty"`
+
+	DurationSeconds float64 `json:"duration_seconds,omitempty"` // Time spent reading the file
+}
+
+// NewRunManifest creates a manifest for a run writing to output in the given format.
+func NewRunManifest(output, format string) *RunManifest {
+	return &RunManifest{
+		StartedAt: time.Now(),
+		Format:    format,
+		Output:    output,
+		Files:     make([]ManifestFile, 0),
+	}
+}
+
+// RecordFile adds a processed input file to the manifest (thread-safe).
+func (m *RunManifest) RecordFile(f ManifestFile) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.Files = append(m.Files, f)
+	m.TotalPackets += f.Packets
+}
+
+// Write saves the manifest as indented JSON.
+func (m *RunManifest) Write(filename string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.FinishedAt = time.Now()
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// runSummary is the single machine-parsable line printed by --quiet runs.
+type runSummary struct {
+	Status          string  `json:"status"`
+	Files           int     `json:"files"`
+	Packets         int     `json:"packets"`
+	Format          string  `json:"format"`
+	Output          string  `json:"output"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// SummaryLine renders the manifest totals as a one-line JSON object.
+// status is "ok" or "interrupted".
+func (m *RunManifest) SummaryLine(status string, elapsed time.Duration) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	data, _ := json.Marshal(runSummary{
+		Status:          status,
+		Files:           len(m.Files),
+		Packets:         m.TotalPackets,
+		Format:          m.Format,
+		Output:          m.Output,
+		DurationSeconds: elapsed.Seconds(),
+	})
+	return string(data)
+}
+
+// manifestPath returns the manifest filename that sits next to an output file,
+// e.g. output/dataset.npy -> output/dataset_manifest.json.
+func manifestPath(outputFile string) string {
+	base := strings.TrimSuffix(outputFile, filepath.Ext(outputFile))
+	return base + "_manifest.json"
+}
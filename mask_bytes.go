@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteRange is an inclusive range of row byte offsets, as in "0-11".
+type ByteRange struct {
+	First int
+	Last  int
+}
+
+// ByteRanges are the offsets that --mask-bytes zeroes in every packet's bytes.
+type ByteRanges []ByteRange
+
+// parseByteRanges parses a comma-separated list of offsets and inclusive
+// offset ranges such as "0-11,34-35,40".
+func parseByteRanges(list string) (ByteRanges, error) {
+	var ranges ByteRanges
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(item, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid offset %q in %q", first, item)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid range %q (use first-last with first <= last)", item)
+			}
+		}
+		ranges = append(ranges, ByteRange{First: start, Last: end})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no offsets in %q", list)
+	}
+	return ranges, nil
+}
+
+// apply zeroes the ranges in data; the parts past its end are ignored.
+func (r ByteRanges) apply(data []byte) {
+	for _, br := range r {
+		if br.First < len(data) {
+			clear(data[br.First:min(br.Last+1, len(data))])
+		}
+	}
+}
+
+// String returns the ranges as --mask-bytes takes them.
+func (r ByteRanges) String() string {
+	items := make([]string, len(r))
+	for i, br := range r {
+		items[i] = strconv.Itoa(br.First)
+		if br.Last != br.First {
+			items[i] += "-" + strconv.Itoa(br.Last)
+		}
+	}
+	return strings.Join(items, ",")
+}
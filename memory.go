@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// parseByteSize parses a size such as "4GB", "512MB", "1.5GiB" or a plain byte
+// count. Units are binary multiples, as memory is usually counted.
+func parseByteSize(s string) (uint64, error) {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	}
+	number := strings.ToUpper(strings.TrimSpace(s))
+	scale := 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			scale = unit.scale
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("%q is not a size such as 4GB or 512MB", s)
+	}
+	return uint64(value * scale), nil
+}
+
+// memoryBudgetShare is the share of --max-memory the rows of an in-memory run
+// may take. Writing needs about as much again (padding and Parquet rows copy
+// the data), so loading stops at half the budget.
+const memoryBudgetShare = 0.5
+
+// MemoryBudget is the --max-memory limit of a run.
+type MemoryBudget struct {
+	limit uint64
+}
+
+// NewMemoryBudget sets the Go runtime's soft memory limit to the budget, so
+// the garbage collector runs harder instead of letting the heap outgrow it.
+func NewMemoryBudget(limit uint64) *MemoryBudget {
+	debug.SetMemoryLimit(int64(limit))
+	return &MemoryBudget{limit: limit}
+}
+
+// near reports whether the live heap has reached memoryBudgetShare of the
+// budget. A nil budget is never near.
+func (b *MemoryBudget) near() bool {
+	if b == nil {
+		return false
+	}
+	threshold := uint64(memoryBudgetShare * float64(b.limit))
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc < threshold {
+		return false
+	}
+	// Part of the heap may be garbage; only a collection tells what is live
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc >= threshold
+}
@@ -0,0 +1,859 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+)
+
+// mergeTable is the per-file outputs of one format of a --per-file run, read
+// row by row to merge them into one dataset (--merge-after).
+type mergeTable interface {
+	counts() []int64 // Rows of each per-file output
+	// newShard creates a merged output, or a shard of it, for rows rows.
+	newShard(filename string, rows int64) (mergeShard, error)
+	Close() error
+}
+
+// mergeShard is an output of a merge, written one row at a time.
+type mergeShard interface {
+	copyRow(file int, row int64) error // Appends row of per-file output file
+	Close() error
+	abort() // Closes and removes an output that could not be finished
+}
+
+// mergePerFileOutputs merges the outputs of a --per-file run into filename,
+// in the order of their inputs or shuffled with seed (0 = not shuffled), and
+// in shards of shardRows rows (0 = one output). It returns the outputs it
+// wrote, named like those of --split: out_00000.parquet, out_00001.parquet...
+func mergePerFileOutputs(format, filename string, manifest *RunManifest, shardRows int64, seed uint64, wopts WriterOptions) ([]string, error) {
+	manifest.mutex.Lock()
+	files := slices.Clone(manifest.Files)
+	manifest.mutex.Unlock()
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		return a.Path < b.Path || a.Path == b.Path && a.Interface < b.Interface
+	})
+
+	var merged []string
+	for i, output := range formatOutputs(format, filename) {
+		var inputs []string
+		for _, f := range files {
+			if f.Output != "" {
+				inputs = append(inputs, formatOutputs(format, f.Output)[i].filename)
+			}
+		}
+		if len(inputs) == 0 {
+			return merged, fmt.Errorf("no per-file outputs to merge")
+		}
+		shards, err := mergeOutputs(output.format, inputs, output.filename, shardRows, seed, wopts)
+		merged = append(merged, shards...)
+		if err != nil {
+			return merged, fmt.Errorf("%s outputs: %w", output.format, err)
+		}
+	}
+	return merged, nil
+}
+
+// mergeOutputs merges the per-file outputs of one format.
+func mergeOutputs(format string, inputs []string, filename string, shardRows int64, seed uint64, wopts WriterOptions) ([]string, error) {
+	var table mergeTable
+	var err error
+	switch format {
+	case "numpy":
+		table, err = openArrayTable(inputs, false, seed == 0)
+	case "bin":
+		table, err = openArrayTable(inputs, true, seed == 0)
+	case "parquet":
+		table, err = openParquetTable(inputs, seed == 0, wopts)
+	default:
+		table, err = openCSVTable(inputs, seed == 0, wopts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer table.Close()
+
+	// Row i of the merged output is row i of the outputs in turn, or of the shuffled order
+	counts := table.counts()
+	starts := make([]int64, len(counts)+1)
+	for i, n := range counts {
+		starts[i+1] = starts[i] + n
+	}
+	total := starts[len(counts)]
+	var order []int64
+	if seed != 0 {
+		order = make([]int64, total)
+		for i := range order {
+			order[i] = int64(i)
+		}
+		rng := rand.New(rand.NewPCG(seed, 0))
+		rng.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	locate := func(i int64) (int, int64) {
+		if order != nil {
+			i = order[i]
+		}
+		file := sort.Search(len(counts), func(f int) bool { return starts[f+1] > i })
+		return file, i - starts[file]
+	}
+
+	shards := int64(1)
+	if shardRows > 0 && total > shardRows {
+		shards = (total + shardRows - 1) / shardRows
+	}
+	var written []string
+	for s := int64(0); s < shards; s++ {
+		name := filename
+		first, last := int64(0), total
+		if shardRows > 0 {
+			name = splitOutputPath(filename, fmt.Sprintf("%05d", s))
+			first, last = s*shardRows, min((s+1)*shardRows, total)
+		}
+		shard, err := table.newShard(name, last-first)
+		if err != nil {
+			return written, err
+		}
+		for i := first; i < last; i++ {
+			file, row := locate(i)
+			if err := shard.copyRow(file, row); err != nil {
+				shard.abort()
+				return written, fmt.Errorf("row %d of %s: %w", row, inputs[file], err)
+			}
+		}
+		if err := shard.Close(); err != nil {
+			return written, err
+		}
+		written = append(written, name)
+	}
+
+	slog.Info("merged per-file outputs", "format", format, "files", len(inputs), "rows", total, "shards", shards, "output", filename, "shuffled", seed != 0)
+	return written, nil
+}
+
+// mergeArray is one of the fixed-size row arrays of a NumPy or bin output.
+type mergeArray struct {
+	suffix  string // _data.npy, _labels.bin, ...
+	descr   string // NumPy dtype descriptor
+	cols    int    // 0 = 1D array
+	rowSize int    // Bytes per row
+}
+
+// arrayTable is the per-file outputs of a NumPy or bin run. Rows are read in
+// place, so even a shuffled merge needs no more memory than one row.
+type arrayTable struct {
+	bin          bool
+	sequential   bool // Rows are read in order, each file's after the previous one's
+	bases        []string
+	arrays       []mergeArray
+	offsets      [][]int64 // Header size of each file's arrays
+	rows         []int64
+	readers      [][]*rowReader // Opened when first read
+	classes      map[string]byte
+	featureNames []string
+	cols         int // Bin data columns
+	hasData      bool
+}
+
+// openArrayTable reads the headers or sidecars of NumPy or bin outputs and
+// checks that their arrays match.
+func openArrayTable(inputs []string, bin, sequential bool) (*arrayTable, error) {
+	t := &arrayTable{bin: bin, sequential: sequential}
+	for i, input := range inputs {
+		var err error
+		if bin {
+			err = t.addBin(binBaseName(input), i == 0)
+		} else {
+			err = t.addNumpy(numpyBaseName(input), i == 0)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", input, err)
+		}
+	}
+	t.readers = make([][]*rowReader, len(inputs))
+	return t, nil
+}
+
+// addNumpy adds the arrays of a NumPy output. The first output sets the
+// arrays, dtypes and columns the others must have.
+func (t *arrayTable) addNumpy(base string, first bool) error {
+	suffixes := []string{"_data.npy", "_labels.npy", "_features.npy"}
+	if !first {
+		suffixes = suffixes[:0]
+		for _, array := range t.arrays {
+			suffixes = append(suffixes, array.suffix)
+		}
+	}
+	var offsets []int64
+	rows := int64(-1)
+	for _, suffix := range suffixes {
+		file, err := os.Open(base + suffix)
+		if errors.Is(err, os.ErrNotExist) && first && suffix != "_data.npy" {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		descr, n, cols, size, err := readNumpyHeader(bufio.NewReader(file))
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", suffix, err)
+		}
+		elemSize, err := strconv.Atoi(descr[2:])
+		if err != nil {
+			return fmt.Errorf("%s: unsupported dtype %s", suffix, descr)
+		}
+		array := mergeArray{suffix: suffix, descr: descr, cols: cols, rowSize: max(cols, 1) * elemSize}
+		if first {
+			t.arrays = append(t.arrays, array)
+		} else if t.arrays[len(offsets)] != array {
+			return fmt.Errorf("%s is %s with %d columns, unlike the first output", suffix, descr, cols)
+		}
+		if rows >= 0 && n != rows {
+			return fmt.Errorf("%s has %d rows, not %d", suffix, n, rows)
+		}
+		rows = n
+		offsets = append(offsets, size)
+
+		switch {
+		case suffix == "_labels.npy" && first:
+			if t.classes, err = readClassMappingFile(base + "_classes.json"); err != nil {
+				return err
+			}
+		case suffix == "_labels.npy":
+			if err := t.addClasses(base + "_classes.json"); err != nil {
+				return err
+			}
+		case suffix == "_features.npy" && first:
+			if t.featureNames, err = readFeatureNamesFile(base + "_features.json"); err != nil {
+				return err
+			}
+		}
+	}
+	t.bases = append(t.bases, base)
+	t.offsets = append(t.offsets, offsets)
+	t.rows = append(t.rows, rows)
+	return nil
+}
+
+// addBin adds the files of a bin output, described by its sidecar.
+func (t *arrayTable) addBin(base string, first bool) error {
+	data, err := os.ReadFile(base + ".json")
+	if err != nil {
+		return err
+	}
+	var sidecar binSidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return fmt.Errorf("invalid sidecar: %w", err)
+	}
+	var arrays []mergeArray
+	if sidecar.Data != "" {
+		arrays = append(arrays, mergeArray{suffix: ".bin", descr: numpyDescrUint8, cols: sidecar.Cols, rowSize: sidecar.Cols})
+	}
+	if sidecar.Labels != "" {
+		arrays = append(arrays, mergeArray{suffix: "_labels.bin", descr: numpyDescrUint8, rowSize: 1})
+	}
+	var featureNames []string
+	if sidecar.Features != nil {
+		featureNames = sidecar.Features.Names
+		arrays = append(arrays, mergeArray{suffix: "_features.bin", descr: numpyDescrFloat64, cols: sidecar.Features.Cols, rowSize: 8 * sidecar.Features.Cols})
+	}
+	if first {
+		t.arrays, t.featureNames, t.cols, t.hasData = arrays, featureNames, sidecar.Cols, sidecar.Data != ""
+		if sidecar.Labels != "" {
+			t.classes = make(map[string]byte)
+		}
+	} else if !slices.Equal(arrays, t.arrays) || !slices.Equal(featureNames, t.featureNames) {
+		return fmt.Errorf("its arrays do not match those of the first output")
+	}
+	for id, class := range sidecar.Classes {
+		n, err := strconv.ParseUint(id, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid class ID %q", id)
+		}
+		if err := t.addClass(class, byte(n)); err != nil {
+			return err
+		}
+	}
+	t.bases = append(t.bases, base)
+	t.offsets = append(t.offsets, make([]int64, len(arrays)))
+	t.rows = append(t.rows, sidecar.Rows)
+	return nil
+}
+
+// addClasses adds the class mapping of a NumPy output.
+func (t *arrayTable) addClasses(filename string) error {
+	classes, err := readClassMappingFile(filename)
+	if err != nil {
+		return err
+	}
+	for class, id := range classes {
+		if err := t.addClass(class, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addClass adds a class of an output, which must have the same ID in all of them.
+func (t *arrayTable) addClass(class string, id byte) error {
+	if other, ok := t.classes[class]; ok && other != id {
+		return fmt.Errorf("class %q is %d here but %d in the first output", class, id, other)
+	}
+	t.classes[class] = id
+	return nil
+}
+
+func (t *arrayTable) counts() []int64 {
+	return t.rows
+}
+
+// read reads row of the arrays of file into rows, one buffer per array.
+func (t *arrayTable) read(file int, row int64, rows [][]byte) error {
+	if t.readers[file] == nil {
+		// Sequential reads go through a buffer; shuffled ones read single rows
+		for i, array := range t.arrays {
+			f, err := os.Open(t.bases[file] + array.suffix)
+			if err != nil {
+				return err
+			}
+			bufSize := array.rowSize
+			if t.sequential {
+				bufSize = 1024 * 1024
+			}
+			t.readers[file] = append(t.readers[file], &rowReader{file: f, offset: t.offsets[file][i], rowSize: array.rowSize, next: -1, buf: bufio.NewReaderSize(f, bufSize)})
+		}
+	}
+	for i, r := range t.readers[file] {
+		if err := r.read(row, rows[i]); err != nil {
+			return err
+		}
+	}
+	// No later row comes from a file read to its end in order
+	if t.sequential && row == t.rows[file]-1 {
+		t.closeFile(file)
+	}
+	return nil
+}
+
+// closeFile closes the arrays of a file.
+func (t *arrayTable) closeFile(file int) {
+	for _, r := range t.readers[file] {
+		r.file.Close()
+	}
+	t.readers[file] = nil
+}
+
+func (t *arrayTable) Close() error {
+	for file := range t.readers {
+		t.closeFile(file)
+	}
+	return nil
+}
+
+// rowReader reads the fixed-size rows of a file through a buffer, seeking
+// only when the row asked for is not the next one.
+type rowReader struct {
+	file    *os.File
+	offset  int64 // Where row 0 starts
+	rowSize int
+	next    int64 // Row the buffer is at (-1 = none)
+	buf     *bufio.Reader
+}
+
+func (r *rowReader) read(row int64, dst []byte) error {
+	if row != r.next {
+		if _, err := r.file.Seek(r.offset+row*int64(r.rowSize), io.SeekStart); err != nil {
+			return err
+		}
+		r.buf.Reset(r.file)
+	}
+	r.next = row + 1
+	_, err := io.ReadFull(r.buf, dst)
+	return err
+}
+
+// arrayMergeShard is a merged NumPy or bin output.
+type arrayMergeShard struct {
+	table   *arrayTable
+	base    string
+	rows    int64
+	files   []*os.File
+	bufs    []*bufio.Writer
+	row     [][]byte
+	partial partialFiles
+}
+
+func (t *arrayTable) newShard(filename string, rows int64) (mergeShard, error) {
+	s := &arrayMergeShard{table: t, rows: rows}
+	if t.bin {
+		s.base = binBaseName(filename)
+	} else {
+		s.base = numpyBaseName(filename)
+	}
+	for _, array := range t.arrays {
+		file, err := s.partial.create(s.base + array.suffix)
+		if err != nil {
+			s.abort()
+			return nil, err
+		}
+		buf := bufio.NewWriterSize(file, 1024*1024)
+		s.files, s.bufs = append(s.files, file), append(s.bufs, buf)
+		s.row = append(s.row, make([]byte, array.rowSize))
+		if !t.bin {
+			if err := writeNumpyHeader(buf, array.descr, rows, array.cols); err != nil {
+				s.abort()
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *arrayMergeShard) copyRow(file int, row int64) error {
+	if err := s.table.read(file, row, s.row); err != nil {
+		return err
+	}
+	for i, buf := range s.bufs {
+		if _, err := buf.Write(s.row[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finishes the arrays and writes the class mapping and feature names,
+// or the bin sidecar.
+func (s *arrayMergeShard) Close() error {
+	var err error
+	for i, file := range s.files {
+		if flushErr := s.bufs[i].Flush(); err == nil {
+			err = flushErr
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err := s.partial.finish(err); err != nil {
+		return err
+	}
+
+	t := s.table
+	if t.bin {
+		return writeBinSidecar(s.base, s.rows, t.cols, t.hasData, t.classes, t.featureNames)
+	}
+	if t.classes != nil {
+		if err := writeClassMappingFile(s.base+"_classes.json", t.classes); err != nil {
+			return err
+		}
+	}
+	if len(t.featureNames) > 0 {
+		return writeFeatureNamesFile(s.base+"_features.json", t.featureNames)
+	}
+	return nil
+}
+
+func (s *arrayMergeShard) abort() {
+	for _, file := range s.files {
+		file.Close()
+	}
+	s.partial.discard()
+}
+
+// csvTable is the per-file outputs of a CSV run. A shuffled merge holds all
+// their rows in memory.
+type csvTable struct {
+	paths  []string
+	header []string
+	rows   []int64
+	loaded [][][]string // The rows of each file, when shuffled
+	wopts  WriterOptions
+
+	current int // File being read in order (-1 = none)
+	reader  *csv.Reader
+	closer  io.Closer
+	next    int64
+}
+
+// openCSVTable checks that the CSV outputs have the same header and counts or
+// loads their rows.
+func openCSVTable(inputs []string, sequential bool, wopts WriterOptions) (*csvTable, error) {
+	t := &csvTable{wopts: wopts, current: -1}
+	for _, input := range inputs {
+		path := csvOutputPath(input, wopts)
+		reader, closer, err := openCSVFile(path)
+		if err != nil {
+			return nil, err
+		}
+		header, err := reader.Read()
+		if err == nil && t.header != nil && !slices.Equal(header, t.header) {
+			err = fmt.Errorf("its header does not match that of %s", t.paths[0])
+		}
+		var rows int64
+		var records [][]string
+		for err == nil {
+			var record []string
+			if record, err = reader.Read(); err == nil {
+				rows++
+				if !sequential {
+					records = append(records, record)
+				}
+			}
+		}
+		closer.Close()
+		if err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if t.header == nil {
+			t.header = header
+		}
+		t.paths = append(t.paths, path)
+		t.rows = append(t.rows, rows)
+		if !sequential {
+			t.loaded = append(t.loaded, records)
+		}
+	}
+	return t, nil
+}
+
+// openCSVFile opens a CSV output, decompressing a .zst one.
+func openCSVFile(path string) (*csv.Reader, io.Closer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var in io.Reader = bufio.NewReaderSize(file, 1024*1024)
+	var closer io.Closer = file
+	if strings.HasSuffix(path, csvZstdExt) {
+		decoder, err := zstd.NewReader(in)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		in, closer = decoder, zstdFileCloser{decoder, file}
+	}
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1 // --length 0 rows keep their own width
+	return reader, closer, nil
+}
+
+// zstdFileCloser closes a zstd decoder and the file it reads.
+type zstdFileCloser struct {
+	decoder *zstd.Decoder
+	file    *os.File
+}
+
+func (c zstdFileCloser) Close() error {
+	c.decoder.Close()
+	return c.file.Close()
+}
+
+func (t *csvTable) counts() []int64 {
+	return t.rows
+}
+
+// record returns row of file, reading the files in order unless they are loaded.
+func (t *csvTable) record(file int, row int64) ([]string, error) {
+	if t.loaded != nil {
+		return t.loaded[file][row], nil
+	}
+	if file != t.current {
+		if t.closer != nil {
+			t.closer.Close()
+		}
+		reader, closer, err := openCSVFile(t.paths[file])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := reader.Read(); err != nil {
+			closer.Close()
+			return nil, err
+		}
+		t.current, t.reader, t.closer, t.next = file, reader, closer, 0
+	}
+	if row != t.next {
+		return nil, fmt.Errorf("CSV rows must be read in order")
+	}
+	t.next++
+	return t.reader.Read()
+}
+
+func (t *csvTable) Close() error {
+	if t.closer != nil {
+		return t.closer.Close()
+	}
+	return nil
+}
+
+// csvMergeShard is a merged CSV output.
+type csvMergeShard struct {
+	table     *csvTable
+	file      *csvOutput
+	bufWriter *bufio.Writer
+	writer    *csv.Writer
+}
+
+func (t *csvTable) newShard(filename string, rows int64) (mergeShard, error) {
+	file, err := createCSVOutput(filename, t.wopts)
+	if err != nil {
+		return nil, err
+	}
+	s := &csvMergeShard{table: t, file: file, bufWriter: bufio.NewWriterSize(file, 1024*1024)}
+	s.writer = csv.NewWriter(s.bufWriter)
+	if err := s.writer.Write(t.header); err != nil {
+		s.abort()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *csvMergeShard) copyRow(file int, row int64) error {
+	record, err := s.table.record(file, row)
+	if err != nil {
+		return err
+	}
+	return s.writer.Write(record)
+}
+
+func (s *csvMergeShard) Close() error {
+	s.writer.Flush()
+	if err := s.writer.Error(); err != nil {
+		s.file.abort()
+		return err
+	}
+	if err := s.bufWriter.Flush(); err != nil {
+		s.file.abort()
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *csvMergeShard) abort() {
+	s.file.abort()
+}
+
+// parquetTable is the per-file outputs of a Parquet run, which must have the
+// same schema. A shuffled merge holds all their rows in memory.
+type parquetTable struct {
+	paths   []string
+	rows    []int64
+	options []parquet.WriterOption // Schema, compression and metadata of the merged outputs
+	loaded  [][]parquet.Row        // The rows of each file, when shuffled
+
+	current int // File being read in order (-1 = none)
+	file    *os.File
+	reader  *parquet.Reader
+	batch   []parquet.Row
+	pos     int // Next row of batch
+	next    int64
+}
+
+// openParquetTable checks that the Parquet outputs have the same schema and
+// counts or loads their rows.
+func openParquetTable(inputs []string, sequential bool, wopts WriterOptions) (*parquetTable, error) {
+	t := &parquetTable{current: -1}
+	var schema string
+	for i, input := range inputs {
+		file, pf, err := openParquetFile(input)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", input, err)
+		}
+		if i == 0 {
+			schema = pf.Schema().String()
+			t.options = parquetMergeOptions(pf, wopts)
+		} else if pf.Schema().String() != schema {
+			file.Close()
+			return nil, fmt.Errorf("%s: its schema does not match that of %s", input, inputs[0])
+		}
+		t.paths = append(t.paths, input)
+		t.rows = append(t.rows, pf.NumRows())
+		if !sequential {
+			rows, err := readParquetRows(pf)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s: %w", input, err)
+			}
+			t.loaded = append(t.loaded, rows)
+		}
+		file.Close()
+	}
+	return t, nil
+}
+
+// openParquetFile opens a Parquet output.
+func openParquetFile(path string) (*os.File, *parquet.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	pf, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, pf, nil
+}
+
+// parquetMergeOptions returns the writer options of the merged outputs: the
+// schema and metadata of the first per-file output, with the compression and
+// class column index of the stream writer.
+func parquetMergeOptions(pf *parquet.File, wopts WriterOptions) []parquet.WriterOption {
+	schema := pf.Schema()
+	classColumn := "class"
+	for _, name := range []string{"Class", "label"} {
+		if _, ok := schema.Lookup(name); ok {
+			classColumn = name
+		}
+	}
+	options := append(parquetClassIndexOptions(classColumn),
+		schema,
+		parquet.Compression(wopts.parquetCodec()),
+		parquet.PageBufferSize(256*1024),
+	)
+	if column, ok := schema.Lookup("data"); ok && column.Node.Type().Kind() == parquet.ByteArray {
+		options = append(options, parquet.SkipPageBounds("data"))
+	}
+	if _, ok := schema.Lookup("packets", "list", "element", "bytes"); ok {
+		options = append(options, parquet.SkipPageBounds("packets", "list", "element", "bytes"))
+	}
+	for _, kv := range pf.Metadata().KeyValueMetadata {
+		options = append(options, parquet.KeyValueMetadata(kv.Key, kv.Value))
+	}
+	return options
+}
+
+// readParquetRows reads all rows of a Parquet file.
+func readParquetRows(pf *parquet.File) ([]parquet.Row, error) {
+	reader := parquet.NewReader(pf)
+	defer reader.Close()
+	rows := make([]parquet.Row, 0, pf.NumRows())
+	batch := make([]parquet.Row, 1024)
+	for {
+		n, err := reader.ReadRows(batch)
+		for _, row := range batch[:n] {
+			rows = append(rows, row.Clone())
+		}
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *parquetTable) counts() []int64 {
+	return t.rows
+}
+
+// row returns row of file, reading the files in order unless they are
+// loaded. It stays valid until the next call.
+func (t *parquetTable) row(file int, row int64) (parquet.Row, error) {
+	if t.loaded != nil {
+		return t.loaded[file][row], nil
+	}
+	if file != t.current {
+		t.closeFile()
+		f, pf, err := openParquetFile(t.paths[file])
+		if err != nil {
+			return nil, err
+		}
+		t.current, t.file, t.reader, t.next = file, f, parquet.NewReader(pf), 0
+		t.batch, t.pos = t.batch[:0], 0
+	}
+	if row != t.next {
+		return nil, fmt.Errorf("Parquet rows must be read in order")
+	}
+	if t.pos == len(t.batch) {
+		t.batch = t.batch[:cap(t.batch)]
+		if len(t.batch) == 0 {
+			t.batch = make([]parquet.Row, 1024)
+		}
+		n, err := t.reader.ReadRows(t.batch)
+		if n == 0 {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		t.batch, t.pos = t.batch[:n], 0
+	}
+	t.next++
+	t.pos++
+	return t.batch[t.pos-1], nil
+}
+
+// closeFile closes the file being read in order.
+func (t *parquetTable) closeFile() {
+	if t.file != nil {
+		t.reader.Close()
+		t.file.Close()
+		t.file, t.current = nil, -1
+	}
+}
+
+func (t *parquetTable) Close() error {
+	t.closeFile()
+	return nil
+}
+
+// parquetMergeShard is a merged Parquet output.
+type parquetMergeShard struct {
+	table   *parquetTable
+	file    *os.File
+	writer  *parquet.Writer
+	rows    []parquet.Row // Reused one-row batch
+	partial partialFiles
+}
+
+func (t *parquetTable) newShard(filename string, rows int64) (mergeShard, error) {
+	s := &parquetMergeShard{table: t, rows: make([]parquet.Row, 1)}
+	file, err := s.partial.create(filename)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	s.writer = parquet.NewWriter(file, t.options...)
+	return s, nil
+}
+
+func (s *parquetMergeShard) copyRow(file int, row int64) error {
+	values, err := s.table.row(file, row)
+	if err != nil {
+		return err
+	}
+	s.rows[0] = values
+	_, err = s.writer.WriteRows(s.rows)
+	return err
+}
+
+func (s *parquetMergeShard) Close() error {
+	err := s.writer.Close()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return s.partial.finish(err)
+}
+
+func (s *parquetMergeShard) abort() {
+	s.file.Close()
+	s.partial.discard()
+}
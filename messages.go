@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Framings of --messages: how the payload of each direction of a TCP session
+// is cut into application messages.
+const (
+	MessagesOff      = ""
+	MessagesAuto     = "auto"     // TLS records or HTTP messages if a direction starts with one, one message per segment otherwise
+	MessagesTLS      = "tls"      // TLS records: a 5-byte header with a 16-bit length
+	MessagesHTTP     = "http"     // HTTP/1.x messages: the headers and a Content-Length or chunked body
+	MessagesLength16 = "length16" // Messages prefixed by their 16-bit big-endian length, e.g. DNS over TCP
+	MessagesLength32 = "length32" // Messages prefixed by their 32-bit big-endian length
+)
+
+// validMessages reports whether framing is a --messages framing.
+func validMessages(framing string) bool {
+	switch framing {
+	case MessagesOff, MessagesAuto, MessagesTLS, MessagesHTTP, MessagesLength16, MessagesLength32:
+		return true
+	}
+	return false
+}
+
+// maxTLSRecord is the longest TLS record payload a peer may send: 2^14 bytes
+// plus the expansion allowed for compression and encryption.
+const maxTLSRecord = 1<<14 + 2048
+
+// maxLengthPrefixed bounds the length read from a length32 prefix, so random
+// bytes are not taken as the start of a huge message.
+const maxLengthPrefixed = 16 << 20
+
+// messageFramer returns the length of the message at the start of stream, or
+// false if stream does not start with one. A message cut short by the end of
+// the stream takes the rest of it.
+type messageFramer func(stream []byte) (int, bool)
+
+// framerFor returns the framer of a framing. With auto, it is chosen by the
+// start of the stream; nil means one message per segment.
+func framerFor(framing string, stream []byte) messageFramer {
+	switch framing {
+	case MessagesTLS:
+		return tlsRecord
+	case MessagesHTTP:
+		return httpMessage
+	case MessagesLength16:
+		return lengthPrefixed(2)
+	case MessagesLength32:
+		return lengthPrefixed(4)
+	}
+	if _, ok := tlsRecord(stream); ok {
+		return tlsRecord
+	}
+	if _, ok := httpMessage(stream); ok {
+		return httpMessage
+	}
+	return nil
+}
+
+// tlsRecord frames a TLS record: content type 20-24, major version 3 and a
+// 16-bit length.
+func tlsRecord(stream []byte) (int, bool) {
+	if len(stream) < 5 || stream[0] < 20 || stream[0] > 24 || stream[1] != 3 || stream[2] > 4 {
+		return 0, false
+	}
+	length := int(binary.BigEndian.Uint16(stream[3:5]))
+	if length > maxTLSRecord {
+		return 0, false
+	}
+	return min(5+length, len(stream)), true
+}
+
+// lengthPrefixed frames messages that start with their length in size bytes,
+// big-endian, not counting the prefix.
+func lengthPrefixed(size int) messageFramer {
+	return func(stream []byte) (int, bool) {
+		if len(stream) < size {
+			return 0, false
+		}
+		var length int
+		if size == 2 {
+			length = int(binary.BigEndian.Uint16(stream))
+		} else {
+			length = int(binary.BigEndian.Uint32(stream))
+		}
+		if length == 0 || length > maxLengthPrefixed {
+			return 0, false
+		}
+		return min(size+length, len(stream)), true
+	}
+}
+
+// httpMethods are the request methods an HTTP message may start with.
+var httpMethods = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+
+// httpMessage frames an HTTP/1.x request or response: the headers up to the
+// blank line, then a chunked body, a Content-Length body or, for a response
+// without either, the rest of the stream. Requests without a length, and
+// 1xx, 204 and 304 responses, have no body.
+func httpMessage(stream []byte) (int, bool) {
+	line, _, _ := bytes.Cut(stream, []byte("\r\n"))
+	response := bytes.HasPrefix(line, []byte("HTTP/1."))
+	if !response && !isHTTPRequestLine(line) {
+		return 0, false
+	}
+	end := bytes.Index(stream, []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(stream), true // Headers cut short
+	}
+	end += 4
+
+	var chunked, hasLength bool
+	length := 0
+	for _, header := range strings.Split(string(stream[len(line)+2:end-4]), "\r\n") {
+		name, value, _ := strings.Cut(header, ":")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "transfer-encoding":
+			chunked = strings.Contains(strings.ToLower(value), "chunked")
+		case "content-length":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				length, hasLength = n, true
+			}
+		}
+	}
+	switch {
+	case response && noHTTPBody(line):
+		return end, true
+	case chunked:
+		return end + httpChunkedBody(stream[end:]), true
+	case hasLength:
+		return min(end+length, len(stream)), true
+	case response:
+		return len(stream), true // Read until the connection closes
+	}
+	return end, true
+}
+
+// isHTTPRequestLine reports whether line looks like "METHOD target HTTP/1.x".
+func isHTTPRequestLine(line []byte) bool {
+	method, rest, ok := bytes.Cut(line, []byte(" "))
+	if !ok || !bytes.Contains(rest, []byte(" HTTP/1.")) {
+		return false
+	}
+	for _, m := range httpMethods {
+		if string(method) == m {
+			return true
+		}
+	}
+	return false
+}
+
+// noHTTPBody reports whether the status of a response line rules out a body.
+func noHTTPBody(statusLine []byte) bool {
+	fields := bytes.Fields(statusLine)
+	if len(fields) < 2 {
+		return false
+	}
+	status, err := strconv.Atoi(string(fields[1]))
+	return err == nil && (status < 200 || status == 204 || status == 304)
+}
+
+// httpChunkedBody returns the length of a chunked body at the start of body,
+// up to the end of its trailer, or all of body if it is cut short.
+func httpChunkedBody(body []byte) int {
+	pos := 0
+	for {
+		lineEnd := bytes.Index(body[pos:], []byte("\r\n"))
+		if lineEnd < 0 {
+			return len(body)
+		}
+		sizeField, _, _ := bytes.Cut(body[pos:pos+lineEnd], []byte(";"))
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(sizeField)), 16, 64)
+		if err != nil || size < 0 || size > int64(len(body)) {
+			return len(body)
+		}
+		pos += lineEnd + 2
+		if size == 0 {
+			// Trailer fields up to the blank line
+			trailerEnd := bytes.Index(body[pos:], []byte("\r\n"))
+			for trailerEnd > 0 {
+				pos += trailerEnd + 2
+				trailerEnd = bytes.Index(body[pos:], []byte("\r\n"))
+			}
+			if trailerEnd < 0 {
+				return len(body)
+			}
+			return pos + 2
+		}
+		pos += int(size) + 2
+		if pos > len(body) {
+			return len(body)
+		}
+	}
+}
+
+// messageSpan is a message of a session: its bytes and the packet it starts in.
+type messageSpan struct {
+	data      []byte
+	start     PacketResult // Packet holding the first byte
+	decrypted bool         // data is the plaintext of a TLS record (--keylog)
+}
+
+// sessionMessages cuts the packets of a session, in capture order, into
+// messages. The payloads of each direction of a TCP session are joined into a
+// stream and framed; where the framing fails, the bytes up to the next segment
+// are a message and framing resumes there. Datagrams are messages as they
+// are. With keys, the TLS records of the session are decrypted where the key
+// log or the secrets embedded in its file have its secrets. Messages are
+// returned in order of the packet they start in.
+func sessionMessages(packets []PacketResult, framing string, keys *KeyLog, embedded tlsSecrets) []messageSpan {
+	var messages []messageSpan
+	var streams [2][]PacketResult
+	for _, p := range packets {
+		if !p.Segment {
+			messages = append(messages, messageSpan{data: p.Data, start: p})
+			continue
+		}
+		streams[p.Direction&1] = append(streams[p.Direction&1], p)
+	}
+	var directions [2][]messageSpan
+	for d, segments := range streams {
+		directions[d] = streamMessages(segments, framing)
+	}
+	if keys != nil {
+		keys.decrypt(&directions, embedded)
+	}
+	for _, d := range directions {
+		messages = append(messages, d...)
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].start.Index < messages[j].start.Index
+	})
+	return messages
+}
+
+// streamMessages frames the joined payloads of the segments of one direction.
+func streamMessages(segments []PacketResult, framing string) []messageSpan {
+	if len(segments) == 0 {
+		return nil
+	}
+	var stream []byte
+	offsets := make([]int, len(segments)) // Start of each segment in stream
+	for i, s := range segments {
+		offsets[i] = len(stream)
+		stream = append(stream, s.Data...)
+	}
+	segmentAt := func(pos int) int {
+		return sort.Search(len(offsets), func(i int) bool { return offsets[i] > pos }) - 1
+	}
+
+	var messages []messageSpan
+	framer := framerFor(framing, stream)
+	pos := 0
+	for pos < len(stream) {
+		i := segmentAt(pos)
+		n, ok := 0, false
+		if framer != nil {
+			n, ok = framer(stream[pos:])
+		}
+		if !ok || n == 0 {
+			// One message up to the next segment, where framing is tried again
+			n = len(stream) - pos
+			if i+1 < len(segments) {
+				n = offsets[i+1] - pos
+			}
+		}
+		messages = append(messages, messageSpan{data: stream[pos : pos+n], start: segments[i]})
+		pos += n
+	}
+	return messages
+}
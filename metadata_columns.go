@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Source columns of --with-columns, written after the feature columns so each
+// row can be traced back to the packet it came from.
+const (
+	ColumnIndex     = "index"     // Position of the packet (session ID in session mode) in its input file
+	ColumnOrigSize  = "orig_size" // Length before padding/truncation
+	ColumnFilename  = "filename"  // Input capture file name
+	ColumnFlowID    = "flow_id"   // Hash of the packet's flow key (see flowID), the same for every packet of a flow
+	ColumnTimestamp = "timestamp" // Capture time in nanoseconds since the Unix epoch, at the resolution of the capture
+	ColumnDecodeOK  = "decode_ok" // Whether every layer of the packet decoded, false for partially parsed packets
+	ColumnDecrypted = "decrypted" // Whether the row is the plaintext of a TLS record decrypted with --keylog
+)
+
+// parseWithColumns parses a comma-separated --with-columns list, keeping its order.
+func parseWithColumns(spec string) ([]string, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var columns []string
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		column := strings.TrimSpace(part)
+		switch column {
+		case ColumnIndex, ColumnOrigSize, ColumnFilename, ColumnFlowID, ColumnTimestamp, ColumnDecodeOK, ColumnDecrypted:
+		default:
+			return nil, fmt.Errorf("unknown column %q (use index, orig_size, filename, flow_id, timestamp, decode_ok or decrypted)", column)
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("column %q is listed twice", column)
+		}
+		seen[column] = true
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// metadataValue renders a --with-columns value of a row for CSV.
+func metadataValue(p PacketResult, column string) string {
+	switch column {
+	case ColumnIndex:
+		return strconv.Itoa(p.Index)
+	case ColumnOrigSize:
+		return strconv.Itoa(p.OriginalSize)
+	case ColumnFlowID:
+		return strconv.FormatUint(p.FlowID, 10)
+	case ColumnTimestamp:
+		return strconv.FormatInt(p.Timestamp.UnixNano(), 10)
+	case ColumnDecodeOK:
+		return strconv.FormatBool(!p.DecodeFailed)
+	case ColumnDecrypted:
+		return strconv.FormatBool(p.Decrypted)
+	}
+	return p.FileName
+}
+
+// hasColumn reports whether --with-columns lists column.
+func (o WriterOptions) hasColumn(column string) bool {
+	return slices.Contains(o.Columns, column)
+}
+
+// metadataFields returns the Parquet struct fields of --with-columns:
+// int64 index and orig_size, string filename, uint64 flow_id, an int64
+// timestamp annotated as TIMESTAMP(NANOS), which pandas and Arrow read as
+// datetimes, and boolean decode_ok and decrypted.
+func metadataFields(columns []string) []reflect.StructField {
+	fields := make([]reflect.StructField, len(columns))
+	for i, column := range columns {
+		fields[i] = reflect.StructField{
+			Name: fmt.Sprintf("Column_%d", i),
+			Type: reflect.TypeOf(int64(0)),
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, column)),
+		}
+		switch column {
+		case ColumnFilename:
+			fields[i].Type = reflect.TypeOf("")
+			fields[i].Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s,dict"`, column))
+		case ColumnFlowID:
+			fields[i].Type = reflect.TypeOf(uint64(0))
+		case ColumnTimestamp:
+			fields[i].Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s,timestamp(nanosecond)"`, column))
+		case ColumnDecodeOK, ColumnDecrypted:
+			fields[i].Type = reflect.TypeOf(false)
+		}
+	}
+	return fields
+}
+
+// setMetadataFields sets the --with-columns fields of a Parquet row starting at field first.
+func setMetadataFields(row reflect.Value, first int, p PacketResult, columns []string) {
+	for i, column := range columns {
+		field := row.Field(first + i)
+		switch column {
+		case ColumnIndex:
+			field.SetInt(int64(p.Index))
+		case ColumnOrigSize:
+			field.SetInt(int64(p.OriginalSize))
+		case ColumnFilename:
+			field.SetString(p.FileName)
+		case ColumnFlowID:
+			field.SetUint(p.FlowID)
+		case ColumnTimestamp:
+			field.SetInt(p.Timestamp.UnixNano())
+		case ColumnDecodeOK:
+			field.SetBool(!p.DecodeFailed)
+		case ColumnDecrypted:
+			field.SetBool(p.Decrypted)
+		}
+	}
+}
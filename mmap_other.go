@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapSupported reports whether --npy-mmap can map output files here.
+const mmapSupported = false
+
+// mmapFile is not implemented on this platform; --npy-mmap is rejected.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// munmapFile is not implemented on this platform.
+func munmapFile(data []byte) error {
+	return errors.ErrUnsupported
+}
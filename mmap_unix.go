@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapSupported reports whether --npy-mmap can map output files here.
+const mmapSupported = true
+
+// mmapFile maps the first size bytes of file for reading and writing; writes
+// to the mapping go to the file.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// munmapFile unmaps a mapping of mmapFile.
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
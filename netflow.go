@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Export protocol versions, the first two bytes of every message.
+const (
+	netflowV5 = 5
+	netflowV9 = 9
+	ipfixV10  = 10
+)
+
+// Header and record sizes of the fixed layouts.
+const (
+	netflowV5HeaderLen = 24
+	netflowV5RecordLen = 48
+	netflowV9HeaderLen = 20
+	ipfixHeaderLen     = 16
+	flowSetHeaderLen   = 4
+)
+
+// Set IDs below 256 carry templates; data sets use the ID of their template.
+const (
+	netflowV9TemplateSet        = 0
+	netflowV9OptionsTemplateSet = 1
+	ipfixTemplateSet            = 2
+	ipfixOptionsTemplateSet     = 3
+	firstDataSetID              = 256
+)
+
+// Information elements read from v9/IPFIX records (same numbers in both).
+const (
+	ieOctetDeltaCount      = 1
+	iePacketDeltaCount     = 2
+	ieProtocolIdentifier   = 4
+	ieIPClassOfService     = 5
+	ieTCPControlBits       = 6
+	ieSourceTransportPort  = 7
+	ieSourceIPv4Address    = 8
+	ieDestTransportPort    = 11
+	ieDestIPv4Address      = 12
+	ieFlowEndSysUpTime     = 21
+	ieFlowStartSysUpTime   = 22
+	ieSourceIPv6Address    = 27
+	ieDestIPv6Address      = 28
+	ieOctetTotalCount      = 85
+	iePacketTotalCount     = 86
+	ieFlowStartSeconds     = 150
+	ieFlowEndSeconds       = 151
+	ieFlowStartMillisecond = 152
+	ieFlowEndMillisecond   = 153
+)
+
+// ipfixVariableLength marks a variable-length field in an IPFIX template.
+const ipfixVariableLength = 65535
+
+// pcapngMagic is the block type of a pcapng Section Header Block.
+const pcapngMagic = 0x0a0d0d0a
+
+// netflowAddrBytes is the row width of flow records: the source and
+// destination addresses, 16 bytes each (IPv4 as IPv4-mapped IPv6).
+const netflowAddrBytes = 32
+
+// netflowFeatureNames are the feature columns of flow record rows (--netflow).
+var netflowFeatureNames = []string{
+	"src_port",
+	"dst_port",
+	"protocol",
+	"tcp_flags",
+	"tos",
+	"packets",
+	"bytes",
+	"start",    // Unix seconds
+	"duration", // Seconds
+}
+
+// flowRecord is one flow of a NetFlow/IPFIX export.
+type flowRecord struct {
+	src, dst         net.IP
+	srcPort, dstPort uint16
+	protocol         uint8
+	tcpFlags         uint8
+	tos              uint8
+	packets, bytes   uint64
+	start, end       time.Time
+}
+
+// templateKey identifies a template: template IDs are only unique per
+// exporter and observation domain (source ID in v9).
+type templateKey struct {
+	exporter string
+	version  uint16
+	domain   uint32
+	id       uint16
+}
+
+// templateField is one field of a data template.
+type templateField struct {
+	id     uint16
+	length uint16 // ipfixVariableLength for variable-length IPFIX fields
+	skip   bool   // Enterprise-specific field, read past but not decoded
+}
+
+// netflowDecoder decodes export messages into flow records. It keeps the
+// templates announced so far, so messages of one stream must be decoded in
+// order by the same decoder.
+type netflowDecoder struct {
+	templates map[templateKey][]templateField
+	unknown   map[templateKey]bool // Data sets skipped for lack of a template, logged once
+}
+
+func newNetflowDecoder() *netflowDecoder {
+	return &netflowDecoder{
+		templates: make(map[templateKey][]templateField),
+		unknown:   make(map[templateKey]bool),
+	}
+}
+
+// decode returns the flow records of one export message from exporter.
+func (d *netflowDecoder) decode(msg []byte, exporter string) ([]flowRecord, error) {
+	if len(msg) < 2 {
+		return nil, errors.New("export message too short")
+	}
+	switch version := binary.BigEndian.Uint16(msg); version {
+	case netflowV5:
+		return decodeNetflowV5(msg)
+	case netflowV9:
+		return d.decodeSets(msg, exporter, netflowV9)
+	case ipfixV10:
+		return d.decodeSets(msg, exporter, ipfixV10)
+	default:
+		return nil, fmt.Errorf("unsupported export version %d (expected NetFlow v5, v9 or IPFIX)", version)
+	}
+}
+
+// decodeNetflowV5 decodes a NetFlow v5 message: a header and fixed 48-byte records.
+func decodeNetflowV5(msg []byte) ([]flowRecord, error) {
+	if len(msg) < netflowV5HeaderLen {
+		return nil, errors.New("NetFlow v5 header truncated")
+	}
+	count := int(binary.BigEndian.Uint16(msg[2:4]))
+	if len(msg) < netflowV5HeaderLen+count*netflowV5RecordLen {
+		return nil, fmt.Errorf("NetFlow v5 message truncated: %d records announced", count)
+	}
+	uptime := binary.BigEndian.Uint32(msg[4:8])
+	export := time.Unix(int64(binary.BigEndian.Uint32(msg[8:12])), int64(binary.BigEndian.Uint32(msg[12:16])))
+
+	records := make([]flowRecord, 0, count)
+	for i := 0; i < count; i++ {
+		r := msg[netflowV5HeaderLen+i*netflowV5RecordLen:]
+		records = append(records, flowRecord{
+			src:      net.IP(r[0:4]).To16(),
+			dst:      net.IP(r[4:8]).To16(),
+			packets:  uint64(binary.BigEndian.Uint32(r[16:20])),
+			bytes:    uint64(binary.BigEndian.Uint32(r[20:24])),
+			start:    uptimeToTime(export, uptime, binary.BigEndian.Uint32(r[24:28])),
+			end:      uptimeToTime(export, uptime, binary.BigEndian.Uint32(r[28:32])),
+			srcPort:  binary.BigEndian.Uint16(r[32:34]),
+			dstPort:  binary.BigEndian.Uint16(r[34:36]),
+			tcpFlags: r[37],
+			protocol: r[38],
+			tos:      r[39],
+		})
+	}
+	return records, nil
+}
+
+// uptimeToTime converts a router uptime in milliseconds to wall-clock time,
+// given the export time and the uptime at export.
+func uptimeToTime(export time.Time, exportUptime, uptime uint32) time.Time {
+	// Serial arithmetic, so values from before an uptime wraparound stay in the past
+	return export.Add(-time.Duration(int32(exportUptime-uptime)) * time.Millisecond)
+}
+
+// decodeSets decodes a v9 or IPFIX message: templates are stored and data sets
+// decoded with the templates known so far.
+func (d *netflowDecoder) decodeSets(msg []byte, exporter string, version uint16) ([]flowRecord, error) {
+	headerLen := netflowV9HeaderLen
+	if version == ipfixV10 {
+		headerLen = ipfixHeaderLen
+	}
+	if len(msg) < headerLen {
+		return nil, fmt.Errorf("export v%d header truncated", version)
+	}
+
+	var export time.Time
+	var uptime uint32
+	var domain uint32
+	if version == netflowV9 {
+		uptime = binary.BigEndian.Uint32(msg[4:8])
+		export = time.Unix(int64(binary.BigEndian.Uint32(msg[8:12])), 0)
+		domain = binary.BigEndian.Uint32(msg[16:20])
+	} else {
+		length := int(binary.BigEndian.Uint16(msg[2:4]))
+		if length < headerLen || length > len(msg) {
+			return nil, fmt.Errorf("export v%d message has invalid length %d", version, length)
+		}
+		msg = msg[:length]
+		export = time.Unix(int64(binary.BigEndian.Uint32(msg[4:8])), 0)
+		domain = binary.BigEndian.Uint32(msg[12:16])
+	}
+
+	var records []flowRecord
+	sets := msg[headerLen:]
+	for len(sets) >= flowSetHeaderLen {
+		id := binary.BigEndian.Uint16(sets[0:2])
+		length := int(binary.BigEndian.Uint16(sets[2:4]))
+		if length < flowSetHeaderLen || length > len(sets) {
+			return records, fmt.Errorf("export v%d set %d has invalid length %d", version, id, length)
+		}
+		body := sets[flowSetHeaderLen:length]
+		sets = sets[length:]
+
+		key := templateKey{exporter: exporter, version: version, domain: domain}
+		switch {
+		case id == netflowV9TemplateSet && version == netflowV9, id == ipfixTemplateSet && version == ipfixV10:
+			d.readTemplates(body, key)
+		case id == netflowV9OptionsTemplateSet && version == netflowV9:
+			// Options data (sampling rates, interface names, ...) is not flow data
+		case id == ipfixOptionsTemplateSet && version == ipfixV10:
+		case id >= firstDataSetID:
+			key.id = id
+			fields, ok := d.templates[key]
+			if !ok {
+				if !d.unknown[key] {
+					d.unknown[key] = true
+					slog.Debug("skipping data set without template", "exporter", exporter, "template", id)
+				}
+				continue
+			}
+			records = append(records, decodeDataSet(body, fields, export, uptime)...)
+		}
+	}
+	return records, nil
+}
+
+// readTemplates stores the templates of a template set and returns how many
+// it held.
+func (d *netflowDecoder) readTemplates(body []byte, key templateKey) int {
+	stored := 0
+	for len(body) >= 4 {
+		key.id = binary.BigEndian.Uint16(body[0:2])
+		count := int(binary.BigEndian.Uint16(body[2:4]))
+		body = body[4:]
+		if key.id < firstDataSetID {
+			// Padding at the end of the set
+			return stored
+		}
+
+		fields := make([]templateField, 0, count)
+		for i := 0; i < count; i++ {
+			if len(body) < 4 {
+				return stored
+			}
+			field := templateField{
+				id:     binary.BigEndian.Uint16(body[0:2]),
+				length: binary.BigEndian.Uint16(body[2:4]),
+			}
+			body = body[4:]
+			if key.version == ipfixV10 && field.id&0x8000 != 0 {
+				// Enterprise-specific element, followed by its enterprise number
+				if len(body) < 4 {
+					return stored
+				}
+				body = body[4:]
+				field.skip = true
+			}
+			fields = append(fields, field)
+		}
+		d.templates[key] = fields
+		stored++
+	}
+	return stored
+}
+
+// decodeDataSet decodes the records of a data set. Trailing bytes too short for
+// another record are padding.
+func decodeDataSet(body []byte, fields []templateField, export time.Time, uptime uint32) []flowRecord {
+	minLen := 0
+	for _, field := range fields {
+		if field.length == ipfixVariableLength {
+			minLen++
+		} else {
+			minLen += int(field.length)
+		}
+	}
+
+	var records []flowRecord
+	for minLen > 0 && len(body) >= minLen {
+		var r flowRecord
+		var startUptime, endUptime uint32
+		var hasUptime bool
+		for _, field := range fields {
+			length := int(field.length)
+			if field.length == ipfixVariableLength {
+				if len(body) < 1 {
+					return records
+				}
+				length, body = int(body[0]), body[1:]
+				if length == 255 {
+					if len(body) < 2 {
+						return records
+					}
+					length, body = int(binary.BigEndian.Uint16(body)), body[2:]
+				}
+			}
+			if length > len(body) {
+				return records
+			}
+			value := body[:length]
+			body = body[length:]
+			if field.skip {
+				continue
+			}
+
+			switch field.id {
+			case ieSourceIPv4Address, ieSourceIPv6Address:
+				r.src = net.IP(value).To16()
+			case ieDestIPv4Address, ieDestIPv6Address:
+				r.dst = net.IP(value).To16()
+			case ieSourceTransportPort:
+				r.srcPort = uint16(readUint(value))
+			case ieDestTransportPort:
+				r.dstPort = uint16(readUint(value))
+			case ieProtocolIdentifier:
+				r.protocol = uint8(readUint(value))
+			case ieTCPControlBits:
+				r.tcpFlags = uint8(readUint(value))
+			case ieIPClassOfService:
+				r.tos = uint8(readUint(value))
+			case iePacketDeltaCount, iePacketTotalCount:
+				r.packets = readUint(value)
+			case ieOctetDeltaCount, ieOctetTotalCount:
+				r.bytes = readUint(value)
+			case ieFlowStartSysUpTime:
+				startUptime, hasUptime = uint32(readUint(value)), true
+			case ieFlowEndSysUpTime:
+				endUptime = uint32(readUint(value))
+			case ieFlowStartSeconds:
+				r.start = time.Unix(int64(readUint(value)), 0)
+			case ieFlowEndSeconds:
+				r.end = time.Unix(int64(readUint(value)), 0)
+			case ieFlowStartMillisecond:
+				r.start = time.UnixMilli(int64(readUint(value)))
+			case ieFlowEndMillisecond:
+				r.end = time.UnixMilli(int64(readUint(value)))
+			}
+		}
+		// v9 exporters report uptimes relative to the message's system uptime
+		if hasUptime && uptime != 0 {
+			r.start = uptimeToTime(export, uptime, startUptime)
+			r.end = uptimeToTime(export, uptime, endUptime)
+		}
+		if r.start.IsZero() {
+			r.start = export
+		}
+		if r.end.Before(r.start) {
+			r.end = r.start
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// readUint reads a big-endian unsigned integer of up to 8 bytes (templates may
+// shorten counters, e.g. to 4 bytes).
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b[:min(len(b), 8)] {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// mapped returns the prefix of addr in its 16-byte form, where an IPv4
+// address follows the 96 bits of the IPv4-mapped prefix.
+func (p IPMaskPrefix) mapped(addr net.IP) int {
+	if addr.To4() == nil {
+		return p.IPv6
+	}
+	if p.IPv4 == 0 {
+		return 0
+	}
+	return 96 + p.IPv4
+}
+
+// row turns a flow record into an output row.
+func (r flowRecord) row(index int, class, fileName string, opts ProcessOptions) PacketResult {
+	data := make([]byte, netflowAddrBytes)
+	copy(data[:16], r.src.To16())
+	copy(data[16:], r.dst.To16())
+	if opts.MaskIP {
+		zeroHostBits(data[:16], opts.MaskPrefix.mapped(r.src))
+		zeroHostBits(data[16:], opts.MaskPrefix.mapped(r.dst))
+	}
+	return PacketResult{
+		Index:        index,
+		OriginalSize: netflowAddrBytes,
+		Data:         data,
+		Class:        class,
+		FileName:     fileName,
+		Timestamp:    opts.emitTime(r.start),
+		Features: []float64{
+			float64(r.srcPort),
+			float64(r.dstPort),
+			float64(r.protocol),
+			float64(r.tcpFlags),
+			float64(r.tos),
+			float64(r.packets),
+			float64(r.bytes),
+			float64(opts.emitTime(r.start).UnixNano()) / 1e9,
+			r.end.Sub(r.start).Seconds(),
+		},
+	}
+}
+
+// flowRows numbers the records of one message from the file's next index on,
+// applies --class-weights and the row limit, and returns the rows.
+func flowRows(records []flowRecord, next *int, fileJob FileJob, fileName string, opts ProcessOptions) []PacketResult {
+	rows := make([]PacketResult, 0, len(records))
+	for _, r := range records {
+		index := *next
+		*next++
+		if opts.ClassWeights != nil && !opts.ClassWeights.keep(fileJob.Class, fileName, index) {
+			continue
+		}
+		row := r.row(index, fileJob.Class, fileName, opts)
+		if opts.Split != nil {
+			// Every record is a flow of its own, so flow grouping is per record
+			row.Split = opts.Split.assign(fileName, index, FlowKey{}, false, 0)
+		}
+		rows = append(rows, row)
+	}
+	return opts.finishRows(rows)
+}
+
+// processNetflowFile reads the flow records of an export file and passes their
+// rows to emit, one batch per export message. The file is either a pcap/pcapng
+// capture of the exporter's UDP datagrams or a raw stream of export messages
+// (e.g. an RFC 5655 IPFIX file).
+func processNetflowFile(ctx context.Context, fileJob FileJob, opts ProcessOptions, emit func([]PacketResult) error) (int, error) {
+	file, err := os.Open(fileJob.FilePath)
+	if err != nil {
+		return 0, fmt.Errorf("%w %s: %w", errCannotOpen, fileJob.FilePath, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return 0, fmt.Errorf("%w %s: %w", errCannotOpen, fileJob.FilePath, err)
+	}
+
+	fileName := fileJob.name()
+	decoder := newNetflowDecoder()
+	count, next := 0, 0
+	handle := func(msg []byte, exporter string) error {
+		opts.Throughput.read(1, int64(len(msg)))
+		records, err := decoder.decode(msg, exporter)
+		if err != nil {
+			slog.Warn("skipping undecodable export message", "file", fileJob.FilePath, "error", err)
+		}
+		rows := flowRows(records, &next, fileJob, fileName, opts)
+		if len(rows) == 0 {
+			return nil
+		}
+		if err := emit(rows); err != nil {
+			return fmt.Errorf("error writing flow records: %w", err)
+		}
+		count += len(rows)
+		return nil
+	}
+
+	if isCaptureFile(magic) {
+		err := readNetflowCapture(ctx, fileJob, opts, handle)
+		return count, err
+	}
+
+	for ctx.Err() == nil && !opts.Limit.reached() {
+		msg, err := readExportMessage(reader, decoder)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A stream cannot be resynchronized after a broken message
+			slog.Warn("stopped reading export file", "file", fileJob.FilePath, "records", next, "error", err)
+			break
+		}
+		if err := handle(msg, ""); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// isCaptureFile reports whether a file starting with magic is a pcap (either
+// byte order) or pcapng capture.
+func isCaptureFile(magic []byte) bool {
+	for _, m := range []uint32{binary.LittleEndian.Uint32(magic), binary.BigEndian.Uint32(magic)} {
+		if m == pcapMagicMicros || m == pcapMagicNanos || m == pcapngMagic {
+			return true
+		}
+	}
+	return false
+}
+
+// readNetflowCapture passes the UDP payload of every packet of a capture to
+// handle, with the exporter's address and port.
+func readNetflowCapture(ctx context.Context, fileJob FileJob, opts ProcessOptions, handle func(msg []byte, exporter string) error) error {
+	capture, err := openInput(fileJob, opts)
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", errCannotOpen, fileJob.FilePath, err)
+	}
+	defer capture.Close()
+
+	packetSource := gopacket.NewPacketSource(capture, capture.LinkType())
+	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	for ctx.Err() == nil && !opts.Limit.reached() {
+		packet, err := packetSource.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			slog.Warn("stopped reading file", "file", fileJob.FilePath, "error", err)
+			break
+		}
+		udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok || packet.NetworkLayer() == nil {
+			continue
+		}
+		exporter := fmt.Sprintf("%s:%d", packet.NetworkLayer().NetworkFlow().Src(), udp.SrcPort)
+		if err := handle(udp.Payload, exporter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExportMessage reads the next message of a raw export stream. NetFlow v9
+// headers carry a record count instead of a length, so v9 messages are read
+// set by set until all records are accounted for, which needs the templates
+// of the stream so far.
+func readExportMessage(r *bufio.Reader, decoder *netflowDecoder) ([]byte, error) {
+	header, err := r.Peek(4)
+	if err == io.EOF && len(header) == 0 {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("export message header truncated: %w", err)
+	}
+
+	var length int
+	switch version := binary.BigEndian.Uint16(header); version {
+	case netflowV5:
+		length = netflowV5HeaderLen + int(binary.BigEndian.Uint16(header[2:4]))*netflowV5RecordLen
+	case ipfixV10:
+		// A length below the header would never consume the stream
+		if length = int(binary.BigEndian.Uint16(header[2:4])); length < ipfixHeaderLen {
+			return nil, fmt.Errorf("IPFIX message has invalid length %d", length)
+		}
+	case netflowV9:
+		return readNetflowV9Message(r, decoder)
+	default:
+		return nil, fmt.Errorf("unsupported export version %d", version)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("export message truncated: %w", err)
+	}
+	return msg, nil
+}
+
+// readNetflowV9Message reads a v9 message from a raw stream.
+func readNetflowV9Message(r *bufio.Reader, decoder *netflowDecoder) ([]byte, error) {
+	msg := make([]byte, netflowV9HeaderLen)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("NetFlow v9 header truncated: %w", err)
+	}
+	remaining := int(binary.BigEndian.Uint16(msg[2:4]))
+	key := templateKey{version: netflowV9, domain: binary.BigEndian.Uint32(msg[16:20])}
+
+	for remaining > 0 {
+		header := make([]byte, flowSetHeaderLen)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, fmt.Errorf("NetFlow v9 flowset truncated: %w", err)
+		}
+		id := binary.BigEndian.Uint16(header[0:2])
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		if length < flowSetHeaderLen {
+			return nil, fmt.Errorf("NetFlow v9 flowset %d has invalid length %d", id, length)
+		}
+		body := make([]byte, length-flowSetHeaderLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("NetFlow v9 flowset truncated: %w", err)
+		}
+		msg = append(append(msg, header...), body...)
+
+		switch {
+		case id == netflowV9TemplateSet:
+			remaining -= max(1, decoder.readTemplates(body, key))
+		case id == netflowV9OptionsTemplateSet:
+			remaining -= countOptionsTemplates(body)
+		case id >= firstDataSetID:
+			key.id = id
+			fields, ok := decoder.templates[key]
+			if !ok {
+				return nil, fmt.Errorf("NetFlow v9 data flowset %d precedes its template", id)
+			}
+			recordLen := 0
+			for _, field := range fields {
+				recordLen += int(field.length)
+			}
+			if recordLen == 0 {
+				return nil, fmt.Errorf("NetFlow v9 template %d is empty", id)
+			}
+			remaining -= len(body) / recordLen
+		default:
+			remaining--
+		}
+	}
+	return msg, nil
+}
+
+// countOptionsTemplates counts the templates of a v9 options template flowset.
+func countOptionsTemplates(body []byte) int {
+	count := 0
+	for len(body) >= 6 {
+		if binary.BigEndian.Uint16(body[0:2]) < firstDataSetID {
+			break
+		}
+		scopeLen := int(binary.BigEndian.Uint16(body[2:4]))
+		optionLen := int(binary.BigEndian.Uint16(body[4:6]))
+		body = body[min(len(body), 6+scopeLen+optionLen):]
+		count++
+	}
+	return max(1, count)
+}
+
+// listenNetflow receives export datagrams on a UDP address and writes their
+// rows until ctx is cancelled (Ctrl-C) or the row limit is reached.
+func listenNetflow(ctx context.Context, addr string, writer StreamWriter, opts ProcessOptions) (int, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	slog.Info("listening for NetFlow/IPFIX exports", "addr", conn.LocalAddr())
+
+	// Unblock the read when the run is stopped
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	decoder := newNetflowDecoder()
+	fileJob := FileJob{FilePath: addr}
+	count, next := 0, 0
+	buf := make([]byte, 65535)
+	for ctx.Err() == nil && !opts.Limit.reached() {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return count, err
+		}
+		exporter := from.String()
+		records, err := decoder.decode(buf[:n], exporter)
+		if err != nil {
+			slog.Warn("skipping undecodable export datagram", "exporter", exporter, "error", err)
+		}
+		rows := flowRows(records, &next, fileJob, exporter, opts)
+		if len(rows) == 0 {
+			continue
+		}
+		if err := writer.WriteBatch(rows); err != nil {
+			return count, err
+		}
+		count += len(rows)
+	}
+	return count, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// exportSet returns a v9 FlowSet or IPFIX set: its ID, its length and body,
+// zero-padded to four bytes like exporters do.
+func exportSet(id uint16, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	set := binary.BigEndian.AppendUint16(nil, id)
+	set = binary.BigEndian.AppendUint16(set, uint16(flowSetHeaderLen+len(body)))
+	return append(set, body...)
+}
+
+// exportTemplate returns a template record announcing fields, given as
+// (element ID, length) pairs.
+func exportTemplate(id uint16, fields ...uint16) []byte {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(fields)/2))
+	for _, v := range fields {
+		body = binary.BigEndian.AppendUint16(body, v)
+	}
+	return body
+}
+
+// netflowV9Message returns a v9 message of sets, with the router uptime in
+// milliseconds and the export time in Unix seconds.
+func netflowV9Message(uptime, unixSecs, sourceID uint32, sets ...[]byte) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, netflowV9)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(sets)))
+	msg = binary.BigEndian.AppendUint32(msg, uptime)
+	msg = binary.BigEndian.AppendUint32(msg, unixSecs)
+	msg = binary.BigEndian.AppendUint32(msg, 1) // Sequence number
+	msg = binary.BigEndian.AppendUint32(msg, sourceID)
+	for _, set := range sets {
+		msg = append(msg, set...)
+	}
+	return msg
+}
+
+// ipfixMessage returns an IPFIX message of sets.
+func ipfixMessage(exportSecs, domain uint32, sets ...[]byte) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, ipfixV10)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint32(msg, exportSecs)
+	msg = binary.BigEndian.AppendUint32(msg, 1) // Sequence number
+	msg = binary.BigEndian.AppendUint32(msg, domain)
+	for _, set := range sets {
+		msg = append(msg, set...)
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	return msg
+}
+
+// checkFlow compares the fields of a decoded flow record with want.
+func checkFlow(t *testing.T, got, want flowRecord) {
+	t.Helper()
+	if !got.src.Equal(want.src) || !got.dst.Equal(want.dst) || got.srcPort != want.srcPort || got.dstPort != want.dstPort ||
+		got.protocol != want.protocol || got.tcpFlags != want.tcpFlags || got.tos != want.tos ||
+		got.packets != want.packets || got.bytes != want.bytes || !got.start.Equal(want.start) || !got.end.Equal(want.end) {
+		t.Errorf("flow = %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeNetflowV5(t *testing.T) {
+	record := func(src, dst net.IP, packets, first, last uint32, sport, dport uint16, flags, proto, tos byte) []byte {
+		r := append(append([]byte(nil), src.To4()...), dst.To4()...)
+		r = append(r, make([]byte, 8)...) // Next hop, input and output interface
+		r = binary.BigEndian.AppendUint32(r, packets)
+		r = binary.BigEndian.AppendUint32(r, packets*100)
+		r = binary.BigEndian.AppendUint32(r, first)
+		r = binary.BigEndian.AppendUint32(r, last)
+		r = binary.BigEndian.AppendUint16(r, sport)
+		r = binary.BigEndian.AppendUint16(r, dport)
+		r = append(r, 0, flags, proto, tos)
+		return append(r, make([]byte, 8)...) // AS numbers, masks and padding
+	}
+	msg := binary.BigEndian.AppendUint16(nil, netflowV5)
+	msg = binary.BigEndian.AppendUint16(msg, 2)
+	msg = binary.BigEndian.AppendUint32(msg, 100000)     // Uptime (ms)
+	msg = binary.BigEndian.AppendUint32(msg, 1700000000) // Export seconds
+	msg = binary.BigEndian.AppendUint32(msg, 0)          // Export nanoseconds
+	msg = append(msg, make([]byte, 8)...)                // Sequence, engine and sampling
+	msg = append(msg, record(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 3, 90000, 95000, 40000, 443, 0x1b, 6, 0)...)
+	msg = append(msg, record(net.IP{10, 0, 0, 3}, net.IP{8, 8, 8, 8}, 1, 99000, 99000, 53000, 53, 0, 17, 0x20)...)
+
+	records, err := newNetflowDecoder().decode(msg, "router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	export := time.Unix(1700000000, 0)
+	checkFlow(t, records[0], flowRecord{src: net.IP{10, 0, 0, 1}, dst: net.IP{10, 0, 0, 2}, srcPort: 40000, dstPort: 443, protocol: 6, tcpFlags: 0x1b,
+		packets: 3, bytes: 300, start: export.Add(-10 * time.Second), end: export.Add(-5 * time.Second)})
+	checkFlow(t, records[1], flowRecord{src: net.IP{10, 0, 0, 3}, dst: net.IP{8, 8, 8, 8}, srcPort: 53000, dstPort: 53, protocol: 17, tos: 0x20,
+		packets: 1, bytes: 100, start: export.Add(-time.Second), end: export.Add(-time.Second)})
+
+	if _, err := newNetflowDecoder().decode(msg[:len(msg)-10], "router"); err == nil {
+		t.Error("truncated v5 message: no error")
+	}
+	if _, err := newNetflowDecoder().decode(msg[:netflowV5HeaderLen-1], "router"); err == nil {
+		t.Error("truncated v5 header: no error")
+	}
+}
+
+// TestDecodeNetflowV9TemplateOrder checks that data sets are decoded only once
+// their template is known: data ahead of its template in a message is
+// skipped, data after it (and in later messages) is decoded, and templates
+// do not leak to other source IDs.
+func TestDecodeNetflowV9TemplateOrder(t *testing.T) {
+	template := exportSet(netflowV9TemplateSet, exportTemplate(256,
+		ieSourceIPv4Address, 4, ieDestIPv4Address, 4, ieSourceTransportPort, 2, ieDestTransportPort, 2,
+		ieProtocolIdentifier, 1, iePacketDeltaCount, 4, ieOctetDeltaCount, 4, ieFlowStartSysUpTime, 4, ieFlowEndSysUpTime, 4))
+	data := func(sport uint16) []byte {
+		r := []byte{192, 168, 1, 10, 192, 168, 1, 1}
+		r = binary.BigEndian.AppendUint16(r, sport)
+		r = binary.BigEndian.AppendUint16(r, 22)
+		r = append(r, 6)
+		r = binary.BigEndian.AppendUint32(r, 12)
+		r = binary.BigEndian.AppendUint32(r, 3400)
+		r = binary.BigEndian.AppendUint32(r, 40000)
+		r = binary.BigEndian.AppendUint32(r, 48000)
+		return exportSet(256, r) // 29-byte record, padded to 32
+	}
+
+	decoder := newNetflowDecoder()
+	records, err := decoder.decode(netflowV9Message(50000, 1700000000, 7, data(1), template, data(2)), "router")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].srcPort != 2 {
+		t.Fatalf("got %+v, want only the record after the template", records)
+	}
+	export := time.Unix(1700000000, 0)
+	checkFlow(t, records[0], flowRecord{src: net.IP{192, 168, 1, 10}, dst: net.IP{192, 168, 1, 1}, srcPort: 2, dstPort: 22, protocol: 6,
+		packets: 12, bytes: 3400, start: export.Add(-10 * time.Second), end: export.Add(-2 * time.Second)})
+
+	records, err = decoder.decode(netflowV9Message(51000, 1700000001, 7, data(3)), "router")
+	if err != nil || len(records) != 1 || records[0].srcPort != 3 {
+		t.Errorf("later message: got %+v, %v, want the record decoded with the stored template", records, err)
+	}
+	for _, other := range []struct {
+		exporter string
+		sourceID uint32
+	}{{"router", 8}, {"other-router", 7}} {
+		records, err = decoder.decode(netflowV9Message(51000, 1700000001, other.sourceID, data(4)), other.exporter)
+		if err != nil || len(records) != 0 {
+			t.Errorf("%s source ID %d: got %+v, %v, want no records without its own template", other.exporter, other.sourceID, records, err)
+		}
+	}
+}
+
+// TestDecodeIPFIX decodes records with IPFIX-only fields (millisecond times,
+// 8-byte counters, an enterprise element and a variable-length element) and
+// stops at a record cut short by the end of its set.
+func TestDecodeIPFIX(t *testing.T) {
+	template := exportTemplate(300,
+		ieSourceIPv6Address, 16, ieDestIPv6Address, 16,
+		0x8000|1000, 2, 0, 9, // Enterprise element 1000, then its enterprise number 9 as two uint16s
+		ieSourceTransportPort, 2, ieDestTransportPort, 2, ieProtocolIdentifier, 1,
+		iePacketTotalCount, 8, ieOctetTotalCount, 8, ieFlowStartMillisecond, 8, ieFlowEndMillisecond, 8,
+		82, ipfixVariableLength) // interfaceName
+	// 11 fields: the enterprise number is not one
+	binary.BigEndian.PutUint16(template[2:], 11)
+
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	start := time.UnixMilli(1700000000123)
+	record := func(name string, nameLen byte) []byte {
+		r := append(append([]byte(nil), src...), dst...)
+		r = append(r, 0xff, 0xff)
+		r = binary.BigEndian.AppendUint16(r, 5353)
+		r = binary.BigEndian.AppendUint16(r, 443)
+		r = append(r, 17)
+		r = binary.BigEndian.AppendUint64(r, 5)
+		r = binary.BigEndian.AppendUint64(r, 6000)
+		r = binary.BigEndian.AppendUint64(r, uint64(start.UnixMilli()))
+		r = binary.BigEndian.AppendUint64(r, uint64(start.UnixMilli()+1500))
+		return append(append(r, nameLen), name...)
+	}
+	body := append(record("eth0", 4), record("", 0)...)
+	body = append(body, record("", 200)...) // Claims 200 name bytes the set does not have
+
+	records, err := newNetflowDecoder().decode(ipfixMessage(1700000010, 1, exportSet(ipfixTemplateSet, template), exportSet(300, body)), "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2 (the truncated third one dropped)", len(records))
+	}
+	for _, r := range records {
+		checkFlow(t, r, flowRecord{src: src, dst: dst, srcPort: 5353, dstPort: 443, protocol: 17,
+			packets: 5, bytes: 6000, start: start, end: start.Add(1500 * time.Millisecond)})
+	}
+}
+
+// TestDecodeTruncatedExport checks that messages and sets cut short are
+// errors, and that the records before a bad set are still returned.
+func TestDecodeTruncatedExport(t *testing.T) {
+	template := exportSet(ipfixTemplateSet, exportTemplate(256, ieSourceIPv4Address, 4, ieDestIPv4Address, 4))
+	data := exportSet(256, []byte{10, 0, 0, 1, 10, 0, 0, 2})
+	msg := ipfixMessage(1700000000, 0, template, data)
+
+	if _, err := newNetflowDecoder().decode(msg[:len(msg)-4], "probe"); err == nil {
+		t.Error("IPFIX message shorter than its length field: no error")
+	}
+	if _, err := newNetflowDecoder().decode(msg[:ipfixHeaderLen-2], "probe"); err == nil {
+		t.Error("truncated IPFIX header: no error")
+	}
+
+	// A v9 set announcing more bytes than the message has
+	v9Template := exportSet(netflowV9TemplateSet, exportTemplate(256, ieSourceIPv4Address, 4, ieDestIPv4Address, 4))
+	bad := exportSet(256, []byte{10, 0, 0, 3, 10, 0, 0, 4})
+	binary.BigEndian.PutUint16(bad[2:], 64)
+	records, err := newNetflowDecoder().decode(netflowV9Message(0, 1700000000, 0, v9Template, data, bad), "router")
+	if err == nil {
+		t.Error("v9 set longer than the message: no error")
+	}
+	if len(records) != 1 || !records[0].dst.Equal(net.IP{10, 0, 0, 2}) {
+		t.Errorf("got %+v, want the record of the set before the bad one", records)
+	}
+
+	if _, err := newNetflowDecoder().decode([]byte{0, 7, 0, 0}, "router"); err == nil {
+		t.Error("unknown version: no error")
+	}
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -14,18 +22,194 @@ func writeNumpyMagic(writer interface{ Write([]byte) (int, error) }) error {
 	return err
 }
 
-// createNumpyHeader creates a NumPy header dictionary string with proper padding.
+// NumPy dtype descriptors used by GoByte outputs.
+const (
+	numpyDescrUint8   = "|u1" // Packet bytes and class labels
+	numpyDescrFloat64 = "<f8" // Feature columns
+)
+
+// Element types of the NumPy data array (--npy-dtype). Bytes keep their value
+// (0-255) unless normalized to 0-1, which needs a float type.
+const (
+	NpyDtypeUint8   = "uint8"
+	NpyDtypeInt16   = "int16"
+	NpyDtypeFloat16 = "float16"
+	NpyDtypeFloat32 = "float32"
+)
+
+// Memory layouts of the 2D NumPy arrays (--npy-order). 1D label arrays are
+// the same in both.
+const (
+	NpyOrderC = "C" // Row-major: the columns of a row are contiguous (default)
+	NpyOrderF = "F" // Column-major (Fortran order): the rows of a column are contiguous
+)
+
+// npyTransposeBlock is the size of the blocks of rows transposeNumpyData reads
+// at a time.
+const npyTransposeBlock = 64 * 1024 * 1024
+
+// numpyDataType is the element type the packet bytes are written as.
+type numpyDataType struct {
+	descr     string
+	size      int  // Bytes per element
+	normalize bool // Bytes are divided by 255
+}
+
+// newNumpyDataType validates --npy-dtype and --npy-normalize.
+func newNumpyDataType(dtype string, normalize bool) (numpyDataType, error) {
+	var t numpyDataType
+	switch dtype {
+	case NpyDtypeUint8, "":
+		t = numpyDataType{descr: numpyDescrUint8, size: 1}
+	case NpyDtypeInt16:
+		t = numpyDataType{descr: "<i2", size: 2}
+	case NpyDtypeFloat16:
+		t = numpyDataType{descr: "<f2", size: 2}
+	case NpyDtypeFloat32:
+		t = numpyDataType{descr: "<f4", size: 4}
+	default:
+		return t, fmt.Errorf("unknown dtype %q (use uint8, int16, float16 or float32)", dtype)
+	}
+	if normalize && dtype != NpyDtypeFloat16 && dtype != NpyDtypeFloat32 {
+		return t, fmt.Errorf("normalized bytes need float16 or float32, not %q", dtype)
+	}
+	t.normalize = normalize
+	return t, nil
+}
+
+// appendRow appends the bytes of a row as elements of the type.
+func (t numpyDataType) appendRow(buf, data []byte) []byte {
+	scale := float32(1)
+	if t.normalize {
+		scale = 255
+	}
+	switch t.descr {
+	case "<i2":
+		for _, b := range data {
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(b))
+		}
+	case "<f2":
+		for _, b := range data {
+			buf = binary.LittleEndian.AppendUint16(buf, float16Bits(float32(b)/scale))
+		}
+	case "<f4":
+		for _, b := range data {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(b)/scale))
+		}
+	default:
+		buf = append(buf, data...)
+	}
+	return buf
+}
+
+// float16Bits returns the IEEE 754 half precision bits of f, rounded to
+// nearest even. Values beyond the half range become infinite.
+func float16Bits(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23&0xff) - 127 + 15
+	mant := bits & 0x7fffff
+	switch {
+	case exp >= 31:
+		return sign | 0x7c00
+	case exp <= 0:
+		// Subnormal: the mantissa with its implicit bit, in units of 2^-24
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		half, rem, halfway := mant>>shift, mant&(1<<shift-1), uint32(1)<<(shift-1)
+		if rem > halfway || rem == halfway && half&1 == 1 {
+			half++
+		}
+		return sign | uint16(half)
+	}
+	half := uint32(exp)<<10 | mant>>13
+	if rem := mant & 0x1fff; rem > 0x1000 || rem == 0x1000 && half&1 == 1 {
+		half++ // May carry into the exponent, up to infinity
+	}
+	return sign | uint16(half)
+}
+
+// numpyBaseName strips the .npy/.npz extension from an output name.
+// NumPy outputs are written as <base>_data.npy, <base>_labels.npy and so on.
+func numpyBaseName(filename string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(filename, ".npy"), ".npz")
+}
+
+// createNumpyHeader creates a uint8 NumPy header dictionary string with proper padding.
 func createNumpyHeader(rows int64, cols int) string {
+	return createNumpyHeaderDescr(numpyDescrUint8, rows, cols)
+}
+
+// createNumpyHeaderDescr creates a NumPy header for an array of the given dtype descriptor.
+// If cols is 0, the header describes a 1D array.
+func createNumpyHeaderDescr(descr string, rows int64, cols int) string {
+	return createNumpyHeaderOrder(descr, rows, cols, false)
+}
+
+// createNumpyHeaderOrder creates a NumPy header like createNumpyHeaderDescr,
+// for a 2D array in Fortran order if fortran is set.
+func createNumpyHeaderOrder(descr string, rows int64, cols int, fortran bool) string {
 	var headerStr string
 	if cols > 0 {
-		headerStr = fmt.Sprintf("{'descr': '|u1', 'fortran_order': False, 'shape': (%d, %d)}", rows, cols)
+		order := "False"
+		if fortran {
+			order = "True"
+		}
+		headerStr = fmt.Sprintf("{'descr': '%s', 'fortran_order': %s, 'shape': (%d, %d)}", descr, order, rows, cols)
 	} else {
-		headerStr = fmt.Sprintf("{'descr': '|u1', 'fortran_order': False, 'shape': (%d,)}", rows)
+		headerStr = fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%d,)}", descr, rows)
 	}
 
 	return padNumpyHeader(headerStr)
 }
 
+// writeNumpyHeader writes the magic string and header of an array with rows rows.
+func writeNumpyHeader(writer io.Writer, descr string, rows int64, cols int) error {
+	headerStr := createNumpyHeaderDescr(descr, rows, cols)
+	block := make([]byte, 0, len(numpyMagicV10)+2+len(headerStr))
+	block = append(block, numpyMagicV10...)
+	block = binary.LittleEndian.AppendUint16(block, uint16(len(headerStr)))
+	block = append(block, headerStr...)
+	_, err := writer.Write(block)
+	return err
+}
+
+// numpyHeaderFields matches the dtype and shape of a GoByte NumPy header.
+var numpyHeaderFields = regexp.MustCompile(`^\{'descr': '([^']+)', 'fortran_order': False, 'shape': \((\d+),(?: (\d+))?\)\}\s*$`)
+
+// readNumpyHeader reads the header of a .npy file written by GoByte (version
+// 1.0, C order) and returns its dtype, rows and columns (0 for a 1D array) and
+// the size of the header, where the first row starts.
+func readNumpyHeader(reader io.Reader) (descr string, rows int64, cols int, size int64, err error) {
+	prefix := make([]byte, len(numpyMagicV10)+2)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return "", 0, 0, 0, err
+	}
+	if !bytes.Equal(prefix[:len(numpyMagicV10)], numpyMagicV10) {
+		return "", 0, 0, 0, fmt.Errorf("not a version 1.0 .npy file")
+	}
+	header := make([]byte, binary.LittleEndian.Uint16(prefix[len(numpyMagicV10):]))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", 0, 0, 0, err
+	}
+	fields := numpyHeaderFields.FindStringSubmatch(string(header))
+	if fields == nil {
+		return "", 0, 0, 0, fmt.Errorf("unexpected .npy header %q", strings.TrimSpace(string(header)))
+	}
+	if rows, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return "", 0, 0, 0, err
+	}
+	if fields[3] != "" {
+		if cols, err = strconv.Atoi(fields[3]); err != nil {
+			return "", 0, 0, 0, err
+		}
+	}
+	return fields[1], rows, cols, int64(len(prefix) + len(header)), nil
+}
+
 // padNumpyHeader pads header to 64-byte alignment.
 func padNumpyHeader(header string) string {
 	// Total header block = 8 (magic+version) + 2 (header_len for v1.0) + len(header)
@@ -93,3 +277,122 @@ func writeClassMappingFile(filename string, classToInt map[string]byte) error {
 
 	return nil
 }
+
+// readClassMappingFile reads a class ID to name mapping written by
+// writeClassMappingFile, {"0": "benign", "1": "malware"}, as class name to ID.
+func readClassMappingFile(filename string) (map[string]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var mapping map[string]string
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid class mapping: %w", err)
+	}
+	classToInt := make(map[string]byte, len(mapping))
+	for key, className := range mapping {
+		id, err := strconv.ParseUint(key, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("class ID %q is not an integer from 0 to 255", key)
+		}
+		if className == "" {
+			return nil, fmt.Errorf("class ID %d has no name", id)
+		}
+		if other, exists := classToInt[className]; exists {
+			return nil, fmt.Errorf("class %q has two IDs, %d and %d", className, other, id)
+		}
+		classToInt[className] = byte(id)
+	}
+	return classToInt, nil
+}
+
+// writeFeatureNamesFile writes the ordered feature column names as a JSON list,
+// so the columns of <basename>_features.npy can be identified.
+func writeFeatureNamesFile(filename string, names []string) error {
+	data, err := json.MarshalIndent(names, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
+
+// readFeatureNamesFile reads the feature column names written by
+// writeFeatureNamesFile.
+func readFeatureNamesFile(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, fmt.Errorf("invalid feature names: %w", err)
+	}
+	return names, nil
+}
+
+// appendFeatureRow appends one row of float64 features in little-endian order.
+// Missing values are written as zero.
+func appendFeatureRow(buf []byte, features []float64, cols int) []byte {
+	for i := 0; i < cols; i++ {
+		v := 0.0
+		if i < len(features) {
+			v = features[i]
+		}
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+	}
+	return buf
+}
+
+// transposeNumpyData rewrites the rows x cols array of itemSize-byte elements
+// that starts at offset start of file from row-major to column-major order
+// (--npy-order F). The columns go to a temporary file next to it, a block of
+// rows at a time, and are then copied back over the rows.
+func transposeNumpyData(file *os.File, start, rows int64, cols, itemSize int) error {
+	if rows == 0 || cols <= 1 {
+		return nil // Both orders are the same
+	}
+	temp, err := os.CreateTemp(filepath.Dir(file.Name()), ".npy-order-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		temp.Close()
+		os.Remove(temp.Name())
+	}()
+
+	rowSize := int64(cols * itemSize)
+	blockRows := min(max(npyTransposeBlock/rowSize, 1), rows)
+	block := make([]byte, blockRows*rowSize)
+	column := make([]byte, blockRows*int64(itemSize))
+	for first := int64(0); first < rows; first += blockRows {
+		n := min(blockRows, rows-first)
+		data := block[:n*rowSize]
+		if _, err := file.ReadAt(data, start+first*rowSize); err != nil {
+			return err
+		}
+		for j := range cols {
+			run := column[:n*int64(itemSize)]
+			if itemSize == 1 {
+				for i := range run {
+					run[i] = data[int64(i)*rowSize+int64(j)]
+				}
+			} else {
+				for i := int64(0); i < n; i++ {
+					copy(run[i*int64(itemSize):(i+1)*int64(itemSize)], data[i*rowSize+int64(j*itemSize):])
+				}
+			}
+			if _, err := temp.WriteAt(run, (int64(j)*rows+first)*int64(itemSize)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(file, temp)
+	return err
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// npyMmapInitialRows is the row capacity a NumpyMmapWriter first sizes its
+// files for; it doubles whenever the rows outgrow it.
+const npyMmapInitialRows = 64 * 1024
+
+// npyMmapArray is one .npy file of a NumpyMmapWriter, pre-sized and mapped
+// into memory so rows are copied to their offset instead of written in turn.
+type npyMmapArray struct {
+	file    *os.File
+	descr   string
+	cols    int    // 0 = 1D array
+	rowSize int    // Bytes per row
+	header  int    // Bytes before the first row
+	data    []byte // Mapping of the header and the capacity rows
+	fortran bool   // A 2D array is transposed to Fortran order by finish
+}
+
+// createNpyMmapArray creates a .npy file, under its partial name, with a
+// placeholder header.
+func createNpyMmapArray(partial *partialFiles, filename, descr string, cols, rowSize int, fortran bool) (*npyMmapArray, error) {
+	file, err := partial.create(filename)
+	if err != nil {
+		return nil, err
+	}
+	a := &npyMmapArray{
+		file:    file,
+		descr:   descr,
+		cols:    cols,
+		rowSize: rowSize,
+		header:  len(numpyMagicV10) + 2 + len(createNumpyHeaderOrder(descr, 0, cols, fortran)),
+		fortran: fortran && cols > 0,
+	}
+	return a, nil
+}
+
+// resize sizes the file for rows rows and maps it again. No row may be
+// copied while the mapping changes.
+func (a *npyMmapArray) resize(rows int64) error {
+	if a.data != nil {
+		if err := munmapFile(a.data); err != nil {
+			return err
+		}
+		a.data = nil
+	}
+	size := int64(a.header) + rows*int64(a.rowSize)
+	if err := a.file.Truncate(size); err != nil {
+		return err
+	}
+	data, err := mmapFile(a.file, int(size))
+	if err != nil {
+		return err
+	}
+	a.data = data
+	return nil
+}
+
+// row returns the bytes of row i, which must be below the capacity.
+func (a *npyMmapArray) row(i int64) []byte {
+	start := int64(a.header) + i*int64(a.rowSize)
+	return a.data[start : start+int64(a.rowSize) : start+int64(a.rowSize)]
+}
+
+// finish writes the header for rows rows, unmaps the file, cuts off the
+// unused capacity and transposes a Fortran-order array.
+func (a *npyMmapArray) finish(rows int64) error {
+	var err error
+	if a.data != nil {
+		headerStr := createNumpyHeaderOrder(a.descr, rows, a.cols, a.fortran)
+		n := copy(a.data, numpyMagicV10)
+		binary.LittleEndian.PutUint16(a.data[n:], uint16(len(headerStr)))
+		copy(a.data[n+2:], headerStr)
+		err = munmapFile(a.data)
+		a.data = nil
+	}
+	if truncErr := a.file.Truncate(int64(a.header) + rows*int64(a.rowSize)); err == nil {
+		err = truncErr
+	}
+	if err == nil && a.fortran {
+		err = transposeNumpyData(a.file, int64(a.header), rows, a.cols, a.rowSize/a.cols)
+	}
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// NumpyMmapWriter writes the same files as NumpyStreamWriter (--npy-mmap).
+// Each file is sized ahead for a number of rows and memory-mapped; a batch
+// only reserves its rows under the lock and its worker then copies them to
+// their offsets alongside the other workers. Rows must have a fixed width.
+type NumpyMmapWriter struct {
+	data     *npyMmapArray // nil without byte columns
+	labels   *npyMmapArray // nil without classes
+	features *npyMmapArray // nil without feature columns
+
+	maxPacketSize int
+	dataType      numpyDataType
+	featureNames  []string
+	baseFilename  string
+	partial       partialFiles // The .npy files, renamed on Close
+
+	mutex       sync.Mutex // Row reservation and class IDs
+	remap       sync.RWMutex
+	rows        int64 // Rows reserved
+	capacity    int64 // Rows the files are sized for
+	classToInt  map[string]byte
+	nextClassID byte
+}
+
+// NewNumpyMmapWriter creates the files of a memory-mapped NumPy output, whose
+// bytes are written as dataType elements and, with fortran, whose 2D arrays
+// are transposed to Fortran order on Close.
+func NewNumpyMmapWriter(filename string, maxPacketSize int, hasClass bool, featureNames []string, dataType numpyDataType, fortran bool) (*NumpyMmapWriter, error) {
+	w := &NumpyMmapWriter{
+		maxPacketSize: maxPacketSize,
+		dataType:      dataType,
+		featureNames:  featureNames,
+		baseFilename:  numpyBaseName(filename),
+		classToInt:    make(map[string]byte),
+	}
+	var err error
+	if maxPacketSize > 0 {
+		if w.data, err = createNpyMmapArray(&w.partial, w.baseFilename+"_data.npy", dataType.descr, maxPacketSize, maxPacketSize*dataType.size, fortran); err != nil {
+			return nil, fmt.Errorf("failed to create data file: %w", err)
+		}
+	}
+	if hasClass {
+		if w.labels, err = createNpyMmapArray(&w.partial, w.baseFilename+"_labels.npy", numpyDescrUint8, 0, 1, false); err != nil {
+			w.closeFiles()
+			return nil, fmt.Errorf("failed to create labels file: %w", err)
+		}
+	}
+	if len(featureNames) > 0 {
+		if w.features, err = createNpyMmapArray(&w.partial, w.baseFilename+"_features.npy", numpyDescrFloat64, len(featureNames), 8*len(featureNames), fortran); err != nil {
+			w.closeFiles()
+			return nil, fmt.Errorf("failed to create features file: %w", err)
+		}
+		if err := writeFeatureNamesFile(w.baseFilename+"_features.json", featureNames); err != nil {
+			w.closeFiles()
+			return nil, fmt.Errorf("failed to write feature names: %w", err)
+		}
+	}
+	if err := w.resize(npyMmapInitialRows); err != nil {
+		w.closeFiles()
+		return nil, fmt.Errorf("failed to map output: %w", err)
+	}
+	return w, nil
+}
+
+// arrays returns the files of the output.
+func (w *NumpyMmapWriter) arrays() []*npyMmapArray {
+	var arrays []*npyMmapArray
+	for _, a := range []*npyMmapArray{w.data, w.labels, w.features} {
+		if a != nil {
+			arrays = append(arrays, a)
+		}
+	}
+	return arrays
+}
+
+// closeFiles unmaps, closes and removes every file opened so far (used on
+// construction errors).
+func (w *NumpyMmapWriter) closeFiles() {
+	for _, a := range w.arrays() {
+		if a.data != nil {
+			munmapFile(a.data)
+		}
+		a.file.Close()
+	}
+	w.partial.discard()
+}
+
+// resize sizes every file for capacity rows.
+func (w *NumpyMmapWriter) resize(capacity int64) error {
+	for _, a := range w.arrays() {
+		if err := a.resize(capacity); err != nil {
+			return err
+		}
+	}
+	w.capacity = capacity
+	return nil
+}
+
+func (w *NumpyMmapWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch reserves rows for the packets, growing the files if needed, and
+// copies the packets into them without holding the lock.
+func (w *NumpyMmapWriter) WriteBatch(packets []PacketResult) error {
+	if len(packets) == 0 {
+		return nil
+	}
+	if w.data != nil {
+		for _, p := range packets {
+			if len(p.Data) > w.maxPacketSize {
+				return fmt.Errorf("row of %d bytes does not fit the %d columns of the data array, set --length, --assume-max-len or --scan-length", len(p.Data), w.maxPacketSize)
+			}
+		}
+	}
+
+	w.mutex.Lock()
+	first := w.rows
+	if need := first + int64(len(packets)); need > w.capacity {
+		capacity := w.capacity
+		for capacity < need {
+			capacity *= 2
+		}
+		// Waits for the workers still copying into the old mappings
+		w.remap.Lock()
+		err := w.resize(capacity)
+		w.remap.Unlock()
+		if err != nil {
+			w.mutex.Unlock()
+			return fmt.Errorf("error growing output: %w", err)
+		}
+	}
+	var classIDs []byte
+	if w.labels != nil {
+		classIDs = make([]byte, len(packets))
+		for i, p := range packets {
+			classID, exists := w.classToInt[p.Class]
+			if !exists {
+				classID = w.nextClassID
+				w.classToInt[p.Class] = classID
+				w.nextClassID++
+			}
+			classIDs[i] = classID
+		}
+	}
+	w.rows += int64(len(packets))
+	w.mutex.Unlock()
+
+	w.remap.RLock()
+	defer w.remap.RUnlock()
+	for i, p := range packets {
+		row := first + int64(i)
+		if w.data != nil {
+			data := w.data.row(row)
+			clear(data[len(w.dataType.appendRow(data[:0], p.Data)):])
+		}
+		if w.labels != nil {
+			w.labels.row(row)[0] = classIDs[i]
+		}
+		if w.features != nil {
+			appendFeatureRow(w.features.row(row)[:0], p.Features, len(w.featureNames))
+		}
+	}
+	return nil
+}
+
+// Close writes the headers with the row count, trims the files to the rows
+// and writes the class mapping. Every file is finished even if another fails;
+// they get their final names only if all of them were.
+func (w *NumpyMmapWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.remap.Lock()
+	defer w.remap.Unlock()
+
+	var err error
+	for _, a := range w.arrays() {
+		if finishErr := a.finish(w.rows); err == nil && finishErr != nil {
+			err = fmt.Errorf("error finishing %s: %w", a.file.Name(), finishErr)
+		}
+	}
+	if err := w.partial.finish(err); err != nil {
+		return err
+	}
+	if w.labels != nil {
+		if err := writeClassMappingFile(w.baseFilename+"_classes.json", w.classToInt); err != nil {
+			slog.Warn("failed to write class mapping", "error", err)
+		}
+	}
+	return nil
+}
+
+// setClassIDs makes the writer use a fixed class numbering instead of numbering
+// classes in order of appearance. It must be called before the first write.
+func (w *NumpyMmapWriter) setClassIDs(ids map[string]byte) {
+	for class, id := range ids {
+		w.classToInt[class] = id
+		if id >= w.nextClassID {
+			w.nextClassID = id + 1
+		}
+	}
+}
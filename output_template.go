@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultOutputTemplate names per-file outputs after their input file.
+const defaultOutputTemplate = "{stem}.{ext}"
+
+// outputPlaceholder matches {name} placeholders in an output template.
+var outputPlaceholder = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// outputNameFields are the values available to --output-template.
+type outputNameFields struct {
+	Class  string // Class label ("unlabeled" for --input runs)
+	Stem   string // Input file name without extension (and _<interface> with --split-by-interface)
+	Length int    // --length (0 = variable)
+	Format string // csv, parquet, numpy, bin, pcap or tokens (comma-separated with several formats)
+}
+
+// formatExtension returns the file extension used for an output format, that
+// of the first format for a list (the writers then swap it per format).
+func formatExtension(format string) string {
+	format, _, _ = strings.Cut(format, ",")
+	switch format {
+	case "parquet":
+		return "parquet"
+	case "numpy":
+		return "npy"
+	case "bin":
+		return "bin"
+	case "pcap":
+		return "pcap"
+	case "tokens":
+		return "txt"
+	}
+	return "csv"
+}
+
+// expandOutputTemplate fills in an output template such as "{class}_{stem}_{len}.{ext}".
+// The result is a relative path; it may contain subdirectories but must not leave
+// the output directory.
+func expandOutputTemplate(template string, f outputNameFields) (string, error) {
+	class := f.Class
+	if class == "" {
+		class = "unlabeled"
+	}
+	values := map[string]string{
+		"class":  class,
+		"stem":   f.Stem,
+		"len":    strconv.Itoa(f.Length),
+		"format": f.Format,
+		"ext":    formatExtension(f.Format),
+	}
+
+	var unknown []string
+	name := outputPlaceholder.ReplaceAllStringFunc(template, func(m string) string {
+		key := m[1 : len(m)-1]
+		value, ok := values[key]
+		if !ok {
+			unknown = append(unknown, m)
+			return m
+		}
+		return value
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown placeholder %s (use {class}, {stem}, {len}, {format} or {ext})", strings.Join(unknown, ", "))
+	}
+
+	name = filepath.Clean(name)
+	if name == "." || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("output template %q must produce a relative file name", template)
+	}
+	return name, nil
+}
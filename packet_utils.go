@@ -6,24 +6,104 @@
 
 package main
 
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+)
+
+// Padding strategies for --pad-mode.
+const (
+	PadZero   = "zero"   // Fill with the pad value (0 unless --pad-value is set)
+	PadRepeat = "repeat" // Repeat the packet's own bytes
+	PadRandom = "random" // Seeded pseudo-random bytes
+)
+
+// Truncation anchors for --truncate-from: which part of a long packet is kept.
+const (
+	TruncateHead   = "head"   // Keep the first bytes (default)
+	TruncateTail   = "tail"   // Keep the last bytes
+	TruncateCenter = "center" // Keep a window centered on the packet
+)
+
+// Padding describes how rows shorter than the output length are filled.
+// The zero value pads with zeros.
+type Padding struct {
+	Mode  string
+	Value byte   // Fill byte for PadZero (and PadRepeat on empty packets)
+	Seed  uint64 // Seed for PadRandom
+}
+
+// newPadding validates the --pad-mode/--pad-value/--pad-seed flags.
+func newPadding(mode string, value int, seed uint64) (Padding, error) {
+	switch mode {
+	case PadZero, PadRepeat, PadRandom:
+	default:
+		return Padding{}, fmt.Errorf("invalid pad mode %q (use zero, repeat or random)", mode)
+	}
+	if value < 0 || value > 255 {
+		return Padding{}, fmt.Errorf("pad value %d out of range 0-255", value)
+	}
+	return Padding{Mode: mode, Value: byte(value), Seed: seed}, nil
+}
+
+// fill pads row[n:], where row[:n] holds the real packet bytes.
+func (p Padding) fill(row []byte, n int) {
+	pad := row[n:]
+	switch {
+	case p.Mode == PadRepeat && n > 0:
+		for i := range pad {
+			pad[i] = row[i%n]
+		}
+	case p.Mode == PadRandom:
+		// Seeded by the packet content, so output doesn't depend on worker scheduling
+		h := fnv.New64a()
+		h.Write(row[:n])
+		rng := rand.New(rand.NewPCG(p.Seed, h.Sum64()))
+		for i := range pad {
+			pad[i] = byte(rng.Uint32())
+		}
+	default:
+		// Buffers may be recycled, so zero padding is written explicitly too
+		for i := range pad {
+			pad[i] = p.Value
+		}
+	}
+}
+
 // If outputLength > 0: truncate or pad to exactly outputLength bytes
 // If outputLength == 0: keep original size (no modification)
-func standardizePacketLength(data []byte, outputLength int) []byte {
+func standardizePacketLength(data []byte, outputLength int, from string, pad Padding) []byte {
 	if outputLength == 0 {
 		// Keep original size - no truncation or padding
 		return data
 	}
 
 	// Apply truncation/padding to specified length
-	return truncatePad(data, outputLength)
+	return truncatePad(data, outputLength, from, pad)
 }
 
 // truncatePad returns a slice of exactly 'length' bytes.
-// If data is longer, it's truncated. If shorter, it's padded with zeros.
-func truncatePad(data []byte, length int) []byte {
-	res := make([]byte, length)
-	copy(res, data)
-	return res
+// If data is longer, it's truncated keeping the part selected by from.
+// If shorter, it's padded according to pad.
+func truncatePad(data []byte, length int, from string, pad Padding) []byte {
+	return truncatePadInto(make([]byte, length), data, from, pad)
+}
+
+// truncatePadInto is truncatePad writing into dst, whose length is the target length.
+func truncatePadInto(dst, data []byte, from string, pad Padding) []byte {
+	if excess := len(data) - len(dst); excess > 0 {
+		switch from {
+		case TruncateTail:
+			data = data[excess:]
+		case TruncateCenter:
+			data = data[excess/2:]
+		}
+	}
+
+	n := copy(dst, data)
+	pad.fill(dst, n)
+	return dst
 }
 
 // determineMaxPacketSize calculates the maximum packet size from a slice of packets.
@@ -41,7 +121,7 @@ func determineMaxPacketSize(packets []PacketResult) int {
 // padToMaxSize pads all packets in a slice to the maximum packet size.
 // This is used for non-streaming modes with variable-length packets
 // to ensure consistent column count in output files.
-func padToMaxSize(packets []PacketResult) []PacketResult {
+func padToMaxSize(packets []PacketResult, pad Padding) []PacketResult {
 	if len(packets) == 0 {
 		return packets
 	}
@@ -54,9 +134,7 @@ func padToMaxSize(packets []PacketResult) []PacketResult {
 	// Pad all packets to max size
 	for i := range packets {
 		if len(packets[i].Data) < maxSize {
-			padded := make([]byte, maxSize)
-			copy(padded, packets[i].Data)
-			packets[i].Data = padded
+			packets[i].Data = truncatePad(packets[i].Data, maxSize, TruncateHead, pad)
 		}
 	}
 
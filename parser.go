@@ -1,47 +1,347 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 // PacketResult struct to keep track of order and packet data
 type PacketResult struct {
-	Index        int     `parquet:"index" csv:"index"`
-	OriginalSize int     `parquet:"original_size" csv:"original_size"`
-	Data         []uint8 `parquet:"data" csv:"-"`
-	Class        string  `parquet:"class" csv:"class"`
-	FileName     string  `parquet:"filename" csv:"filename"`
+	Index        int            `parquet:"index" csv:"index"`
+	OriginalSize int            `parquet:"original_size" csv:"original_size"`
+	Data         []uint8        `parquet:"data" csv:"-"`
+	Class        string         `parquet:"class" csv:"class"`
+	FileName     string         `parquet:"filename" csv:"filename"`
+	Timestamp    time.Time      `parquet:"timestamp" csv:"timestamp"`
+	Features     []float64      `parquet:"-" csv:"-"` // Optional feature columns, named by ProcessOptions.FeatureNames
+	Session      int            `parquet:"-" csv:"-"` // Session ID within the file (session mode only)
+	Split        int            `parquet:"-" csv:"-"` // Index into the --split outputs
+	FlowID       uint64         `parquet:"-" csv:"-"` // Hash of the flow key (--with-columns flow_id only)
+	SplitPoint   float64        `parquet:"-" csv:"-"` // Hash of the split group in [0, 1), kept so cached rows can be split again
+	Direction    uint8          `parquet:"-" csv:"-"` // 1 if the packet goes against its session's first packet (session mode only)
+	Copy         int            `parquet:"-" csv:"-"` // Augmented variant of the packet (--augment only, 0 = the packet itself)
+	Packets      []FlowPacket   `parquet:"-" csv:"-"` // Packets of a session row (--parquet-layout flows only)
+	DecodeFailed bool           `parquet:"-" csv:"-"` // A layer of the packet (of any packet of a session row) failed to decode
+	Segment      bool           `parquet:"-" csv:"-"` // The row is the payload of a TCP segment, part of a stream (--messages only)
+	Decrypted    bool           `parquet:"-" csv:"-"` // The row is the plaintext of a TLS record decrypted with --keylog
+	Frame        *capturedFrame `parquet:"-" csv:"-"` // The packet as captured (--export-pcaps only, until exported)
 }
 
 // PacketJob struct to pass to workers
 type PacketJob struct {
-	Index    int
-	Packet   gopacket.Packet
-	Class    string
-	FileName string
+	Index      int
+	Packet     gopacket.Packet
+	Class      string
+	FileName   string
+	Features   []float64 // Features computed in capture order by the reader
+	Session    int       // Session ID assigned by the reader (session mode only)
+	Split      int       // Split assigned by the reader (--split only)
+	FlowID     uint64    // Flow ID computed by the reader (--with-columns flow_id only)
+	SplitPoint float64   // Split group hash computed by the reader (--split only)
+	Direction  uint8     // Direction within the session assigned by the reader (session mode only)
+	Copy       int       // Augmented variant the worker is making (--augment only, 0 = the packet itself)
+	Weight     float64   // Weight of the packet's label (label_weight column only)
+	LinkType   layers.LinkType
 }
 
 // FileJob struct for file-level parallelism
 type FileJob struct {
-	FilePath string
-	Class    string
+	FilePath    string
+	Class       string
+	Interface   string // PCAPNG interface read with --split-by-interface ("" = the whole file)
+	InterfaceID int
+	Archive     string // Tar or zip archive holding the capture, named <archive>/<member> by FilePath ("" = a file)
+	Member      string // Name of the capture in Archive
+	Live        bool   // FilePath names a network interface captured with --live
+}
+
+// Extraction levels: which part of each packet becomes the row.
+const (
+	ExtractIP = "ip" // IP header onwards (default)
+	ExtractL7 = "l7" // TCP/UDP payload or SCTP user data only, all headers stripped
+)
+
+// ProcessOptions holds the packet processing settings shared by all modes.
+type ProcessOptions struct {
+	OutputLength   int               // Pad/truncate length (0 = keep original size)
+	AssumedLength  int               // Byte columns of streamed rows with OutputLength 0 (--assume-max-len or from the snap lengths)
+	Padding        Padding           // How short packets are padded
+	TruncateFrom   string            // Which part of long packets is kept (head, tail or center)
+	MaskIP         bool              // Zero out source and destination IP addresses
+	MaskPrefix     IPMaskPrefix      // Network bits --ipmask keeps (host-only mode; zero = whole address)
+	ZeroPayload    bool              // Zero every byte after the transport header
+	Anon           *Anonymizer       // --anon-preset IP pseudonyms, MAC masking and report (nil = off)
+	TimeShift      time.Duration     // Added to packet timestamps before they are coarsened (--time-shift)
+	TimeResolution time.Duration     // Coarsen packet timestamps to this granularity (0 = exact)
+	Normalize      NormalizeFields   // Volatile header fields to zero out
+	Augment        *Augmenter        // Add augmented variants of each sample (nil = off)
+	MaskBytes      ByteRanges        // Offsets of each packet's bytes to zero out (nil = none)
+	IncludeL2      bool              // Keep the Ethernet header (and VLAN tags) at the start of each row
+	StripTrailer   bool              // End rows with the IP packet, without Ethernet padding and FCS
+	Extract        string            // Extraction level, ExtractIP or ExtractL7
+	Salvage        bool              // Skip damaged pcap records instead of stopping at the first one
+	Readers        int               // Concurrent readers of one classic pcap file (0 or 1 = one)
+	Ordered        bool              // Streamed rows are written in capture order, as --streaming=false sorts them
+	Timing         bool              // Add inter-arrival time feature columns
+	DropRetrans    bool              // Drop TCP segments whose payload was already seen
+	Messages       string            // Framing of --messages rows, one per application message of a session ("" = off)
+	KeyLog         *KeyLog           // TLS secrets that decrypt --messages rows (nil = none)
+	Dedup          *FlowDeduplicator // Cross-file duplicate flow detection (nil = off)
+	TCPFlags       *TCPFlagFilter    // Keep/drop packets by TCP flags (nil = keep all)
+	Where          *WhereFilter      // Keep packets matching a --where expression (nil = keep all)
+	ICMP           string            // ICMPKeep, ICMPDrop or ICMPOnly
+	QUIC           string            // QUICKeep, QUICDrop or QUICOnly
+	GTPDecap       bool              // Replace GTP-U user packets by the subscriber packets they carry
+	GTPC           string            // GTPCKeep, GTPCDrop or GTPCOnly for GTP signalling (GTP-C and GTP-U path messages)
+	IPDecap        int               // Outer IP headers of IP-in-IP and 6in4 tunnels to remove (0 = off)
+	OnlyIP         bool              // Drop packets without IPv4/IPv6 (ARP, LLDP, STP, ...)
+	MinLen         int               // Drop frames shorter than this on the wire (0 = no limit)
+	MaxLen         int               // Drop frames longer than this on the wire (0 = no limit)
+	SkipPackets    int               // Ignore the first packets of each file
+	SkipTime       time.Duration     // Ignore packets in the first seconds of each file
+	MaxPerFile     int               // Stop reading each file after this many packets, not counting skipped ones (0 = no limit)
+	Limit          *RowLimit         // Stop the run after this many rows (nil = no limit)
+	Quota          *ClassQuota       // Stop taking rows of a class after this many (nil = no quota)
+	ICMPFeatures   bool              // Add icmp_type/icmp_code feature columns
+	QUICFeatures   bool              // Add QUIC header feature columns
+	TCPFeatures    bool              // Add TTL and TCP window/option feature columns
+	TupleHash      *TupleHasher      // Add the salted 5-tuple hash feature column (nil = off)
+	LabelBy        string            // Class source, LabelByDataset, LabelByProtocol, LabelByZeek, LabelBySuricata or LabelByRules
+	Zeek           *ZeekIndex        // Connections of --zeek-logs for labels and features (nil = off)
+	Suricata       *SuricataIndex    // Alerts of --suricata-eve for labels (nil = off)
+	Rules          *LabelRules       // Rules of --label-rules for labels (nil = off)
+	LabelWeights   *LabelWeights     // Add a label_weight column (nil = off)
+	ClassWeights   ClassWeights      // Per-class keep probabilities (nil = keep all)
+	ClassIDs       map[string]byte   // Fixed NumPy and bin label IDs across --incremental shards (nil = per run)
+	Split          *Split            // Train/val/test assignment (nil = single output)
+	Duplicates     *DuplicateReport  // Cross-class identical row report (nil = off)
+	Quality        *QualityReport    // Per-class data quality counts (nil = off)
+	Stats          *ClassStatsReport // Per-class row and size statistics (nil = off)
+	Classes        *ClassCounter     // Rows per class, for the imbalance warning (nil = not counted)
+	Export         *SubsetExport     // Original frames of the rows, per class (--export-pcaps, nil = off)
+	SessionBytes   int               // Emit one row of N concatenated bytes per session (0 = one row per packet)
+	TimeWindow     time.Duration     // Sessions are host pairs per time bucket of this length (0 = flows)
+	Aggregate      bool              // Replace each TimeWindow session by a row of counts (--aggregate)
+	FlowTimeouts   FlowTimeouts      // End flows after a maximum duration or idle gap (zero = never)
+	FlowDirection  string            // Flow key convention, FlowBidirectional or FlowUnidirectional
+	NetFlow        bool              // Inputs are NetFlow/IPFIX exports, one row per flow record
+	Errors         *ErrorHandler     // Policy for unopenable files and undecodable packets
+	Retry          *FileRetry        // Retries of dataset inputs that fail to open (nil = none)
+	Cache          *RowCache         // --cache-dir rows of already decoded files (nil = off)
+	Memory         *MemoryBudget     // --max-memory budget of in-memory runs (nil = unlimited)
+	Throughput     *Throughput       // Parsing and writing rates for progress logs (nil = not counted)
+	Progress       *Progress         // Inputs being read, for --tui and --web (nil = off)
+	Rotation       *Rotation         // Skips packets repeated across --input-rotation files (nil = off)
+	Scale          *Scaler           // Replace bytes and features with scaled float columns (nil = raw values)
+	Tokens         *Tokenizer        // Replace bytes with OutputLength BPE token IDs (nil = raw bytes)
+	Window         Windowing         // Split packets (or sessions) into overlapping fixed-size rows
+	PacketWindow   PacketWindowing   // Concatenate consecutive packets into rows
+	Writer         WriterOptions     // Output encoding settings
+}
+
+// FeatureNames returns the names of the optional feature columns enabled by
+// the options, in the order their values appear in PacketResult.Features.
+// With scaling, every column (bytes included) is a feature column.
+func (o ProcessOptions) FeatureNames() []string {
+	if o.Scale != nil {
+		return o.Scale.columns
+	}
+	if o.NetFlow {
+		return netflowFeatureNames
+	}
+	var names []string
+	if o.Tokens != nil {
+		names = append(names, o.Tokens.columns...)
+	}
+	if o.Timing {
+		names = append(names, timingFeatureNames...)
+	}
+	if o.Zeek != nil && o.Zeek.features {
+		names = append(names, zeekFeatureNames...)
+	}
+	if o.ICMPFeatures {
+		names = append(names, icmpFeatureNames...)
+	}
+	if o.QUICFeatures {
+		names = append(names, quicFeatureNames...)
+	}
+	if o.TupleHash != nil {
+		names = append(names, tupleHashFeatureNames...)
+	}
+	if o.TCPFeatures {
+		names = append(names, tcpFeatureNames...)
+	}
+	if o.LabelWeights != nil {
+		names = append(names, labelWeightFeatureNames...)
+	}
+	if o.Aggregate {
+		names = append(names, aggregateFeatureNames...)
+	} else if o.TimeWindow > 0 {
+		names = append(names, timeWindowFeatureNames...)
+	}
+	return names
+}
+
+// hasClass reports whether the rows of fileJobs carry a class label: their
+// dataset class, or a label from another source (--label-by, --suricata-eve,
+// --label-rules).
+func (o ProcessOptions) hasClass(fileJobs []FileJob) bool {
+	switch o.LabelBy {
+	case LabelByProtocol, LabelByZeek, LabelBySuricata, LabelByRules:
+		return true
+	}
+	return len(fileJobs) > 0 && fileJobs[0].Class != ""
+}
+
+// classIDs numbers the classes the run can produce in sorted order: the
+// dataset classes of fileJobs, all protocol labels with --label-by protocol,
+// the values of the Zeek field with --label-by zeek, the alert labels and
+// benign with --suricata-eve, or the rule classes and the default with
+// --label-rules.
+func (o ProcessOptions) classIDs(fileJobs []FileJob) map[string]byte {
+	if o.ClassIDs != nil {
+		return o.ClassIDs
+	}
+	switch o.LabelBy {
+	case LabelByProtocol:
+		return protocolClassIDs()
+	case LabelByZeek:
+		return o.Zeek.classIDs()
+	case LabelBySuricata:
+		return o.Suricata.classIDs()
+	case LabelByRules:
+		return o.Rules.classIDs()
+	}
+	return datasetClassIDs(fileJobs)
+}
+
+// finishRows cuts finished rows to the --max-per-class quota and the
+// --max-packets limit and passes the remaining ones to the enabled row reports.
+func (o ProcessOptions) finishRows(rows []PacketResult) []PacketResult {
+	rows = o.Quota.take(rows)
+	rows = rows[:o.Limit.take(len(rows))]
+	if o.Duplicates != nil {
+		o.Duplicates.add(rows)
+	}
+	if o.Quality != nil {
+		o.Quality.add(rows)
+	}
+	if o.Stats != nil {
+		o.Stats.add(rows)
+	}
+	if o.Classes != nil {
+		o.Classes.add(rows)
+	}
+	if o.Export != nil {
+		o.Export.add(rows)
+	}
+	return rows
+}
+
+// classDone reports whether a file can add no rows, since its class has all
+// of its --max-per-class rows and its rows carry the class of the file.
+func (o ProcessOptions) classDone(fileJob FileJob) bool {
+	switch o.LabelBy {
+	case LabelByProtocol, LabelByZeek, LabelBySuricata, LabelByRules:
+		return false
+	}
+	return o.Quota.full(fileJob.Class)
+}
+
+// packetRows reports whether processPacket emits finished rows. Session and
+// window rows are cut from the raw packet bytes afterwards.
+func (o ProcessOptions) packetRows() bool {
+	return !o.sessionRows() && o.Window.Size == 0
+}
+
+// sessionRows reports whether rows are assembled per session once a file has
+// been read: --session-bytes rows, --messages, --aggregate counts and
+// --packet-window rows.
+func (o ProcessOptions) sessionRows() bool {
+	return o.SessionBytes > 0 || o.Messages != MessagesOff || o.Aggregate || o.PacketWindow.Size > 0
+}
+
+// bytesAsFeatures reports whether rows carry no bytes because --scale or BPE
+// tokenization turned them into feature columns, or --aggregate rows only
+// have counts.
+func (o ProcessOptions) bytesAsFeatures() bool {
+	return o.Scale != nil || o.Tokens != nil || o.Aggregate
+}
+
+// writerPacketSize returns the number of byte columns passed to stream writers:
+// none when bytes are written as features, otherwise --length or the longest
+// row assumed for variable-length rows.
+func (o ProcessOptions) writerPacketSize() int {
+	switch {
+	case o.bytesAsFeatures():
+		return 0
+	case o.OutputLength > 0:
+		return o.OutputLength
+	case o.AssumedLength > 0:
+		return o.AssumedLength
+	}
+	return jumboFrameLen - ethernetHeaderLen
+}
+
+// packetReader is a source of raw packets; *pcap.Handle, streamCapture and
+// salvageReader implement it.
+type packetReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	Close()
+}
+
+// openCapture opens a PCAP/PCAPNG file with libpcap (the pure Go reader in
+// builds without cgo and on Windows), with the salvage reader when salvage mode
+// is enabled and the file is a classic pcap, or an .etl capture converted by
+// pktmon.
+func openCapture(filePath string, opts ProcessOptions) (packetReader, error) {
+	if isETL(filePath) {
+		return openETL(filePath)
+	}
+	if opts.Salvage {
+		reader, err := newSalvageReader(filePath)
+		if err == nil {
+			return reader, nil
+		}
+		slog.Debug("salvage reader unavailable, using libpcap", "file", filePath, "error", err)
+	}
+	return openOffline(filePath)
 }
 
 // Note: truncatePad has been moved to packet_utils.go for better modularity
 
-// maskIPAddresses masks source and destination IP addresses in the packet.
+// Ways --ipmask masks IP addresses.
+const (
+	IPMaskFull     = "full"      // Zero the whole address (default)
+	IPMaskHostOnly = "host-only" // Zero the host bits after a prefix, keeping the network
+)
+
+// IPMaskPrefix is the number of leading address bits --ipmask keeps for each
+// IP version. Zero masks the whole address.
+type IPMaskPrefix struct {
+	IPv4 int
+	IPv6 int
+}
+
+// maskIPAddresses masks source and destination IP addresses in the packet,
+// keeping the leading prefix bits of each.
 // It handles both IPv4 and IPv6 packets.
-func maskIPAddresses(data []byte) []byte {
+func maskIPAddresses(data []byte, prefix IPMaskPrefix) []byte {
 	if len(data) < 20 {
 		// Too short to be a valid IP packet
 		return data
@@ -52,9 +352,9 @@ func maskIPAddresses(data []byte) []byte {
 
 	switch version {
 	case 4: // IPv4
-		return maskIPv4(data)
+		return maskIPv4(data, prefix.IPv4)
 	case 6: // IPv6
-		return maskIPv6(data)
+		return maskIPv6(data, prefix.IPv6)
 	default:
 		// Not an IP packet, return as-is
 		return data
@@ -62,7 +362,7 @@ func maskIPAddresses(data []byte) []byte {
 }
 
 // maskIPv4 masks IPv4 source and destination addresses
-func maskIPv4(data []byte) []byte {
+func maskIPv4(data []byte, prefix int) []byte {
 	if len(data) < 20 {
 		return data
 	}
@@ -82,20 +382,16 @@ func maskIPv4(data []byte) []byte {
 	}
 
 	// Zero out source IP (bytes 12-15)
-	for i := 12; i < 16; i++ {
-		data[i] = 0
-	}
+	zeroHostBits(data[12:16], prefix)
 
 	// Zero out destination IP (bytes 16-19)
-	for i := 16; i < 20; i++ {
-		data[i] = 0
-	}
+	zeroHostBits(data[16:20], prefix)
 
 	return data
 }
 
 // maskIPv6 masks IPv6 source and destination addresses
-func maskIPv6(data []byte) []byte {
+func maskIPv6(data []byte, prefix int) []byte {
 	if len(data) < 40 {
 		return data
 	}
@@ -106,99 +402,919 @@ func maskIPv6(data []byte) []byte {
 	// Bytes 24-39: Destination IP (128 bits = 16 bytes)
 
 	// Zero out source IP (bytes 8-23)
-	for i := 8; i < 24; i++ {
-		data[i] = 0
-	}
+	zeroHostBits(data[8:24], prefix)
 
 	// Zero out destination IP (bytes 24-39)
-	for i := 24; i < 40; i++ {
-		data[i] = 0
-	}
+	zeroHostBits(data[24:40], prefix)
 
 	return data
 }
 
-// worker processes packets from the jobs channel and sends results to the results channel.
+// zeroHostBits zeroes every bit of addr after the first prefix bits.
+func zeroHostBits(addr []byte, prefix int) {
+	for i := range addr {
+		switch keep := prefix - i*8; {
+		case keep <= 0:
+			addr[i] = 0
+		case keep < 8:
+			addr[i] &= 0xFF << (8 - keep)
+		}
+	}
+}
+
+// NormalizeFields selects volatile header fields that are zeroed in each row,
+// so models don't learn capture-environment artifacts.
+type NormalizeFields struct {
+	TTL      bool // IPv4 TTL / IPv6 hop limit
+	IPID     bool // IPv4 identification
+	Checksum bool // IPv4 header checksum and TCP/UDP/SCTP checksum
+}
+
+// parseNormalizeFields parses a comma-separated list such as "ttl,ipid,checksum".
+func parseNormalizeFields(list string) (NormalizeFields, error) {
+	var fields NormalizeFields
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "":
+		case "ttl":
+			fields.TTL = true
+		case "ipid":
+			fields.IPID = true
+		case "checksum":
+			fields.Checksum = true
+		default:
+			return fields, fmt.Errorf("unknown field %q (use ttl, ipid or checksum)", name)
+		}
+	}
+	return fields, nil
+}
+
+// any reports whether at least one field is selected.
+func (f NormalizeFields) any() bool {
+	return f.TTL || f.IPID || f.Checksum
+}
+
+// normalizeFields zeroes the selected fields of the IP packet starting at data[0].
+func normalizeFields(data []byte, fields NormalizeFields) {
+	if len(data) < 20 {
+		return
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0F) * 4
+		if ihl < 20 || len(data) < ihl {
+			return
+		}
+		if fields.IPID {
+			data[4], data[5] = 0, 0
+		}
+		if fields.TTL {
+			data[8] = 0
+		}
+		if fields.Checksum {
+			data[10], data[11] = 0, 0
+			// Only the first fragment carries the transport header
+			if data[6]&0x1F == 0 && data[7] == 0 {
+				zeroTransportChecksum(data[ihl:], data[9])
+			}
+		}
+	case 6:
+		if len(data) < 40 {
+			return
+		}
+		if fields.TTL {
+			data[7] = 0
+		}
+		if fields.Checksum {
+			// Extension headers are not walked; only TCP/UDP/SCTP directly after the fixed header
+			zeroTransportChecksum(data[40:], data[6])
+		}
+	}
+}
+
+// zeroTransportChecksum zeroes the TCP, UDP or SCTP checksum of a transport header.
+func zeroTransportChecksum(data []byte, protocol byte) {
+	switch layers.IPProtocol(protocol) {
+	case layers.IPProtocolTCP:
+		if len(data) >= 18 {
+			data[16], data[17] = 0, 0
+		}
+	case layers.IPProtocolUDP:
+		if len(data) >= 8 {
+			data[6], data[7] = 0, 0
+		}
+	case layers.IPProtocolSCTP:
+		if len(data) >= sctpCommonHeaderLen {
+			clear(data[8:12])
+		}
+	}
+}
+
+// layerOffset returns the byte offset of b, a slice of the packet data such as
+// a layer's contents or payload, within the packet data, or -1 if b is not part
+// of it. Decoded layers share the packet's buffer, so a slice's capacity locates
+// it exactly, whatever the encapsulation and even when an Ethernet trailer
+// follows the IP packet.
+func layerOffset(packet gopacket.Packet, b []byte) int {
+	offset := cap(packet.Data()) - cap(b)
+	if offset < 0 || offset > len(packet.Data()) {
+		return -1
+	}
+	return offset
+}
+
+// ipHeaders returns every decoded IPv4/IPv6 header of the packet, outer and
+// tunnelled (GRE, IP-in-IP, VXLAN, ...), as sub-slices of row, which holds the
+// packet data from rowStart on. Headers outside the row are skipped.
+func ipHeaders(packet gopacket.Packet, row []byte, rowStart int) [][]byte {
+	var headers [][]byte
+	for _, layer := range packet.Layers() {
+		if layer.LayerType() != layers.LayerTypeIPv4 && layer.LayerType() != layers.LayerTypeIPv6 {
+			continue
+		}
+		offset := layerOffset(packet, layer.LayerContents()) - rowStart
+		if offset < 0 || offset >= len(row) {
+			continue
+		}
+		headers = append(headers, row[offset:])
+	}
+	// The datagram quoted by an ICMP error carries the addresses of the original packet
+	if m, ok := icmpOf(packet); ok {
+		if quoted := m.quoted(); quoted != nil {
+			if offset := layerOffset(packet, quoted) - rowStart; offset >= 0 && offset < len(row) {
+				headers = append(headers, row[offset:])
+			}
+		}
+	}
+	return headers
+}
+
+// isIPPacket reports whether the packet carries IPv4 or IPv6. A packet whose
+// IP header cannot be decoded still counts if its EtherType (or the protocol
+// of its PPP header) announces IP.
+func isIPPacket(packet gopacket.Packet) bool {
+	for _, layer := range packet.Layers() {
+		var ethernetType layers.EthernetType
+		switch l := layer.(type) {
+		case *layers.IPv4, *layers.IPv6:
+			return true
+		case *layers.Ethernet:
+			ethernetType = l.EthernetType
+		case *layers.Dot1Q:
+			ethernetType = l.Type
+		case *layers.PPP:
+			if l.PPPType == layers.PPPTypeIPv4 || l.PPPType == layers.PPPTypeIPv6 {
+				return true
+			}
+			continue
+		default:
+			continue
+		}
+		if ethernetType == layers.EthernetTypeIPv4 || ethernetType == layers.EthernetTypeIPv6 {
+			return true
+		}
+	}
+	return false
+}
+
+// frameLength returns the packet's length on the wire, which is larger than
+// its data when the capture was cut at a snap length.
+func frameLength(packet gopacket.Packet) int {
+	if length := packet.Metadata().Length; length > 0 {
+		return length
+	}
+	return len(packet.Data())
+}
+
+// payloadRanges returns the application bytes of the packet as sub-slices of
+// the packet data: everything after the transport or ICMP header, or after the
+// network header for packets without one (e.g. non-first fragments). For SCTP
+// they are the user data of its DATA chunks, so chunk headers are kept. It
+// returns nil if the packet has no network layer.
+func payloadRanges(packet gopacket.Packet) [][]byte {
+	var payload []byte
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.SCTP:
+		return sctpUserData(transport)
+	case nil:
+		network := packet.NetworkLayer()
+		if network == nil {
+			return nil
+		}
+		payload = network.LayerPayload()
+		if m, ok := icmpOf(packet); ok && m.body != nil {
+			payload = m.body
+		}
+	default:
+		payload = transport.LayerPayload()
+	}
+	offset := layerOffset(packet, payload)
+	if offset < 0 {
+		return nil
+	}
+	return [][]byte{packet.Data()[offset:]}
+}
+
+// l7Payload returns the application bytes carried by the transport layer: the
+// TCP/UDP payload or the user data of the SCTP DATA chunks, concatenated. For
+// ICMP it is the message body, e.g. echo data or the datagram quoted by an
+// error. It returns nil for other packets without a transport layer.
+func l7Payload(packet gopacket.Packet) []byte {
+	switch transport := packet.TransportLayer().(type) {
+	case nil:
+		if m, ok := icmpOf(packet); ok {
+			return m.body
+		}
+		return nil
+	case *layers.SCTP:
+		chunks := sctpUserData(transport)
+		if len(chunks) == 1 {
+			return chunks[0]
+		}
+		var payload []byte
+		for _, chunk := range chunks {
+			payload = append(payload, chunk...)
+		}
+		return payload
+	default:
+		return transport.LayerPayload()
+	}
+}
+
+// packetBatchSize is the number of packets carried per channel send between the
+// reader, the workers and the collector. Batching keeps channel contention low.
+const packetBatchSize = 64
+
+// packetBatch is a batch of rows together with the arena their bytes live in.
+type packetBatch struct {
+	seq     int // Position of the job batch in read order (with batchOptions.sequence)
+	rows    []PacketResult
+	csvRows [][]string // Rows already encoded for the CSV writer (nil if not encoded)
+	arena   *byteArena // nil when the rows outlive the batch
+	written bool       // Rows already written by the worker (parallel Parquet encoders)
+	err     error      // Error of the worker's write
+}
+
+// batchOptions controls how workers prepare result batches for their consumer.
+type batchOptions struct {
+	arena    bool                 // Allocate row bytes from a per-batch arena the consumer releases
+	csv      *CSVStreamWriter     // Encode rows for this writer in the worker (nil = no encoding)
+	parquet  *ParquetStreamWriter // Write rows to this writer's row group encoders in the worker (nil = consumer writes)
+	sequence *batchSequence       // Number batches, and send empty ones too, so the consumer can restore read order (nil = off)
+}
+
+// batchSequence numbers the job batches workers take, in the order the reader
+// sent them, for --ordered.
+type batchSequence struct {
+	mutex sync.Mutex
+	next  int
+}
+
+// receive takes the next job batch and its number. Receiving under the mutex
+// keeps the numbers in channel order.
+func (s *batchSequence) receive(jobs <-chan []PacketJob) ([]PacketJob, int, bool) {
+	if s == nil {
+		batch, ok := <-jobs
+		return batch, 0, ok
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	batch, ok := <-jobs
+	seq := s.next
+	s.next++
+	return batch, seq, ok
+}
+
+// reorderBuffer hands result batches to a consumer in read order, holding back
+// those that overtook an earlier batch. It holds at most about one batch per
+// worker and queued job.
+type reorderBuffer struct {
+	next    int
+	pending map[int]packetBatch
+}
+
+// add takes a batch and calls consume for each batch that is now next in order.
+func (r *reorderBuffer) add(batch packetBatch, consume func(packetBatch)) {
+	if r.pending == nil {
+		r.pending = make(map[int]packetBatch)
+	}
+	r.pending[batch.seq] = batch
+	for {
+		next, ok := r.pending[r.next]
+		if !ok {
+			return
+		}
+		delete(r.pending, r.next)
+		r.next++
+		consume(next)
+	}
+}
+
+// worker processes batches of packets from the jobs channel and sends result batches to the results channel.
 // This is the core packet processing logic that runs in parallel.
-func worker(jobs <-chan PacketJob, results chan<- PacketResult, wg *sync.WaitGroup, maskIP bool) {
+func worker(jobs <-chan []PacketJob, results chan<- packetBatch, wg *sync.WaitGroup, fileJob FileJob, opts ProcessOptions, batching batchOptions) {
 	defer wg.Done()
-	for job := range jobs {
+	for {
+		batch, seq, ok := batching.sequence.receive(jobs)
+		if !ok {
+			return
+		}
+		var arena *byteArena
+		if batching.arena {
+			arena = newByteArena()
+		}
+
+		out := make([]PacketResult, 0, len(batch))
+		for _, job := range batch {
+			// Augmented variants follow their packet, with its index
+			for job.Copy = 0; job.Copy <= opts.Augment.copiesOf(job.Class); job.Copy++ {
+				res, ok := processPacket(job, fileJob, opts, arena)
+				if !ok {
+					break
+				}
+				if opts.Window.Size == 0 || opts.sessionRows() {
+					out = append(out, res)
+					continue
+				}
+				n := len(out)
+				out = opts.Window.split(out, res, opts.Padding, arena)
+				if opts.Scale != nil {
+					opts.Scale.applyRows(out[n:])
+				}
+			}
+		}
+
+		if !opts.sessionRows() {
+			out = opts.finishRows(out)
+		}
+		if len(out) == 0 && batching.sequence == nil {
+			arena.release()
+			continue
+		}
+
+		result := packetBatch{seq: seq, rows: out, arena: arena}
+		if batching.csv != nil {
+			// Number formatting is the bulk of CSV writing; do it here in parallel
+			result.csvRows = make([][]string, len(out))
+			for i, res := range out {
+				result.csvRows[i] = batching.csv.encodeRow(res)
+			}
+		}
+		if batching.parquet != nil {
+			// Parquet encoding is the bottleneck; each worker fills its own row group
+			result.written = true
+			result.err = opts.Throughput.write(out, func() error { return batching.parquet.WriteBatch(out) })
+		}
+		results <- result
+	}
+}
+
+// linkLayerOf returns the Ethernet or SLL header of a packet, nil for raw IP, or why it cannot become a row.
+func linkLayerOf(packet gopacket.Packet, includeL2 bool) (gopacket.Layer, error) {
+	packetLayers := packet.Layers()
+	if len(packetLayers) == 0 {
+		return nil, errors.New("empty packet")
+	}
+	first := packetLayers[0]
+	if failure, ok := first.(*gopacket.DecodeFailure); ok {
+		return nil, failure.Error()
+	}
+	switch {
+	case first.LayerType() == layers.LayerTypeEthernet:
+		return first, nil
+	case includeL2:
+		return nil, fmt.Errorf("--include-l2 needs Ethernet frames, not %s", first.LayerType())
+	case first.LayerType() == layers.LayerTypeLinuxSLL:
+		return first, nil
+	case first.LayerType() == layers.LayerTypeIPv4 || first.LayerType() == layers.LayerTypeIPv6:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported link layer %s (use Ethernet, Linux cooked or raw IP captures)", first.LayerType())
+}
 
-		ethLayer := job.Packet.Layer(layers.LayerTypeEthernet)
+// processPacket turns one packet into an output row, standardized to the output
+// length unless session or window mode needs the raw bytes. Row bytes are taken from arena.
+// It returns false if the packet is filtered out or cannot be decoded.
+func processPacket(job PacketJob, fileJob FileJob, opts ProcessOptions, arena *byteArena) (PacketResult, bool) {
+	link, linkErr := linkLayerOf(job.Packet, opts.IncludeL2)
 
-		if ethLayer != nil {
-			eth, _ := ethLayer.(*layers.Ethernet)
+	// Packets decoded only in part still become rows, but are counted per input
+	errLayer := job.Packet.ErrorLayer()
+	if errLayer != nil && job.Copy == 0 {
+		opts.Errors.DecodeFailed(fileJob)
+	}
 
-			// Extract payload (strips Ethernet header)
-			payload := eth.LayerPayload()
+	if linkErr != nil {
+		// Undecodable packet or unsupported link type
+		opts.Errors.PacketError(job, fileJob.FilePath, linkErr)
+		return PacketResult{}, false
+	}
 
-			// 'payload' might point to a memory buffer that gets reused.
-			// It is safer to make a copy for the final list.
-			dataCopy := make([]uint8, len(payload))
-			copy(dataCopy, payload)
+	// Filtered-out packets are not errors, just not part of the dataset
+	if opts.TCPFlags != nil && !opts.TCPFlags.keep(job.Packet) {
+		return PacketResult{}, false
+	}
+	if opts.Where != nil && !opts.Where.keep(job.Packet) {
+		return PacketResult{}, false
+	}
+	if !keepICMP(job.Packet, opts.ICMP) {
+		return PacketResult{}, false
+	}
+	if !keepQUIC(job.Packet, opts.QUIC) {
+		return PacketResult{}, false
+	}
+	if !keepGTPControl(job.Packet, opts.GTPC) {
+		return PacketResult{}, false
+	}
+	if opts.OnlyIP && !isIPPacket(job.Packet) {
+		return PacketResult{}, false
+	}
+	if opts.MinLen > 0 || opts.MaxLen > 0 {
+		length := frameLength(job.Packet)
+		if length < opts.MinLen || (opts.MaxLen > 0 && length > opts.MaxLen) {
+			return PacketResult{}, false
+		}
+	}
+
+	// Extract payload (strips the Ethernet or Linux cooked capture header, and
+	// the PPPoE and PPP headers of ISP edge captures, so rows start at the IP
+	// header like any other)
+	payload, rowStart := linkPayload(job.Packet, link)
+
+	// Keep the Ethernet header (and VLAN tags, which are part of its payload)
+	if opts.IncludeL2 {
+		payload = job.Packet.Data()[:len(link.LayerContents())+len(link.LayerPayload())]
+		rowStart = 0
+	}
+
+	// Padding and FCS bytes differ between capture setups, not between traffic
+	if opts.StripTrailer {
+		payload = payload[:max(0, min(len(payload), frameEnd(job.Packet)-rowStart))]
+	}
+
+	// Keep only the application payload; packets without one carry no L7 bytes
+	if opts.Extract == ExtractL7 {
+		payload = l7Payload(job.Packet)
+		if len(payload) == 0 {
+			return PacketResult{}, false
+		}
+	}
+
+	// 'payload' might point to a memory buffer that gets reused.
+	// It is safer to make a copy for the final list.
+	dataCopy := arena.alloc(len(payload))
+	copy(dataCopy, payload)
+
+	if opts.Anon != nil && job.Copy == 0 {
+		opts.Anon.inspect(job.Packet)
+	}
+
+	// Randomize the fields of an augmented variant before masking, which may
+	// zero the checksums it keeps valid
+	if job.Copy > 0 {
+		opts.Augment.apply(job.Packet, job.FileName, job.Index, dataCopy, rowStart, job.Copy)
+	}
 
-			// Apply IP masking if requested
-			if maskIP && len(dataCopy) > 0 {
-				dataCopy = maskIPAddresses(dataCopy)
+	// Apply IP masking or pseudonyms and field normalization to every IP header
+	// found by the decoder. If the IP layer could not be decoded, the row is
+	// assumed to start at it; rows of non-IP packets are left as they are. L7
+	// rows contain no IP header, except the datagram quoted by an ICMP error.
+	if (opts.MaskIP || opts.Anon.pseudonymizesIPs() || opts.Normalize.any()) && len(dataCopy) > 0 {
+		var headers [][]byte
+		if opts.Extract != ExtractL7 {
+			headers = ipHeaders(job.Packet, dataCopy, rowStart)
+			if len(headers) == 0 && isIPPacket(job.Packet) {
+				headers = [][]byte{dataCopy}
 			}
+		} else if m, ok := icmpOf(job.Packet); ok && m.quoted() != nil {
+			headers = [][]byte{dataCopy}
+		}
+		for _, ipHeader := range headers {
+			if opts.MaskIP {
+				maskIPAddresses(ipHeader, opts.MaskPrefix)
+			} else if opts.Anon.pseudonymizesIPs() {
+				opts.Anon.pseudonymizeIPs(ipHeader)
+			}
+			normalizeFields(ipHeader, opts.Normalize)
+		}
+	}
+	if opts.Anon != nil && opts.IncludeL2 {
+		opts.Anon.maskMACs(dataCopy)
+	}
 
-			results <- PacketResult{
-				Index:    job.Index,
-				Data:     dataCopy,
-				Class:    job.Class,
-				FileName: job.FileName,
+	// Keep the headers but drop the application content
+	if opts.ZeroPayload {
+		for _, payload := range payloadRanges(job.Packet) {
+			offset := layerOffset(job.Packet, payload) - rowStart
+			if offset < 0 || offset > len(dataCopy) {
+				continue
+			}
+			zeroed := dataCopy[offset:min(offset+len(payload), len(dataCopy))]
+			clear(zeroed)
+			if opts.Anon != nil {
+				opts.Anon.payloadBytes.Add(int64(len(zeroed)))
 			}
 		}
 	}
+
+	// Offsets are those of the extracted bytes, before truncation moves them
+	opts.MaskBytes.apply(dataCopy)
+
+	// Standardize packet length consistently (after masking, so truncation can't expose addresses).
+	// Session and window rows are standardized once they are cut, token rows by the tokenizer.
+	originalSize := len(dataCopy)
+	if opts.packetRows() && opts.OutputLength > 0 && opts.Tokens == nil {
+		dataCopy = truncatePadInto(arena.alloc(opts.OutputLength), dataCopy, opts.TruncateFrom, opts.Padding)
+	}
+
+	// Stateless features follow the reader's
+	features := job.Features
+	if opts.ICMPFeatures {
+		features = append(features[:len(features):len(features)], icmpFeatures(job.Packet)...)
+	}
+	if opts.QUICFeatures {
+		features = append(features[:len(features):len(features)], quicFeatures(job.Packet)...)
+	}
+	if opts.TupleHash != nil {
+		features = append(features[:len(features):len(features)], opts.TupleHash.features(job.Packet)...)
+	}
+	if opts.TCPFeatures {
+		features = append(features[:len(features):len(features)], tcpFeatures(job.Packet)...)
+	}
+	if opts.LabelWeights != nil {
+		features = append(features[:len(features):len(features)], job.Weight)
+	}
+	if opts.Aggregate {
+		// Only the size is counted, so the bytes need not be kept until the file is read
+		features = aggregatePacketValues(job.Packet)
+		dataCopy = nil
+	}
+
+	result := PacketResult{
+		Index:        job.Index,
+		OriginalSize: originalSize,
+		Data:         dataCopy,
+		Class:        job.Class,
+		FileName:     job.FileName,
+		Timestamp:    opts.emitTime(job.Packet.Metadata().Timestamp),
+		Features:     features,
+		Session:      job.Session,
+		Split:        job.Split,
+		FlowID:       job.FlowID,
+		SplitPoint:   job.SplitPoint,
+		Direction:    job.Direction,
+		Copy:         job.Copy,
+		DecodeFailed: errLayer != nil,
+	}
+	if opts.Messages != MessagesOff {
+		_, result.Segment = job.Packet.TransportLayer().(*layers.TCP)
+	}
+	if opts.Export != nil {
+		result.Frame = &capturedFrame{
+			data:     bytes.Clone(job.Packet.Data()),
+			info:     job.Packet.Metadata().CaptureInfo,
+			linkType: job.LinkType,
+		}
+	}
+	if opts.Tokens != nil {
+		opts.Tokens.apply(&result)
+	}
+	if opts.Scale != nil && opts.packetRows() {
+		opts.Scale.apply(&result)
+	}
+	return result, true
+}
+
+// readPackets reads packets from handle and sends them to the jobs channel.
+// The first packet read gets index first (its position in the file).
+// Packets of flows in dropFlows (duplicates found by --dedup-flows) are skipped,
+// and so are packets repeating the previous file of --input-rotation.
+// Reading stops at end of file or as soon as ctx is cancelled, so an interrupted
+// run still drains the workers and finalizes its writers.
+func readPackets(ctx context.Context, handle packetReader, fileJob FileJob, fileName string, jobs chan<- []PacketJob, dropFlows map[FlowKey]bool, opts ProcessOptions, first int) {
+	linkType := handle.LinkType()
+	packetSource := gopacket.NewPacketSource(handle, linkType)
+	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+
+	var retrans *retransmissionTracker
+	if opts.DropRetrans {
+		retrans = newRetransmissionTracker()
+	}
+
+	flows := newFlowTracker(opts.FlowTimeouts)
+	var timing *timingTracker
+	if opts.Timing {
+		timing = newTimingTracker(opts.TimeShift, opts.TimeResolution)
+	}
+	var labels *protocolTracker
+	if opts.LabelBy == LabelByProtocol {
+		labels = newProtocolTracker()
+	}
+
+	// Session IDs in order of first appearance and the source of their
+	// first packet (session mode only)
+	var sessions map[sessionKey]int
+	var origins []sessionOrigin
+	if opts.sessionRows() && !opts.PacketWindow.byFile() {
+		sessions = make(map[sessionKey]int)
+	}
+
+	var quality qualityCounts
+	if opts.Quality != nil {
+		quality = make(qualityCounts)
+	}
+
+	counter := first
+	dropped := 0
+	sampledOut := 0
+	decapsulated := 0
+	var readBytes int64
+	unshown, shownBytes := 0, int64(0) // Read packets and bytes not yet counted by Progress
+	batch := make([]PacketJob, 0, packetBatchSize)
+	captured := newCaptureRange(opts)
+	rotation := opts.Rotation.open()
+	withFlowID := opts.Writer.hasColumn(ColumnFlowID)
+	for ctx.Err() == nil && !opts.Limit.reached() {
+		packet, err := packetSource.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err == errReadTimeout {
+			// A quiet interface: hand the packets read so far to the workers
+			if len(batch) > 0 {
+				jobs <- batch
+				batch = make([]PacketJob, 0, packetBatchSize)
+			}
+			continue
+		}
+		if err != nil {
+			slog.Warn("stopped reading file", "file", fileJob.FilePath, "packets", counter, "error", err)
+			if quality != nil {
+				quality.class(fileJob.Class).TruncatedFiles++
+			}
+			break
+		}
+		readBytes += int64(packet.Metadata().CaptureLength)
+		if unshown++; unshown == progressReadBatch {
+			opts.Progress.read(fileJob, unshown, readBytes-shownBytes)
+			unshown, shownBytes = 0, readBytes
+		}
+
+		// Skipped packets keep their index too, so it stays the position in the capture
+		keep, done := captured.next(packet)
+		if done {
+			slog.Debug("reached packet limit", "file", fileJob.FilePath, "packets", captured.taken)
+			break
+		}
+		if !keep {
+			counter++
+			continue
+		}
+		if rotation.duplicate(packet) {
+			counter++
+			continue
+		}
+		if opts.GTPDecap || opts.IPDecap > 0 {
+			var ok bool
+			if packet, ok = opts.decapsulate(packet); ok {
+				decapsulated++
+			}
+		}
+
+		// Dropped packets keep their index so row order still matches the capture
+		if dropFlows != nil {
+			if key, ok := flowKeyOf(packet); ok && dropFlows[key] {
+				counter++
+				continue
+			}
+		}
+		if retrans != nil && retrans.isRetransmission(packet) {
+			dropped++
+			counter++
+			continue
+		}
+
+		// Per-flow state (timeouts, timing, sessions, splits) follows --flow-direction
+		flowKey, hasFlow := flowKeyIn(packet, opts.FlowDirection)
+		generation := 0
+		if hasFlow {
+			generation = flows.generation(flowKey, packet.Metadata().Timestamp)
+		}
+		var features []float64
+		if timing != nil {
+			features = timing.features(packet, flowKey, hasFlow, generation)
+		}
+		class := fileJob.Class
+		if labels != nil {
+			class = labels.label(packet)
+		}
+		if opts.Zeek != nil {
+			conn, orig := opts.Zeek.match(packet)
+			if opts.LabelBy == LabelByZeek {
+				class = opts.Zeek.label(conn)
+			}
+			if opts.Zeek.features {
+				features = append(features, opts.Zeek.featureValues(conn, orig)...)
+			}
+		}
+		if opts.Suricata != nil {
+			class = opts.Suricata.label(packet)
+		}
+		var ruleWeight *float64
+		if opts.Rules != nil {
+			class, ruleWeight = opts.Rules.label(packet)
+		}
+		if quality != nil {
+			quality.inspect(packet, class)
+		}
+
+		// A class with all its --max-per-class rows needs no more packets, and
+		// the file none at all if its rows all have its class. Sessions are
+		// only cut once the whole file is read, so they are kept whole.
+		if sessions == nil && opts.Quota.full(class) {
+			if opts.classDone(fileJob) {
+				slog.Debug("stopped reading file, its class has --max-per-class rows", "file", fileJob.FilePath, "class", class, "packets", counter)
+				break
+			}
+			counter++
+			continue
+		}
+
+		session := 0
+		direction := uint8(0)
+		if sessions != nil {
+			if !hasFlow {
+				// Not part of any IP session
+				counter++
+				continue
+			}
+			key := newSessionKey(flowKey, generation, packet.Metadata().Timestamp, opts.TimeWindow)
+			id, exists := sessions[key]
+			if !exists {
+				id = len(sessions)
+				sessions[key] = id
+				origins = append(origins, sessionOriginOf(packet))
+			}
+			session = id
+			direction = origins[id].direction(packet, opts.TimeWindow > 0)
+		}
+
+		// Sessions are sampled as a whole, so kept sessions stay complete
+		if opts.ClassWeights != nil {
+			position := counter
+			if sessions != nil {
+				position = session
+			}
+			if !opts.ClassWeights.keep(class, fileName, position) {
+				sampledOut++
+				counter++
+				continue
+			}
+		}
+
+		// Sessions are flows, so they keep the split of their first packet
+		split := 0
+		var splitPoint float64
+		if opts.Split != nil {
+			splitPoint = opts.Split.point(fileName, counter, flowKey, hasFlow, generation)
+			split = opts.Split.pick(splitPoint)
+		}
+
+		var id uint64
+		if withFlowID && opts.Aggregate {
+			// Aggregate rows are host pairs, whatever the ports
+			hostPair := flowKey
+			hostPair.Transport = gopacket.Flow{}
+			id = flowID(hostPair, hasFlow, 0)
+		} else if withFlowID {
+			id = flowID(flowKey, hasFlow, generation)
+		}
+
+		weight := 0.0
+		if ruleWeight != nil {
+			weight = *ruleWeight
+		} else if opts.LabelWeights != nil {
+			weight = opts.LabelWeights.of(class)
+		}
+
+		batch = append(batch, PacketJob{
+			Index:      counter,
+			Packet:     packet,
+			Class:      class,
+			FileName:   fileName,
+			Features:   features,
+			Session:    session,
+			Split:      split,
+			FlowID:     id,
+			SplitPoint: splitPoint,
+			Direction:  direction,
+			Weight:     weight,
+			LinkType:   linkType,
+		})
+		counter++
+
+		if len(batch) == packetBatchSize {
+			jobs <- batch
+			batch = make([]PacketJob, 0, packetBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		jobs <- batch
+	}
+	opts.Throughput.read(captured.seen, readBytes)
+	opts.Progress.read(fileJob, unshown, readBytes-shownBytes)
+	if skipped := rotation.close(); skipped > 0 {
+		slog.Info("skipped packets repeated from the previous rotation file", "file", fileJob.FilePath, "packets", skipped)
+	}
+
+	if quality != nil {
+		opts.Quality.merge(quality)
+	}
+	if dropped > 0 {
+		slog.Debug("dropped retransmitted segments", "file", fileJob.FilePath, "packets", dropped)
+	}
+	if sampledOut > 0 {
+		slog.Debug("dropped packets by class weight", "file", fileJob.FilePath, "packets", sampledOut)
+	}
+	if decapsulated > 0 {
+		slog.Debug("decapsulated tunnelled packets", "file", fileJob.FilePath, "packets", decapsulated)
+	}
+
+	if salvage, ok := handle.(*salvageReader); ok && salvage.skippedBytes > 0 {
+		opts.Errors.Salvaged(fileJob, salvage.skippedBytes, salvage.resyncs)
+	}
+}
+
+// scanDuplicateFlows runs the --dedup-flows pass over a file, if enabled.
+// It reads the file separately so streaming modes don't have to buffer flows.
+func scanDuplicateFlows(ctx context.Context, fileJob FileJob, opts ProcessOptions) (map[FlowKey]bool, error) {
+	if opts.Dedup == nil {
+		return nil, nil
+	}
+	dropFlows, err := opts.Dedup.scan(ctx, fileJob, opts)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate flow scan of %s: %w", fileJob.FilePath, err)
+	}
+	return dropFlows, nil
 }
 
 // processFile processes a single PCAP/PCAPNG file and returns all packets with metadata.
 // This function uses packet-level parallelism with worker goroutines.
-func processFile(fileJob FileJob, outputLength int, sortPackets bool, workersPerFile int, maskIP bool) ([]PacketResult, error) {
+func processFile(ctx context.Context, fileJob FileJob, opts ProcessOptions, sortPackets bool, workersPerFile int) ([]PacketResult, error) {
+	// Cached rows are already in capture order
+	if opts.Cache != nil {
+		return opts.Cache.rows(ctx, fileJob, opts, workersPerFile)
+	}
+
+	// Flow exports are decoded record by record, without packet workers
+	if opts.NetFlow {
+		var rows []PacketResult
+		_, err := processNetflowFile(ctx, fileJob, opts, func(batch []PacketResult) error {
+			rows = append(rows, batch...)
+			return nil
+		})
+		return rows, err
+	}
+
 	// Open PCAP file
-	handle, err := pcap.OpenOffline(fileJob.FilePath)
+	handle, err := openInput(fileJob, opts)
 	if err != nil {
-		return nil, fmt.Errorf("cannot open file %s: %w", fileJob.FilePath, err)
+		return nil, fmt.Errorf("%w %s: %w", errCannotOpen, fileJob.FilePath, err)
 	}
 	defer handle.Close()
+	defer opts.Progress.end(opts.Progress.begin(fileJob))
 
-	fileName := filepath.Base(fileJob.FilePath)
+	dropFlows, err := scanDuplicateFlows(ctx, fileJob, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := fileJob.name()
 
 	// Setup channels for packet processing
-	jobs := make(chan PacketJob, 256)
-	results := make(chan PacketResult, 256)
+	jobs := make(chan []PacketJob, 4)
+	results := make(chan packetBatch, 4)
 
-	// Start workers for this file
+	// Start workers for this file (rows are kept, so no arena)
 	var wg sync.WaitGroup
 	for w := 0; w < workersPerFile; w++ {
 		wg.Add(1)
-		go worker(jobs, results, &wg, maskIP)
+		go worker(jobs, results, &wg, fileJob, opts, batchOptions{})
 	}
 
 	// Start collector goroutine
 	finalPackets := make([]PacketResult, 0, 10000)
 	done := make(chan bool)
 	go func() {
-		for res := range results {
-			finalPackets = append(finalPackets, res)
+		for batch := range results {
+			finalPackets = append(finalPackets, batch.rows...)
 		}
 		done <- true
 	}()
 
 	// Read and distribute packets to workers
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
-
-	counter := 0
-	for packet := range packetSource.Packets() {
-		jobs <- PacketJob{
-			Index:    counter,
-			Packet:   packet,
-			Class:    fileJob.Class,
-			FileName: fileName,
-		}
-		counter++
-	}
+	readCapture(ctx, handle, fileJob, fileName, jobs, dropFlows, opts)
 
 	// Shutdown
 	close(jobs)
@@ -206,78 +1322,143 @@ func processFile(fileJob FileJob, outputLength int, sortPackets bool, workersPer
 	close(results)
 	<-done
 
-	// Sort if requested
+	// Collapse packets into one row per session
+	if opts.sessionRows() {
+		sessions := newSessionAssembler(opts, fileJob)
+		for _, p := range finalPackets {
+			sessions.add(p)
+		}
+		finalPackets = sessions.rows()
+		if opts.Scale != nil {
+			opts.Scale.applyRows(finalPackets)
+		}
+		finalPackets = opts.finishRows(finalPackets)
+	}
+
+	// Sort if requested (stable, so the windows of a packet stay in order)
 	if sortPackets {
-		sort.Slice(finalPackets, func(i, j int) bool {
+		sort.SliceStable(finalPackets, func(i, j int) bool {
 			return finalPackets[i].Index < finalPackets[j].Index
 		})
 	}
 
-	// Standardize packet lengths consistently
-	// If outputLength > 0: truncate/pad to that length
-	// If outputLength == 0: keep original size
-	for i := range finalPackets {
-		finalPackets[i].OriginalSize = len(finalPackets[i].Data)
-		finalPackets[i].Data = standardizePacketLength(finalPackets[i].Data, outputLength)
-	}
-
 	return finalPackets, nil
 }
 
 // processFileStreaming processes a single PCAP/PCAPNG file and streams packets directly to a writer.
-func processFileStreaming(fileJob FileJob, writer StreamWriter, outputLength int, workersPerFile int, maskIP bool) (int, error) {
+func processFileStreaming(ctx context.Context, fileJob FileJob, writer StreamWriter, opts ProcessOptions, workersPerFile int) (int, error) {
+	writeBatch := func(rows []PacketResult) error {
+		return opts.Throughput.write(rows, func() error { return writer.WriteBatch(rows) })
+	}
+	if opts.NetFlow {
+		return processNetflowFile(ctx, fileJob, opts, writeBatch)
+	}
+	if opts.Cache != nil {
+		rows, err := opts.Cache.rows(ctx, fileJob, opts, workersPerFile)
+		if err != nil || len(rows) == 0 {
+			return 0, err
+		}
+		if err := writeBatch(rows); err != nil {
+			return 0, err
+		}
+		return len(rows), nil
+	}
+
 	// Open PCAP file
-	handle, err := pcap.OpenOffline(fileJob.FilePath)
+	handle, err := openInput(fileJob, opts)
 	if err != nil {
-		return 0, fmt.Errorf("cannot open file %s: %w", fileJob.FilePath, err)
+		return 0, fmt.Errorf("%w %s: %w", errCannotOpen, fileJob.FilePath, err)
 	}
 	defer handle.Close()
+	defer opts.Progress.end(opts.Progress.begin(fileJob))
 
-	fileName := filepath.Base(fileJob.FilePath)
+	dropFlows, err := scanDuplicateFlows(ctx, fileJob, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	fileName := fileJob.name()
 
 	// Setup channels for packet processing
-	jobs := make(chan PacketJob, 512)
-	results := make(chan PacketResult, 512)
+	jobs := make(chan []PacketJob, 8)
+	results := make(chan packetBatch, 8)
+
+	// In session mode rows are only complete once the whole file has been read
+	var sessions *sessionAssembler
+	if opts.sessionRows() {
+		sessions = newSessionAssembler(opts, fileJob)
+	}
+
+	// Rows are written as they arrive, so their bytes can live in arenas recycled
+	// after each batch and CSV rows can be encoded by the workers (except in session mode).
+	var batching batchOptions
+	if sessions == nil {
+		batching.arena = true
+		batching.csv, _ = writer.(*CSVStreamWriter)
+		if pw, ok := writer.(*ParquetStreamWriter); ok && pw.shards != nil && !opts.Ordered {
+			batching.parquet = pw
+		}
+		if opts.Ordered {
+			batching.sequence = &batchSequence{}
+		}
+	}
 
 	// Start workers for this file
 	var wg sync.WaitGroup
 	for w := 0; w < workersPerFile; w++ {
 		wg.Add(1)
-		go worker(jobs, results, &wg, maskIP)
+		go worker(jobs, results, &wg, fileJob, opts, batching)
 	}
 
 	// Start writer goroutine that streams packets directly to disk
 	packetCount := 0
 	var writeErr error
 	done := make(chan bool)
+	var reorder reorderBuffer
 	go func() {
-		for res := range results {
-			res.OriginalSize = len(res.Data)
-			// Standardize packet length consistently
-			res.Data = standardizePacketLength(res.Data, outputLength)
-			if err := writer.WritePacket(res); err != nil {
-				writeErr = err
-				break
+		consume := func(batch packetBatch) {
+			// After a write error keep draining, so workers never block on a full channel
+			switch {
+			case writeErr != nil:
+			case len(batch.rows) == 0: // Only sent to keep --ordered batches numbered
+			case sessions != nil:
+				for _, res := range batch.rows {
+					sessions.add(res)
+				}
+			case batch.written:
+				if batch.err != nil {
+					writeErr = batch.err
+				} else {
+					packetCount += len(batch.rows)
+				}
+			case batch.csvRows != nil:
+				if err := opts.Throughput.write(batch.rows, func() error { return batching.csv.WriteEncoded(batch.csvRows) }); err != nil {
+					writeErr = err
+				} else {
+					packetCount += len(batch.rows)
+				}
+			default:
+				if err := writeBatch(batch.rows); err != nil {
+					writeErr = err
+				} else {
+					packetCount += len(batch.rows)
+				}
+			}
+			// Writers copy row bytes, so the batch's buffers can be reused
+			batch.arena.release()
+		}
+		for batch := range results {
+			if batching.sequence != nil {
+				reorder.add(batch, consume)
+			} else {
+				consume(batch)
 			}
-			packetCount++
 		}
 		done <- true
 	}()
 
 	// Read and distribute packets to workers
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
-
-	counter := 0
-	for packet := range packetSource.Packets() {
-		jobs <- PacketJob{
-			Index:    counter,
-			Packet:   packet,
-			Class:    fileJob.Class,
-			FileName: fileName,
-		}
-		counter++
-	}
+	readCapture(ctx, handle, fileJob, fileName, jobs, dropFlows, opts)
 
 	// Shutdown
 	close(jobs)
@@ -285,6 +1466,19 @@ func processFileStreaming(fileJob FileJob, writer StreamWriter, outputLength int
 	close(results)
 	<-done
 
+	if sessions != nil && writeErr == nil {
+		rows := sessions.rows()
+		if opts.Scale != nil {
+			opts.Scale.applyRows(rows)
+		}
+		rows = opts.finishRows(rows)
+		if err := writeBatch(rows); err != nil {
+			writeErr = err
+		} else {
+			packetCount += len(rows)
+		}
+	}
+
 	if writeErr != nil {
 		return packetCount, fmt.Errorf("error writing packets: %w", writeErr)
 	}
@@ -294,7 +1488,11 @@ func processFileStreaming(fileJob FileJob, writer StreamWriter, outputLength int
 
 // processFilesParallel processes multiple files with limited parallelism.
 // Each file is processed with its own set of packet workers.
-func processFilesParallel(fileJobs []FileJob, outputLength int, sortPackets bool, maxConcurrentFiles int, maskIP bool) []PacketResult {
+// Files are no longer loaded once the heap nears the --max-memory budget; they
+// are returned as deferred so the caller can stream them instead.
+// Results and deferred files are returned in the order of fileJobs, whichever
+// file finishes first, so runs over the same inputs give the same rows.
+func processFilesParallel(ctx context.Context, fileJobs []FileJob, opts ProcessOptions, sortPackets bool, maxConcurrentFiles int, manifest *RunManifest) ([]PacketResult, []FileJob) {
 	// Calculate workers per file
 	totalCores := runtime.NumCPU()
 	workersPerFile := totalCores / maxConcurrentFiles
@@ -302,19 +1500,18 @@ func processFilesParallel(fileJobs []FileJob, outputLength int, sortPackets bool
 		workersPerFile = 1
 	}
 
-	fmt.Printf("Processing %d files with %d concurrent files, %d workers per file\n\n",
-		len(fileJobs), maxConcurrentFiles, workersPerFile)
+	slog.Info("processing files", "files", len(fileJobs), "concurrent", maxConcurrentFiles, "workers_per_file", workersPerFile)
 
-	// Create channel for file jobs
-	fileChannel := make(chan FileJob, len(fileJobs))
-	for _, job := range fileJobs {
-		fileChannel <- job
+	// Create channel for the positions of the file jobs
+	fileChannel := make(chan int, len(fileJobs))
+	for i := range fileJobs {
+		fileChannel <- i
 	}
 	close(fileChannel)
 
-	// Collect results from all files
-	var resultsMutex sync.Mutex
-	allResults := make([]PacketResult, 0, 100000)
+	// Results of each file at its position, joined in file order at the end
+	fileResults := make([][]PacketResult, len(fileJobs))
+	isDeferred := make([]bool, len(fileJobs))
 
 	// Start file processors
 	var wg sync.WaitGroup
@@ -322,31 +1519,95 @@ func processFilesParallel(fileJobs []FileJob, outputLength int, sortPackets bool
 		wg.Add(1)
 		go func(workerID int) {
 			defer wg.Done()
-			for fileJob := range fileChannel {
-				fmt.Printf("[Worker %d] Processing %s (class: %s)\n", workerID, filepath.Base(fileJob.FilePath), fileJob.Class)
+			for position := range fileChannel {
+				fileJob := fileJobs[position]
+				if ctx.Err() != nil || opts.Limit.reached() {
+					return
+				}
+				if opts.classDone(fileJob) {
+					slog.Debug("skipped file, its class has --max-per-class rows", "file", fileJob.FilePath, "class", fileJob.Class)
+					continue
+				}
+				if opts.Memory.near() {
+					isDeferred[position] = true
+					continue
+				}
+
+				slog.Debug("processing file", "worker", workerID, "file", fileJob.FilePath, "class", fileJob.Class)
 
-				packets, err := processFile(fileJob, outputLength, sortPackets, workersPerFile, maskIP)
+				started := time.Now()
+				var packets []PacketResult
+				err := opts.Retry.run(ctx, fileJob, func() (err error) {
+					packets, err = processFile(ctx, fileJob, opts, sortPackets, workersPerFile)
+					return err
+				})
 				if err != nil {
-					log.Printf("[Worker %d] Error processing %s: %v\n", workerID, fileJob.FilePath, err)
+					opts.Errors.FileError(fileJob, err)
 					continue
 				}
 
-				fmt.Printf("[Worker %d] Processed %s: %d packets\n", workerID, filepath.Base(fileJob.FilePath), len(packets))
+				manifest.RecordFile(ManifestFile{
+					Path:            fileJob.FilePath,
+					Interface:       fileJob.Interface,
+					Class:           fileJob.Class,
+					Packets:         len(packets),
+					Complete:        ctx.Err() == nil,
+					DurationSeconds: time.Since(started).Seconds(),
+				})
 
-				// Add results to global list (thread-safe)
-				resultsMutex.Lock()
-				allResults = append(allResults, packets...)
-				resultsMutex.Unlock()
+				slog.Info(progressLogMessage, append([]any{"worker", workerID, "file", fileJob.FilePath, "class", fileJob.Class, "packets", len(packets)}, opts.Throughput.progress()...)...)
+
+				fileResults[position] = packets
 			}
 		}(i)
 	}
 
 	wg.Wait()
-	return allResults
+
+	total := 0
+	for _, packets := range fileResults {
+		total += len(packets)
+	}
+	allResults := make([]PacketResult, 0, total)
+	var deferred []FileJob
+	for i, packets := range fileResults {
+		allResults = append(allResults, packets...)
+		fileResults[i] = nil
+		if isDeferred[i] {
+			deferred = append(deferred, fileJobs[i])
+		}
+	}
+	return allResults, deferred
+}
+
+// firstPassOptions returns opts for a pass that only inspects the rows (--scale
+// statistics, BPE training) before the output pass. Rows are processed the same
+// way, but with separate duplicate flow detection and without error reporting,
+// which the output pass does. The returned function releases the pass.
+func firstPassOptions(opts ProcessOptions) (ProcessOptions, func(), error) {
+	var err error
+	opts.Errors, err = NewErrorHandler(OnErrorSkip, "", nil)
+	if err != nil {
+		return opts, nil, err
+	}
+	opts.Anon = opts.Anon.forPass()
+	opts.Zeek = opts.Zeek.forPass()
+	opts.KeyLog = opts.KeyLog.forPass()
+	opts.Suricata = opts.Suricata.forPass()
+	opts.Rules = opts.Rules.forPass()
+	if opts.Dedup == nil {
+		return opts, func() {}, nil
+	}
+	opts.Dedup, err = NewFlowDeduplicator(opts.Dedup.mode, os.DevNull)
+	if err != nil {
+		return opts, nil, err
+	}
+	// Close would log the duplicates a second time
+	return opts, func() { opts.Dedup.reportFile.Close() }, nil
 }
 
 // processFilesStreamingSingleOutput processes multiple files and streams all packets to a single output file.
-func processFilesStreamingSingleOutput(fileJobs []FileJob, writer StreamWriter, outputLength int, maxConcurrentFiles int, maskIP bool) (int, error) {
+func processFilesStreamingSingleOutput(ctx context.Context, fileJobs []FileJob, writer StreamWriter, opts ProcessOptions, maxConcurrentFiles int, manifest *RunManifest) (int, error) {
 	// Calculate workers per file
 	totalCores := runtime.NumCPU()
 	workersPerFile := totalCores / maxConcurrentFiles
@@ -368,12 +1629,38 @@ func processFilesStreamingSingleOutput(fileJobs []FileJob, writer StreamWriter,
 	// Process files sequentially to maintain order and avoid writer contention
 	fileNum := 0
 	for fileJob := range fileChannel {
+		if ctx.Err() != nil || opts.Limit.reached() {
+			break
+		}
+		if opts.classDone(fileJob) {
+			slog.Debug("skipped file, its class has --max-per-class rows", "file", fileJob.FilePath, "class", fileJob.Class)
+			continue
+		}
+
 		fileNum++
-		fmt.Printf("[%d/%d] Processing %s (class: %s)\n", fileNum, len(fileJobs), filepath.Base(fileJob.FilePath), fileJob.Class)
+		slog.Debug("processing file", "file_num", fileNum, "total_files", len(fileJobs), "file", fileJob.FilePath, "class", fileJob.Class)
 
-		count, err := processFileStreaming(fileJob, writer, outputLength, workersPerFile, maskIP)
+		started := time.Now()
+		var count int
+		err := opts.Retry.run(ctx, fileJob, func() (err error) {
+			count, err = processFileStreaming(ctx, fileJob, writer, opts, workersPerFile)
+			return err
+		})
+		if errors.Is(err, errCannotOpen) {
+			opts.Errors.FileError(fileJob, err)
+			continue
+		}
+
+		manifest.RecordFile(ManifestFile{
+			Path:            fileJob.FilePath,
+			Interface:       fileJob.Interface,
+			Class:           fileJob.Class,
+			Packets:         count,
+			Complete:        err == nil && ctx.Err() == nil,
+			DurationSeconds: time.Since(started).Seconds(),
+		})
 		if err != nil {
-			log.Printf("Error processing %s: %v\n", fileJob.FilePath, err)
+			slog.Error("error processing file", "file", fileJob.FilePath, "error", err)
 			processErr = err
 			break
 		}
@@ -388,9 +1675,15 @@ func processFilesStreamingSingleOutput(fileJobs []FileJob, writer StreamWriter,
 		allocMB := int(m.Alloc / 1024 / 1024)
 		sysMB := int(m.Sys / 1024 / 1024)
 
-		fmt.Printf("[%d/%d] Processed %s: %d packets\n", fileNum, len(fileJobs), filepath.Base(fileJob.FilePath), count)
-		fmt.Printf("        Memory: Alloc=%dMB, Sys=%dMB, TotalPackets=%d\n",
-			allocMB, sysMB, totalPackets)
+		slog.Info(progressLogMessage, append([]any{
+			"file_num", fileNum,
+			"total_files", len(fileJobs),
+			"file", fileJob.FilePath,
+			"class", fileJob.Class,
+			"packets", count,
+			"total_packets", totalPackets,
+			"alloc_mb", allocMB,
+			"sys_mb", sysMB}, opts.Throughput.progress()...)...)
 	}
 
 	if processErr != nil {
@@ -400,8 +1693,60 @@ func processFilesStreamingSingleOutput(fileJobs []FileJob, writer StreamWriter,
 	return totalPackets, nil
 }
 
+// perFileOutputNames maps each input file to its per-file output path.
+// It fails if the template maps two inputs to the same output.
+func perFileOutputNames(fileJobs []FileJob, outputDir, outputFormat, outputTemplate string, outputLength int) (map[string]string, error) {
+	outputs := make(map[string]string, len(fileJobs))
+	owners := make(map[string]string, len(fileJobs))
+	for _, job := range fileJobs {
+		baseName := filepath.Base(job.FilePath)
+		stem := baseName[:len(baseName)-len(filepath.Ext(baseName))]
+		if job.Interface != "" {
+			stem += "_" + job.Interface
+		}
+
+		name, err := expandOutputTemplate(outputTemplate, outputNameFields{
+			Class:  job.Class,
+			Stem:   stem,
+			Length: outputLength,
+			Format: outputFormat,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		outputFile := filepath.Join(outputDir, name)
+		if owner, exists := owners[outputFile]; exists {
+			return nil, fmt.Errorf("%s and %s would both write %s (add {class} to --output-template)", owner, job.key(), outputFile)
+		}
+		owners[outputFile] = job.key()
+		outputs[job.key()] = outputFile
+	}
+	return outputs, nil
+}
+
+// datasetClassIDs numbers the dataset's classes in sorted order.
+func datasetClassIDs(fileJobs []FileJob) map[string]byte {
+	var classes []string
+	seen := make(map[string]bool)
+	for _, job := range fileJobs {
+		if job.Class != "" && !seen[job.Class] {
+			seen[job.Class] = true
+			classes = append(classes, job.Class)
+		}
+	}
+	sort.Strings(classes)
+
+	ids := make(map[string]byte, len(classes))
+	for i, class := range classes {
+		ids[class] = byte(i)
+	}
+	return ids
+}
+
 // processFilesStreamingPerFile processes multiple files and creates a separate output file for each input file.
-func processFilesStreamingPerFile(fileJobs []FileJob, outputDir string, outputFormat string, outputLength int, maxConcurrentFiles int, maskIP bool) error {
+// Output names come from outputTemplate (see expandOutputTemplate).
+func processFilesStreamingPerFile(ctx context.Context, fileJobs []FileJob, outputDir string, outputFormat string, outputTemplate string, opts ProcessOptions, maxConcurrentFiles int, manifest *RunManifest) error {
 	// Calculate workers per file
 	totalCores := runtime.NumCPU()
 	workersPerFile := totalCores / maxConcurrentFiles
@@ -409,9 +1754,11 @@ func processFilesStreamingPerFile(fileJobs []FileJob, outputDir string, outputFo
 		workersPerFile = 1
 	}
 
-	fmt.Printf("Processing %d files with per-file output (maximum memory efficiency)\n", len(fileJobs))
-	fmt.Printf("Output directory: %s\n", outputDir)
-	fmt.Printf("Max concurrent files: %d, Workers per file: %d\n\n", maxConcurrentFiles, workersPerFile)
+	slog.Info("processing files with per-file output",
+		"files", len(fileJobs),
+		"output_dir", outputDir,
+		"concurrent", maxConcurrentFiles,
+		"workers_per_file", workersPerFile)
 
 	// Create output directory if it doesn't exist
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
@@ -419,11 +1766,14 @@ func processFilesStreamingPerFile(fileJobs []FileJob, outputDir string, outputFo
 	}
 
 	// For streaming writers, we need to know the expected packet size for buffer allocation
-	// If outputLength > 0: use that, otherwise use a reasonable default for buffer sizing
-	bufferSize := outputLength
-	if bufferSize == 0 {
-		bufferSize = 1500 // Default for buffer allocation only
+	bufferSize := opts.writerPacketSize()
+
+	// Resolve every output name up front so collisions fail before any work is done
+	outputFiles, err := perFileOutputNames(fileJobs, outputDir, outputFormat, outputTemplate, opts.OutputLength)
+	if err != nil {
+		return err
 	}
+	classIDs := opts.classIDs(fileJobs)
 
 	// Create channel for file jobs
 	fileChannel := make(chan FileJob, len(fileJobs))
@@ -444,35 +1794,62 @@ func processFilesStreamingPerFile(fileJobs []FileJob, outputDir string, outputFo
 
 			fileNum := 0
 			for fileJob := range fileChannel {
+				if ctx.Err() != nil || opts.Limit.reached() {
+					return
+				}
+				if opts.classDone(fileJob) {
+					slog.Debug("skipped file, its class has --max-per-class rows", "file", fileJob.FilePath, "class", fileJob.Class)
+					continue
+				}
+
 				fileNum++
 
-				// Generate output filename
-				baseName := filepath.Base(fileJob.FilePath)
-				ext := filepath.Ext(baseName)
-				nameWithoutExt := baseName[:len(baseName)-len(ext)]
+				outputFile := outputFiles[fileJob.key()]
+				if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+					slog.Error("failed to create output directory", "worker", workerID, "output", outputFile, "error", err)
+					errMutex.Lock()
+					if firstError == nil {
+						firstError = err
+					}
+					errMutex.Unlock()
+					continue
+				}
 
-				var outputFile string
-				if outputFormat == "parquet" {
-					outputFile = filepath.Join(outputDir, nameWithoutExt+".parquet")
-				} else {
-					outputFile = filepath.Join(outputDir, nameWithoutExt+".csv")
+				// Reuse the output of a file converted alike by an earlier run
+				var entry string
+				if opts.Cache != nil {
+					entry = opts.Cache.outputEntry(fileJob, outputFile, classIDs)
+				}
+				if entry != "" {
+					started := time.Now()
+					cached, err := opts.Cache.restoreOutput(entry, outputFormat, outputFile)
+					if err == nil {
+						if opts.Classes != nil {
+							opts.Classes.addCounts(cached.Classes)
+						}
+						manifest.RecordFile(ManifestFile{
+							Path:            fileJob.FilePath,
+							Interface:       fileJob.Interface,
+							Class:           fileJob.Class,
+							Packets:         cached.Rows,
+							Complete:        true,
+							Output:          outputFile,
+							DurationSeconds: time.Since(started).Seconds(),
+						})
+						slog.Info(progressLogMessage, append([]any{"worker", workerID, "file", fileJob.FilePath, "class", fileJob.Class, "packets", cached.Rows, "output", outputFile, "cached", true}, opts.Throughput.progress()...)...)
+						continue
+					}
+					if !errors.Is(err, os.ErrNotExist) {
+						slog.Warn("failed to reuse cached output", "file", fileJob.FilePath, "error", err)
+					}
 				}
 
-				fmt.Printf("[Worker %d] Processing %s -> %s\n", workerID, baseName, filepath.Base(outputFile))
+				slog.Debug("processing file", "worker", workerID, "file", fileJob.FilePath, "output", outputFile)
 
 				// Create writer for this file
-				var writer StreamWriter
-				var err error
-				hasClass := fileJob.Class != ""
-
-				if outputFormat == "parquet" {
-					writer, err = NewParquetStreamWriter(outputFile, bufferSize, hasClass)
-				} else {
-					writer, err = NewCSVStreamWriter(outputFile, bufferSize, hasClass)
-				}
-
+				writer, err := NewStreamWriter(outputFormat, outputFile, bufferSize, opts.hasClass([]FileJob{fileJob}), opts.FeatureNames(), opts.Writer)
 				if err != nil {
-					log.Printf("[Worker %d] Failed to create writer for %s: %v\n", workerID, outputFile, err)
+					slog.Error("failed to create writer", "worker", workerID, "output", outputFile, "error", err)
 					errMutex.Lock()
 					if firstError == nil {
 						firstError = err
@@ -481,12 +1858,44 @@ func processFilesStreamingPerFile(fileJobs []FileJob, outputDir string, outputFo
 					continue
 				}
 
+				if numbered, ok := writer.(classNumberedWriter); ok {
+					// Same label IDs in every file, so per-file arrays can be concatenated
+					numbered.setClassIDs(classIDs)
+				}
+				var counter *classCountingWriter
+				if entry != "" {
+					counter = &classCountingWriter{StreamWriter: writer, counts: make(map[string]int64)}
+					writer = counter
+				}
+
 				// Process file
-				count, err := processFileStreaming(fileJob, writer, outputLength, workersPerFile, maskIP)
-				writer.Close()
+				started := time.Now()
+				var count int
+				err = opts.Retry.run(ctx, fileJob, func() (err error) {
+					count, err = processFileStreaming(ctx, fileJob, writer, opts, workersPerFile)
+					return err
+				})
+				closeErr := opts.Throughput.write(nil, writer.Close)
+
+				if errors.Is(err, errCannotOpen) {
+					// Don't leave an empty output behind for a file that was skipped
+					removeOutput(outputFormat, outputFile)
+					opts.Errors.FileError(fileJob, err)
+					continue
+				}
+
+				manifest.RecordFile(ManifestFile{
+					Path:            fileJob.FilePath,
+					Interface:       fileJob.Interface,
+					Class:           fileJob.Class,
+					Packets:         count,
+					Complete:        err == nil && ctx.Err() == nil,
+					Output:          outputFile,
+					DurationSeconds: time.Since(started).Seconds(),
+				})
 
 				if err != nil {
-					log.Printf("[Worker %d] Error processing %s: %v\n", workerID, fileJob.FilePath, err)
+					slog.Error("error processing file", "worker", workerID, "file", fileJob.FilePath, "error", err)
 					errMutex.Lock()
 					if firstError == nil {
 						firstError = err
@@ -495,7 +1904,13 @@ func processFilesStreamingPerFile(fileJobs []FileJob, outputDir string, outputFo
 					continue
 				}
 
-				fmt.Printf("[Worker %d] Completed %s: %d packets -> %s\n", workerID, baseName, count, filepath.Base(outputFile))
+				if counter != nil && closeErr == nil && ctx.Err() == nil {
+					if err := opts.Cache.storeOutput(entry, outputFormat, outputFile, cachedOutput{Rows: count, Classes: counter.counts}); err != nil {
+						slog.Warn("failed to write cache entry", "file", fileJob.FilePath, "output", outputFile, "error", err)
+					}
+				}
+
+				slog.Info(progressLogMessage, append([]any{"worker", workerID, "file", fileJob.FilePath, "class", fileJob.Class, "packets", count, "output", outputFile}, opts.Throughput.progress()...)...)
 			}
 		}(i)
 	}
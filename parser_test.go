@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// paddedFrame returns a short UDP/IPv4 Ethernet frame with the padding that
+// brings it to the 60-byte Ethernet minimum.
+func paddedFrame(t *testing.T) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 40001}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, udp, gopacket.Payload{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	data := append(buf.Bytes(), make([]byte, 60-len(buf.Bytes()))...)
+	for i := 46; i < len(data); i++ {
+		data[i] = 0xee
+	}
+	return gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// TestIncludeL2MasksPaddedFrames checks that --ipmask finds the IP header of
+// rows that keep the Ethernet header when padding follows the IP packet.
+func TestIncludeL2MasksPaddedFrames(t *testing.T) {
+	packet := paddedFrame(t)
+	opts := ProcessOptions{MaskIP: true, IncludeL2: true}
+	result, ok := processPacket(PacketJob{Packet: packet}, FileJob{}, opts, nil)
+	if !ok {
+		t.Fatal("packet was dropped")
+	}
+	row := result.Data
+	if len(row) != 60 {
+		t.Fatalf("row has %d bytes, want 60", len(row))
+	}
+	if got := net.HardwareAddr(row[6:12]).String(); got != "02:00:00:00:00:01" {
+		t.Errorf("source MAC is %s, want it kept", got)
+	}
+	for i, b := range row[26:34] {
+		if b != 0 {
+			t.Fatalf("address byte %d is %#x, want it masked: % x", i, b, row[26:34])
+		}
+	}
+	if row[14] != 0x45 || row[23] != byte(layers.IPProtocolUDP) {
+		t.Errorf("IP header bytes changed: % x", row[14:34])
+	}
+}
+
+// TestLinkTypesGiveSameRows checks that Linux cooked (SLL) and raw IP captures
+// of a packet give the row of its Ethernet frame.
+func TestLinkTypesGiveSameRows(t *testing.T) {
+	frame := paddedFrame(t)
+	ip := frame.Data()[ethernetHeaderLen:46]
+	sll := append([]byte{0, 0, 0, 1, 0, 6, 2, 0, 0, 0, 0, 1, 0, 0, 0x08, 0x00}, ip...)
+	opts := ProcessOptions{MaskIP: true, StripTrailer: true}
+
+	want, ok := processPacket(PacketJob{Packet: frame}, FileJob{}, opts, nil)
+	if !ok {
+		t.Fatal("Ethernet frame was dropped")
+	}
+	for _, c := range []struct {
+		name  string
+		data  []byte
+		first gopacket.LayerType
+	}{
+		{"sll", sll, layers.LayerTypeLinuxSLL},
+		{"raw", ip, layers.LayerTypeIPv4},
+	} {
+		packet := gopacket.NewPacket(c.data, c.first, gopacket.Default)
+		got, ok := processPacket(PacketJob{Packet: packet}, FileJob{}, opts, nil)
+		if !ok {
+			t.Errorf("%s packet was dropped", c.name)
+			continue
+		}
+		if string(got.Data) != string(want.Data) {
+			t.Errorf("%s row is % x, want % x", c.name, got.Data, want.Data)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapIndexStride is the number of records between the offsets kept by the
+// index; a chunk reader discards at most this many records to reach its start.
+const pcapIndexStride = 4096
+
+// pcapIndex locates the records of a classic pcap file, so several readers can
+// each decode a disjoint chunk of it.
+type pcapIndex struct {
+	order     binary.ByteOrder
+	nanos     bool
+	linkType  layers.LinkType
+	records   int     // Complete records in the file
+	offsets   []int64 // Offset of every pcapIndexStride-th record
+	truncated bool    // The file ends in the middle of a record
+}
+
+// indexPcap scans the record headers of a classic pcap file. PCAPNG files are
+// not supported.
+func indexPcap(filePath string) (*pcapIndex, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, 1024*1024)
+
+	header := make([]byte, pcapGlobalHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("reading global header: %w", err)
+	}
+	index := &pcapIndex{}
+	switch {
+	case binary.LittleEndian.Uint32(header) == pcapMagicMicros:
+		index.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header) == pcapMagicMicros:
+		index.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header) == pcapMagicNanos:
+		index.order, index.nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header) == pcapMagicNanos:
+		index.order, index.nanos = binary.BigEndian, true
+	default:
+		return nil, errors.New("not a classic pcap file (pcapng files are read by one reader)")
+	}
+	index.linkType = layers.LinkType(index.order.Uint32(header[20:24]) & 0x0FFFFFFF)
+
+	offset := int64(pcapGlobalHeaderLen)
+	record := make([]byte, pcapRecordHeaderLen)
+	for {
+		if _, err := io.ReadFull(reader, record); err != nil {
+			index.truncated = err == io.ErrUnexpectedEOF
+			return index, nil
+		}
+		inclLen := int(index.order.Uint32(record[8:12]))
+		if n, err := reader.Discard(inclLen); err != nil {
+			index.truncated = n < inclLen
+			return index, nil
+		}
+		if index.records%pcapIndexStride == 0 {
+			index.offsets = append(index.offsets, offset)
+		}
+		index.records++
+		offset += int64(pcapRecordHeaderLen + inclLen)
+	}
+}
+
+// pcapChunk is the range of record numbers [start, end) of one reader.
+type pcapChunk struct {
+	start, end int
+}
+
+// chunks divides the records from skip on (at most limit of them, 0 = all)
+// into up to n chunks of about the same size.
+func (x *pcapIndex) chunks(n, skip, limit int) []pcapChunk {
+	first, last := min(skip, x.records), x.records
+	if limit > 0 {
+		last = min(last, first+limit)
+	}
+	size := (last - first + n - 1) / n
+	size = max(size, pcapIndexStride)
+	var chunks []pcapChunk
+	for start := first; start < last; start += size {
+		chunks = append(chunks, pcapChunk{start: start, end: min(start+size, last)})
+	}
+	return chunks
+}
+
+// pcapChunkReader reads the records of one chunk. It implements packetReader.
+type pcapChunkReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	index  *pcapIndex
+	next   int // Record number of the next record in the file
+	chunk  pcapChunk
+}
+
+// openPcapChunk opens a file at the indexed record nearest before the chunk.
+func openPcapChunk(filePath string, index *pcapIndex, chunk pcapChunk) (*pcapChunkReader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	mark := chunk.start / pcapIndexStride
+	if _, err := file.Seek(index.offsets[mark], io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &pcapChunkReader{
+		file:   file,
+		reader: bufio.NewReaderSize(file, 1024*1024),
+		index:  index,
+		next:   mark * pcapIndexStride,
+		chunk:  chunk,
+	}, nil
+}
+
+// ReadPacketData implements gopacket.PacketDataSource.
+func (r *pcapChunkReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	header := make([]byte, pcapRecordHeaderLen)
+	for ; r.next < r.chunk.start; r.next++ {
+		if _, err := io.ReadFull(r.reader, header); err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		if _, err := r.reader.Discard(int(r.index.order.Uint32(header[8:12]))); err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+	}
+	if r.next >= r.chunk.end {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	sec := int64(r.index.order.Uint32(header[0:4]))
+	frac := int64(r.index.order.Uint32(header[4:8]))
+	if !r.index.nanos {
+		frac *= 1000
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(sec, frac).UTC(),
+		CaptureLength: int(r.index.order.Uint32(header[8:12])),
+		Length:        int(r.index.order.Uint32(header[12:16])),
+	}
+	// Packets are decoded without copying, so every record gets its own buffer
+	data := make([]byte, ci.CaptureLength)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	r.next++
+	return data, ci, nil
+}
+
+// LinkType returns the link type from the pcap global header.
+func (r *pcapChunkReader) LinkType() layers.LinkType {
+	return r.index.linkType
+}
+
+// Close closes the file.
+func (r *pcapChunkReader) Close() {
+	r.file.Close()
+}
+
+// parallelReaders returns the number of concurrent readers of one file. Options
+// that follow a file's packets in capture order (flow timeouts, sessions,
+// timing, retransmissions, protocol labels, Zeek and Suricata matching,
+// --skip-seconds, salvage, --input-rotation) need a single reader, and so
+// do --ordered streaming runs, which restore the order of one reader's batches.
+func (o ProcessOptions) parallelReaders() int {
+	if o.Readers <= 1 || o.Ordered || o.Salvage || o.Rotation != nil || o.Timing || o.sessionRows() || o.DropRetrans ||
+		(o.LabelBy != LabelByDataset && o.LabelBy != LabelByRules) || o.Zeek != nil || o.Suricata != nil ||
+		o.SkipTime > 0 || o.FlowTimeouts != (FlowTimeouts{}) {
+		return 1
+	}
+	return o.Readers
+}
+
+// readCapture reads the packets of a file into jobs. With --readers, chunks of
+// a classic pcap are read concurrently, each packet keeping its position in
+// the file as index; otherwise handle is read in capture order.
+func readCapture(ctx context.Context, handle packetReader, fileJob FileJob, fileName string, jobs chan<- []PacketJob, dropFlows map[FlowKey]bool, opts ProcessOptions) {
+	readers := opts.parallelReaders()
+	if readers <= 1 {
+		readPackets(ctx, handle, fileJob, fileName, jobs, dropFlows, opts, 0)
+		return
+	}
+	index, err := indexPcap(fileJob.FilePath)
+	if err != nil {
+		slog.Debug("reading file with one reader", "file", fileJob.FilePath, "error", err)
+		readPackets(ctx, handle, fileJob, fileName, jobs, dropFlows, opts, 0)
+		return
+	}
+	if index.truncated {
+		slog.Warn("stopped reading file", "file", fileJob.FilePath, "packets", index.records, "error", io.ErrUnexpectedEOF)
+		if opts.Quality != nil {
+			opts.Quality.merge(qualityCounts{fileJob.Class: {TruncatedFiles: 1}})
+		}
+	}
+
+	// The chunks cover exactly the packets --skip-packets and --max-packets-per-file select
+	chunks := index.chunks(readers, opts.SkipPackets, opts.MaxPerFile)
+	chunkOpts := opts
+	chunkOpts.SkipPackets = 0
+	chunkOpts.MaxPerFile = 0
+	var wg sync.WaitGroup
+	for _, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reader, err := openPcapChunk(fileJob.FilePath, index, chunk)
+			if err != nil {
+				slog.Warn("failed to read file chunk", "file", fileJob.FilePath, "first_packet", chunk.start, "error", err)
+				return
+			}
+			defer reader.Close()
+			readPackets(ctx, reader, fileJob, fileName, jobs, dropFlows, chunkOpts, chunk.start)
+		}()
+	}
+	wg.Wait()
+}
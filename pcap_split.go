@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Ways `gobyte split` cuts a capture into pieces.
+const (
+	PcapSplitPackets = "packets" // A new piece every N packets
+	PcapSplitTime    = "time"    // A new piece every time interval
+	PcapSplitFlows   = "flows"   // N pieces, each flow in one of them
+)
+
+// pcapSplitSnapLen is the snap length written to the pieces' headers; it only
+// has to be at least the longest captured packet.
+const pcapSplitSnapLen = 262144
+
+// pcapSplitSpec is a parsed --by value such as packets=1000000, time=10m or flows=8.
+type pcapSplitSpec struct {
+	by       string
+	packets  int
+	interval time.Duration
+	pieces   int
+}
+
+// parsePcapSplitSpec parses --by. A bare "flows" makes one piece per CPU.
+func parsePcapSplitSpec(spec string) (pcapSplitSpec, error) {
+	by, value, hasValue := strings.Cut(spec, "=")
+	s := pcapSplitSpec{by: by}
+	switch by {
+	case PcapSplitPackets:
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return s, fmt.Errorf("--by packets needs a positive packet count, e.g. packets=1000000")
+		}
+		s.packets = n
+	case PcapSplitTime:
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("--by time needs a positive duration, e.g. time=10m")
+		}
+		s.interval = d
+	case PcapSplitFlows:
+		s.pieces = runtime.NumCPU()
+		if hasValue {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return s, fmt.Errorf("--by flows needs a positive piece count, e.g. flows=8")
+			}
+			s.pieces = n
+		}
+	default:
+		return s, fmt.Errorf("unknown --by %q (use packets=N, time=DURATION or flows[=N])", spec)
+	}
+	return s, nil
+}
+
+// runPcapSplit is the `gobyte split` subcommand: it cuts captures into smaller
+// pcap files, so a huge capture can be processed as several input files or on
+// several machines.
+func runPcapSplit(args []string) {
+	flags := flag.NewFlagSet("split", flag.ExitOnError)
+	by := flags.String("by", "", "How to cut each capture: packets=N (every N packets), time=DURATION (e.g. 10m, from the first packet) or flows[=N] (N pieces, default one per CPU, keeping each flow in one piece)")
+	outputDir := flags.String("output-dir", "output", "Directory for the pieces, named <stem>_0001.pcap, <stem>_0002.pcap, ...")
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s split --by packets=N|time=DURATION|flows[=N] [--output-dir dir] capture.pcap...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Cuts PCAP/PCAPNG captures into smaller pcap files.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	parseArgs(flags, args)
+
+	if err := setupLogger(*logLevel, false); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if flags.NArg() == 0 || *by == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	spec, err := parsePcapSplitSpec(*by)
+	if err != nil {
+		fatal("invalid --by", "error", err)
+	}
+	if err := os.MkdirAll(*outputDir, 0755); err != nil {
+		fatal("failed to create output directory", "dir", *outputDir, "error", err)
+	}
+
+	for _, input := range flags.Args() {
+		t0 := time.Now()
+		pieces, packets, err := splitCapture(input, *outputDir, spec)
+		if err != nil {
+			fatal("failed to split capture", "input", input, "error", err)
+		}
+		slog.Info("split capture", "input", input, "packets", packets, "pieces", pieces, "output_dir", *outputDir, "duration", time.Since(t0))
+	}
+}
+
+// pcapPiece is an open output file of a split.
+type pcapPiece struct {
+	file   *os.File
+	buffer *bufio.Writer
+	writer *pcapgo.Writer
+}
+
+// pcapPieces creates the pieces of one capture on demand and closes them.
+type pcapPieces struct {
+	dir      string
+	stem     string
+	linkType layers.LinkType
+	open     map[int]*pcapPiece
+	created  int
+}
+
+// get returns piece n (0-based), creating its file on first use.
+func (p *pcapPieces) get(n int) (*pcapPiece, error) {
+	if piece, ok := p.open[n]; ok {
+		return piece, nil
+	}
+	file, err := os.Create(filepath.Join(p.dir, fmt.Sprintf("%s_%04d.pcap", p.stem, n+1)))
+	if err != nil {
+		return nil, err
+	}
+	piece := &pcapPiece{file: file, buffer: bufio.NewWriterSize(file, 1024*1024)}
+	piece.writer = pcapgo.NewWriterNanos(piece.buffer)
+	if err := piece.writer.WriteFileHeader(pcapSplitSnapLen, p.linkType); err != nil {
+		file.Close()
+		return nil, err
+	}
+	p.open[n] = piece
+	p.created++
+	return piece, nil
+}
+
+// close finishes piece n.
+func (p *pcapPieces) close(n int) error {
+	piece, ok := p.open[n]
+	if !ok {
+		return nil
+	}
+	delete(p.open, n)
+	err := piece.buffer.Flush()
+	if closeErr := piece.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closeAll finishes every open piece.
+func (p *pcapPieces) closeAll() error {
+	var firstErr error
+	for n := range p.open {
+		if err := p.close(n); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// splitCapture writes the packets of a capture to its pieces and returns the
+// number of pieces and packets. Packets keep their capture order within each
+// piece. In time mode a packet stamped earlier than the current piece stays in
+// it, so slightly reordered captures do not reopen finished pieces.
+func splitCapture(input, outputDir string, spec pcapSplitSpec) (int, int, error) {
+	handle, err := openCapture(input, ProcessOptions{})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer handle.Close()
+
+	pieces := &pcapPieces{
+		dir:      outputDir,
+		stem:     strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)),
+		linkType: handle.LinkType(),
+		open:     make(map[int]*pcapPiece),
+	}
+	current := 0
+	var start time.Time
+	packets := 0
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			pieces.closeAll()
+			return pieces.created, packets, fmt.Errorf("after %d packets: %w", packets, err)
+		}
+
+		n := current
+		switch spec.by {
+		case PcapSplitPackets:
+			n = packets / spec.packets
+		case PcapSplitTime:
+			if packets == 0 {
+				start = ci.Timestamp
+			}
+			n = max(current, int(ci.Timestamp.Sub(start)/spec.interval))
+		case PcapSplitFlows:
+			// Decoded only for the flow key; both directions hash alike
+			packet := gopacket.NewPacket(data, handle.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+			key, ok := flowKeyOf(packet)
+			n = int(flowID(key, ok, 0) % uint64(spec.pieces))
+		}
+		// Packet and time pieces are finished in order, so only one is open
+		if n != current && spec.by != PcapSplitFlows {
+			if err := pieces.close(current); err != nil {
+				pieces.closeAll()
+				return pieces.created, packets, err
+			}
+		}
+		current = n
+
+		piece, err := pieces.get(n)
+		if err == nil {
+			err = piece.writer.WritePacket(ci, data)
+		}
+		if err != nil {
+			pieces.closeAll()
+			return pieces.created, packets, err
+		}
+		packets++
+	}
+	return pieces.created, packets, pieces.closeAll()
+}
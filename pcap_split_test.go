@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// TestPcapSplitFlagsAfterCapture runs `gobyte split` with the argument order
+// of its documentation, the capture before --by and --output-dir.
+func TestPcapSplitFlagsAfterCapture(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "big.pcap")
+	file, err := os.Create(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	data := paddedFrame(t).Data()
+	for i := 0; i < 5; i++ {
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0), CaptureLength: len(data), Length: len(data)}
+		if err := writer.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := filepath.Join(dir, "pieces")
+	runPcapSplit([]string{input, "--by", "packets=2", "--output-dir", outputDir, "--log-level", "error"})
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"big_0001.pcap", "big_0002.pcap", "big_0003.pcap"}; !slices.Equal(names, want) {
+		t.Errorf("pieces %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// key identifies an input: its path, and its interface with --split-by-interface.
+func (j FileJob) key() string {
+	if j.Interface == "" {
+		return j.FilePath
+	}
+	return j.FilePath + "@" + j.Interface
+}
+
+// name is the file name rows of the input carry: capture.pcapng@eth0 for an
+// interface of a --split-by-interface input.
+func (j FileJob) name() string {
+	if j.Interface == "" {
+		return filepath.Base(j.FilePath)
+	}
+	return filepath.Base(j.FilePath) + "@" + j.Interface
+}
+
+// openInput opens the packets of an input: one interface of a PCAPNG file with
+// --split-by-interface, a capture inside an archive, a network interface with
+// --live, or the whole capture.
+func openInput(fileJob FileJob, opts ProcessOptions) (packetReader, error) {
+	if fileJob.Live {
+		return openLive(fileJob.FilePath)
+	}
+	if fileJob.Archive != "" {
+		return openArchiveMember(fileJob)
+	}
+	if fileJob.Interface == "" {
+		return openCapture(fileJob.FilePath, opts)
+	}
+	return openInterface(fileJob.FilePath, fileJob.InterfaceID)
+}
+
+// isPcapng reports whether a file starts with a PCAPNG section header (whose
+// block type reads the same in either byte order).
+func isPcapng(filePath string) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false, nil
+	}
+	return binary.LittleEndian.Uint32(magic) == pcapngMagic, nil
+}
+
+// newNgReader reads a PCAPNG file whose interfaces may have different link types.
+func newNgReader(file *os.File) (*pcapgo.NgReader, error) {
+	return pcapgo.NewNgReader(bufio.NewReaderSize(file, 1024*1024), pcapgo.NgReaderOptions{
+		WantMixedLinkType:  true,
+		SkipUnknownVersion: true,
+	})
+}
+
+// captureInterface is an interface of a PCAPNG file that captured packets.
+type captureInterface struct {
+	id      int
+	name    string
+	packets int
+}
+
+// listInterfaces reads a PCAPNG file and returns its interfaces with packets,
+// in the order of their descriptions. Unnamed interfaces are called if<id>, and
+// a repeated name gets the id appended.
+func listInterfaces(filePath string) ([]captureInterface, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := newNgReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var packets []int
+	for {
+		_, ci, err := reader.ZeroCopyReadPacketData()
+		if err != nil {
+			// A damaged tail is reported when the interfaces are read
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("stopped listing interfaces", "file", filePath, "error", err)
+			}
+			break
+		}
+		for len(packets) <= ci.InterfaceIndex {
+			packets = append(packets, 0)
+		}
+		packets[ci.InterfaceIndex]++
+	}
+
+	var interfaces []captureInterface
+	seen := make(map[string]bool)
+	for id, n := range packets {
+		if n == 0 {
+			continue
+		}
+		name := fmt.Sprintf("if%d", id)
+		if intf, err := reader.Interface(id); err == nil && intf.Name != "" {
+			name = intf.Name
+		}
+		if seen[name] {
+			name = fmt.Sprintf("%s_%d", name, id)
+		}
+		seen[name] = true
+		interfaces = append(interfaces, captureInterface{id: id, name: name, packets: n})
+	}
+	return interfaces, nil
+}
+
+// splitInterfaces replaces every PCAPNG file of fileJobs with one input per
+// interface that captured packets. With asClass each interface's rows get
+// their own class: <class>_<interface>, or the interface name for unlabeled
+// input. Classic pcap files have no interfaces and are kept whole.
+func splitInterfaces(fileJobs []FileJob, asClass bool) ([]FileJob, error) {
+	var jobs []FileJob
+	for _, job := range fileJobs {
+		pcapng, err := isPcapng(job.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		if !pcapng {
+			slog.Debug("not a PCAPNG file, keeping it whole", "file", job.FilePath)
+			jobs = append(jobs, job)
+			continue
+		}
+		interfaces, err := listInterfaces(job.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", job.FilePath, err)
+		}
+		for _, intf := range interfaces {
+			split := job
+			split.Interface = intf.name
+			split.InterfaceID = intf.id
+			if asClass {
+				split.Class = intf.name
+				if job.Class != "" {
+					split.Class = job.Class + "_" + intf.name
+				}
+			}
+			jobs = append(jobs, split)
+			slog.Debug("found interface", "file", job.FilePath, "interface", intf.name, "packets", intf.packets)
+		}
+		slog.Info("split file by interface", "file", job.FilePath, "interfaces", len(interfaces))
+	}
+	return jobs, nil
+}
+
+// interfaceReader reads the packets of one interface of a PCAPNG file. It
+// implements packetReader.
+type interfaceReader struct {
+	file     *os.File
+	reader   *pcapgo.NgReader
+	id       int
+	linkType layers.LinkType
+
+	// The first packet, read ahead to learn the interface's link type
+	first     []byte
+	firstInfo gopacket.CaptureInfo
+	firstErr  error
+	pending   bool
+}
+
+// openInterface opens interface id of a PCAPNG file.
+func openInterface(filePath string, id int) (*interfaceReader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newNgReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r := &interfaceReader{file: file, reader: reader, id: id}
+	r.first, r.firstInfo, r.firstErr = r.next()
+	r.pending = true
+	if intf, err := reader.Interface(id); err == nil {
+		r.linkType = intf.LinkType
+	}
+	return r, nil
+}
+
+// next returns the next packet of the interface.
+func (r *interfaceReader) next() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := r.reader.ReadPacketData()
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		if ci.InterfaceIndex == r.id {
+			ci.AncillaryData = nil
+			return data, ci, nil
+		}
+	}
+}
+
+// ReadPacketData implements gopacket.PacketDataSource.
+func (r *interfaceReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if r.pending {
+		r.pending = false
+		return r.first, r.firstInfo, r.firstErr
+	}
+	return r.next()
+}
+
+// LinkType returns the link type of the interface.
+func (r *interfaceReader) LinkType() layers.LinkType {
+	return r.linkType
+}
+
+// Close closes the file.
+func (r *interfaceReader) Close() {
+	r.file.Close()
+}
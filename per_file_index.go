@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// perFileIndexName is the file, in a --per-file output directory, that maps
+// every input to its output.
+const perFileIndexName = "index.csv"
+
+// writePerFileIndex writes index.csv to a --per-file output directory: one
+// line per input with its output name and the files written for it (NumPy and
+// bin outputs are several files), relative to dir and separated by ";", its
+// class, rows and outcome, so loaders can enumerate the shards and check that
+// every input made it. Skipped and unreached inputs have no output; skipped
+// ones have an error.
+func writePerFileIndex(dir, format string, manifest *RunManifest, errs *ErrorHandler, jobs []FileJob) error {
+	manifest.mutex.Lock()
+	results := fileResults(manifest, errs, jobs)
+	manifest.mutex.Unlock()
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		return a.Path < b.Path || a.Path == b.Path && a.Interface < b.Interface
+	})
+
+	file, err := os.Create(filepath.Join(dir, perFileIndexName))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	w.Write([]string{"input", "output", "files", "class", "rows", "status", "error"})
+	for _, result := range results {
+		input := FileJob{FilePath: result.Path, Interface: result.Interface}.key()
+		var output string
+		var files []string
+		if result.Output != "" {
+			output = relativePath(dir, result.Output)
+			for _, path := range outputArtifacts(format, result.Output) {
+				if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+					files = append(files, relativePath(dir, path))
+				}
+			}
+		}
+		w.Write([]string{input, output, strings.Join(files, ";"), result.Class, strconv.Itoa(result.Rows), result.Outcome, result.Error})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// relativePath returns path relative to dir, or path if it is not below dir.
+func relativePath(dir, path string) string {
+	if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pppoeIP returns the IP packet of a PPPoE session frame carrying IPv4 or
+// IPv6 over PPP, as a sub-slice of the packet data after the 6-byte PPPoE and
+// the PPP protocol headers, or nil for other packets. The PPPoE length field
+// bounds it, so Ethernet padding of short frames is left out.
+func pppoeIP(packet gopacket.Packet) []byte {
+	pppoe, ok := packet.Layer(layers.LayerTypePPPoE).(*layers.PPPoE)
+	if !ok || pppoe.Code != layers.PPPoECodeSession {
+		return nil
+	}
+	ppp, ok := packet.Layer(layers.LayerTypePPP).(*layers.PPP)
+	if !ok || (ppp.PPPType != layers.PPPTypeIPv4 && ppp.PPPType != layers.PPPTypeIPv6) {
+		return nil
+	}
+	return ppp.LayerPayload()
+}
+
+// linkPayload returns the bytes of a frame after its link framing, with
+// their offset in the packet data: the IP packet of a PPPoE session frame,
+// the whole packet of raw IP captures (link is nil), or else the payload of
+// the link layer (VLAN tags of Ethernet frames included).
+func linkPayload(packet gopacket.Packet, link gopacket.Layer) ([]byte, int) {
+	if ip := pppoeIP(packet); len(ip) > 0 {
+		if offset := layerOffset(packet, ip); offset >= 0 {
+			return ip, offset
+		}
+	}
+	if link == nil {
+		return packet.Data(), 0
+	}
+	return link.LayerPayload(), len(link.LayerContents())
+}
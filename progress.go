@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressReadBatch is the number of packets readers count before reporting
+// them to Progress.
+const progressReadBatch = 1024
+
+// progressFinished is the number of finished inputs Progress remembers.
+const progressFinished = 20
+
+// Progress follows the inputs of a run as they are read, for the --tui
+// dashboard and the --web status page. A nil Progress counts nothing, so
+// readers need not check whether either is shown.
+type Progress struct {
+	start   time.Time
+	files   int          // Inputs of the run
+	done    atomic.Int64 // Inputs finished
+	packets atomic.Int64 // Packets read so far
+	bytes   atomic.Int64 // Their captured bytes
+
+	mutex    sync.Mutex
+	tasks    map[string]*progressTask // Inputs being read, by FileJob.key
+	slots    []bool                   // Slots of the inputs being read in use
+	finished []ProgressFile           // Last finished inputs, oldest first
+}
+
+// progressTask is an input being read.
+type progressTask struct {
+	slot    int
+	name    string
+	class   string
+	size    int64 // File size, or 0 if unknown
+	started time.Time
+	packets atomic.Int64
+	bytes   atomic.Int64 // Captured bytes read, with record headers
+}
+
+// ProgressFile is an input being read or finished, as shown by the dashboard
+// and the status page.
+type ProgressFile struct {
+	Slot     int     `json:"slot"` // Stable position of an input being read while others come and go
+	Name     string  `json:"name"`
+	Class    string  `json:"class,omitempty"`
+	Packets  int64   `json:"packets"`
+	Share    float64 `json:"share,omitempty"` // Estimated share of the file read, 0 to 0.99
+	Duration float64 `json:"duration_s"`      // Seconds since the input was opened, or spent reading it
+}
+
+// NewProgress starts following a run over files inputs.
+func NewProgress(files int) *Progress {
+	return &Progress{
+		start: time.Now(),
+		files: files,
+		tasks: make(map[string]*progressTask),
+	}
+}
+
+// begin marks an input as being read and returns its task.
+func (p *Progress) begin(fileJob FileJob) *progressTask {
+	if p == nil {
+		return nil
+	}
+	task := &progressTask{name: fileJob.name(), class: fileJob.Class, started: time.Now()}
+	if size, err := inputSize(fileJob); err == nil {
+		task.size = size
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for task.slot < len(p.slots) && p.slots[task.slot] {
+		task.slot++
+	}
+	if task.slot == len(p.slots) {
+		p.slots = append(p.slots, false)
+	}
+	p.slots[task.slot] = true
+	p.tasks[fileJob.key()] = task
+	return task
+}
+
+// read counts packets of an input and their captured bytes.
+func (p *Progress) read(fileJob FileJob, packets int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.packets.Add(int64(packets))
+	p.bytes.Add(bytes)
+	p.mutex.Lock()
+	task := p.tasks[fileJob.key()]
+	p.mutex.Unlock()
+	if task != nil {
+		task.packets.Add(int64(packets))
+		// Each classic pcap record has a 16-byte header
+		task.bytes.Add(bytes + int64(packets)*pcapRecordHeaderLen)
+	}
+}
+
+// end marks the input of a task as finished.
+func (p *Progress) end(task *progressTask) {
+	if p == nil || task == nil {
+		return
+	}
+	p.done.Add(1)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, t := range p.tasks {
+		if t == task {
+			delete(p.tasks, key)
+		}
+	}
+	p.slots[task.slot] = false
+	file := task.file()
+	file.Share = 0
+	p.finished = append(p.finished, file)
+	if len(p.finished) > progressFinished {
+		p.finished = p.finished[len(p.finished)-progressFinished:]
+	}
+}
+
+// reading returns the inputs being read, by slot.
+func (p *Progress) reading() []ProgressFile {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	files := make([]ProgressFile, 0, len(p.tasks))
+	for _, task := range p.tasks {
+		files = append(files, task.file())
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Slot < files[j].Slot })
+	return files
+}
+
+// recent returns the last finished inputs, latest first.
+func (p *Progress) recent() []ProgressFile {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	files := make([]ProgressFile, len(p.finished))
+	for i, file := range p.finished {
+		files[len(files)-1-i] = file
+	}
+	return files
+}
+
+// file describes the task as it stands.
+func (t *progressTask) file() ProgressFile {
+	share := 0.0
+	if t.size > 0 {
+		// PCAPNG blocks are larger than pcap records, so the estimate stops short of the end
+		share = min(float64(t.bytes.Load())/float64(t.size), 0.99)
+	}
+	return ProgressFile{
+		Slot:     t.slot,
+		Name:     t.name,
+		Class:    t.class,
+		Packets:  t.packets.Load(),
+		Share:    share,
+		Duration: roundRate(time.Since(t.started).Seconds()),
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Label sources for --label-by.
+const (
+	LabelByDataset  = "dataset"  // Class directory of the input file (default)
+	LabelByProtocol = "protocol" // Application protocol detected per flow
+	LabelByZeek     = "zeek"     // Field of the matching Zeek connection (--zeek-label)
+	LabelBySuricata = "suricata" // Alert of the packet's flow in --suricata-eve, else benign
+	LabelByRules    = "rules"    // First matching rule of --label-rules, else its default
+)
+
+// protocolLabels are the classes of --label-by protocol, in sorted order:
+// application protocols, then the transport for undetected traffic.
+var protocolLabels = []string{"dhcp", "dns", "http", "icmp", "ntp", "other", "quic", "sctp", "ssh", "tcp", "tls", "udp"}
+
+// httpPrefixes start HTTP/1.x requests and responses.
+var httpPrefixes = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("HTTP/1."),
+}
+
+// wellKnownPorts guess the protocol of TCP/UDP packets whose flow has not
+// given itself away yet (handshakes, pure ACKs, ...).
+var wellKnownPorts = map[string]map[uint16]string{
+	"tcp": {22: "ssh", 53: "dns", 80: "http", 443: "tls", 8080: "http"},
+	"udp": {53: "dns", 67: "dhcp", 68: "dhcp", 123: "ntp", 5353: "dns"},
+}
+
+// protocolTracker labels packets with their application protocol for
+// --label-by protocol. Like nDPI, it classifies a flow once a payload gives
+// the protocol away and labels the rest of the flow the same. Packets seen
+// before that fall back to well-known ports, then to the transport protocol.
+// Packets must be fed in capture order.
+type protocolTracker struct {
+	flows map[FlowKey]string
+}
+
+func newProtocolTracker() *protocolTracker {
+	return &protocolTracker{
+		flows: make(map[FlowKey]string),
+	}
+}
+
+// label returns the protocol class of the next packet of the file.
+func (t *protocolTracker) label(packet gopacket.Packet) string {
+	if _, ok := icmpOf(packet); ok {
+		return "icmp"
+	}
+	transport := transportProtocol(packet)
+	if transport == "other" {
+		return transport
+	}
+
+	// Packets with a transport layer always have a flow key
+	key, _ := flowKeyOf(packet)
+	if label, ok := t.flows[key]; ok {
+		return label
+	}
+	if label := payloadProtocol(packet); label != "" {
+		t.flows[key] = label
+		return label
+	}
+	if label := portProtocol(packet, transport); label != "" {
+		return label
+	}
+	return transport
+}
+
+// transportProtocol returns tcp, udp, sctp or other.
+func transportProtocol(packet gopacket.Packet) string {
+	switch packet.TransportLayer().(type) {
+	case *layers.TCP:
+		return "tcp"
+	case *layers.UDP:
+		return "udp"
+	case *layers.SCTP:
+		return "sctp"
+	}
+	return "other"
+}
+
+// payloadProtocol detects the application protocol from the packet's own
+// headers and payload, or returns "" if nothing matches.
+func payloadProtocol(packet gopacket.Packet) string {
+	if _, ok := quicOf(packet); ok {
+		return "quic"
+	}
+	if dns, ok := packet.Layer(layers.LayerTypeDNS).(*layers.DNS); ok && len(dns.Questions) > 0 {
+		return "dns"
+	}
+	if packet.Layer(layers.LayerTypeDHCPv4) != nil {
+		return "dhcp"
+	}
+
+	payload := l7Payload(packet)
+	switch {
+	case len(payload) >= 5 && payload[0] >= 0x14 && payload[0] <= 0x17 && payload[1] == 0x03 && payload[2] <= 0x04:
+		// TLS record: change_cipher_spec, alert, handshake or application_data, version 3.x
+		return "tls"
+	case bytes.HasPrefix(payload, []byte("SSH-")):
+		return "ssh"
+	}
+	for _, prefix := range httpPrefixes {
+		if bytes.HasPrefix(payload, prefix) {
+			return "http"
+		}
+	}
+	return ""
+}
+
+// portProtocol guesses the protocol from well-known TCP/UDP ports, or returns "".
+func portProtocol(packet gopacket.Packet, transport string) string {
+	var src, dst uint16
+	switch l := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		src, dst = uint16(l.SrcPort), uint16(l.DstPort)
+	case *layers.UDP:
+		src, dst = uint16(l.SrcPort), uint16(l.DstPort)
+	default:
+		return ""
+	}
+	ports := wellKnownPorts[transport]
+	if label, ok := ports[dst]; ok {
+		return label
+	}
+	return ports[src]
+}
+
+// protocolClassIDs numbers the protocol labels in sorted order.
+func protocolClassIDs() map[string]byte {
+	ids := make(map[string]byte, len(protocolLabels))
+	for i, label := range protocolLabels {
+		ids[label] = byte(i)
+	}
+	return ids
+}
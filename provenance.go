@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// provenanceMetadataKey is the Parquet key-value metadata that records how a
+// Parquet output was made; other outputs get a <base>_provenance.json sidecar.
+const (
+	provenanceMetadataKey = "gobyte.provenance"
+	provenanceSuffix      = "_provenance.json"
+)
+
+// provenanceSecretFlags are flags whose values are left out of provenance
+// records, which travel with the dataset.
+var provenanceSecretFlags = []string{"anon-key", "tuple-hash-salt"}
+
+// redactedValue replaces secrets in provenance records.
+const redactedValue = "<redacted>"
+
+// Provenance records how an output was made, so a dataset artifact can be
+// traced back to the tool, the options and the seeds of the run that wrote
+// it and, with its inputs, made again.
+type Provenance struct {
+	Tool      string    `json:"tool"`
+	Version   string    `json:"version"`            // Module version of the build, "(devel)" for a source build
+	Revision  string    `json:"revision,omitempty"` // VCS revision of the build, "-modified" if the tree had changes
+	GoVersion string    `json:"go_version"`
+	CreatedAt time.Time `json:"created_at"`
+	Command   []string  `json:"command"`
+
+	// Options holds every flag of the run with its resolved value, defaults
+	// included, so a later release with other defaults reads it the same.
+	Options map[string]string `json:"options"`
+	Seeds   map[string]string `json:"seeds"` // The *-seed options
+
+	// NotReproducible lists the options whose effect on the rows this record
+	// cannot repeat: values drawn at random per run, or rows written in the
+	// order workers finish them.
+	NotReproducible []string `json:"not_reproducible,omitempty"`
+
+	// Classes is the label ID of each class in outputs that number classes:
+	// NumPy, bin, --separate-labels and the huggingface Parquet layout.
+	Classes map[string]byte `json:"classes,omitempty"`
+}
+
+// newProvenance records the options of the run, as parsed into flags.
+func newProvenance(flags *flag.FlagSet) *Provenance {
+	p := &Provenance{
+		Tool:      "gobyte",
+		Version:   "unknown",
+		GoVersion: runtime.Version(),
+		CreatedAt: time.Now().UTC(),
+		Command:   redactArgs(flags, os.Args),
+		Options:   make(map[string]string),
+		Seeds:     make(map[string]string),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		p.Version = info.Main.Version
+		modified := false
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				p.Revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if modified && p.Revision != "" {
+			p.Revision += "-modified"
+		}
+	}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		value := redactFlagValue(f.Name, f.Value.String())
+		p.Options[f.Name] = value
+		if strings.HasSuffix(f.Name, "-seed") {
+			p.Seeds[f.Name] = value
+		}
+	})
+
+	option := func(name string) string { return p.Options[name] }
+	anonymized := option("ip-anon") != IPAnonOff || option("mac-anon") != MACAnonOff || option("anon-preset") != AnonOff
+	if anonymized && option("anon-key") == "" {
+		p.NotReproducible = append(p.NotReproducible, "anon-key: a random pseudonym key per run")
+	}
+	if option("time-shift") == TimeShiftRandom {
+		p.NotReproducible = append(p.NotReproducible, "time-shift: a random offset per run")
+	}
+	if option("tuple-hash") == "true" && option("tuple-hash-salt") == "" {
+		p.NotReproducible = append(p.NotReproducible, "tuple-hash-salt: a random salt per run")
+	}
+	if option("sort") == "false" {
+		p.NotReproducible = append(p.NotReproducible, "sort: rows of a file in the order workers finish them")
+	}
+	if option("streaming") == "true" && option("ordered") == "false" {
+		p.NotReproducible = append(p.NotReproducible, "ordered: streamed rows in the order workers finish them")
+	}
+	return p
+}
+
+// redactFlagValue returns the value of a flag for a provenance record:
+// without secrets and without the password of a ClickHouse DSN.
+func redactFlagValue(name, value string) string {
+	switch {
+	case value == "":
+		return value
+	case slices.Contains(provenanceSecretFlags, name):
+		return redactedValue
+	case name == "clickhouse":
+		if u, err := url.Parse(value); err == nil {
+			return u.Redacted()
+		}
+		return redactedValue
+	}
+	return value
+}
+
+// redactArgs returns the command line with the values of secret flags
+// replaced.
+func redactArgs(flags *flag.FlagSet, args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 0; i < len(redacted); i++ {
+		if !strings.HasPrefix(redacted[i], "-") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(redacted[i], "-"), "=")
+		f := flags.Lookup(name)
+		if f == nil || isBoolFlag(f) {
+			continue
+		}
+		if hasValue {
+			redacted[i] = strings.TrimSuffix(redacted[i], value) + redactFlagValue(name, value)
+		} else if i+1 < len(redacted) {
+			i++
+			redacted[i] = redactFlagValue(name, redacted[i])
+		}
+	}
+	return redacted
+}
+
+// withClasses returns a copy of the record with the label IDs of an output.
+func (p *Provenance) withClasses(classes map[string]byte) *Provenance {
+	record := *p
+	record.Classes = classes
+	return &record
+}
+
+// marshal returns the record as JSON, indented for a sidecar. Secrets read
+// as <redacted>, not with escaped brackets.
+func (p *Provenance) marshal(indent bool) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if indent {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(p); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// provenancePath returns the sidecar of an output, or "" for Parquet, which
+// embeds its record.
+func provenancePath(format, filename string) string {
+	switch format {
+	case "parquet":
+		return ""
+	case "numpy":
+		return numpyBaseName(filename) + provenanceSuffix
+	case "bin":
+		return binBaseName(filename) + provenanceSuffix
+	case "pcap":
+		return pcapBaseName(filename) + provenanceSuffix
+	case "tokens":
+		return tokensBaseName(filename) + provenanceSuffix
+	}
+	return strings.TrimSuffix(filename, ".csv") + provenanceSuffix
+}
+
+// outputClasses returns the label IDs that an output was written with, read
+// from its class mapping, or nil if it does not number classes.
+func outputClasses(format, filename string) map[string]byte {
+	switch format {
+	case "pcap", "tokens":
+		return nil
+	case "numpy":
+		classes, _ := readClassMappingFile(numpyBaseName(filename) + "_classes.json")
+		return classes
+	case "bin":
+		data, err := os.ReadFile(binBaseName(filename) + ".json")
+		if err != nil {
+			return nil
+		}
+		var sidecar binSidecar
+		if json.Unmarshal(data, &sidecar) != nil || len(sidecar.Classes) == 0 {
+			return nil
+		}
+		classes := make(map[string]byte, len(sidecar.Classes))
+		for id, class := range sidecar.Classes {
+			if n, err := strconv.ParseUint(id, 10, 8); err == nil {
+				classes[class] = byte(n)
+			}
+		}
+		return classes
+	}
+	_, _, classesPath := separateLabelsPaths(filename)
+	classes, _ := readClassMappingFile(classesPath)
+	return classes
+}
+
+// writeProvenance writes the provenance sidecars of the run's CSV, NumPy and
+// bin outputs; Parquet outputs embed theirs as they are written.
+func (r *runReporter) writeProvenance(p *Provenance, store *ObjectStore) {
+	if p == nil {
+		return
+	}
+	r.manifest.mutex.Lock()
+	outputs := r.outputs()
+	r.manifest.mutex.Unlock()
+
+	// The formats of a --format list share a sidecar, with the label IDs
+	// of those that number classes
+	var sidecars []string
+	classes := make(map[string]map[string]byte)
+	for _, output := range outputs {
+		for _, out := range formatOutputs(r.format, output) {
+			sidecar := provenancePath(out.format, out.filename)
+			if sidecar == "" || !outputExists(out.format, out.filename, store) {
+				continue
+			}
+			if _, listed := classes[sidecar]; !listed {
+				sidecars = append(sidecars, sidecar)
+				classes[sidecar] = nil
+			}
+			if classes[sidecar] == nil {
+				classes[sidecar] = outputClasses(out.format, out.filename)
+			}
+		}
+	}
+	for _, sidecar := range sidecars {
+		if err := writeProvenanceFile(sidecar, p.withClasses(classes[sidecar]), store); err != nil {
+			slog.Warn("failed to write provenance", "output", sidecar, "error", err)
+		}
+	}
+}
+
+// outputExists reports whether the run wrote an output, which it did for an
+// object store URL if it got this far.
+func outputExists(format, filename string, store *ObjectStore) bool {
+	if store != nil {
+		return true
+	}
+	for _, path := range outputArtifacts(format, filename) {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && !strings.HasSuffix(path, provenanceSuffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeProvenanceFile writes a provenance sidecar, uploading it next to an
+// object store output.
+func writeProvenanceFile(filename string, p *Provenance, store *ObjectStore) error {
+	data, err := p.marshal(true)
+	if err != nil {
+		return err
+	}
+	var partial partialFiles
+	file, err := partial.createOutput(filename, store)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return partial.finish(err)
+}
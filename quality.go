@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// ClassQuality counts data problems of one class for --quality-report.
+type ClassQuality struct {
+	Packets          int `json:"packets"`           // Packets read (after --dedup-flows and --drop-retransmissions)
+	Malformed        int `json:"malformed"`         // Packets with a layer gopacket could not decode
+	NonIP            int `json:"non_ip"`            // Packets without an IPv4/IPv6 layer
+	EmptyPayload     int `json:"empty_payload"`     // TCP/UDP/SCTP packets without application bytes
+	TruncatedPackets int `json:"truncated_packets"` // Packets cut short by the capture snap length
+	TruncatedFiles   int `json:"truncated_files"`   // Files whose reading stopped on an error before the end
+	Rows             int `json:"rows"`              // Rows written
+	AllZeroRows      int `json:"all_zero_rows"`     // Rows whose bytes are all zero
+}
+
+// add sums the counts of o into q.
+func (q *ClassQuality) add(o *ClassQuality) {
+	q.Packets += o.Packets
+	q.Malformed += o.Malformed
+	q.NonIP += o.NonIP
+	q.EmptyPayload += o.EmptyPayload
+	q.TruncatedPackets += o.TruncatedPackets
+	q.TruncatedFiles += o.TruncatedFiles
+	q.Rows += o.Rows
+	q.AllZeroRows += o.AllZeroRows
+}
+
+// QualityReport collects per-class data quality counts and writes them to
+// quality.json. It is safe for concurrent use by readers and workers.
+type QualityReport struct {
+	filename string
+	classes  map[string]*ClassQuality
+	mutex    sync.Mutex
+}
+
+// NewQualityReport creates a report written to filename on Close.
+func NewQualityReport(filename string) *QualityReport {
+	return &QualityReport{
+		filename: filename,
+		classes:  make(map[string]*ClassQuality),
+	}
+}
+
+// qualityCounts are the counts of one file, merged into the report once the
+// file has been read so readers don't contend for the lock per packet.
+type qualityCounts map[string]*ClassQuality
+
+// class returns the counts of a class, creating them on first use.
+func (c qualityCounts) class(name string) *ClassQuality {
+	q, ok := c[name]
+	if !ok {
+		q = &ClassQuality{}
+		c[name] = q
+	}
+	return q
+}
+
+// inspect counts the problems of a packet read for class.
+func (c qualityCounts) inspect(packet gopacket.Packet, class string) {
+	q := c.class(class)
+	q.Packets++
+	if packet.ErrorLayer() != nil {
+		q.Malformed++
+	}
+	if !isIPPacket(packet) {
+		q.NonIP++
+	}
+	if packet.TransportLayer() != nil && len(l7Payload(packet)) == 0 {
+		q.EmptyPayload++
+	}
+	if md := packet.Metadata(); md.Truncated || (md.Length > 0 && md.CaptureLength < md.Length) {
+		q.TruncatedPackets++
+	}
+}
+
+// merge adds the counts of a file to the report.
+func (r *QualityReport) merge(counts qualityCounts) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for class, q := range counts {
+		qualityCounts(r.classes).class(class).add(q)
+	}
+}
+
+// add counts finished rows and the ones whose bytes are all zero.
+func (r *QualityReport) add(rows []PacketResult) {
+	counts := make(qualityCounts)
+	for _, row := range rows {
+		q := counts.class(row.Class)
+		q.Rows++
+		if allZero(row.Data) {
+			q.AllZeroRows++
+		}
+	}
+	r.merge(counts)
+}
+
+// allZero reports whether b has bytes and all of them are zero. Rows without
+// bytes (--scale, BPE tokens) are never all-zero.
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// qualityFile is the layout of quality.json.
+type qualityFile struct {
+	Total   ClassQuality             `json:"total"`
+	Classes map[string]*ClassQuality `json:"classes"` // Unlabeled rows are listed under ""
+}
+
+// Close writes the report and logs the totals.
+func (r *QualityReport) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	report := qualityFile{Classes: r.classes}
+	for _, q := range r.classes {
+		report.Total.add(q)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.filename, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write quality report: %w", err)
+	}
+
+	t := report.Total
+	slog.Info("data quality report",
+		"packets", t.Packets,
+		"malformed", t.Malformed,
+		"non_ip", t.NonIP,
+		"empty_payload", t.EmptyPayload,
+		"truncated_packets", t.TruncatedPackets,
+		"truncated_files", t.TruncatedFiles,
+		"all_zero_rows", t.AllZeroRows,
+		"report", r.filename)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// QUIC handling modes for --quic.
+const (
+	QUICKeep = "keep" // QUIC packets are rows like any other (default)
+	QUICDrop = "drop" // Exclude QUIC packets
+	QUICOnly = "only" // Keep only QUIC packets
+)
+
+// quicPort is the UDP port QUIC is detected on (HTTP/3).
+const quicPort = 443
+
+// Smallest plausible QUIC packets: a long header up to both connection ID
+// lengths, and a short header with an empty connection ID, a 1-byte packet
+// number and room for the header protection sample (RFC 9001 5.4.2).
+const (
+	quicMinLongHeader = 7
+	quicMinShortLen   = 21
+	quicMaxCIDLen     = 20
+)
+
+// quicFeatureNames are the feature columns added by --quic-features, in row
+// order. Fields a packet does not have (all of them for non-QUIC packets) are -1.
+var quicFeatureNames = []string{
+	"quic_long_header", // 1 for long headers, 0 for short headers
+	"quic_version",     // Long headers only; 0 is version negotiation
+	"quic_packet_type", // Long header type bits: Initial, 0-RTT, Handshake, Retry (version 1 numbering)
+	"quic_dcid_len",    // Long headers only; short headers do not carry it
+	"quic_scid_len",    // Long headers only
+}
+
+// quicHeader is the invariant part of a QUIC packet header (RFC 8999).
+type quicHeader struct {
+	long       bool
+	version    uint32
+	packetType int
+	dcidLen    int
+	scidLen    int
+}
+
+// quicOf detects QUIC in a UDP packet to or from port 443, or returns false.
+func quicOf(packet gopacket.Packet) (quicHeader, bool) {
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || (udp.SrcPort != quicPort && udp.DstPort != quicPort) {
+		return quicHeader{}, false
+	}
+	return parseQUICHeader(udp.Payload)
+}
+
+// keepQUIC reports whether the packet passes the --quic mode.
+func keepQUIC(packet gopacket.Packet, mode string) bool {
+	_, isQUIC := quicOf(packet)
+	switch mode {
+	case QUICDrop:
+		return !isQUIC
+	case QUICOnly:
+		return isQUIC
+	}
+	return true
+}
+
+// parseQUICHeader checks whether a UDP payload starts with a QUIC header.
+// Long headers are validated field by field; short headers only carry the
+// fixed bit, so they are recognized by it and a plausible length.
+func parseQUICHeader(b []byte) (quicHeader, bool) {
+	if len(b) == 0 {
+		return quicHeader{}, false
+	}
+	first := b[0]
+
+	if first&0x80 == 0 {
+		if first&0x40 == 0 || len(b) < quicMinShortLen {
+			return quicHeader{}, false
+		}
+		return quicHeader{packetType: -1, dcidLen: -1, scidLen: -1}, true
+	}
+
+	if len(b) < quicMinLongHeader {
+		return quicHeader{}, false
+	}
+	h := quicHeader{
+		long:       true,
+		version:    binary.BigEndian.Uint32(b[1:5]),
+		packetType: int(first>>4) & 0x3,
+		dcidLen:    int(b[5]),
+	}
+	// Version negotiation packets need not set the fixed bit
+	if h.version != 0 && first&0x40 == 0 {
+		return quicHeader{}, false
+	}
+	if h.dcidLen > quicMaxCIDLen || len(b) < 7+h.dcidLen {
+		return quicHeader{}, false
+	}
+	h.scidLen = int(b[6+h.dcidLen])
+	if h.scidLen > quicMaxCIDLen || len(b) < 7+h.dcidLen+h.scidLen {
+		return quicHeader{}, false
+	}
+	if h.version == 0 {
+		h.packetType = -1
+	}
+	return h, true
+}
+
+// quicFeatures returns the --quic-features values of a packet.
+func quicFeatures(packet gopacket.Packet) []float64 {
+	h, ok := quicOf(packet)
+	if !ok {
+		return []float64{-1, -1, -1, -1, -1}
+	}
+	if !h.long {
+		return []float64{0, -1, -1, -1, -1}
+	}
+	return []float64{1, float64(h.version), float64(h.packetType), float64(h.dcidLen), float64(h.scidLen)}
+}
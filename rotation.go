@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"hash/maphash"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// rotationTailPackets is the number of last packets of a rotation file that
+// the first packets of the next file are compared against.
+const rotationTailPackets = 4096
+
+// rotationFiles orders the files of --input-rotation chronologically by the
+// timestamp of their first packet, so capture.pcap, capture.pcap1, ...
+// (tcpdump -C) or strftime names (tcpdump -G) sort alike. A file without a
+// readable packet is placed by its modification time.
+func rotationFiles(files []string) []FileJob {
+	starts := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		start, err := firstPacketTime(file)
+		if err != nil {
+			slog.Debug("ordering rotation file by modification time", "file", file, "error", err)
+			if info, statErr := os.Stat(file); statErr == nil {
+				start = info.ModTime()
+			}
+		}
+		starts[file] = start
+	}
+	sorted := append([]string(nil), files...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return starts[sorted[i]].Before(starts[sorted[j]])
+	})
+
+	jobs := make([]FileJob, len(sorted))
+	for i, file := range sorted {
+		jobs[i] = FileJob{FilePath: file}
+	}
+	return jobs
+}
+
+// firstPacketTime returns the timestamp of the first packet of a capture.
+func firstPacketTime(filePath string) (time.Time, error) {
+	handle, err := openCapture(filePath, ProcessOptions{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer handle.Close()
+	_, ci, err := handle.ReadPacketData()
+	if errors.Is(err, io.EOF) {
+		return time.Time{}, errors.New("no packets")
+	}
+	return ci.Timestamp, err
+}
+
+// rotationPacket identifies a packet by its timestamp and content.
+type rotationPacket struct {
+	timestamp int64
+	sum       uint64
+}
+
+// Rotation carries the end of each --input-rotation file over to the next one,
+// whose leading packets that repeat it are skipped: a sensor restarted by a
+// cron job, or files copied off a ring buffer while it rotates, repeat packets
+// across the boundary. Files must be read one after the other.
+type Rotation struct {
+	seed  maphash.Seed
+	tail  map[rotationPacket]bool // Last packets of the previous file
+	last  int64                   // Timestamp of the previous file's last packet
+	mutex sync.Mutex
+}
+
+// NewRotation creates a rotation before its first file.
+func NewRotation() *Rotation {
+	return &Rotation{seed: maphash.MakeSeed()}
+}
+
+// rotationFile follows the packets of one rotation file.
+type rotationFile struct {
+	rotation *Rotation
+	tail     map[rotationPacket]bool
+	last     int64
+	overlap  bool // Packets so far are not newer than the previous file
+	ring     []rotationPacket
+	next     int
+	skipped  int
+}
+
+// open starts the next file. A nil Rotation returns a nil file, which skips nothing.
+func (r *Rotation) open() *rotationFile {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &rotationFile{
+		rotation: r,
+		tail:     r.tail,
+		last:     r.last,
+		overlap:  r.tail != nil,
+		ring:     make([]rotationPacket, 0, rotationTailPackets),
+	}
+}
+
+// duplicate records a packet and reports whether it repeats the end of the
+// previous file. Only packets up to the previous file's last timestamp are
+// compared; the first newer packet ends the overlap.
+func (f *rotationFile) duplicate(packet gopacket.Packet) bool {
+	if f == nil {
+		return false
+	}
+	p := rotationPacket{
+		timestamp: packet.Metadata().Timestamp.UnixNano(),
+		sum:       maphash.Bytes(f.rotation.seed, packet.Data()),
+	}
+	if len(f.ring) < rotationTailPackets {
+		f.ring = append(f.ring, p)
+	} else {
+		f.ring[f.next] = p
+		f.next = (f.next + 1) % rotationTailPackets
+	}
+
+	if f.overlap && p.timestamp > f.last {
+		f.overlap = false
+	}
+	if f.overlap && f.tail[p] {
+		f.skipped++
+		return true
+	}
+	return false
+}
+
+// close hands the end of the file over to the next one and returns the
+// number of packets skipped as repeats.
+func (f *rotationFile) close() int {
+	if f == nil {
+		return 0
+	}
+	f.rotation.mutex.Lock()
+	defer f.rotation.mutex.Unlock()
+	if len(f.ring) == 0 {
+		return f.skipped
+	}
+	tail := make(map[rotationPacket]bool, len(f.ring))
+	last := f.ring[0].timestamp
+	for _, p := range f.ring {
+		tail[p] = true
+		last = max(last, p.timestamp)
+	}
+	f.rotation.tail, f.rotation.last = tail, last
+	return f.skipped
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runReportName is the file, in the report directory, that describes how a
+// run ended for orchestration tools.
+const runReportName = "run_report.json"
+
+// Outcomes of an input file in run_report.json.
+const (
+	OutcomeComplete     = "complete"      // All its rows were written
+	OutcomePartial      = "partial"       // Cut short by an interruption or a write error
+	OutcomeSkipped      = "skipped"       // Could not be opened or read, see its error
+	OutcomeNotProcessed = "not_processed" // Never reached, e.g. after --max-packets or a failure
+)
+
+// Report files a run may write next to its output, listed as artifacts when
+// this run wrote them.
+var runReportFiles = []string{
+	"errors.jsonl", "duplicate_flows.jsonl", "duplicates.csv", "vocab.json", "stats.json",
+	"quality.json", "class_stats.json", skippedFilesName, "anonymization_report.json", "suggested_class_weights.json", "manifest.json",
+	"README.md", perFileIndexName, schemaName,
+}
+
+// RunReport is run_report.json: how a run ended, the outcome of each input
+// and the files it wrote, so orchestration tools (Airflow, Snakemake, ...)
+// need not scrape logs. It is written on success, failure and interruption.
+type RunReport struct {
+	Status          string          `json:"status"` // "ok", "failed" or "interrupted"
+	ExitCode        int             `json:"exit_code"`
+	Error           string          `json:"error,omitempty"`
+	Command         []string        `json:"command"`
+	StartedAt       time.Time       `json:"started_at"`
+	FinishedAt      time.Time       `json:"finished_at"`
+	DurationSeconds float64         `json:"duration_seconds"`
+	Format          string          `json:"format"`
+	Output          string          `json:"output"`
+	Rows            int             `json:"rows"`
+	Files           map[string]int  `json:"files"` // Inputs per outcome
+	FileResults     []RunReportFile `json:"file_results"`
+	Artifacts       []string        `json:"artifacts"`
+}
+
+// RunReportFile is the outcome of one input.
+type RunReportFile struct {
+	Path            string  `json:"path"`
+	Interface       string  `json:"interface,omitempty"`
+	Class           string  `json:"class,omitempty"`
+	Outcome         string  `json:"outcome"`
+	Rows            int     `json:"rows"`
+	DecodeErrors    int     `json:"decode_errors"` // Packets with a layer that failed to decode, kept as rows or skipped
+	DurationSeconds float64 `json:"duration_seconds"`
+	Output          string  `json:"output,omitempty"` // Per-file output with --per-file
+	Error           string  `json:"error,omitempty"`
+}
+
+// runReporter gathers what run_report.json needs while the run goes on.
+type runReporter struct {
+	filename string
+	dir      string   // Report directory
+	command  []string // The command line, secrets redacted
+	split    *Split   // --split, whose outputs replace the output
+	format   string
+	manifest *RunManifest
+	errors   *ErrorHandler
+	jobs     *[]FileJob // The run's inputs, once known
+	merged   []string   // --merge-after outputs
+}
+
+// write saves the report of a run that ended with status and exit code.
+// errMsg describes the failure of a failed run.
+func (r *runReporter) write(status string, exitCode int, errMsg string) {
+	report := r.build(status, exitCode, errMsg)
+	// Redacted secrets read as <redacted>, as in the provenance sidecar
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(report)
+	if err == nil {
+		err = os.WriteFile(r.filename, data.Bytes(), 0644)
+	}
+	if err != nil {
+		slog.Warn("failed to write run report", "report", r.filename, "error", err)
+		return
+	}
+	slog.Debug("run report written", "report", r.filename)
+}
+
+// build assembles the report from the manifest, the skipped files and the
+// files on disk.
+func (r *runReporter) build(status string, exitCode int, errMsg string) RunReport {
+	m := r.manifest
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	finished := time.Now()
+	report := RunReport{
+		Status:          status,
+		ExitCode:        exitCode,
+		Error:           errMsg,
+		Command:         r.command,
+		StartedAt:       m.StartedAt,
+		FinishedAt:      finished,
+		DurationSeconds: finished.Sub(m.StartedAt).Seconds(),
+		Format:          m.Format,
+		Output:          m.Output,
+		Rows:            m.TotalPackets,
+		Files:           make(map[string]int),
+		FileResults:     make([]RunReportFile, 0, len(m.Files)),
+		Artifacts:       make([]string, 0),
+	}
+
+	var jobs []FileJob
+	if r.jobs != nil {
+		jobs = *r.jobs
+	}
+	report.FileResults = append(report.FileResults, fileResults(m, r.errors, jobs)...)
+	for _, result := range report.FileResults {
+		report.Files[result.Outcome]++
+	}
+
+	// Only files this run wrote, not those left by an earlier one
+	written := func(path string) bool {
+		info, err := os.Stat(path)
+		return err == nil && info.Mode().IsRegular() && !info.ModTime().Before(m.StartedAt.Truncate(time.Second))
+	}
+	listed := make(map[string]bool) // Separate labels and NumPy share _classes.json
+	for _, output := range r.outputs() {
+		for _, path := range outputArtifacts(r.format, output) {
+			if written(path) && !listed[path] {
+				listed[path] = true
+				report.Artifacts = append(report.Artifacts, path)
+			}
+		}
+	}
+	for _, name := range append(runReportFiles, filepath.Base(manifestPath(m.Output))) {
+		if path := filepath.Join(r.dir, name); written(path) {
+			report.Artifacts = append(report.Artifacts, path)
+		}
+	}
+	return report
+}
+
+// outputs returns the outputs the run may have written: the output or its
+// splits, the merged outputs and the per-file outputs. The caller holds
+// r.manifest.mutex.
+func (r *runReporter) outputs() []string {
+	m := r.manifest
+	var outputs []string
+	if r.split != nil {
+		for _, name := range r.split.names() {
+			outputs = append(outputs, splitOutputPath(m.Output, name))
+		}
+	} else if m.Output != stdoutOutput {
+		outputs = append(outputs, m.Output)
+	}
+	outputs = append(outputs, r.merged...)
+	for _, f := range m.Files {
+		if f.Output != "" {
+			outputs = append(outputs, f.Output)
+		}
+	}
+	return outputs
+}
+
+// fileResults returns the outcome of every input: those in the manifest, then
+// the other jobs, skipped or never reached. The caller holds m.mutex.
+func fileResults(m *RunManifest, errs *ErrorHandler, jobs []FileJob) []RunReportFile {
+	var results []RunReportFile
+	recorded := make(map[string]bool)
+	decodeErrors := errs.decodeErrors()
+	for _, f := range m.Files {
+		outcome := OutcomeComplete
+		if !f.Complete {
+			outcome = OutcomePartial
+		}
+		results = append(results, RunReportFile{
+			Path:            f.Path,
+			Interface:       f.Interface,
+			Class:           f.Class,
+			Outcome:         outcome,
+			Rows:            f.Packets,
+			DecodeErrors:    decodeErrors[FileJob{FilePath: f.Path, Interface: f.Interface}.key()],
+			DurationSeconds: f.DurationSeconds,
+			Output:          f.Output,
+		})
+		recorded[FileJob{FilePath: f.Path, Interface: f.Interface}.key()] = true
+	}
+	skipped := errs.fileErrors()
+	for _, job := range jobs {
+		if recorded[FileJob{FilePath: job.FilePath, Interface: job.Interface}.key()] {
+			continue
+		}
+		result := RunReportFile{Path: job.FilePath, Interface: job.Interface, Class: job.Class, Outcome: OutcomeNotProcessed}
+		if err, ok := skipped[job.FilePath]; ok {
+			result.Outcome, result.Error = OutcomeSkipped, err
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// outputArtifacts returns the files a stream writer may create for an output,
+// like removeOutput deletes them.
+func outputArtifacts(format, filename string) []string {
+	if outputs := formatOutputs(format, filename); len(outputs) > 1 {
+		var paths []string
+		for _, output := range outputs {
+			paths = append(paths, outputArtifacts(output.format, output.filename)...)
+		}
+		return paths
+	}
+	var suffixes []string
+	base := filename
+	switch format {
+	case "numpy":
+		base = numpyBaseName(filename)
+		suffixes = []string{"_data.npy", "_labels.npy", "_classes.json", "_features.npy", "_features.json", ".npz", provenanceSuffix}
+	case "bin":
+		base = binBaseName(filename)
+		suffixes = []string{".bin", "_labels.bin", "_features.bin", ".json", provenanceSuffix}
+	case "pcap", "tokens":
+		return []string{filename, provenancePath(format, filename)}
+	default:
+		dataPath, labelsPath, classesPath := separateLabelsPaths(filename)
+		paths := []string{filename, filename + csvZstdExt, dataPath, dataPath + csvZstdExt, labelsPath, classesPath}
+		if sidecar := provenancePath(format, filename); sidecar != "" {
+			paths = append(paths, sidecar)
+		}
+		return paths
+	}
+	paths := make([]string, len(suffixes))
+	for i, suffix := range suffixes {
+		paths[i] = base + suffix
+	}
+	return paths
+}
+
+// fatalMessage renders the message and attributes of a fatal error on one
+// line for the run report, e.g. "failed to process file: input=a.pcap error=...".
+func fatalMessage(msg string, args ...any) string {
+	var line strings.Builder
+	line.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		if i == 0 {
+			line.WriteString(":")
+		}
+		fmt.Fprintf(&line, " %v=%v", args[i], args[i+1])
+	}
+	return line.String()
+}
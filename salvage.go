@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Classic pcap magic numbers (microsecond and nanosecond resolution).
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+)
+
+const (
+	pcapGlobalHeaderLen = 24
+	pcapRecordHeaderLen = 16
+
+	// salvageMaxRecord caps record lengths considered plausible while resynchronizing.
+	salvageMaxRecord = 262144
+
+	// salvageMaxTimeJump rejects candidate headers whose timestamp is far from the last good record.
+	salvageMaxTimeJump = 30 * 24 * time.Hour
+)
+
+// salvageReader reads classic pcap files and skips damaged records instead of aborting.
+// When a record header is implausible it scans forward byte by byte until it finds a
+// header that is valid and is followed by another valid header (or end of file).
+type salvageReader struct {
+	file         *os.File
+	reader       *bufio.Reader
+	order        binary.ByteOrder
+	nanos        bool
+	snapLen      uint32
+	linkType     layers.LinkType
+	lastTime     int64 // Seconds of the last good record, 0 before the first one
+	skippedBytes int64
+	resyncs      int
+}
+
+// newSalvageReader opens a classic pcap file for salvage reading.
+// The global header must be intact; pcapng files are not supported.
+func newSalvageReader(filename string) (*salvageReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &salvageReader{
+		file:   file,
+		reader: bufio.NewReaderSize(file, 2*salvageMaxRecord),
+	}
+
+	header := make([]byte, pcapGlobalHeaderLen)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading global header: %w", err)
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(header) == pcapMagicMicros:
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header) == pcapMagicMicros:
+		r.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header) == pcapMagicNanos:
+		r.order, r.nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header) == pcapMagicNanos:
+		r.order, r.nanos = binary.BigEndian, true
+	default:
+		file.Close()
+		return nil, errors.New("not a classic pcap file (salvage mode does not support pcapng)")
+	}
+
+	r.snapLen = r.order.Uint32(header[16:20])
+	if r.snapLen == 0 || r.snapLen > salvageMaxRecord {
+		r.snapLen = salvageMaxRecord
+	}
+	r.linkType = layers.LinkType(r.order.Uint32(header[20:24]) & 0x0FFFFFFF)
+
+	return r, nil
+}
+
+// validHeader reports whether a 16-byte record header looks plausible.
+func (r *salvageReader) validHeader(h []byte) bool {
+	sec := int64(r.order.Uint32(h[0:4]))
+	frac := r.order.Uint32(h[4:8])
+	inclLen := r.order.Uint32(h[8:12])
+	origLen := r.order.Uint32(h[12:16])
+
+	maxFrac := uint32(1000000)
+	if r.nanos {
+		maxFrac = 1000000000
+	}
+
+	if frac >= maxFrac || inclLen == 0 || inclLen > r.snapLen || inclLen > origLen || origLen > salvageMaxRecord {
+		return false
+	}
+
+	if r.lastTime != 0 {
+		jump := time.Duration(sec-r.lastTime) * time.Second
+		if jump > salvageMaxTimeJump || jump < -salvageMaxTimeJump {
+			return false
+		}
+	}
+
+	return true
+}
+
+// confirmed reports whether the header at the current position is valid and is
+// followed by another valid header or by the end of the file.
+func (r *salvageReader) confirmed() bool {
+	h, err := r.reader.Peek(pcapRecordHeaderLen)
+	if err != nil || !r.validHeader(h) {
+		return false
+	}
+
+	recordLen := pcapRecordHeaderLen + int(r.order.Uint32(h[8:12]))
+	next, err := r.reader.Peek(recordLen + pcapRecordHeaderLen)
+	if err != nil {
+		// Last record in the file: accept it if the record itself is complete
+		return len(next) == recordLen
+	}
+	return r.validHeader(next[recordLen:])
+}
+
+// resync skips bytes until the next confirmed record header or end of file.
+func (r *salvageReader) resync() error {
+	r.resyncs++
+	for {
+		if _, err := r.reader.Discard(1); err != nil {
+			return io.EOF
+		}
+		r.skippedBytes++
+
+		if _, err := r.reader.Peek(pcapRecordHeaderLen); err != nil {
+			// Trailing garbage shorter than a header
+			n, _ := r.reader.Discard(pcapRecordHeaderLen)
+			r.skippedBytes += int64(n)
+			return io.EOF
+		}
+		if r.confirmed() {
+			return nil
+		}
+	}
+}
+
+// ReadPacketData implements gopacket.PacketDataSource.
+func (r *salvageReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		h, err := r.reader.Peek(pcapRecordHeaderLen)
+		if len(h) == 0 && err != nil {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		if err != nil || !r.validHeader(h) {
+			if err := r.resync(); err != nil {
+				return nil, gopacket.CaptureInfo{}, err
+			}
+			continue
+		}
+
+		inclLen := int(r.order.Uint32(h[8:12]))
+		record, err := r.reader.Peek(pcapRecordHeaderLen + inclLen)
+		if err != nil {
+			// Truncated final record
+			r.skippedBytes += int64(len(record))
+			r.reader.Discard(len(record))
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+
+		sec := int64(r.order.Uint32(h[0:4]))
+		frac := int64(r.order.Uint32(h[4:8]))
+		if !r.nanos {
+			frac *= 1000
+		}
+
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Unix(sec, frac).UTC(),
+			CaptureLength: inclLen,
+			Length:        int(r.order.Uint32(h[12:16])),
+		}
+
+		// Copy out of the bufio buffer, which is reused on the next read
+		data := make([]byte, inclLen)
+		copy(data, record[pcapRecordHeaderLen:])
+
+		r.reader.Discard(len(record))
+		r.lastTime = sec
+
+		return data, ci, nil
+	}
+}
+
+// LinkType returns the link type from the pcap global header.
+func (r *salvageReader) LinkType() layers.LinkType {
+	return r.linkType
+}
+
+// Close closes the underlying file.
+func (r *salvageReader) Close() {
+	r.file.Close()
+}
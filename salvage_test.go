@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// salvageCapture returns a classic pcap of n 40-byte packets whose first byte
+// is their number, and the offset of each record header in it.
+func salvageCapture(t *testing.T, n int) ([]byte, []int) {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := pcapgo.NewWriter(&buf)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int
+	for i := 0; i < n; i++ {
+		data := bytes.Repeat([]byte{0xee}, 40)
+		data[0] = byte(i)
+		offsets = append(offsets, buf.Len())
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(1700000000+int64(i), 0), CaptureLength: len(data), Length: len(data)}
+		if err := writer.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes(), offsets
+}
+
+// salvagePackets reads a capture in salvage mode and returns the numbers of
+// the packets it recovered.
+func salvagePackets(t *testing.T, capture []byte) ([]int, *salvageReader) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "damaged.pcap")
+	if err := os.WriteFile(filename, capture, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := newSalvageReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	var numbers []int
+	for {
+		data, ci, err := r.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return numbers, r
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ci.CaptureLength != 40 || !ci.Timestamp.Equal(time.Unix(1700000000+int64(data[0]), 0)) {
+			t.Errorf("packet %d: capture info %+v", data[0], ci)
+		}
+		numbers = append(numbers, int(data[0]))
+	}
+}
+
+// TestSalvageCorruptRecordHeaders damages record headers in the ways a torn
+// or overwritten capture does and checks that the packets around them are
+// recovered.
+func TestSalvageCorruptRecordHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(capture []byte, offsets []int) []byte
+		want   []int
+	}{
+		{"intact", func(c []byte, _ []int) []byte { return c }, []int{0, 1, 2, 3, 4, 5}},
+		{"huge length", func(c []byte, o []int) []byte {
+			binary.LittleEndian.PutUint32(c[o[2]+8:], 0xffffffff)
+			return c
+		}, []int{0, 1, 3, 4, 5}},
+		{"zeroed header", func(c []byte, o []int) []byte {
+			copy(c[o[1]:], make([]byte, pcapRecordHeaderLen))
+			return c
+		}, []int{0, 2, 3, 4, 5}},
+		{"timestamp jump", func(c []byte, o []int) []byte {
+			binary.LittleEndian.PutUint32(c[o[3]:], 100)
+			return c
+		}, []int{0, 1, 2, 4, 5}},
+		{"garbage between records", func(c []byte, o []int) []byte {
+			return slices.Insert(c, o[4], bytes.Repeat([]byte{0xff}, 23)...)
+		}, []int{0, 1, 2, 3, 4, 5}},
+		{"two damaged headers", func(c []byte, o []int) []byte {
+			binary.LittleEndian.PutUint32(c[o[1]+4:], 2000000) // Microseconds past a second
+			binary.LittleEndian.PutUint32(c[o[4]+12:], 1)      // Original length below the captured one
+			return c
+		}, []int{0, 2, 3, 5}},
+		{"truncated last record", func(c []byte, _ []int) []byte { return c[:len(c)-10] }, []int{0, 1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		capture, offsets := salvageCapture(t, 6)
+		got, r := salvagePackets(t, tt.damage(capture, offsets))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: recovered packets %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.name != "intact" && r.skippedBytes == 0 {
+			t.Errorf("%s: no skipped bytes counted", tt.name)
+		}
+	}
+}
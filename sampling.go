@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+)
+
+// ClassWeights maps class names to the probability that a row of the class is
+// kept (--class-weights). Classes without a weight are kept entirely.
+type ClassWeights map[string]float64
+
+// readClassWeights loads a JSON object such as {"benign": 0.25, "scan": 1}.
+func readClassWeights(filename string) (ClassWeights, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var weights ClassWeights
+	if err := json.Unmarshal(data, &weights); err != nil {
+		return nil, fmt.Errorf("invalid class weights file %s: %w", filename, err)
+	}
+	for class, p := range weights {
+		if math.IsNaN(p) || p < 0 || p > 1 {
+			return nil, fmt.Errorf("class weights file %s: weight of %q must be a keep probability between 0 and 1, got %v", filename, class, p)
+		}
+	}
+	return weights, nil
+}
+
+// unknownClasses returns the weighted classes that are not among the run's
+// classes (name -> ID), sorted.
+func (w ClassWeights) unknownClasses(known map[string]byte) []string {
+	var unknown []string
+	for class := range w {
+		if _, ok := known[class]; !ok {
+			unknown = append(unknown, class)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// keep reports whether the row at position index of a file is kept. The
+// decision hashes the class, file and position, so the sample is the same in
+// every run and does not depend on worker scheduling.
+func (w ClassWeights) keep(class, fileName string, index int) bool {
+	p, ok := w[class]
+	if !ok || p >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%s", class, fileName)
+	binary.Write(h, binary.LittleEndian, int64(index))
+	// Top 53 bits as a uniform float in [0, 1)
+	return float64(h.Sum64()>>11)/(1<<53) < p
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Scaling methods for --scale.
+const (
+	ScaleOff    = ""       // Raw byte values (default)
+	ScaleMinMax = "minmax" // (x - min) / (max - min), in [0, 1] on the fitted data
+	ScaleZScore = "zscore" // (x - mean) / std
+)
+
+// ScaleColumn holds the statistics of one output column.
+type ScaleColumn struct {
+	Name string  `json:"name"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	Std  float64 `json:"std"` // Population standard deviation
+}
+
+// ScaleStats is the content of stats.json: the method and the per-column
+// statistics needed to apply the same transform at inference time.
+type ScaleStats struct {
+	Method  string        `json:"method"`
+	Rows    int64         `json:"rows"`
+	Columns []ScaleColumn `json:"columns"`
+}
+
+// scaleColumnNames returns the columns that are scaled: one per byte of a
+// fixed-length row followed by the feature columns.
+func scaleColumnNames(opts ProcessOptions) []string {
+	names := make([]string, 0, opts.OutputLength+len(opts.FeatureNames()))
+	for i := 0; i < opts.OutputLength; i++ {
+		names = append(names, fmt.Sprintf("Byte_%d", i))
+	}
+	return append(names, opts.FeatureNames()...)
+}
+
+// Scaler turns a row's bytes and features into scaled float64 columns.
+type Scaler struct {
+	columns []string
+	offset  []float64 // Subtracted from each value
+	factor  []float64 // Then multiplied; 0 for constant columns
+}
+
+// NewScaler creates a scaler for method from stats.
+func NewScaler(method string, stats *ScaleStats) (*Scaler, error) {
+	s := &Scaler{
+		columns: make([]string, len(stats.Columns)),
+		offset:  make([]float64, len(stats.Columns)),
+		factor:  make([]float64, len(stats.Columns)),
+	}
+	for i, c := range stats.Columns {
+		s.columns[i] = c.Name
+		var spread float64
+		switch method {
+		case ScaleMinMax:
+			s.offset[i], spread = c.Min, c.Max-c.Min
+		case ScaleZScore:
+			s.offset[i], spread = c.Mean, c.Std
+		default:
+			return nil, fmt.Errorf("invalid --scale method %q (use minmax or zscore)", method)
+		}
+		// Constant columns carry no information and scale to 0
+		if spread > 0 {
+			s.factor[i] = 1 / spread
+		}
+	}
+	return s, nil
+}
+
+// apply replaces p's bytes and features with the scaled values of all columns.
+func (s *Scaler) apply(p *PacketResult) {
+	values := make([]float64, len(s.columns))
+	for i, b := range p.Data {
+		if i < len(values) {
+			values[i] = (float64(b) - s.offset[i]) * s.factor[i]
+		}
+	}
+	for i, f := range p.Features {
+		if j := len(p.Data) + i; j < len(values) {
+			values[j] = (f - s.offset[j]) * s.factor[j]
+		}
+	}
+	p.Data = nil
+	p.Features = values
+}
+
+// applyRows scales rows in place.
+func (s *Scaler) applyRows(rows []PacketResult) {
+	for i := range rows {
+		s.apply(&rows[i])
+	}
+}
+
+// columnStats accumulates the statistics of one column (Welford's algorithm for mean and variance).
+type columnStats struct {
+	min, max, mean, m2 float64
+}
+
+// ScaleStatsCollector is a StreamWriter that computes column statistics
+// instead of writing rows; it backs the first pass of --scale.
+type ScaleStatsCollector struct {
+	columns []string
+	stats   []columnStats
+	rows    int64
+	mutex   sync.Mutex
+}
+
+func newScaleStatsCollector(columns []string) *ScaleStatsCollector {
+	return &ScaleStatsCollector{
+		columns: columns,
+		stats:   make([]columnStats, len(columns)),
+	}
+}
+
+func (c *ScaleStatsCollector) WritePacket(p PacketResult) error {
+	return c.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch adds the bytes and features of packets to the statistics.
+func (c *ScaleStatsCollector) WriteBatch(packets []PacketResult) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, p := range packets {
+		c.rows++
+		for i := range c.stats {
+			var v float64
+			if i < len(p.Data) {
+				v = float64(p.Data[i])
+			} else if j := i - len(p.Data); j < len(p.Features) {
+				v = p.Features[j]
+			}
+			c.add(i, v)
+		}
+	}
+	return nil
+}
+
+// add adds one value of column i. The caller holds the mutex.
+func (c *ScaleStatsCollector) add(i int, v float64) {
+	s := &c.stats[i]
+	if c.rows == 1 {
+		s.min, s.max = v, v
+	} else {
+		s.min = math.Min(s.min, v)
+		s.max = math.Max(s.max, v)
+	}
+	delta := v - s.mean
+	s.mean += delta / float64(c.rows)
+	s.m2 += delta * (v - s.mean)
+}
+
+func (c *ScaleStatsCollector) Close() error {
+	return nil
+}
+
+// result returns the statistics collected so far.
+func (c *ScaleStatsCollector) result(method string) *ScaleStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := &ScaleStats{Method: method, Rows: c.rows, Columns: make([]ScaleColumn, len(c.columns))}
+	for i, s := range c.stats {
+		column := ScaleColumn{Name: c.columns[i], Min: s.min, Max: s.max, Mean: s.mean}
+		if c.rows > 0 {
+			column.Std = math.Sqrt(s.m2 / float64(c.rows))
+		}
+		stats.Columns[i] = column
+	}
+	return stats
+}
+
+// computeScaleStats runs a first pass over fileJobs that only collects column
+// statistics.
+func computeScaleStats(ctx context.Context, fileJobs []FileJob, method string, opts ProcessOptions, maxConcurrentFiles int) (*ScaleStats, error) {
+	opts, closePass, err := firstPassOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer closePass()
+
+	collector := newScaleStatsCollector(scaleColumnNames(opts))
+	if _, err := processFilesStreamingSingleOutput(ctx, fileJobs, collector, opts, maxConcurrentFiles, NewRunManifest("", "")); err != nil {
+		return nil, err
+	}
+
+	stats := collector.result(method)
+	if stats.Rows == 0 {
+		return nil, fmt.Errorf("no rows to compute scaling statistics from")
+	}
+	return stats, nil
+}
+
+// readScaleStats loads a stats.json written by an earlier run and checks that
+// its columns match the columns of this run.
+func readScaleStats(filename string, opts ProcessOptions) (*ScaleStats, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var stats ScaleStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, fmt.Errorf("invalid stats file %s: %w", filename, err)
+	}
+
+	names := make([]string, len(stats.Columns))
+	for i, c := range stats.Columns {
+		names[i] = c.Name
+	}
+	if want := scaleColumnNames(opts); !slices.Equal(names, want) {
+		return nil, fmt.Errorf("stats file %s has %d columns, this run produces %d (check --length, --session-bytes, --timing and --icmp-features)", filename, len(names), len(want))
+	}
+	return &stats, nil
+}
+
+// writeScaleStats writes stats as indented JSON.
+func writeScaleStats(filename string, stats *ScaleStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// schemaName is the file, in the report directory, that describes the columns
+// of the run's outputs for feature stores and model cards.
+const schemaName = "schema.json"
+
+// Schema is schema.json: what a row of the run is and, per output format, the
+// columns of its rows in file order, their types, what they mean and the
+// masking applied to them. Every output of a format (splits, per-file and
+// merged outputs) has the same columns.
+type Schema struct {
+	Rows    string         `json:"rows"` // What one row is
+	Outputs []SchemaOutput `json:"outputs"`
+}
+
+// SchemaOutput is the column list of one format of a --format list.
+type SchemaOutput struct {
+	Format  string         `json:"format"`
+	Layout  string         `json:"layout,omitempty"` // --parquet-layout of Parquet outputs
+	Columns []SchemaColumn `json:"columns"`
+}
+
+// SchemaColumn is one column, or a numbered group such as Byte_{i}.
+type SchemaColumn struct {
+	Name        string   `json:"name"`
+	Count       int      `json:"count,omitempty"` // Columns of a {i} group, numbered from 0 (0 = as wide as the longest row)
+	Dtype       string   `json:"dtype"`
+	File        string   `json:"file,omitempty"` // Array or file holding the column: data, labels or features
+	Description string   `json:"description"`
+	Masking     []string `json:"masking,omitempty"`
+}
+
+// featureDescriptions gives the meaning of the feature columns of
+// ProcessOptions.FeatureNames, except those of flow records.
+var featureDescriptions = map[string]string{
+	"delta_time":         "Seconds since the previous packet in the file",
+	"flow_iat":           "Seconds since the previous packet of the same flow",
+	"flow_iat_mean":      "Running mean of the flow's inter-arrival times, in seconds",
+	"flow_iat_std":       "Running standard deviation of the flow's inter-arrival times, in seconds",
+	"flow_iat_min":       "Smallest inter-arrival time of the flow so far, in seconds",
+	"flow_iat_max":       "Largest inter-arrival time of the flow so far, in seconds",
+	"zeek_matched":       "1 if the packet matched a Zeek connection, else 0 (the other zeek columns are -1)",
+	"zeek_orig":          "1 if the packet was sent by the connection originator",
+	"zeek_duration":      "Duration of the Zeek connection, in seconds",
+	"zeek_orig_pkts":     "Packets sent by the connection originator",
+	"zeek_resp_pkts":     "Packets sent by the connection responder",
+	"zeek_orig_bytes":    "Payload bytes sent by the connection originator",
+	"zeek_resp_bytes":    "Payload bytes sent by the connection responder",
+	"zeek_history":       "Bit i set if the connection history has letter i of " + zeekHistoryLetters,
+	"icmp_type":          "ICMP or ICMPv6 type, -1 without an ICMP layer",
+	"icmp_code":          "ICMP or ICMPv6 code, -1 without an ICMP layer",
+	"quic_long_header":   "1 for a QUIC long header, 0 for a short header, -1 for other packets",
+	"quic_version":       "QUIC version of a long header (0 is version negotiation), else -1",
+	"quic_packet_type":   "QUIC long header type bits (Initial, 0-RTT, Handshake, Retry), else -1",
+	"quic_dcid_len":      "Destination connection ID length of a QUIC long header, else -1",
+	"quic_scid_len":      "Source connection ID length of a QUIC long header, else -1",
+	"tuple_hash":         "Salted hash of the flow's 5-tuple, the same for both directions",
+	"ttl":                "IPv4 TTL or IPv6 hop limit of the innermost IP header, -1 without IP",
+	"tcp_window":         "Advertised TCP window, unscaled, -1 without TCP",
+	"tcp_mss":            "TCP MSS option, -1 if absent",
+	"tcp_window_scale":   "TCP window scale shift count, -1 if absent",
+	"tcp_sack_permitted": "1 if the TCP SACK-permitted option is present, else 0",
+	"tcp_timestamps":     "1 if the TCP timestamp option is present, else 0",
+	"label_weight":       "Weight of the row's label for weighted losses, from --label-rules or --label-weights",
+	"window_start":       "Start of the time window, in Unix seconds",
+	"packets":            "Packets of the host pair in the window",
+	"bytes":              "Sum of the packets' extracted sizes",
+	"duration":           "Seconds between the window's first and last packet",
+	"origin_ports":       "Distinct ports used by the host that sent the window's first packet",
+	"peer_ports":         "Distinct ports used by the other host",
+	"syn":                "TCP SYN packets without ACK (connection attempts)",
+}
+
+// netflowFeatureDescriptions gives the meaning of the feature columns of flow
+// records (--netflow).
+var netflowFeatureDescriptions = map[string]string{
+	"src_port":  "Source port",
+	"dst_port":  "Destination port",
+	"protocol":  "IP protocol number",
+	"tcp_flags": "OR of the TCP flags of the flow's packets",
+	"tos":       "IP type of service",
+	"packets":   "Packets of the flow",
+	"bytes":     "Bytes of the flow",
+	"start":     "Flow start, in Unix seconds",
+	"duration":  "Flow duration, in seconds",
+}
+
+// columnDescriptions gives the meaning of the --with-columns source columns.
+var columnDescriptions = map[string]string{
+	ColumnIndex:     "Position of the packet (session ID in session mode) in its input file",
+	ColumnOrigSize:  "Length of the row's bytes before padding or truncation",
+	ColumnFilename:  "Input capture file name",
+	ColumnFlowID:    "Hash of the packet's flow key, the same for every packet of a flow",
+	ColumnTimestamp: "Capture time in nanoseconds since the Unix epoch",
+	ColumnDecodeOK:  "Whether every layer of the packet decoded",
+	ColumnDecrypted: "Whether the row is the plaintext of a TLS record decrypted with --keylog",
+}
+
+// newSchema describes the outputs of format written with opts.
+func newSchema(opts ProcessOptions, format string, hasClass bool) *Schema {
+	schema := &Schema{Rows: opts.rowDescription()}
+	for _, f := range strings.Split(format, ",") {
+		output := SchemaOutput{Format: f}
+		if f == "parquet" {
+			output.Layout = opts.Writer.ParquetLayout
+			if output.Layout == "" {
+				output.Layout = ParquetLayoutBinary
+			}
+		}
+		output.Columns = opts.schemaColumns(f, output.Layout, hasClass)
+		schema.Outputs = append(schema.Outputs, output)
+	}
+	return schema
+}
+
+// rowDescription says what one row of the run is.
+func (o ProcessOptions) rowDescription() string {
+	var row string
+	switch {
+	case o.NetFlow:
+		return "One NetFlow or IPFIX flow record"
+	case o.Aggregate:
+		return fmt.Sprintf("Counts over the packets of one host pair in a %s window", o.TimeWindow)
+	case o.TimeWindow > 0:
+		row = fmt.Sprintf("The bytes of one host pair's packets in a %s window, concatenated", o.TimeWindow)
+	case o.Writer.ParquetLayout == ParquetLayoutFlows:
+		row = "One session with the list of its packets"
+	case o.SessionBytes > 0:
+		row = fmt.Sprintf("The first %d bytes of one session's packets, concatenated", o.SessionBytes)
+	case o.Messages != MessagesOff:
+		row = fmt.Sprintf("One application message of a session (%s framing)", o.Messages)
+	case o.PacketWindow.Size > 0:
+		scope := "a flow"
+		if o.PacketWindow.byFile() {
+			scope = "the capture"
+		}
+		row = fmt.Sprintf("%d consecutive packets of %s, %d bytes each, concatenated; windows start every %d packets",
+			o.PacketWindow.Size, scope, o.PacketWindow.PacketLength, o.PacketWindow.Stride)
+	default:
+		row = "One packet"
+	}
+	if o.Window.Size > 0 {
+		row += fmt.Sprintf(", split into %d-byte windows every %d bytes", o.Window.Size, o.Window.Stride)
+	}
+	if o.Augment != nil {
+		row += "; each sample is followed by " + o.Augment.String()
+	}
+	return row
+}
+
+// schemaColumns lists the columns of a format's rows in file order.
+func (o ProcessOptions) schemaColumns(format, layout string, hasClass bool) []SchemaColumn {
+	if format == "pcap" {
+		linkType := "LINKTYPE_RAW"
+		if o.IncludeL2 {
+			linkType = "LINKTYPE_ETHERNET"
+		}
+		return []SchemaColumn{{
+			Name:        "packet",
+			Dtype:       linkType,
+			Description: "Packet record: the bytes of the row without padding, the capture time in nanoseconds and the length before truncation",
+			Masking:     append(o.byteMasking(), o.timeMasking()...),
+		}}
+	}
+	if format == "tokens" {
+		token := "one byte as a decimal number"
+		switch {
+		case o.Writer.TokenWord > 1:
+			token = fmt.Sprintf("a hex word of %d bytes", o.Writer.TokenWord)
+		case o.Writer.ByteRepr == ByteReprHex:
+			token = "one byte as two hex digits"
+		}
+		var columns []SchemaColumn
+		if hasClass {
+			columns = append(columns, SchemaColumn{Name: "label", Dtype: "string", Description: "Class name after " + tokensLabelPrefix + ", whitespace replaced by underscores"})
+		}
+		return append(columns, SchemaColumn{
+			Name:        "tokens",
+			Dtype:       "string",
+			Description: "Space-separated tokens of the row's bytes without padding, each " + token,
+			Masking:     o.byteMasking(),
+		})
+	}
+
+	var columns []SchemaColumn
+	array := format == "numpy" || format == "bin"
+
+	// Bytes, unless they were turned into feature columns
+	if !o.bytesAsFeatures() {
+		data := SchemaColumn{
+			Name:        "Byte_{i}",
+			Count:       max(o.OutputLength, o.AssumedLength),
+			Dtype:       "uint8",
+			Description: o.bytesDescription(),
+			Masking:     o.byteMasking(),
+		}
+		switch {
+		case format == "csv":
+			switch o.Writer.ByteRepr {
+			case ByteReprHex:
+				data.Dtype = "string"
+				data.Description += ", as two lower-case hex digits"
+			case ByteReprFloat:
+				data.Dtype = "float64"
+				data.Description += ", divided by 255"
+			}
+		case format == "numpy":
+			data.Name, data.File = "data", "data"
+			data.Dtype = numpyDtypeName(o.Writer.numpyData())
+			if o.Writer.numpyData().normalize {
+				data.Description += ", divided by 255"
+			}
+			if o.Writer.numpyFortran() {
+				data.Description += ", in column-major (Fortran) order"
+			}
+		case format == "bin":
+			data.Name, data.File = "data", "data"
+		case layout == ParquetLayoutBinary:
+			data.Name, data.Count, data.Dtype = "data", 0, "binary"
+		case layout == ParquetLayoutHF:
+			data.Name, data.Count, data.Dtype = "data", 0, "list<uint8>"
+		case layout == ParquetLayoutFlows:
+			data.Name, data.Count = "packets", 0
+			data.Dtype = "list<struct<bytes: binary, timestamp: timestamp[ns], direction: uint8>>"
+			data.Description = "Packets of the session: their bytes, capture time and direction (0 = like the first packet, 1 = the other way)"
+			data.Masking = append(data.Masking, o.timeMasking()...)
+		}
+		columns = append(columns, data)
+	}
+
+	for _, name := range o.FeatureNames() {
+		column := SchemaColumn{Name: name, Dtype: "float64", Description: o.featureDescription(name)}
+		if array {
+			column.File = "features"
+		}
+		switch {
+		case strings.HasPrefix(name, "Byte_") && o.Scale != nil:
+			column.Masking = o.byteMasking()
+		case strings.HasPrefix(name, "Token_"):
+			column.Masking = o.byteMasking()
+		case o.isTimeFeature(name):
+			column.Masking = o.timeMasking()
+		}
+		columns = append(columns, column)
+	}
+	if o.Scale != nil || o.Tokens != nil {
+		columns = groupNumberedColumns(columns)
+	}
+
+	// NumPy and bin outputs have no source columns
+	if !array {
+		for _, name := range o.Writer.Columns {
+			column := SchemaColumn{Name: name, Dtype: sourceColumnDtype(format, name), Description: columnDescriptions[name]}
+			if name == ColumnTimestamp {
+				column.Masking = o.timeMasking()
+			}
+			columns = append(columns, column)
+		}
+	}
+
+	// Classes as names, or as IDs where the output numbers them
+	classes := "Class of the row: " + o.labelDescription()
+	numbered := SchemaColumn{Name: "label", Dtype: "uint8", Description: "Class ID of the row: " + o.labelDescription()}
+	switch {
+	case array:
+		if hasClass {
+			numbered.File = "labels"
+			columns = append(columns, numbered)
+		}
+	case o.Writer.SeparateLabels:
+		if hasClass {
+			numbered.File = "labels"
+			columns = append(columns, numbered)
+		}
+	case format == "csv" || layout == ParquetLayoutWide:
+		if hasClass {
+			columns = append(columns, SchemaColumn{Name: "Class", Dtype: "string", Description: classes})
+		}
+	case layout == ParquetLayoutHF:
+		if hasClass {
+			numbered.Dtype = "int64"
+			numbered.Description += " (a datasets ClassLabel with the class names)"
+			columns = append(columns, numbered)
+		}
+	default:
+		column := SchemaColumn{Name: "class", Dtype: "string", Description: classes}
+		if !hasClass {
+			column.Description = "Always null: the inputs have no classes"
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// bytesDescription says what the byte columns of a row hold.
+func (o ProcessOptions) bytesDescription() string {
+	if o.NetFlow {
+		return "Source and destination addresses of the flow, 16 bytes each (IPv4 as IPv4-mapped IPv6)"
+	}
+	start := o.bytesStart()
+	if o.StripTrailer && o.Extract != ExtractL7 {
+		start += " to the end of the IP packet"
+	}
+	if o.OutputLength == 0 {
+		return "Bytes of the row from " + start + ", as long as the row (CSV, NumPy and bin pad to the longest row)"
+	}
+	truncate := o.TruncateFrom
+	if truncate == "" {
+		truncate = TruncateHead
+	}
+	pad := o.Padding.Mode
+	if pad == "" {
+		pad = PadZero
+	}
+	return fmt.Sprintf("Bytes of the row from %s, padded (%s) or truncated (%s) to %d", start, pad, truncate, o.OutputLength)
+}
+
+// bytesStart says where the bytes of a row start.
+func (o ProcessOptions) bytesStart() string {
+	switch {
+	case o.IncludeL2:
+		return "the Ethernet header"
+	case o.Extract == ExtractL7:
+		return "the TCP or UDP payload"
+	case o.GTPDecap || o.IPDecap > 0:
+		return "the IP header (of the inner packet for decapsulated tunnels)"
+	}
+	return "the IP header"
+}
+
+// byteMasking lists what the run removed from the bytes of rows.
+func (o ProcessOptions) byteMasking() []string {
+	var masking []string
+	switch {
+	case o.MaskIP && (o.MaskPrefix.IPv4 > 0 || o.MaskPrefix.IPv6 > 0):
+		masking = append(masking, fmt.Sprintf("IP host bits zeroed, keeping the /%d IPv4 and /%d IPv6 network", o.MaskPrefix.IPv4, o.MaskPrefix.IPv6))
+	case o.MaskIP:
+		masking = append(masking, "IP addresses zeroed")
+	}
+	if o.Anon.pseudonymizesIPs() {
+		masking = append(masking, fmt.Sprintf("IP addresses replaced by keyed-hash pseudonyms (%s key)", o.Anon.keyKind()))
+	}
+	if o.IncludeL2 && o.Anon != nil {
+		switch {
+		case o.Anon.macs == MACAnonOUI:
+			masking = append(masking, "MAC addresses pseudonymized, keeping the vendor OUI")
+		case o.Anon.preset == AnonStrict:
+			masking = append(masking, "MAC addresses zeroed")
+		}
+	}
+	if o.ZeroPayload {
+		masking = append(masking, "bytes after the transport header zeroed")
+	}
+	if o.Normalize.TTL {
+		masking = append(masking, "IPv4 TTL and IPv6 hop limit zeroed")
+	}
+	if o.Normalize.IPID {
+		masking = append(masking, "IPv4 identification zeroed")
+	}
+	if o.Normalize.Checksum {
+		masking = append(masking, "IPv4, TCP, UDP and SCTP checksums zeroed")
+	}
+	if len(o.MaskBytes) > 0 {
+		masking = append(masking, fmt.Sprintf("bytes at offsets %s of each packet zeroed", o.MaskBytes))
+	}
+	return masking
+}
+
+// timeMasking lists what the run changed in timestamps and the columns
+// computed from them.
+func (o ProcessOptions) timeMasking() []string {
+	var masking []string
+	if o.TimeShift != 0 {
+		masking = append(masking, "shifted by --time-shift")
+	}
+	if o.TimeResolution > 0 {
+		masking = append(masking, "truncated to "+o.TimeResolution.String())
+	}
+	return masking
+}
+
+// isTimeFeature reports whether a feature column is computed from packet
+// timestamps, which --time-shift and --time-resolution change.
+func (o ProcessOptions) isTimeFeature(name string) bool {
+	switch name {
+	case "window_start", "duration":
+		return true
+	case "start":
+		return o.NetFlow
+	}
+	return strings.HasPrefix(name, "flow_iat") || name == "delta_time"
+}
+
+// featureDescription gives the meaning of a feature column.
+func (o ProcessOptions) featureDescription(name string) string {
+	description := featureDescriptions[name]
+	switch {
+	case strings.HasPrefix(name, "Byte_"):
+		description = "Byte i of the row, from " + o.bytesStart()
+	case strings.HasPrefix(name, "Token_"):
+		description = "BPE token i of the row's bytes (IDs of vocab.json), padded with 0"
+	case o.NetFlow:
+		description = netflowFeatureDescriptions[name]
+	}
+	if o.Scale != nil {
+		description += ", scaled with the statistics of stats.json"
+	}
+	return description
+}
+
+// groupNumberedColumns replaces runs of Byte_N and Token_N columns by a
+// Byte_{i} or Token_{i} group described by its first column.
+func groupNumberedColumns(columns []SchemaColumn) []SchemaColumn {
+	var grouped []SchemaColumn
+	for _, column := range columns {
+		prefix, _, numbered := strings.Cut(column.Name, "_")
+		numbered = numbered && (prefix == "Byte" || prefix == "Token")
+		if !numbered {
+			grouped = append(grouped, column)
+			continue
+		}
+		group := prefix + "_{i}"
+		if last := len(grouped) - 1; last >= 0 && grouped[last].Name == group {
+			grouped[last].Count++
+			continue
+		}
+		column.Name, column.Count = group, 1
+		grouped = append(grouped, column)
+	}
+	return grouped
+}
+
+// sourceColumnDtype returns the type of a --with-columns column in a format.
+func sourceColumnDtype(format, column string) string {
+	switch column {
+	case ColumnFilename:
+		return "string"
+	case ColumnFlowID:
+		return "uint64"
+	case ColumnTimestamp:
+		if format == "parquet" {
+			return "timestamp[ns]"
+		}
+	case ColumnDecodeOK, ColumnDecrypted:
+		return "bool"
+	}
+	return "int64"
+}
+
+// labelDescription says where the class of a row comes from.
+func (o ProcessOptions) labelDescription() string {
+	switch o.LabelBy {
+	case LabelByProtocol:
+		return "application protocol detected per flow"
+	case LabelByZeek:
+		return "field of the matching Zeek connection"
+	case LabelBySuricata:
+		return "Suricata alert of the packet's flow, else benign"
+	case LabelByRules:
+		return "first matching rule of --label-rules, else its default"
+	}
+	return "class directory of the input file"
+}
+
+// numpyDtypeName returns the name of a NumPy element type.
+func numpyDtypeName(t numpyDataType) string {
+	switch t.descr {
+	case "<i2":
+		return NpyDtypeInt16
+	case "<f2":
+		return NpyDtypeFloat16
+	case "<f4":
+		return NpyDtypeFloat32
+	}
+	return NpyDtypeUint8
+}
+
+// writeSchema writes the schema of the run's outputs to filename.
+func writeSchema(filename string, schema *Schema) error {
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0644)
+}
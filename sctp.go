@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket/layers"
+)
+
+// SCTP chunk types that carry user data, with the length of their chunk header.
+const (
+	sctpChunkData       = 0  // DATA (RFC 9260)
+	sctpChunkIData      = 64 // I-DATA (RFC 8260)
+	sctpDataHeaderLen   = 16
+	sctpIDataHeaderLen  = 20
+	sctpCommonHeaderLen = 12
+)
+
+// sctpUserData returns the user data of every DATA and I-DATA chunk of an SCTP
+// packet as sub-slices of the packet data. Control chunks (INIT, SACK,
+// HEARTBEAT, ...) carry no application bytes. gopacket treats everything after
+// the first DATA chunk header as its payload, so the chunks are walked here by
+// their own length fields, which also handles several chunks bundled in one packet.
+// A chunk cut short by the snap length gives the user data that was captured.
+func sctpUserData(sctp *layers.SCTP) [][]byte {
+	var chunks [][]byte
+	data := sctp.LayerPayload()
+	for len(data) >= 4 {
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if length < 4 {
+			break
+		}
+		length = min(length, len(data))
+
+		header := 0
+		switch data[0] {
+		case sctpChunkData:
+			header = sctpDataHeaderLen
+		case sctpChunkIData:
+			header = sctpIDataHeaderLen
+		}
+		if header > 0 && length > header {
+			chunks = append(chunks, data[header:length])
+		}
+
+		// Chunks are padded to a multiple of 4 bytes
+		next := (length + 3) &^ 3
+		if next >= len(data) {
+			break
+		}
+		data = data[next:]
+	}
+	return chunks
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// separateLabelsPaths returns the files of a --separate-labels output, named
+// like the NumPy arrays: output/out.csv -> out_data.csv (X), out_labels.csv
+// (y, one class ID per row) and out_classes.json (class ID to name).
+func separateLabelsPaths(filename string) (data, labels, classes string) {
+	ext := filepath.Ext(filename)
+	base := filename[:len(filename)-len(ext)]
+	return base + "_data" + ext, base + "_labels" + ext, base + "_classes.json"
+}
+
+// labelRow is a row of a Parquet labels file.
+type labelRow struct {
+	Label uint8 `parquet:"label"`
+}
+
+// SeparateLabelsWriter writes the rows of a CSV or Parquet output without
+// their class to one file and the class IDs to another, for loaders that
+// expect X and y apart (scikit-learn, PyTorch TensorDataset).
+type SeparateLabelsWriter struct {
+	data     StreamWriter
+	hasClass bool
+
+	mutex         sync.Mutex
+	labelsFile    *os.File
+	partial       partialFiles    // The labels file, renamed on Close
+	labelsCSV     *bufio.Writer   // CSV labels (nil for Parquet)
+	labelsParquet *parquet.Writer // Parquet labels (nil for CSV)
+	classesFile   string
+	classToInt    map[string]byte
+	nextClassID   byte
+}
+
+// NewSeparateLabelsWriter creates the data writer of a CSV or Parquet output
+// and, if the rows have classes, its labels file.
+func NewSeparateLabelsWriter(format, filename string, maxPacketSize int, hasClass bool, featureNames []string, wopts WriterOptions) (*SeparateLabelsWriter, error) {
+	dataPath, labelsPath, classesPath := separateLabelsPaths(filename)
+	wopts.SeparateLabels = false
+	data, err := NewStreamWriter(format, dataPath, maxPacketSize, false, featureNames, wopts)
+	if err != nil {
+		return nil, err
+	}
+	w := &SeparateLabelsWriter{
+		data:        data,
+		hasClass:    hasClass,
+		classesFile: classesPath,
+		classToInt:  make(map[string]byte),
+	}
+	if !hasClass {
+		return w, nil
+	}
+
+	w.labelsFile, err = w.partial.create(labelsPath)
+	if err != nil {
+		data.Close()
+		return nil, fmt.Errorf("failed to create labels file: %w", err)
+	}
+	if format == "parquet" {
+		w.labelsParquet = parquet.NewWriter(w.labelsFile, parquet.SchemaOf(labelRow{}), parquet.Compression(wopts.parquetCodec()))
+	} else {
+		w.labelsCSV = bufio.NewWriterSize(w.labelsFile, 64*1024)
+		w.labelsCSV.WriteString("label\n")
+	}
+	return w, nil
+}
+
+func (w *SeparateLabelsWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch writes the rows to the data file and their class IDs, in the
+// same order, to the labels file.
+func (w *SeparateLabelsWriter) WriteBatch(packets []PacketResult) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.data.WriteBatch(packets); err != nil {
+		return err
+	}
+	if !w.hasClass {
+		return nil
+	}
+	for _, p := range packets {
+		classID, exists := w.classToInt[p.Class]
+		if !exists {
+			classID = w.nextClassID
+			w.classToInt[p.Class] = classID
+			w.nextClassID++
+		}
+		if w.labelsCSV != nil {
+			w.labelsCSV.WriteString(strconv.Itoa(int(classID)))
+			if err := w.labelsCSV.WriteByte('\n'); err != nil {
+				return fmt.Errorf("error writing label: %w", err)
+			}
+			continue
+		}
+		if err := w.labelsParquet.Write(&labelRow{Label: classID}); err != nil {
+			return fmt.Errorf("error writing label: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close finishes the data and labels files and writes the class mapping.
+func (w *SeparateLabelsWriter) Close() error {
+	err := w.data.Close()
+	if !w.hasClass {
+		return err
+	}
+	var labelsErr error
+	if w.labelsCSV != nil {
+		labelsErr = w.labelsCSV.Flush()
+	} else {
+		labelsErr = w.labelsParquet.Close()
+	}
+	if closeErr := w.labelsFile.Close(); labelsErr == nil {
+		labelsErr = closeErr
+	}
+	if err == nil {
+		err = labelsErr
+	}
+	// Without its data file the labels are of no use
+	if err := w.partial.finish(err); err != nil {
+		return err
+	}
+	return writeClassMappingFile(w.classesFile, w.classToInt)
+}
+
+// setClassIDs makes the labels use a fixed class numbering instead of numbering
+// classes in order of appearance. It must be called before the first write.
+func (w *SeparateLabelsWriter) setClassIDs(ids map[string]byte) {
+	for class, id := range ids {
+		w.classToInt[class] = id
+		if id >= w.nextClassID {
+			w.nextClassID = id + 1
+		}
+	}
+}
+
+// writeSeparateLabels writes the rows of an in-memory run as --separate-labels
+// files. Variable-length rows (outputLength==0) are padded to the longest.
+func writeSeparateLabels(format, filename string, packets []PacketResult, outputLength int, featureNames []string, classIDs map[string]byte, pad Padding, wopts WriterOptions) error {
+	if len(packets) == 0 {
+		return fmt.Errorf("no packets to write")
+	}
+	if outputLength == 0 {
+		packets = padToMaxSize(packets, pad)
+	}
+	writer, err := NewSeparateLabelsWriter(format, filename, len(packets[0].Data), packets[0].Class != "", featureNames, wopts)
+	if err != nil {
+		return err
+	}
+	writer.setClassIDs(classIDs)
+	for start := 0; start < len(packets); start += packetBatchSize {
+		if err := writer.WriteBatch(packets[start:min(start+packetBatchSize, len(packets))]); err != nil {
+			writer.Close()
+			return err
+		}
+	}
+	return writer.Close()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// timeWindowFeatureNames are the feature columns of --window-seconds rows, in
+// row order: the bucket start (Unix seconds) and aggregates of its packets.
+var timeWindowFeatureNames = []string{
+	"window_start",
+	"packets",
+	"bytes",    // Sum of the packets' extracted sizes before truncation
+	"duration", // Seconds between the bucket's first and last packet
+}
+
+// sessionKey identifies a session: a bidirectional flow, or with
+// --window-seconds a host pair during one time bucket.
+type sessionKey struct {
+	flow       FlowKey
+	generation int   // Flow of the key when flow timeouts split it
+	bucket     int64 // Bucket number since the Unix epoch (0 without time windows)
+}
+
+// newSessionKey returns the session of a packet seen at ts with the given
+// flow key and generation. Time buckets are aligned to the epoch, so they
+// line up across files.
+func newSessionKey(key FlowKey, generation int, ts time.Time, period time.Duration) sessionKey {
+	if period == 0 {
+		return sessionKey{flow: key, generation: generation}
+	}
+	// Ports are ignored: all traffic between two hosts shares a bucket
+	key.Transport = gopacket.Flow{}
+	return sessionKey{flow: key, bucket: bucketOf(ts, period)}
+}
+
+// FlowPacket is a packet of a session row in the flows layout, which keeps
+// the packets of a flow apart instead of concatenating their bytes.
+type FlowPacket struct {
+	Data      []byte
+	Timestamp time.Time
+	Direction uint8 // 0 = like the session's first packet, 1 = the other way
+}
+
+// sessionOrigin is the source of a session's first packet, against which the
+// direction of its other packets is told.
+type sessionOrigin struct {
+	network, transport gopacket.Endpoint
+}
+
+// sessionOriginOf returns the source of a packet with a network layer.
+func sessionOriginOf(packet gopacket.Packet) sessionOrigin {
+	var origin sessionOrigin
+	if network := packet.NetworkLayer(); network != nil {
+		origin.network = network.NetworkFlow().Src()
+	}
+	if transport := packet.TransportLayer(); transport != nil {
+		origin.transport = transport.TransportFlow().Src()
+	}
+	return origin
+}
+
+// direction returns 0 for a packet sent from the session's origin and 1 for
+// one sent to it. Host pair sessions (--window-seconds) ignore ports, so only
+// the source host counts.
+func (o sessionOrigin) direction(packet gopacket.Packet, hostPairs bool) uint8 {
+	source := sessionOriginOf(packet)
+	if source.network != o.network || (!hostPairs && source.transport != o.transport) {
+		return 1
+	}
+	return 0
+}
+
+// bucketOf returns the number of the time bucket a timestamp falls in.
+func bucketOf(t time.Time, period time.Duration) int64 {
+	n, p := t.UnixNano(), period.Nanoseconds()
+	// Floor division, also for timestamps before 1970
+	bucket := n / p
+	if n%p < 0 {
+		bucket--
+	}
+	return bucket
+}
+
+// sessionAssembler groups the rows of one capture file by bidirectional session
+// and concatenates them into one fixed-length row per session (USTC-TK2016 style).
+// Rows may arrive out of order from the workers; they are reordered by packet index.
+type sessionAssembler struct {
+	length   int
+	from     string // Truncation anchor
+	padding  Padding
+	window   Windowing       // Split each session into windows instead of padding it
+	packets  PacketWindowing // Cut each session into --packet-window rows
+	period   time.Duration   // Time bucket length with --window-seconds (0 = flow sessions)
+	nested   bool            // Keep the packets of each session for --parquet-layout flows
+	counts   bool            // Replace each session by its --aggregate counts
+	messages string          // Cut each session into --messages rows with this framing
+	keys     *KeyLog         // Decrypt the TLS records of --messages rows (--keylog or embedded secrets)
+	embedded tlsSecrets      // TLS secrets embedded in the file
+	augment  *Augmenter      // Lose and duplicate packets of augmented variants
+	sessions map[sessionVariant][]PacketResult
+}
+
+// sessionVariant identifies the packets of a session, or of one of its
+// --augment variants.
+type sessionVariant struct {
+	id   int // Session ID
+	copy int // Augmented variant (0 = the session as captured)
+}
+
+func newSessionAssembler(opts ProcessOptions, fileJob FileJob) *sessionAssembler {
+	length := opts.SessionBytes
+	var embedded tlsSecrets
+	if opts.Messages != MessagesOff {
+		length = opts.OutputLength // Message rows keep their length with --length 0
+		if opts.KeyLog != nil {
+			embedded = opts.KeyLog.embeddedSecrets(fileJob)
+		}
+	}
+	return &sessionAssembler{
+		length:   length,
+		from:     opts.TruncateFrom,
+		padding:  opts.Padding,
+		window:   opts.Window,
+		packets:  opts.PacketWindow,
+		period:   opts.TimeWindow,
+		nested:   opts.Writer.ParquetLayout == ParquetLayoutFlows,
+		counts:   opts.Aggregate,
+		messages: opts.Messages,
+		keys:     opts.KeyLog,
+		embedded: embedded,
+		augment:  opts.Augment,
+		sessions: make(map[sessionVariant][]PacketResult),
+	}
+}
+
+// add buffers a packet row for its session.
+func (a *sessionAssembler) add(p PacketResult) {
+	key := sessionVariant{id: p.Session, copy: p.Copy}
+	a.sessions[key] = append(a.sessions[key], p)
+}
+
+// rows returns one row per session in order of first appearance in the file.
+// Each row holds the session's packet bytes in capture order, truncated or
+// padded to the configured length. OriginalSize is the untruncated total.
+// With windowing, the session is only truncated and each window becomes a row.
+func (a *sessionAssembler) rows() []PacketResult {
+	keys := make([]sessionVariant, 0, len(a.sessions))
+	for key := range a.sessions {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(x, y sessionVariant) int {
+		return cmp.Or(cmp.Compare(x.id, y.id), cmp.Compare(x.copy, y.copy))
+	})
+
+	rows := make([]PacketResult, 0, len(keys))
+	for _, key := range keys {
+		id, packets := key.id, a.sessions[key]
+		sort.Slice(packets, func(i, j int) bool {
+			return packets[i].Index < packets[j].Index
+		})
+		if key.copy > 0 && a.augment.flowLevel() {
+			packets = a.augment.perturb(packets, id, key.copy)
+		}
+
+		if a.counts {
+			rows = append(rows, a.aggregateRow(id, packets))
+			continue
+		}
+		if a.messages != MessagesOff {
+			rows = append(rows, a.messageRows(id, packets)...)
+			continue
+		}
+		if a.packets.Size > 0 {
+			rows = a.packets.rows(rows, packets, a.from, a.padding)
+			continue
+		}
+
+		var session []byte
+		for _, p := range packets {
+			session = append(session, p.Data...)
+		}
+
+		row := PacketResult{
+			Index:        id,
+			OriginalSize: len(session),
+			Data:         session,
+			Class:        packets[0].Class,
+			FileName:     packets[0].FileName,
+			Timestamp:    packets[0].Timestamp,
+			Session:      id,
+			Split:        packets[0].Split,
+			FlowID:       packets[0].FlowID,
+			DecodeFailed: slices.ContainsFunc(packets, func(p PacketResult) bool { return p.DecodeFailed }),
+		}
+		// Per-packet columns are rejected in session mode, so these are the
+		// --zeek-features of the first packet's connection, if any
+		row.Features = packets[0].Features
+		if a.nested {
+			row.Packets = flowPackets(packets, a.length)
+		}
+		if a.period > 0 {
+			row.Features = append(row.Features[:len(row.Features):len(row.Features)], a.timeWindowFeatures(packets, len(session))...)
+		}
+		if a.window.Size > 0 {
+			if len(session) > a.length {
+				row.Data = truncatePad(session, a.length, a.from, a.padding)
+			}
+			rows = a.window.split(rows, row, a.padding, nil)
+			continue
+		}
+		row.Data = truncatePad(session, a.length, a.from, a.padding)
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// aggregateRow returns the --aggregate row of a session's packets, given in
+// capture order. It has no bytes, only counts.
+func (a *sessionAssembler) aggregateRow(id int, packets []PacketResult) PacketResult {
+	row := PacketResult{
+		Index:     id,
+		Class:     packets[0].Class,
+		FileName:  packets[0].FileName,
+		Timestamp: packets[0].Timestamp,
+		Session:   id,
+		Split:     packets[0].Split,
+		FlowID:    packets[0].FlowID,
+		Features:  aggregateFeatures(packets, a.period),
+	}
+	for _, p := range packets {
+		row.OriginalSize += p.OriginalSize
+		row.DecodeFailed = row.DecodeFailed || p.DecodeFailed
+	}
+	return row
+}
+
+// messageRows returns the --messages rows of a session's packets, given in
+// capture order: one per application message, truncated or padded to the
+// configured length unless it is 0. Decrypted TLS records hold their
+// plaintext. A message carries the index, time and
+// direction of the packet it starts in, and the class, split and flow of the
+// session's first packet.
+func (a *sessionAssembler) messageRows(id int, packets []PacketResult) []PacketResult {
+	messages := sessionMessages(packets, a.messages, a.keys, a.embedded)
+	rows := make([]PacketResult, 0, len(messages))
+	for _, m := range messages {
+		data := m.data
+		if a.length > 0 {
+			data = truncatePad(data, a.length, a.from, a.padding)
+		} else {
+			data = append([]byte(nil), data...)
+		}
+		rows = append(rows, PacketResult{
+			Index:        m.start.Index,
+			OriginalSize: len(m.data),
+			Data:         data,
+			Class:        packets[0].Class,
+			FileName:     packets[0].FileName,
+			Timestamp:    m.start.Timestamp,
+			Session:      id,
+			Split:        packets[0].Split,
+			FlowID:       packets[0].FlowID,
+			Direction:    m.start.Direction,
+			DecodeFailed: m.start.DecodeFailed,
+			Decrypted:    m.decrypted,
+		})
+	}
+	return rows
+}
+
+// flowPackets returns the packets of a session, given in capture order, for
+// the flows layout: each keeps its own bytes, and the session is cut after
+// limit bytes in total like its concatenated row.
+func flowPackets(packets []PacketResult, limit int) []FlowPacket {
+	flow := make([]FlowPacket, 0, len(packets))
+	for _, p := range packets {
+		if limit <= 0 {
+			break
+		}
+		data := p.Data[:min(len(p.Data), limit)]
+		limit -= len(data)
+		flow = append(flow, FlowPacket{Data: data, Timestamp: p.Timestamp, Direction: p.Direction})
+	}
+	return flow
+}
+
+// timeWindowFeatures returns the timeWindowFeatureNames values of one bucket's
+// packets, given in capture order with their total size.
+func (a *sessionAssembler) timeWindowFeatures(packets []PacketResult, size int) []float64 {
+	first, last := packets[0].Timestamp, packets[len(packets)-1].Timestamp
+	start := time.Unix(0, bucketOf(first, a.period)*a.period.Nanoseconds())
+	return []float64{
+		float64(start.UnixNano()) / 1e9,
+		float64(len(packets)),
+		float64(size),
+		last.Sub(first).Seconds(),
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+)
+
+// Shared memory handoff (--shm): files of the ring directory.
+const (
+	shmDoneName     = "done.json" // Written after the last batch
+	shmPollInterval = 2 * time.Millisecond
+)
+
+// shmRoot is where --shm names without a directory are created: tmpfs on
+// Linux, so batches never reach a disk.
+func shmRoot() string {
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// shmRing hands record batches to a co-located consumer through shared
+// memory: each batch is an Arrow IPC file, batch_NNNNNN.arrow, in a
+// directory on tmpfs, which the consumer memory-maps and reads without
+// copying or deserializing, then removes. Batches appear under their final
+// name only once complete. At most segments batches wait for the consumer;
+// the writer blocks until it removes the oldest, so a slow training loop
+// throttles packet processing like a Flight client does. done.json marks
+// the end of the run.
+type shmRing struct {
+	dir      string
+	schema   *arrow.Schema
+	segments int
+	batches  int
+	rows     int64
+}
+
+// shmDone is done.json.
+type shmDone struct {
+	Batches  int    `json:"batches"`
+	Rows     int64  `json:"rows"`
+	Complete bool   `json:"complete"`        // False if the run failed or was interrupted
+	Error    string `json:"error,omitempty"` // Why it failed
+}
+
+// newSHMRing creates the ring directory of name: a path if it has a
+// directory, else a directory under shmRoot. It must not exist yet, so a
+// consumer never reads batches left by an earlier run.
+func newSHMRing(name string, segments int, schema *arrow.Schema) (*shmRing, error) {
+	dir := name
+	if !strings.ContainsRune(name, os.PathSeparator) {
+		dir = filepath.Join(shmRoot(), name)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("%s already exists; remove it or choose another --shm name", dir)
+		}
+		return nil, err
+	}
+	return &shmRing{dir: dir, schema: schema, segments: segments}, nil
+}
+
+// batchPath returns the file of batch n.
+func (r *shmRing) batchPath(n int) string {
+	return filepath.Join(r.dir, fmt.Sprintf("batch_%06d.arrow", n))
+}
+
+// write waits for room in the ring and writes a record batch.
+func (r *shmRing) write(ctx context.Context, record arrow.RecordBatch) error {
+	if r.batches >= r.segments {
+		oldest := r.batchPath(r.batches - r.segments)
+		for {
+			if _, err := os.Stat(oldest); errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(shmPollInterval):
+			}
+		}
+	}
+
+	var partial partialFiles
+	path := r.batchPath(r.batches)
+	file, err := partial.create(path)
+	if err != nil {
+		return err
+	}
+	writer, err := ipc.NewFileWriter(file, ipc.WithSchema(r.schema))
+	if err == nil {
+		err = writer.Write(record)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err := partial.finish(err); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	r.batches++
+	r.rows += record.NumRows()
+	return nil
+}
+
+// finish writes done.json, recording err if the run failed.
+func (r *shmRing) finish(err error) error {
+	done := shmDone{Batches: r.batches, Rows: r.rows, Complete: err == nil}
+	if err != nil {
+		done.Error = err.Error()
+	}
+	data, marshalErr := json.Marshal(done)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	var partial partialFiles
+	file, createErr := partial.create(filepath.Join(r.dir, shmDoneName))
+	if createErr != nil {
+		return createErr
+	}
+	_, writeErr := file.Write(append(data, '\n'))
+	if closeErr := file.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	return partial.finish(writeErr)
+}
+
+// serveSharedMemory processes fileJobs and hands the rows to a co-located
+// process as record batches in a shared memory ring (--shm). The ring's path
+// is printed on stdout, so the consumer can start the run as a subprocess
+// and read the path from its first line. The schema is that of --flight-addr.
+func serveSharedMemory(ctx context.Context, fileJobs []FileJob, name string, segments int, opts ProcessOptions, maxConcurrentFiles int, manifest *RunManifest) {
+	dataLength := opts.OutputLength
+	if opts.bytesAsFeatures() {
+		dataLength = 0 // Bytes are sent as float columns
+	}
+	writer := NewFlightStreamWriter(dataLength, opts.hasClass(fileJobs), opts.FeatureNames())
+	ring, err := newSHMRing(name, segments, writer.schema)
+	if err != nil {
+		fatal("failed to create shared memory ring", "shm", name, "error", err)
+	}
+	slog.Info("mode: shared memory", "dir", ring.dir, "segments", segments)
+	manifest.Output = ring.dir
+	fmt.Println(ring.dir)
+
+	// Batches are written as the writer completes them; a failed write
+	// stops the workers through the writer's done channel
+	finished := make(chan error, 1)
+	go func() {
+		var err error
+		for record := range writer.records {
+			if err == nil {
+				if err = ring.write(ctx, record); err != nil {
+					close(writer.done)
+				}
+			}
+			record.Release()
+		}
+		finished <- err
+	}()
+
+	t0 := time.Now()
+	totalPackets, err := processFilesStreamingSingleOutput(ctx, fileJobs, writer, opts, maxConcurrentFiles, manifest)
+	if closeErr := writer.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if ringErr := <-finished; ringErr != nil {
+		err = ringErr // The workers stopped because of it
+	}
+	if err == nil {
+		err = ctx.Err() // Interrupted: the consumer sees an incomplete run
+	}
+	if finishErr := ring.finish(err); finishErr != nil {
+		slog.Warn("failed to write the end of the shared memory ring", "dir", ring.dir, "error", finishErr)
+	}
+	if err != nil && ctx.Err() == nil {
+		fatal("shared memory handoff failed", "dir", ring.dir, "error", err)
+	}
+
+	slog.Info("shared memory handoff completed",
+		"packets", totalPackets,
+		"batches", ring.batches,
+		"rows", ring.rows,
+		"duration", time.Since(t0),
+		"dir", ring.dir)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Grouping units for --split-by: every row of a group lands in the same split.
+const (
+	SplitByPacket = "packet" // Each packet on its own (leaks flows across splits)
+	SplitByFlow   = "flow"   // Bidirectional 5-tuple within a file (default)
+	SplitByFile   = "file"   // Input capture file
+)
+
+// splitNames name the outputs of --split, in the order of its fractions.
+var splitNames = []string{"train", "val", "test"}
+
+// Split assigns rows to train/val/test outputs (--split, --split-by).
+type Split struct {
+	Fractions []float64 // Share of groups per split, summing to 1
+	By        string    // Grouping unit, SplitByPacket, SplitByFlow or SplitByFile
+}
+
+// parseSplit parses --split fractions such as "0.8,0.1,0.1" or "0.9,0.1"
+// (train/val without a test split).
+func parseSplit(spec, by string) (*Split, error) {
+	if by != SplitByPacket && by != SplitByFlow && by != SplitByFile {
+		return nil, fmt.Errorf("unknown grouping %q (use packet, flow or file)", by)
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) < 2 || len(parts) > len(splitNames) {
+		return nil, fmt.Errorf("%q must list 2 or 3 fractions (train,val[,test])", spec)
+	}
+	s := &Split{By: by}
+	sum := 0.0
+	for _, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(f) || f < 0 {
+			return nil, fmt.Errorf("%q is not a fraction between 0 and 1", part)
+		}
+		s.Fractions = append(s.Fractions, f)
+		sum += f
+	}
+	if math.Abs(sum-1) > 1e-6 {
+		return nil, fmt.Errorf("fractions %q sum to %v, not 1", spec, sum)
+	}
+	return s, nil
+}
+
+// names returns the names of the enabled splits.
+func (s *Split) names() []string {
+	return splitNames[:len(s.Fractions)]
+}
+
+// assign returns the split of a packet at position index of a file, given its
+// flow key (hasKey is false without a network layer) and the flow generation
+// of that key. The decision hashes the file name and the packet's group, so it
+// is the same in every run and independent of worker scheduling. Packets
+// without a flow key are grouped on their own with --split-by flow.
+func (s *Split) assign(fileName string, index int, key FlowKey, hasKey bool, generation int) int {
+	return s.pick(s.point(fileName, index, key, hasKey, generation))
+}
+
+// point hashes the packet's group (see assign) to a uniform value in [0, 1).
+// It does not depend on the fractions, so cached rows can be split again.
+func (s *Split) point(fileName string, index int, key FlowKey, hasKey bool, generation int) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(fileName))
+	switch s.By {
+	case SplitByPacket:
+		binary.Write(h, binary.LittleEndian, int64(index))
+	case SplitByFlow:
+		if hasKey {
+			h.Write([]byte(key.String()))
+			// Flows split by timeouts are separate groups; the first keeps its plain hash
+			if generation > 0 {
+				binary.Write(h, binary.LittleEndian, int64(generation))
+			}
+		} else {
+			binary.Write(h, binary.LittleEndian, int64(index))
+		}
+	}
+	// Top 53 bits as a uniform float in [0, 1)
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+// pick returns the split whose share of [0, 1) holds u.
+func (s *Split) pick(u float64) int {
+	for i, f := range s.Fractions {
+		if u < f {
+			return i
+		}
+		u -= f
+	}
+	return len(s.Fractions) - 1
+}
+
+// splitOutputPath inserts the split name before the extension, e.g.
+// output/output.csv -> output/output_train.csv.
+func splitOutputPath(filename, name string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + name + ext
+}
+
+// totalSizeMB returns the size of a run's output, summed over the splits.
+func totalSizeMB(split *Split, filename, format string) float64 {
+	if split == nil {
+		return outputSizeMB(filename, format)
+	}
+	total := 0.0
+	for _, name := range split.names() {
+		total += outputSizeMB(splitOutputPath(filename, name), format)
+	}
+	return total
+}
+
+// splitWriter routes rows to one stream writer per split.
+type splitWriter struct {
+	writers []StreamWriter
+}
+
+// newSplitWriter creates a writer per split next to filename. classIDs fixes
+// the NumPy and bin class numbering so the label IDs of all splits agree.
+func newSplitWriter(split *Split, format, filename string, maxPacketSize int, hasClass bool, featureNames []string, classIDs map[string]byte, wopts WriterOptions) (*splitWriter, error) {
+	w := &splitWriter{}
+	for _, name := range split.names() {
+		writer, err := NewStreamWriter(format, splitOutputPath(filename, name), maxPacketSize, hasClass, featureNames, wopts)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		if numbered, ok := writer.(classNumberedWriter); ok {
+			numbered.setClassIDs(classIDs)
+		}
+		w.writers = append(w.writers, writer)
+	}
+	return w, nil
+}
+
+func (w *splitWriter) WritePacket(p PacketResult) error {
+	return w.writers[p.Split].WritePacket(p)
+}
+
+// WriteBatch hands each split writer its rows of the batch in one call.
+func (w *splitWriter) WriteBatch(packets []PacketResult) error {
+	parts := make([][]PacketResult, len(w.writers))
+	for _, p := range packets {
+		parts[p.Split] = append(parts[p.Split], p)
+	}
+	for i, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		if err := w.writers[i].WriteBatch(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *splitWriter) Close() error {
+	var firstErr error
+	for _, writer := range w.writers {
+		if err := writer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// SubsetExport writes the original frames of the packets that became rows
+// (--export-pcaps), after filtering, sampling, class weights and
+// --max-packets, to one PCAPNG file per class (and per split with --split),
+// so the exact training set can be inspected in Wireshark. Frames are written
+// as captured, before masking. It is safe for concurrent use by workers.
+type SubsetExport struct {
+	dir   string
+	split *Split
+
+	mutex sync.Mutex
+	files map[string]*subsetFile // By path
+	err   error                  // First write error; later rows are not written
+	rows  int64
+}
+
+// capturedFrame is the frame a row was made from, as captured.
+type capturedFrame struct {
+	data     []byte
+	info     gopacket.CaptureInfo
+	linkType layers.LinkType
+}
+
+// subsetFile is an open PCAPNG file of a SubsetExport, with an interface
+// per link type of the captures its frames came from.
+type subsetFile struct {
+	file       *os.File
+	buffer     *bufio.Writer
+	writer     *pcapgo.NgWriter
+	interfaces map[layers.LinkType]int
+	partial    partialFiles // The file, renamed on Close
+}
+
+// NewSubsetExport creates an export into dir, created if needed.
+func NewSubsetExport(dir string, split *Split) (*SubsetExport, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &SubsetExport{dir: dir, split: split, files: make(map[string]*subsetFile)}, nil
+}
+
+// subsetFileName returns the file name of a class: the class with characters
+// other than letters, digits, dots, dashes and underscores replaced, or
+// unlabeled for rows without a class.
+func subsetFileName(class string) string {
+	if class == "" {
+		return "unlabeled.pcapng"
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, class)
+	return strings.TrimLeft(name, ".") + ".pcapng"
+}
+
+// add writes the frames of finished rows and drops them from the rows.
+func (e *SubsetExport) add(rows []PacketResult) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for i := range rows {
+		row := &rows[i]
+		frame := row.Frame
+		row.Frame = nil // Rows of in-memory runs are kept until the end
+		if e.err != nil || frame == nil {
+			continue
+		}
+		path := filepath.Join(e.dir, subsetFileName(row.Class))
+		if e.split != nil {
+			path = filepath.Join(e.dir, e.split.names()[row.Split], subsetFileName(row.Class))
+		}
+		if e.err = e.write(path, frame); e.err == nil {
+			e.rows++
+		}
+	}
+}
+
+// write appends a frame to the file at path, opening it on first use.
+func (e *SubsetExport) write(path string, frame *capturedFrame) error {
+	linkType := frame.linkType
+	f, ok := e.files[path]
+	if !ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		f = &subsetFile{interfaces: make(map[layers.LinkType]int)}
+		file, err := f.partial.create(path)
+		if err != nil {
+			return err
+		}
+		f.file = file
+		f.buffer = bufio.NewWriterSize(file, 1024*1024)
+		f.writer, err = pcapgo.NewNgWriterInterface(f.buffer, subsetInterface(linkType), pcapgo.NgWriterOptions{})
+		if err != nil {
+			file.Close()
+			f.partial.discard()
+			return err
+		}
+		f.interfaces[linkType] = 0
+		e.files[path] = f
+	}
+
+	id, ok := f.interfaces[linkType]
+	if !ok {
+		var err error
+		id, err = f.writer.AddInterface(subsetInterface(linkType))
+		if err != nil {
+			return err
+		}
+		f.interfaces[linkType] = id
+	}
+	info := frame.info
+	info.InterfaceIndex = id
+	return f.writer.WritePacket(info, frame.data)
+}
+
+// subsetInterface describes the captures of one link type, with nanosecond
+// timestamps.
+func subsetInterface(linkType layers.LinkType) pcapgo.NgInterface {
+	return pcapgo.NgInterface{LinkType: linkType, SnapLength: pcapOutputSnapLen, TimestampResolution: 9}
+}
+
+// Close finishes the files and returns the first error of the export. Files
+// are removed if writing failed.
+func (e *SubsetExport) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	err := e.err
+	for _, f := range e.files {
+		fileErr := f.writer.Flush()
+		if fileErr == nil {
+			fileErr = f.buffer.Flush()
+		}
+		if closeErr := f.file.Close(); fileErr == nil {
+			fileErr = closeErr
+		}
+		if err == nil {
+			err = fileErr
+		}
+	}
+	for _, f := range e.files {
+		if finishErr := f.partial.finish(err); err == nil {
+			err = finishErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write exported packets: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Fields of an alert usable as its label (--suricata-label).
+const (
+	SuricataSignature   = "signature"    // Rule message, e.g. "ET SCAN Nmap Scripting Engine User-Agent Detected"
+	SuricataSignatureID = "signature_id" // Rule SID
+	SuricataCategory    = "category"     // Rule classtype description, e.g. "Attempted Information Leak"
+)
+
+// suricataBenign labels packets of flows without an alert.
+const suricataBenign = "benign"
+
+// suricataTimeSlack is how far a packet may lie outside its flow's time span
+// and still be labeled with the flow's alert.
+const suricataTimeSlack = time.Second
+
+// eveEvent holds the fields of an eve.json line used for labeling.
+type eveEvent struct {
+	Timestamp string `json:"timestamp"`
+	EventType string `json:"event_type"`
+	FlowID    uint64 `json:"flow_id"`
+	SrcIP     string `json:"src_ip"`
+	SrcPort   uint16 `json:"src_port"`
+	DestIP    string `json:"dest_ip"`
+	DestPort  uint16 `json:"dest_port"`
+	Proto     string `json:"proto"`
+	Alert     *struct {
+		Signature   string `json:"signature"`
+		SignatureID int64  `json:"signature_id"`
+		Category    string `json:"category"`
+		Severity    int    `json:"severity"`
+	} `json:"alert"`
+	Flow *struct {
+		Start string `json:"start"`
+		End   string `json:"end"`
+	} `json:"flow"`
+}
+
+// alertedFlow is a flow with at least one alert.
+type alertedFlow struct {
+	key        endpointKey
+	start, end time.Time
+	label      string
+	severity   int // Of the alert the label comes from; 1 is the most severe
+}
+
+// SuricataIndex labels packets whose flow raised a Suricata alert
+// (--suricata-eve) with the alert's signature; other packets are benign.
+// It is safe for concurrent use by readers.
+type SuricataIndex struct {
+	flows   map[endpointKey][]*alertedFlow // Sorted by start time
+	classes map[string]byte                // Labels in sorted order
+
+	alerted atomic.Int64
+	benign  atomic.Int64
+}
+
+// NewSuricataIndex reads the alerts of an eve.json file, labeled by field
+// (SuricataSignature, SuricataSignatureID or SuricataCategory). A flow with
+// several alerts takes the label of the most severe one (the first on a tie).
+// Flow events, if logged, extend the labels to the packets after a flow's
+// last alert.
+func NewSuricataIndex(filename, field string) (*SuricataIndex, error) {
+	if field != SuricataSignature && field != SuricataSignatureID && field != SuricataCategory {
+		return nil, fmt.Errorf("unknown alert field %q (use signature, signature_id or category)", field)
+	}
+
+	// Alerts come before their flow's flow event, which is only written when
+	// the flow times out, so flow events are read in a second pass
+	byID := make(map[uint64]*alertedFlow)
+	var unidentified []*alertedFlow
+	alerts := 0
+	err := readEve(filename, func(event eveEvent, ts time.Time) error {
+		if event.EventType != "alert" || event.Alert == nil {
+			return nil
+		}
+		src, dst, proto, err := event.endpoints()
+		if err != nil {
+			return err
+		}
+		alerts++
+
+		label := event.Alert.Signature
+		switch field {
+		case SuricataSignatureID:
+			label = strconv.FormatInt(event.Alert.SignatureID, 10)
+		case SuricataCategory:
+			label = event.Alert.Category
+		}
+		if label == "" {
+			label = "-"
+		}
+
+		start := ts
+		if event.Flow != nil {
+			if t, err := parseEveTime(event.Flow.Start); err == nil && t.Before(start) {
+				start = t
+			}
+		}
+
+		flow, ok := byID[event.FlowID]
+		if !ok || event.FlowID == 0 {
+			flow = &alertedFlow{key: newEndpointKey(src, dst, proto), start: start, end: ts, label: label, severity: event.Alert.Severity}
+			if event.FlowID == 0 {
+				unidentified = append(unidentified, flow)
+			} else {
+				byID[event.FlowID] = flow
+			}
+			return nil
+		}
+		if start.Before(flow.start) {
+			flow.start = start
+		}
+		if ts.After(flow.end) {
+			flow.end = ts
+		}
+		if event.Alert.Severity < flow.severity {
+			flow.label, flow.severity = label, event.Alert.Severity
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(byID) > 0 {
+		err = readEve(filename, func(event eveEvent, _ time.Time) error {
+			flow, ok := byID[event.FlowID]
+			if !ok || event.EventType != "flow" || event.Flow == nil {
+				return nil
+			}
+			if end, err := parseEveTime(event.Flow.End); err == nil && end.After(flow.end) {
+				flow.end = end
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	idx := &SuricataIndex{
+		flows:   make(map[endpointKey][]*alertedFlow),
+		classes: make(map[string]byte),
+	}
+	labels := map[string]bool{suricataBenign: true}
+	add := func(flow *alertedFlow) {
+		idx.flows[flow.key] = append(idx.flows[flow.key], flow)
+		labels[flow.label] = true
+	}
+	for _, flow := range byID {
+		add(flow)
+	}
+	for _, flow := range unidentified {
+		add(flow)
+	}
+	for _, flows := range idx.flows {
+		sort.Slice(flows, func(i, j int) bool {
+			return flows[i].start.Before(flows[j].start)
+		})
+	}
+
+	names := make([]string, 0, len(labels))
+	for label := range labels {
+		names = append(names, label)
+	}
+	sort.Strings(names)
+	for i, label := range names {
+		idx.classes[label] = byte(i)
+	}
+
+	slog.Info("loaded Suricata alerts", "file", filename, "alerts", alerts, "flows", len(byID)+len(unidentified), "labels", len(labels))
+	return idx, nil
+}
+
+// forPass returns an index with the same alerts but its own counters, so a
+// first pass over the inputs does not count packets twice.
+func (s *SuricataIndex) forPass() *SuricataIndex {
+	if s == nil {
+		return nil
+	}
+	return &SuricataIndex{flows: s.flows, classes: s.classes}
+}
+
+// classIDs numbers the labels in sorted order.
+func (s *SuricataIndex) classIDs() map[string]byte {
+	return s.classes
+}
+
+// label returns the alert label of a packet's flow, or suricataBenign. Of the
+// alerted flows of the 5-tuple that span the packet's time, the one started
+// last wins.
+func (s *SuricataIndex) label(packet gopacket.Packet) string {
+	if src, dst, proto, ok := packetEndpoints(packet); ok {
+		flows := s.flows[newEndpointKey(src, dst, proto)]
+		ts := packet.Metadata().Timestamp
+		i := sort.Search(len(flows), func(i int) bool {
+			return flows[i].start.After(ts.Add(suricataTimeSlack))
+		})
+		for i--; i >= 0; i-- {
+			if !ts.After(flows[i].end.Add(suricataTimeSlack)) {
+				s.alerted.Add(1)
+				return flows[i].label
+			}
+		}
+	}
+	s.benign.Add(1)
+	return suricataBenign
+}
+
+// logMatches logs how many packets were labeled by an alert, warning when
+// none were although there are alerts.
+func (s *SuricataIndex) logMatches() {
+	alerted, benign := s.alerted.Load(), s.benign.Load()
+	if alerted == 0 && len(s.flows) > 0 {
+		slog.Warn("no packet matched a Suricata alert, check that eve.json belongs to the captures", "packets", benign)
+		return
+	}
+	slog.Info("labeled packets by Suricata alerts", "alerted", alerted, "benign", benign)
+}
+
+// endpoints parses the addresses, ports and transport of an event. Suricata
+// names transports in upper case and ICMPv6 "IPv6-ICMP".
+func (e eveEvent) endpoints() (src, dst netip.AddrPort, proto string, err error) {
+	srcAddr, err := netip.ParseAddr(e.SrcIP)
+	if err != nil {
+		return src, dst, "", fmt.Errorf("invalid src_ip: %w", err)
+	}
+	dstAddr, err := netip.ParseAddr(e.DestIP)
+	if err != nil {
+		return src, dst, "", fmt.Errorf("invalid dest_ip: %w", err)
+	}
+	proto = strings.ToLower(e.Proto)
+	if proto == "ipv6-icmp" {
+		proto = "icmp"
+	}
+	return netip.AddrPortFrom(srcAddr.Unmap(), e.SrcPort), netip.AddrPortFrom(dstAddr.Unmap(), e.DestPort), proto, nil
+}
+
+// parseEveTime parses an eve.json timestamp such as
+// 2024-03-01T12:00:00.123456+0000.
+func parseEveTime(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02T15:04:05.999999999-0700", s)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339Nano, s)
+	}
+	return t, err
+}
+
+// readEve passes every event of an eve.json file (or rotated .gz archive) to
+// fn with its timestamp. Lines that are not JSON objects are skipped.
+func readEve(filename string, fn func(eveEvent, time.Time) error) error {
+	r, err := openLogFile(filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Bytes()
+		if len(text) == 0 || text[0] != '{' {
+			continue
+		}
+		var event eveEvent
+		if err := json.Unmarshal(text, &event); err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		ts, err := parseEveTime(event.Timestamp)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid timestamp %q", filename, line, event.Timestamp)
+		}
+		if err := fn(event, ts); err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
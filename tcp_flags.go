@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// TCPFlagFilter keeps or drops packets based on their TCP flags.
+// A packet is kept if it matches any include term (or there are none) and no exclude term.
+type TCPFlagFilter struct {
+	include []string
+	exclude []string
+}
+
+// tcpFlagTerms are the names accepted by --tcp-flags.
+var tcpFlagTerms = []string{"fin", "syn", "rst", "psh", "ack", "urg", "ece", "cwr", "pure-ack"}
+
+// parseTCPFlagFilter parses a comma-separated list such as "syn,ack" or "!pure-ack".
+// A leading '!' turns a term into an exclusion. An empty list returns nil (no filtering).
+func parseTCPFlagFilter(list string) (*TCPFlagFilter, error) {
+	filter := &TCPFlagFilter{}
+	for _, term := range strings.Split(list, ",") {
+		term = strings.ToLower(strings.TrimSpace(term))
+		if term == "" {
+			continue
+		}
+
+		exclude := strings.HasPrefix(term, "!")
+		name := strings.TrimPrefix(term, "!")
+		if !validTCPFlagTerm(name) {
+			return nil, fmt.Errorf("unknown TCP flag %q (use %s, optionally prefixed with !)", name, strings.Join(tcpFlagTerms, ", "))
+		}
+
+		if exclude {
+			filter.exclude = append(filter.exclude, name)
+		} else {
+			filter.include = append(filter.include, name)
+		}
+	}
+
+	if len(filter.include) == 0 && len(filter.exclude) == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+func validTCPFlagTerm(name string) bool {
+	for _, t := range tcpFlagTerms {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// keep reports whether the packet passes the filter. Non-TCP packets pass only
+// when the filter has no include terms.
+func (f *TCPFlagFilter) keep(packet gopacket.Packet) bool {
+	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return len(f.include) == 0
+	}
+	tcp, _ := tcpLayer.(*layers.TCP)
+
+	for _, name := range f.exclude {
+		if tcpFlagMatches(tcp, name) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, name := range f.include {
+		if tcpFlagMatches(tcp, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// tcpFlagMatches reports whether a TCP segment has the named flag set.
+// "pure-ack" matches segments with only ACK (and optionally PSH) set and no payload.
+func tcpFlagMatches(tcp *layers.TCP, name string) bool {
+	switch name {
+	case "fin":
+		return tcp.FIN
+	case "syn":
+		return tcp.SYN
+	case "rst":
+		return tcp.RST
+	case "psh":
+		return tcp.PSH
+	case "ack":
+		return tcp.ACK
+	case "urg":
+		return tcp.URG
+	case "ece":
+		return tcp.ECE
+	case "cwr":
+		return tcp.CWR
+	case "pure-ack":
+		return tcp.ACK && !tcp.SYN && !tcp.FIN && !tcp.RST && len(tcp.Payload) == 0
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcpFeatureNames are the feature columns added by --tcp-features, in row
+// order: the header fields passive OS fingerprinting (p0f and the like) relies
+// on. Fields a packet does not have (all of them for packets without IP) are -1.
+var tcpFeatureNames = []string{
+	"ttl",                // IPv4 TTL or IPv6 hop limit of the innermost IP header
+	"tcp_window",         // Advertised window, unscaled
+	"tcp_mss",            // MSS option, usually only on SYN and SYN-ACK
+	"tcp_window_scale",   // Window scale option shift count
+	"tcp_sack_permitted", // 1 if the SACK-permitted option is present, else 0
+	"tcp_timestamps",     // 1 if the timestamp option is present, else 0
+}
+
+// tcpFeatures returns the --tcp-features values of a packet, taken from its
+// innermost IP header and the TCP header that follows it.
+func tcpFeatures(packet gopacket.Packet) []float64 {
+	values := []float64{-1, -1, -1, -1, -1, -1}
+	var tcp *layers.TCP
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.IPv4:
+			values[0], tcp = float64(l.TTL), nil
+		case *layers.IPv6:
+			values[0], tcp = float64(l.HopLimit), nil
+		case *layers.TCP:
+			tcp = l
+		}
+	}
+	if tcp == nil {
+		return values
+	}
+
+	values[1] = float64(tcp.Window)
+	values[4], values[5] = 0, 0
+	for _, opt := range tcp.Options {
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(opt.OptionData) == 2 {
+				values[2] = float64(binary.BigEndian.Uint16(opt.OptionData))
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(opt.OptionData) == 1 {
+				values[3] = float64(opt.OptionData[0])
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			values[4] = 1
+		case layers.TCPOptionKindTimestamps:
+			values[5] = 1
+		}
+	}
+	return values
+}
@@ -168,7 +168,7 @@ echo "  Peak RAM: ${PEAK_RAM_MB} MB | Avg RAM: ${AVG_RAM_MB} MB"
 DATA_FILE_SIZE=$(du -h output/test5_data.npy 2>/dev/null | cut -f1 || echo "N/A")
 LABELS_FILE_SIZE=$(du -h output/test5_labels.npy 2>/dev/null | cut -f1 || echo "N/A")
 TOTAL_SIZE=$(du -ch output/test5_data.npy output/test5_labels.npy output/test5_classes.json 2>/dev/null | tail -1 | cut -f1 || echo "N/A")
-PACKET_COUNT=$(grep -E "(Total packets|Processed.*packets)" /tmp/gobyte_test5.log | grep -oP '\d+' | head -1 || echo "N/A")
+PACKET_COUNT=$(grep -oP 'msg="streaming mode completed" packets=\K\d+' /tmp/gobyte_test5.log | head -1 || echo "N/A")
 echo "  Output: $DATA_FILE_SIZE (data.npy), $LABELS_FILE_SIZE (labels.npy), $TOTAL_SIZE total, $PACKET_COUNT packets"
 rm -f output/test5_data.npy output/test5_labels.npy output/test5_classes.json 2>/dev/null
 echo -e "${GREEN}[PASS] Test 5 passed${NC}"
@@ -186,7 +186,7 @@ echo ""
 PEAK_RAM_MB=$(echo $RAM_STATS | awk '{print $1}')
 AVG_RAM_MB=$(echo $RAM_STATS | awk '{print $2}')
 echo "  Peak RAM: ${PEAK_RAM_MB} MB | Avg RAM: ${AVG_RAM_MB} MB"
-OUTPUT_DIR=$(grep "Output dir:" /tmp/gobyte_test6.log | awk '{print $NF}' || echo "")
+OUTPUT_DIR=$(grep -oP 'msg="per-file mode completed".* output_dir=\K\S+' /tmp/gobyte_test6.log || echo "")
 if [ -n "$OUTPUT_DIR" ] && [ -d "$OUTPUT_DIR" ]; then
     OUTPUT_COUNT=$(find "$OUTPUT_DIR" -name "*.csv" | wc -l)
     TOTAL_OUTPUT_SIZE=$(du -sh "$OUTPUT_DIR" | cut -f1)
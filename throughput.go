@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Throughput counts the work of the parsing and writing stages of a run, for
+// the packets/s and MB/s of progress logs and summaries. Parsing is timed by
+// the wall clock; writing by the time spent inside writers, so a write rate
+// close to the overall rate means the run waits on its output.
+type Throughput struct {
+	start       time.Time
+	readPackets atomic.Int64 // Packets read from the captures, skipped ones included
+	readBytes   atomic.Int64 // Their captured bytes
+	writeRows   atomic.Int64 // Rows handed to writers
+	writeBytes  atomic.Int64 // Their bytes and feature values
+	writeTime   atomic.Int64 // Nanoseconds spent in writers
+}
+
+// NewThroughput starts counting at the current time.
+func NewThroughput() *Throughput {
+	return &Throughput{start: time.Now()}
+}
+
+// read counts packets read by the parsing stage. A nil Throughput counts nothing.
+func (t *Throughput) read(packets int, bytes int64) {
+	if t == nil {
+		return
+	}
+	t.readPackets.Add(int64(packets))
+	t.readBytes.Add(bytes)
+}
+
+// write runs write, which writes rows, and counts the rows and its duration.
+func (t *Throughput) write(rows []PacketResult, write func() error) error {
+	if t == nil {
+		return write()
+	}
+	started := time.Now()
+	err := write()
+	t.writeTime.Add(int64(time.Since(started)))
+
+	bytes := 0
+	for _, row := range rows {
+		bytes += len(row.Data) + 8*len(row.Features)
+	}
+	t.writeRows.Add(int64(len(rows)))
+	t.writeBytes.Add(int64(bytes))
+	return err
+}
+
+// rates returns the packets/s and MB/s of both stages as log attributes, with
+// parsing timed over parseTime. Write rates are left out until rows are written.
+func (t *Throughput) rates(parseTime time.Duration) []any {
+	if t == nil {
+		return nil
+	}
+	attrs := []any{
+		"parse_pps", int64(perSecond(float64(t.readPackets.Load()), parseTime)),
+		"parse_mb_s", roundRate(perSecond(float64(t.readBytes.Load())/(1024*1024), parseTime)),
+	}
+	writeTime := time.Duration(t.writeTime.Load())
+	if writeTime == 0 {
+		return attrs
+	}
+	return append(attrs,
+		"write_pps", int64(perSecond(float64(t.writeRows.Load()), writeTime)),
+		"write_mb_s", roundRate(perSecond(float64(t.writeBytes.Load())/(1024*1024), writeTime)))
+}
+
+// progress returns the rates since the start of the run.
+func (t *Throughput) progress() []any {
+	if t == nil {
+		return nil
+	}
+	return t.rates(time.Since(t.start))
+}
+
+// perSecond divides n by d in seconds, or returns 0 for an empty duration.
+func perSecond(n float64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return n / d.Seconds()
+}
+
+// roundRate rounds a rate to one decimal for logs.
+func roundRate(rate float64) float64 {
+	return math.Round(rate*10) / 10
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// timingFeatureNames are the feature columns added by --timing, in row order.
+// All values are in seconds. Flow statistics cover the flow up to and including
+// the current packet, so they never use information from later packets.
+var timingFeatureNames = []string{
+	"delta_time",    // Time since the previous packet in the file
+	"flow_iat",      // Time since the previous packet of the same flow
+	"flow_iat_mean", // Running mean of the flow's inter-arrival times
+	"flow_iat_std",  // Running standard deviation of the flow's inter-arrival times
+	"flow_iat_min",  // Smallest inter-arrival time seen in the flow so far
+	"flow_iat_max",  // Largest inter-arrival time seen in the flow so far
+}
+
+// flowTiming accumulates inter-arrival statistics for one flow (Welford's algorithm).
+type flowTiming struct {
+	generation int // Flow of the key the statistics belong to (--flow-timeout)
+	last       time.Time
+	count      int // Number of inter-arrival times observed
+	mean       float64
+	m2         float64
+	min        float64
+	max        float64
+}
+
+// timingTracker computes timing features for the packets of one capture file.
+// Packets must be fed in capture order.
+type timingTracker struct {
+	last       time.Time
+	flows      map[FlowKey]*flowTiming
+	shift      time.Duration // Added to timestamps before they are truncated
+	resolution time.Duration // Timestamps are truncated to this granularity (0 = exact)
+}
+
+func newTimingTracker(shift, resolution time.Duration) *timingTracker {
+	return &timingTracker{
+		flows:      make(map[FlowKey]*flowTiming),
+		shift:      shift,
+		resolution: resolution,
+	}
+}
+
+// features returns the timing feature values for the next packet of the file,
+// given its flow key (hasKey is false without a network layer) and the flow
+// generation of that key. The first packet of the file and of each flow gets
+// zero inter-arrival values.
+func (t *timingTracker) features(packet gopacket.Packet, key FlowKey, hasKey bool, generation int) []float64 {
+	ts := packet.Metadata().Timestamp.Add(t.shift).Truncate(t.resolution)
+	values := make([]float64, len(timingFeatureNames))
+
+	if !t.last.IsZero() {
+		values[0] = ts.Sub(t.last).Seconds()
+	}
+	t.last = ts
+
+	if !hasKey {
+		return values
+	}
+
+	flow, exists := t.flows[key]
+	if !exists || flow.generation != generation {
+		t.flows[key] = &flowTiming{generation: generation, last: ts}
+		return values
+	}
+
+	iat := ts.Sub(flow.last).Seconds()
+	flow.last = ts
+
+	flow.count++
+	delta := iat - flow.mean
+	flow.mean += delta / float64(flow.count)
+	flow.m2 += delta * (iat - flow.mean)
+	if flow.count == 1 || iat < flow.min {
+		flow.min = iat
+	}
+	if flow.count == 1 || iat > flow.max {
+		flow.max = iat
+	}
+
+	values[1] = iat
+	values[2] = flow.mean
+	values[3] = math.Sqrt(flow.m2 / float64(flow.count))
+	values[4] = flow.min
+	values[5] = flow.max
+	return values
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ethernetFCSLen is the length of the Ethernet frame check sequence, a CRC-32
+// that some capture setups (NIC offload off, taps, some switches) keep at the
+// end of every frame.
+const ethernetFCSLen = 4
+
+// frameEnd returns where the content of a frame ends in its packet data
+// (--strip-trailer): after its outermost IP packet, as long as the IP header
+// says, so Ethernet padding and an FCS after it are left out. A frame without
+// IP ends before its last 4 bytes if they are the frame's FCS.
+func frameEnd(packet gopacket.Packet) int {
+	data := packet.Data()
+	for _, layer := range packet.Layers() {
+		if layer.LayerType() != layers.LayerTypeIPv4 && layer.LayerType() != layers.LayerTypeIPv6 {
+			continue
+		}
+		// The decoder bounds the IP payload by the length fields
+		if offset := layerOffset(packet, layer.LayerContents()); offset >= 0 {
+			return min(offset+len(layer.LayerContents())+len(layer.LayerPayload()), len(data))
+		}
+		return len(data)
+	}
+	if hasFCS(data) {
+		return len(data) - ethernetFCSLen
+	}
+	return len(data)
+}
+
+// hasFCS reports whether a frame ends with its Ethernet FCS: the CRC-32 of
+// the bytes before it, least significant byte first.
+func hasFCS(frame []byte) bool {
+	n := len(frame) - ethernetFCSLen
+	if n < ethernetHeaderLen {
+		return false
+	}
+	return crc32.ChecksumIEEE(frame[:n]) == binary.LittleEndian.Uint32(frame[n:])
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// decapsulate replaces a tunnelled packet by the packet it carries, as
+// --gtp-decap and --ip-decap select: GTP-U first, then up to IPDecap outer
+// IP headers of IP-in-IP and 6in4 tunnels, also inside GTP-U. It reports
+// whether the packet was replaced.
+func (o ProcessOptions) decapsulate(packet gopacket.Packet) (gopacket.Packet, bool) {
+	decapsulated := false
+	if o.GTPDecap {
+		var ok bool
+		packet, ok = decapsulateGTP(packet)
+		decapsulated = ok
+	}
+	if o.IPDecap > 0 {
+		var ok bool
+		packet, ok = decapsulateIP(packet, o.IPDecap)
+		decapsulated = decapsulated || ok
+	}
+	return packet, decapsulated
+}
+
+// decapsulateIP removes up to depth outer IP headers of IP-in-IP (protocol 4)
+// and 6in4 (protocol 41) tunnels, over IPv4 or IPv6, and returns the packet
+// below them as an Ethernet frame of its own. Packets whose outermost IP
+// header carries no IP packet are returned unchanged.
+func decapsulateIP(packet gopacket.Packet, depth int) (gopacket.Packet, bool) {
+	// The IP headers of the packet, outermost first, as long as each one
+	// carries the next
+	var stack []gopacket.Layer
+scan:
+	for _, layer := range packet.Layers() {
+		switch layer.LayerType() {
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			stack = append(stack, layer)
+		case layers.LayerTypeIPv6HopByHop, layers.LayerTypeIPv6Destination, layers.LayerTypeIPv6Routing, layers.LayerTypeIPv6Fragment:
+			// Extension headers of the last IPv6 header
+		case layers.LayerTypeEthernet, layers.LayerTypeLinuxSLL, layers.LayerTypeDot1Q, layers.LayerTypePPPoE, layers.LayerTypePPP:
+			if len(stack) > 0 {
+				break scan
+			}
+		default:
+			break scan
+		}
+	}
+	if len(stack) < 2 {
+		return packet, false
+	}
+
+	// The inner packet ends with its IP payload, before any Ethernet padding
+	inner := stack[min(depth, len(stack)-1)]
+	offset := layerOffset(packet, inner.LayerContents())
+	if offset < 0 {
+		return packet, false
+	}
+	end := min(offset+len(inner.LayerContents())+len(inner.LayerPayload()), len(packet.Data()))
+	return innerFrame(packet, packet.Data()[offset:end])
+}
+
+// innerFrame returns the IP packet inner, carried by a tunnelled packet, as
+// a frame of its own. Ethernet frames become the outer MAC addresses, the
+// EtherType of inner, then inner; packets of Linux cooked and raw IP captures
+// become the raw IP packet inner. The outer VLAN tags, PPPoE and tunnel
+// headers are removed; the capture time is kept, and the capture and wire
+// lengths shrink by the removed bytes. It returns the packet unchanged if
+// inner is not IPv4 or IPv6.
+func innerFrame(packet gopacket.Packet, inner []byte) (gopacket.Packet, bool) {
+	if len(inner) == 0 {
+		return packet, false
+	}
+	var etherType layers.EthernetType
+	var first gopacket.LayerType
+	switch inner[0] >> 4 {
+	case 4:
+		etherType, first = layers.EthernetTypeIPv4, layers.LayerTypeIPv4
+	case 6:
+		etherType, first = layers.EthernetTypeIPv6, layers.LayerTypeIPv6
+	default:
+		return packet, false
+	}
+
+	var frame []byte
+	if eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok && len(eth.Contents) >= ethernetHeaderLen {
+		frame = make([]byte, ethernetHeaderLen+len(inner))
+		copy(frame, eth.Contents[:12])
+		binary.BigEndian.PutUint16(frame[12:ethernetHeaderLen], uint16(etherType))
+		copy(frame[ethernetHeaderLen:], inner)
+		first = layers.LayerTypeEthernet
+	} else {
+		frame = append([]byte(nil), inner...)
+	}
+
+	decapsulated := gopacket.NewPacket(frame, first, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	metadata := decapsulated.Metadata()
+	*metadata = *packet.Metadata()
+	removed := len(packet.Data()) - len(frame)
+	metadata.CaptureLength = len(frame)
+	metadata.Length = max(metadata.Length-removed, len(frame))
+	return decapsulated, true
+}
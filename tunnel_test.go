@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// gtpFrame returns an Ethernet frame carrying a UDP/IPv4 subscriber packet in
+// a GTP-U tunnel.
+func gtpFrame(t *testing.T) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	outer := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{192, 0, 2, 1}, DstIP: net.IP{192, 0, 2, 2}}
+	tunnel := &layers.UDP{SrcPort: 2152, DstPort: 2152}
+	gtp := &layers.GTPv1U{Version: 1, ProtocolType: 1, MessageType: gtpMessageTPDU, TEID: 7}
+	inner := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 40001}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, outer, tunnel, gtp, inner, udp, gopacket.Payload{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// TestGTPDecapOfRawIP checks that --gtp-decap unwraps GTP-U in raw IP
+// captures, which have no Ethernet header to rebuild, as in Ethernet ones.
+func TestGTPDecapOfRawIP(t *testing.T) {
+	frame := gtpFrame(t)
+	raw := gopacket.NewPacket(frame.Data()[ethernetHeaderLen:], layers.LayerTypeIPv4, gopacket.Default)
+	for name, packet := range map[string]gopacket.Packet{"ethernet": frame, "raw": raw} {
+		decapsulated, ok := decapsulateGTP(packet)
+		if !ok {
+			t.Errorf("%s packet was not decapsulated", name)
+			continue
+		}
+		ip, ok := decapsulated.NetworkLayer().(*layers.IPv4)
+		if !ok || !ip.SrcIP.Equal(net.IP{10, 0, 0, 1}) {
+			t.Errorf("%s packet decapsulated to %v, want the subscriber packet", name, decapsulated.NetworkLayer())
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Throughput history of the status page: a sample every webSampleInterval,
+// at most webHistory of them. When the history is full, neighbouring samples
+// are merged and the interval doubles, so a run of any length fits.
+const (
+	webSampleInterval = 5 * time.Second
+	webHistory        = 720
+	webLogs           = 50 // Warnings and errors kept for the page
+)
+
+// Run states reported by the status page.
+const (
+	WebRunning     = "running"
+	WebCompleted   = "completed"
+	WebInterrupted = "interrupted"
+	WebFailed      = "failed"
+)
+
+// WebStatus serves the --web status page of a run: its inputs and their
+// progress, warnings and errors, and the throughput history, for runs on
+// remote servers nobody watches in a terminal. A nil WebStatus serves nothing.
+type WebStatus struct {
+	progress   *Progress
+	throughput *Throughput
+	errors     *ErrorHandler
+	output     string
+
+	mutex       sync.Mutex
+	state       string
+	history     []webSample
+	interval    time.Duration // Time covered by each sample
+	lastPackets int64
+	lastBytes   int64
+	lastSample  time.Time
+	logs        []webLog // Last warnings and errors, oldest first
+	stop        chan struct{}
+	stopped     chan struct{}
+}
+
+// webSample is the throughput of the readers over one interval.
+type webSample struct {
+	Elapsed       float64 `json:"t"` // Seconds from the start of the run to the end of the interval
+	PacketsPerSec float64 `json:"pps"`
+	MBPerSec      float64 `json:"mb_s"`
+}
+
+// webLog is a warning or error logged during the run.
+type webLog struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	Attrs   string    `json:"attrs,omitempty"`
+}
+
+// webStatus is the JSON document of /status.json the page is drawn from.
+type webStatus struct {
+	State          string         `json:"state"`
+	Output         string         `json:"output,omitempty"`
+	Elapsed        float64        `json:"elapsed_s"`
+	Files          int            `json:"files"`
+	FilesDone      int64          `json:"files_done"`
+	Packets        int64          `json:"packets"`
+	Rows           int64          `json:"rows"`
+	SkippedFiles   int            `json:"skipped_files"`
+	SkippedPackets int            `json:"skipped_packets"`
+	HeapMB         uint64         `json:"heap_mb"`
+	SysMB          uint64         `json:"sys_mb"`
+	Reading        []ProgressFile `json:"reading"`
+	Finished       []ProgressFile `json:"finished"`
+	Throughput     []webSample    `json:"throughput"`
+	Logs           []webLog       `json:"logs"`
+}
+
+// NewWebStatus starts serving the status page of a run on addr, e.g. :8080.
+// Warnings and errors of the default logger are kept for the page from here on.
+func NewWebStatus(addr string, progress *Progress, throughput *Throughput, errors *ErrorHandler, output string) (*WebStatus, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	w := &WebStatus{
+		progress:   progress,
+		throughput: throughput,
+		errors:     errors,
+		output:     output,
+		state:      WebRunning,
+		interval:   webSampleInterval,
+		lastSample: progress.start,
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", w.servePage)
+	mux.HandleFunc("GET /status.json", w.serveStatus)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	slog.SetDefault(slog.New(&webLogHandler{handler: slog.Default().Handler(), web: w}))
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Warn("status page stopped", "error", err)
+		}
+	}()
+	go w.run()
+	slog.Info("serving status page", "url", "http://"+webURLHost(listener.Addr()))
+	return w, nil
+}
+
+// webURLHost returns the host:port to browse for a listener address, naming
+// localhost for listeners on all interfaces.
+func webURLHost(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || !tcp.IP.IsUnspecified() {
+		return addr.String()
+	}
+	return fmt.Sprintf("localhost:%d", tcp.Port)
+}
+
+// run samples the throughput until Finish.
+func (w *WebStatus) run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(webSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mutex.Lock()
+			w.sample(false)
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// sample adds the throughput since the last sample to the history once a
+// sample interval has passed, or always if final. The caller holds the mutex.
+func (w *WebStatus) sample(final bool) {
+	now := time.Now()
+	elapsed := now.Sub(w.lastSample)
+	if elapsed < w.interval && !final {
+		return
+	}
+	packets, bytes := w.progress.packets.Load(), w.progress.bytes.Load()
+	w.history = append(w.history, webSample{
+		Elapsed:       roundRate(now.Sub(w.progress.start).Seconds()),
+		PacketsPerSec: roundRate(perSecond(float64(packets-w.lastPackets), elapsed)),
+		MBPerSec:      roundRate(perSecond(float64(bytes-w.lastBytes)/(1024*1024), elapsed)),
+	})
+	w.lastPackets, w.lastBytes, w.lastSample = packets, bytes, now
+
+	if len(w.history) < webHistory {
+		return
+	}
+	merged := w.history[:0]
+	for i := 0; i+1 < len(w.history); i += 2 {
+		a, b := w.history[i], w.history[i+1]
+		merged = append(merged, webSample{
+			Elapsed:       b.Elapsed,
+			PacketsPerSec: roundRate((a.PacketsPerSec + b.PacketsPerSec) / 2),
+			MBPerSec:      roundRate((a.MBPerSec + b.MBPerSec) / 2),
+		})
+	}
+	w.history = merged
+	w.interval *= 2
+}
+
+// Finish stops sampling and records the final state of the run. The page is
+// served until the process exits, so it shows how the run ended.
+func (w *WebStatus) Finish(state string) {
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.stopped
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.state = state
+	w.sample(true)
+}
+
+// status returns the current status of the run.
+func (w *WebStatus) status() webStatus {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	status := webStatus{
+		Output:    w.output,
+		Elapsed:   roundRate(time.Since(w.progress.start).Seconds()),
+		Files:     w.progress.files,
+		FilesDone: w.progress.done.Load(),
+		Packets:   w.progress.packets.Load(),
+		Rows:      w.throughput.writeRows.Load(),
+		HeapMB:    stats.HeapAlloc >> 20,
+		SysMB:     stats.Sys >> 20,
+		Reading:   w.progress.reading(),
+		Finished:  w.progress.recent(),
+	}
+	if w.errors != nil {
+		status.SkippedFiles, status.SkippedPackets = w.errors.skipped()
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	status.State = w.state
+	status.Throughput = append([]webSample(nil), w.history...)
+	status.Logs = append([]webLog(nil), w.logs...)
+	return status
+}
+
+func (w *WebStatus) serveStatus(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(rw).Encode(w.status()); err != nil {
+		slog.Debug("failed to send status", "error", err)
+	}
+}
+
+func (w *WebStatus) servePage(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(rw, webPage)
+}
+
+// webLogHandler keeps the warnings and errors of the run for the status page.
+type webLogHandler struct {
+	handler slog.Handler
+	web     *WebStatus
+	attrs   []slog.Attr // Attributes of WithAttrs, shown with each record
+}
+
+func (h *webLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *webLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelWarn {
+		var attrs []string
+		for _, attr := range h.attrs {
+			attrs = append(attrs, attr.String())
+		}
+		record.Attrs(func(attr slog.Attr) bool {
+			attrs = append(attrs, attr.String())
+			return true
+		})
+		w := h.web
+		w.mutex.Lock()
+		w.logs = append(w.logs, webLog{
+			Time:    record.Time,
+			Level:   record.Level.String(),
+			Message: record.Message,
+			Attrs:   strings.Join(attrs, " "),
+		})
+		if len(w.logs) > webLogs {
+			w.logs = w.logs[len(w.logs)-webLogs:]
+		}
+		w.mutex.Unlock()
+	}
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *webLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &webLogHandler{handler: h.handler.WithAttrs(attrs), web: h.web, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+func (h *webLogHandler) WithGroup(name string) slog.Handler {
+	return &webLogHandler{handler: h.handler.WithGroup(name), web: h.web, attrs: h.attrs}
+}
+
+// webPage is the status page. It polls /status.json and redraws itself, so
+// it needs nothing but a browser.
+const webPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GoByte</title>
+<style>
+body { font: 14px sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; }
+td, th { padding: 2px 12px 2px 0; text-align: left; }
+.num { text-align: right; font-variant-numeric: tabular-nums; }
+.bar { width: 200px; height: 10px; background: #eee; }
+.bar div { height: 100%; background: #4a7; }
+.state { font-weight: bold; }
+.WARN { color: #a60; }
+.ERROR { color: #c00; }
+svg { background: #f7f7f7; }
+</style>
+</head>
+<body>
+<h1>GoByte <span class="state" id="state"></span></h1>
+<table id="summary"></table>
+<h2>Throughput (packets/s)</h2>
+<svg id="chart" width="720" height="120"></svg>
+<h2>Reading</h2>
+<table id="reading"></table>
+<h2>Recently finished</h2>
+<table id="finished"></table>
+<h2>Warnings and errors</h2>
+<table id="logs"></table>
+<script>
+const esc = s => String(s).replace(/[&<>"]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c]));
+const num = n => Math.round(n).toLocaleString();
+const dur = s => { s = Math.round(s); return (s >= 3600 ? Math.floor(s / 3600) + "h" : "") + (s >= 60 ? Math.floor(s % 3600 / 60) + "m" : "") + s % 60 + "s"; };
+function rows(id, head, lines) {
+  document.getElementById(id).innerHTML = "<tr>" + head.map(h => "<th>" + h + "</th>").join("") + "</tr>" + lines.join("");
+}
+function draw(s) {
+  document.getElementById("state").textContent = s.state;
+  document.getElementById("summary").innerHTML = [
+    ["Output", esc(s.output || "-")],
+    ["Elapsed", dur(s.elapsed_s)],
+    ["Files", num(s.files_done) + " / " + num(s.files)],
+    ["Packets read", num(s.packets)],
+    ["Rows written", num(s.rows)],
+    ["Skipped", num(s.skipped_files) + " files, " + num(s.skipped_packets) + " packets"],
+    ["Memory", s.heap_mb + " MB heap, " + s.sys_mb + " MB from OS"],
+  ].map(([k, v]) => "<tr><th>" + k + "</th><td>" + v + "</td></tr>").join("");
+
+  const chart = document.getElementById("chart"), t = s.throughput;
+  const peak = Math.max(1, ...t.map(p => p.pps)), end = Math.max(1, ...t.map(p => p.t));
+  const points = t.map(p => (p.t / end * 716 + 2).toFixed(1) + "," + (118 - p.pps / peak * 110).toFixed(1)).join(" ");
+  chart.innerHTML = '<polyline fill="none" stroke="#4a7" stroke-width="2" points="' + points + '"/>' +
+    '<text x="4" y="14" font-size="11">' + num(peak) + ' pkt/s</text>';
+
+  rows("reading", ["", "File", "Class", "Packets", "Progress", "Time"], s.reading.map(f =>
+    "<tr><td>" + f.slot + "</td><td>" + esc(f.name) + "</td><td>" + esc(f.class || "") + "</td><td class=num>" + num(f.packets) +
+    "</td><td><div class=bar><div style='width:" + Math.round((f.share || 0) * 100) + "%'></div></div></td><td>" + dur(f.duration_s) + "</td></tr>"));
+  rows("finished", ["File", "Class", "Packets", "Time"], s.finished.map(f =>
+    "<tr><td>" + esc(f.name) + "</td><td>" + esc(f.class || "") + "</td><td class=num>" + num(f.packets) + "</td><td>" + dur(f.duration_s) + "</td></tr>"));
+  rows("logs", ["Time", "Level", "Message"], s.logs.slice().reverse().map(l =>
+    "<tr class=" + l.level + "><td>" + new Date(l.time).toLocaleTimeString() + "</td><td>" + l.level + "</td><td>" + esc(l.message) + " " + esc(l.attrs || "") + "</td></tr>"));
+}
+async function poll() {
+  try {
+    const response = await fetch("status.json", {cache: "no-store"});
+    const s = await response.json();
+    draw(s);
+    if (s.state !== "running") return;
+  } catch (e) {
+    document.getElementById("state").textContent = "(not reachable: the run has ended or the server is down)";
+  }
+  setTimeout(poll, 2000);
+}
+poll();
+</script>
+</body>
+</html>
+`
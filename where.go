@@ -0,0 +1,629 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// WhereFilter is a compiled --where expression such as
+// 'ip.ttl < 10 && tcp.dport == 443'. It is safe for concurrent use by workers.
+//
+// Expressions combine comparisons of header fields with a number, or of
+// address fields with an address or CIDR prefix (== and != only), using !, &&,
+// || and parentheses. A field alone is true when the packet has it and it is
+// not zero, e.g. tcp or tcp.flags.syn. Fields read the innermost header of
+// their protocol, so tunneled (GRE, IP-in-IP, VXLAN) packets are matched on the
+// encapsulated packet. A comparison with a field the packet lacks is false,
+// with != too. Port and address fields that cover both ends (tcp.port, ip.addr)
+// match if either end does; with != neither end may be equal.
+type WhereFilter struct {
+	expr whereNode
+}
+
+// parseWhere compiles a --where expression. An empty expression returns nil
+// (no filtering).
+func parseWhere(expr string) (*WhereFilter, error) {
+	tokens, err := whereTokens(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &whereParser{tokens: tokens}
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return &WhereFilter{expr: node}, nil
+}
+
+// keep reports whether the packet matches the expression.
+func (f *WhereFilter) keep(packet gopacket.Packet) bool {
+	c := newWhereContext(packet)
+	return f.expr.eval(&c)
+}
+
+// whereContext holds the innermost headers of a packet.
+type whereContext struct {
+	packet gopacket.Packet
+	eth    *layers.Ethernet
+	vlan   *layers.Dot1Q
+	ipv4   *layers.IPv4
+	ipv6   *layers.IPv6 // Only one of ipv4 and ipv6 is set
+	tcp    *layers.TCP
+	udp    *layers.UDP // Only one of tcp and udp is set
+	icmp4  *layers.ICMPv4
+	icmp6  *layers.ICMPv6
+}
+
+func newWhereContext(packet gopacket.Packet) whereContext {
+	c := whereContext{packet: packet}
+	for _, layer := range packet.Layers() {
+		switch l := layer.(type) {
+		case *layers.Ethernet:
+			c.eth = l
+		case *layers.Dot1Q:
+			c.vlan = l
+		case *layers.IPv4:
+			c.ipv4, c.ipv6 = l, nil
+			c.tcp, c.udp, c.icmp4, c.icmp6 = nil, nil, nil, nil
+		case *layers.IPv6:
+			c.ipv4, c.ipv6 = nil, l
+			c.tcp, c.udp, c.icmp4, c.icmp6 = nil, nil, nil, nil
+		case *layers.TCP:
+			c.tcp, c.udp = l, nil
+		case *layers.UDP:
+			c.tcp, c.udp = nil, l
+		case *layers.ICMPv4:
+			c.icmp4 = l
+		case *layers.ICMPv6:
+			c.icmp6 = l
+		}
+	}
+	return c
+}
+
+// whereValues are the values of a field in a packet: none if the packet lacks
+// it, two for fields covering both ends.
+type whereValues struct {
+	n       int
+	numbers [2]int64
+	addrs   [2]netip.Addr
+}
+
+func whereNumber(v int64) whereValues {
+	return whereValues{n: 1, numbers: [2]int64{v}}
+}
+
+func wherePair(a, b int64) whereValues {
+	return whereValues{n: 2, numbers: [2]int64{a, b}}
+}
+
+func whereBool(b bool) whereValues {
+	if b {
+		return whereNumber(1)
+	}
+	return whereNumber(0)
+}
+
+func whereAddrs(raw ...[]byte) whereValues {
+	v := whereValues{n: len(raw)}
+	for i, b := range raw {
+		addr, _ := netip.AddrFromSlice(b)
+		v.addrs[i] = addr.Unmap()
+	}
+	return v
+}
+
+// whereField is a header field usable in --where.
+type whereField struct {
+	address bool // Compared with addresses and prefixes instead of numbers
+	values  func(c *whereContext) whereValues
+}
+
+// whereTCPFlag returns the field of one TCP flag.
+func whereTCPFlag(flag func(*layers.TCP) bool) whereField {
+	return whereField{values: func(c *whereContext) whereValues {
+		if c.tcp == nil {
+			return whereValues{}
+		}
+		return whereBool(flag(c.tcp))
+	}}
+}
+
+// whereFields are the fields of --where.
+var whereFields = map[string]whereField{
+	"frame.len":    {values: func(c *whereContext) whereValues { return whereNumber(int64(c.packet.Metadata().Length)) }},
+	"frame.caplen": {values: func(c *whereContext) whereValues { return whereNumber(int64(c.packet.Metadata().CaptureLength)) }},
+
+	"eth": {values: func(c *whereContext) whereValues { return whereBool(c.eth != nil) }},
+	"eth.type": {values: func(c *whereContext) whereValues {
+		if c.eth == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.eth.EthernetType))
+	}},
+	"vlan": {values: func(c *whereContext) whereValues { return whereBool(c.vlan != nil) }},
+	"vlan.id": {values: func(c *whereContext) whereValues {
+		if c.vlan == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.vlan.VLANIdentifier))
+	}},
+
+	"ip": {values: func(c *whereContext) whereValues { return whereBool(c.ipv4 != nil || c.ipv6 != nil) }},
+	"ip.version": {values: func(c *whereContext) whereValues {
+		switch {
+		case c.ipv4 != nil:
+			return whereNumber(4)
+		case c.ipv6 != nil:
+			return whereNumber(6)
+		}
+		return whereValues{}
+	}},
+	"ip.ttl": {values: func(c *whereContext) whereValues {
+		switch {
+		case c.ipv4 != nil:
+			return whereNumber(int64(c.ipv4.TTL))
+		case c.ipv6 != nil:
+			return whereNumber(int64(c.ipv6.HopLimit))
+		}
+		return whereValues{}
+	}},
+	"ip.proto": {values: func(c *whereContext) whereValues {
+		switch {
+		case c.ipv4 != nil:
+			return whereNumber(int64(c.ipv4.Protocol))
+		case c.ipv6 != nil:
+			return whereNumber(int64(c.ipv6.NextHeader))
+		}
+		return whereValues{}
+	}},
+	"ip.len": {values: func(c *whereContext) whereValues {
+		switch {
+		case c.ipv4 != nil:
+			return whereNumber(int64(c.ipv4.Length))
+		case c.ipv6 != nil:
+			return whereNumber(int64(c.ipv6.Length) + 40)
+		}
+		return whereValues{}
+	}},
+	"ip.tos": {values: func(c *whereContext) whereValues {
+		switch {
+		case c.ipv4 != nil:
+			return whereNumber(int64(c.ipv4.TOS))
+		case c.ipv6 != nil:
+			return whereNumber(int64(c.ipv6.TrafficClass))
+		}
+		return whereValues{}
+	}},
+	"ip.id": {values: func(c *whereContext) whereValues {
+		if c.ipv4 == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.ipv4.Id))
+	}},
+	"ip.df": {values: func(c *whereContext) whereValues {
+		if c.ipv4 == nil {
+			return whereValues{}
+		}
+		return whereBool(c.ipv4.Flags&layers.IPv4DontFragment != 0)
+	}},
+	"ip.mf": {values: func(c *whereContext) whereValues {
+		if c.ipv4 == nil {
+			return whereValues{}
+		}
+		return whereBool(c.ipv4.Flags&layers.IPv4MoreFragments != 0)
+	}},
+	"ip.frag": {values: func(c *whereContext) whereValues {
+		if c.ipv4 == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.ipv4.FragOffset))
+	}},
+	"ip.flow": {values: func(c *whereContext) whereValues {
+		if c.ipv6 == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.ipv6.FlowLabel))
+	}},
+	"ip.src": {address: true, values: func(c *whereContext) whereValues {
+		switch {
+		case c.ipv4 != nil:
+			return whereAddrs(c.ipv4.SrcIP)
+		case c.ipv6 != nil:
+			return whereAddrs(c.ipv6.SrcIP)
+		}
+		return whereValues{}
+	}},
+	"ip.dst": {address: true, values: func(c *whereContext) whereValues {
+		switch {
+		case c.ipv4 != nil:
+			return whereAddrs(c.ipv4.DstIP)
+		case c.ipv6 != nil:
+			return whereAddrs(c.ipv6.DstIP)
+		}
+		return whereValues{}
+	}},
+	"ip.addr": {address: true, values: func(c *whereContext) whereValues {
+		switch {
+		case c.ipv4 != nil:
+			return whereAddrs(c.ipv4.SrcIP, c.ipv4.DstIP)
+		case c.ipv6 != nil:
+			return whereAddrs(c.ipv6.SrcIP, c.ipv6.DstIP)
+		}
+		return whereValues{}
+	}},
+
+	"tcp": {values: func(c *whereContext) whereValues { return whereBool(c.tcp != nil) }},
+	"tcp.sport": {values: func(c *whereContext) whereValues {
+		if c.tcp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.tcp.SrcPort))
+	}},
+	"tcp.dport": {values: func(c *whereContext) whereValues {
+		if c.tcp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.tcp.DstPort))
+	}},
+	"tcp.port": {values: func(c *whereContext) whereValues {
+		if c.tcp == nil {
+			return whereValues{}
+		}
+		return wherePair(int64(c.tcp.SrcPort), int64(c.tcp.DstPort))
+	}},
+	"tcp.seq": {values: func(c *whereContext) whereValues {
+		if c.tcp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.tcp.Seq))
+	}},
+	"tcp.ack": {values: func(c *whereContext) whereValues {
+		if c.tcp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.tcp.Ack))
+	}},
+	"tcp.win": {values: func(c *whereContext) whereValues {
+		if c.tcp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.tcp.Window))
+	}},
+	"tcp.len": {values: func(c *whereContext) whereValues {
+		if c.tcp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(len(c.tcp.Payload)))
+	}},
+	"tcp.flags": {values: func(c *whereContext) whereValues {
+		if c.tcp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.tcp.Contents[13]))
+	}},
+	"tcp.flags.fin": whereTCPFlag(func(t *layers.TCP) bool { return t.FIN }),
+	"tcp.flags.syn": whereTCPFlag(func(t *layers.TCP) bool { return t.SYN }),
+	"tcp.flags.rst": whereTCPFlag(func(t *layers.TCP) bool { return t.RST }),
+	"tcp.flags.psh": whereTCPFlag(func(t *layers.TCP) bool { return t.PSH }),
+	"tcp.flags.ack": whereTCPFlag(func(t *layers.TCP) bool { return t.ACK }),
+	"tcp.flags.urg": whereTCPFlag(func(t *layers.TCP) bool { return t.URG }),
+	"tcp.flags.ece": whereTCPFlag(func(t *layers.TCP) bool { return t.ECE }),
+	"tcp.flags.cwr": whereTCPFlag(func(t *layers.TCP) bool { return t.CWR }),
+
+	"udp": {values: func(c *whereContext) whereValues { return whereBool(c.udp != nil) }},
+	"udp.sport": {values: func(c *whereContext) whereValues {
+		if c.udp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.udp.SrcPort))
+	}},
+	"udp.dport": {values: func(c *whereContext) whereValues {
+		if c.udp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(c.udp.DstPort))
+	}},
+	"udp.port": {values: func(c *whereContext) whereValues {
+		if c.udp == nil {
+			return whereValues{}
+		}
+		return wherePair(int64(c.udp.SrcPort), int64(c.udp.DstPort))
+	}},
+	"udp.len": {values: func(c *whereContext) whereValues {
+		if c.udp == nil {
+			return whereValues{}
+		}
+		return whereNumber(int64(len(c.udp.Payload)))
+	}},
+
+	"icmp": {values: func(c *whereContext) whereValues { return whereBool(c.icmp4 != nil || c.icmp6 != nil) }},
+	"icmp.type": {values: func(c *whereContext) whereValues {
+		switch {
+		case c.icmp4 != nil:
+			return whereNumber(int64(c.icmp4.TypeCode.Type()))
+		case c.icmp6 != nil:
+			return whereNumber(int64(c.icmp6.TypeCode.Type()))
+		}
+		return whereValues{}
+	}},
+	"icmp.code": {values: func(c *whereContext) whereValues {
+		switch {
+		case c.icmp4 != nil:
+			return whereNumber(int64(c.icmp4.TypeCode.Code()))
+		case c.icmp6 != nil:
+			return whereNumber(int64(c.icmp6.TypeCode.Code()))
+		}
+		return whereValues{}
+	}},
+}
+
+// whereFieldNames lists the fields for error messages.
+func whereFieldNames() string {
+	names := make([]string, 0, len(whereFields))
+	for name := range whereFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// whereNode is a compiled part of an expression.
+type whereNode interface {
+	eval(c *whereContext) bool
+}
+
+type whereAnd struct{ left, right whereNode }
+
+func (n whereAnd) eval(c *whereContext) bool { return n.left.eval(c) && n.right.eval(c) }
+
+type whereOr struct{ left, right whereNode }
+
+func (n whereOr) eval(c *whereContext) bool { return n.left.eval(c) || n.right.eval(c) }
+
+type whereNot struct{ node whereNode }
+
+func (n whereNot) eval(c *whereContext) bool { return !n.node.eval(c) }
+
+// whereTest is a field on its own: present and not zero.
+type whereTest struct{ field whereField }
+
+func (n whereTest) eval(c *whereContext) bool {
+	v := n.field.values(c)
+	for i := range v.n {
+		if n.field.address || v.numbers[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// whereCompare compares a field with a number.
+type whereCompare struct {
+	field whereField
+	op    string
+	value int64
+}
+
+func (n whereCompare) eval(c *whereContext) bool {
+	v := n.field.values(c)
+	if n.op == "!=" {
+		for i := range v.n {
+			if v.numbers[i] == n.value {
+				return false
+			}
+		}
+		return v.n > 0
+	}
+	for i := range v.n {
+		x := v.numbers[i]
+		switch {
+		case n.op == "==" && x == n.value,
+			n.op == "<" && x < n.value,
+			n.op == "<=" && x <= n.value,
+			n.op == ">" && x > n.value,
+			n.op == ">=" && x >= n.value:
+			return true
+		}
+	}
+	return false
+}
+
+// whereMatch compares an address field with a prefix (a single address is a
+// full-length prefix).
+type whereMatch struct {
+	field  whereField
+	equal  bool
+	prefix netip.Prefix
+}
+
+func (n whereMatch) eval(c *whereContext) bool {
+	v := n.field.values(c)
+	for i := range v.n {
+		if n.prefix.Contains(v.addrs[i]) {
+			return n.equal
+		}
+	}
+	return v.n > 0 && !n.equal
+}
+
+// whereOperators are the operator tokens, longest first.
+var whereOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"}
+
+// whereTokens splits an expression into operators and words (field names,
+// numbers and addresses).
+func whereTokens(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		if expr[i] == ' ' || expr[i] == '\t' {
+			i++
+			continue
+		}
+		operator := ""
+		for _, op := range whereOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				operator = op
+				break
+			}
+		}
+		if operator != "" {
+			tokens = append(tokens, operator)
+			i += len(operator)
+			continue
+		}
+		j := i
+		for j < len(expr) && isWhereWordByte(expr[j]) {
+			j++
+		}
+		if j == i {
+			return nil, fmt.Errorf("unexpected %q at position %d", expr[i], i+1)
+		}
+		tokens = append(tokens, expr[i:j])
+		i = j
+	}
+	return tokens, nil
+}
+
+func isWhereWordByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' ||
+		b == '.' || b == '_' || b == ':' || b == '/'
+}
+
+// whereParser parses tokens by precedence: || binds loosest, then &&, then !.
+type whereParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *whereParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *whereParser) or() (whereNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = whereOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *whereParser) and() (whereNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = whereAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *whereParser) unary() (whereNode, error) {
+	switch token := p.peek(); token {
+	case "!":
+		p.pos++
+		node, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return whereNot{node}, nil
+	case "(":
+		p.pos++
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) after %q", strings.Join(p.tokens[:p.pos], " "))
+		}
+		p.pos++
+		return node, nil
+	case "":
+		return nil, fmt.Errorf("expression ends early")
+	}
+	return p.comparison()
+}
+
+func (p *whereParser) comparison() (whereNode, error) {
+	name := p.peek()
+	field, ok := whereFields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q (use %s)", name, whereFieldNames())
+	}
+	p.pos++
+
+	op := p.peek()
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return whereTest{field}, nil
+	}
+	p.pos++
+	value := p.peek()
+	if value == "" || slices.Contains(whereOperators, value) {
+		return nil, fmt.Errorf("%s %s needs a value", name, op)
+	}
+	p.pos++
+
+	if field.address {
+		if op != "==" && op != "!=" {
+			return nil, fmt.Errorf("%s can only be compared with == or !=", name)
+		}
+		prefix, err := parseWherePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s %s: %w", name, op, value, err)
+		}
+		return whereMatch{field: field, equal: op == "==", prefix: prefix}, nil
+	}
+	number, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s %s: not a number", name, op, value)
+	}
+	return whereCompare{field: field, op: op, value: number}, nil
+}
+
+// parseWherePrefix parses an address or CIDR prefix.
+func parseWherePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// whereTestPackets returns a TCP SYN over IPv4 and a UDP datagram over IPv6,
+// both as Ethernet frames.
+func whereTestPackets(t *testing.T) (tcp, udp gopacket.Packet) {
+	t.Helper()
+	build := func(layerType layers.EthernetType, l ...gopacket.SerializableLayer) gopacket.Packet {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layerType}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, append([]gopacket.SerializableLayer{eth}, l...)...); err != nil {
+			t.Fatal(err)
+		}
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	}
+
+	ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 5, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 1, 2, 3}, DstIP: net.IP{192, 168, 0, 10}}
+	tcpLayer := &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true, Window: 64240}
+	tcpLayer.SetNetworkLayerForChecksum(ip4)
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8:1::53")}
+	udpLayer := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udpLayer.SetNetworkLayerForChecksum(ip6)
+	return build(layers.EthernetTypeIPv4, ip4, tcpLayer, gopacket.Payload("x")),
+		build(layers.EthernetTypeIPv6, ip6, udpLayer, gopacket.Payload("query"))
+}
+
+func TestWhereFilter(t *testing.T) {
+	tcp, udp := whereTestPackets(t)
+	tests := []struct {
+		expr     string
+		tcp, udp bool
+	}{
+		// Fields alone and missing fields
+		{"tcp", true, false},
+		{"udp", false, true},
+		{"tcp.flags.syn", true, false},
+		{"tcp.flags.ack", false, false},
+		{"tcp.dport == 443", true, false},
+		{"tcp.dport != 443", false, false}, // A packet without the field never compares true
+		{"!tcp.dport == 443", false, true},
+
+		// Numbers, ranges and both-ends fields
+		{"ip.ttl < 10", true, false},
+		{"ip.ttl >= 64", false, true},
+		{"tcp.dport >= 400 && tcp.dport <= 500", true, false},
+		{"udp.port == 53", false, true},
+		{"udp.port == 5353", false, true},
+		{"udp.port != 53", false, false}, // Neither end may be equal
+		{"ip.proto == 0x11", false, true},
+		{"tcp.win > 64239 && tcp.win < 64241", true, false},
+
+		// Addresses and CIDR prefixes
+		{"ip.src == 10.1.2.3", true, false},
+		{"ip.src == 10.0.0.0/8", true, false},
+		{"ip.dst == 10.0.0.0/8", false, false},
+		{"ip.addr == 192.168.0.0/16", true, false},
+		{"ip.addr != 192.168.0.0/16", false, true},
+		{"ip.dst == 2001:db8:1::/48", false, true},
+		{"ip.src == ::ffff:10.1.2.3", true, false}, // IPv4-mapped addresses match IPv4
+
+		// Precedence: ! binds tightest, then &&, then ||
+		{"udp || tcp && ip.ttl > 10", false, true},
+		{"(udp || tcp) && ip.ttl > 10", false, true},
+		{"udp || tcp && ip.ttl < 10", true, true},
+		{"!udp && ip", true, false},
+		{"!(udp && ip)", true, false},
+		{"!!tcp", true, false},
+		{"tcp && udp || ip.version == 6", false, true},
+		{"tcp && (udp || ip.version == 6)", false, false},
+	}
+	for _, tt := range tests {
+		filter, err := parseWhere(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := filter.keep(tcp); got != tt.tcp {
+			t.Errorf("%q on TCP/IPv4 = %v, want %v", tt.expr, got, tt.tcp)
+		}
+		if got := filter.keep(udp); got != tt.udp {
+			t.Errorf("%q on UDP/IPv6 = %v, want %v", tt.expr, got, tt.udp)
+		}
+	}
+}
+
+func TestParseWhereErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp.dprt == 443",                   // Unknown field
+		"tcp.dport ==",                      // Missing value
+		"tcp.dport == &&",                   // Operator as value
+		"tcp.dport == http",                 // Not a number
+		"ip.src < 10.0.0.1",                 // Addresses take == and != only
+		"ip.src == 10.0.0.0/33",             // Prefix too long
+		"ip.src == 10.0.0",                  // Not an address
+		"(tcp && udp",                       // Unbalanced parentheses
+		"tcp && udp)",                       // Trailing token
+		"tcp &&",                            // Ends early
+		"tcp & udp",                         // Unknown operator
+		"tcp.dport == 443 || !",             // Ends after !
+		"tcp.dport == 443 tcp",              // Two expressions
+		"tcp.dport = 443",                   // Assignment is not an operator
+		"tcp.dport == 99999999999999999999", // Overflow
+	} {
+		if _, err := parseWhere(expr); err == nil {
+			t.Errorf("%q: no error", expr)
+		}
+	}
+	if filter, err := parseWhere("  "); filter != nil || err != nil {
+		t.Errorf("blank expression = %v, %v, want no filter", filter, err)
+	}
+}
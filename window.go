@@ -0,0 +1,74 @@
+package main
+
+import "slices"
+
+// Windowing splits row bytes into overlapping fixed-size windows (--window/--stride),
+// each emitted as its own row.
+type Windowing struct {
+	Size   int // Window length in bytes (0 = off)
+	Stride int // Offset between window starts
+}
+
+// split appends one row per window of p's bytes to rows. Windows start every
+// Stride bytes until one reaches the end of the data; the last window and
+// rows shorter than Size are padded. Window bytes are taken from arena.
+func (w Windowing) split(rows []PacketResult, p PacketResult, pad Padding, arena *byteArena) []PacketResult {
+	data := p.Data
+	for start := 0; ; start += w.Stride {
+		end := min(start+w.Size, len(data))
+		row := p
+		row.Data = truncatePadInto(arena.alloc(w.Size), data[start:end], TruncateHead, pad)
+		rows = append(rows, row)
+		if end == len(data) {
+			return rows
+		}
+	}
+}
+
+// Scopes of --packet-window-by: what the packets of a window are consecutive in.
+const (
+	PacketWindowByFlow = "flow" // Packets of one bidirectional flow (default)
+	PacketWindowByFile = "file" // Packets of the capture, whatever their flow
+)
+
+// PacketWindowing concatenates consecutive packets into one row
+// (--packet-window/--packet-stride), each packet truncated or padded to
+// PacketLength bytes, for models that read a short packet sequence.
+type PacketWindowing struct {
+	Size         int    // Packets per row (0 = off)
+	Stride       int    // Packets between window starts
+	PacketLength int    // Bytes of each packet in the row (--length)
+	By           string // PacketWindowByFlow or PacketWindowByFile
+}
+
+// byFile reports whether windows span the whole capture rather than a flow.
+func (w PacketWindowing) byFile() bool {
+	return w.Size > 0 && w.By == PacketWindowByFile
+}
+
+// rows appends one row per window of packets, given in capture order, to
+// rows. Windows start every Stride packets until one reaches the last packet;
+// a window of fewer than Size packets, at the end or of a short flow, is
+// padded. A row takes its columns from its first packet.
+func (w PacketWindowing) rows(rows []PacketResult, packets []PacketResult, from string, pad Padding) []PacketResult {
+	for start := 0; start < len(packets); start += w.Stride {
+		end := min(start+w.Size, len(packets))
+		window := packets[start:end]
+		data := make([]byte, w.Size*w.PacketLength)
+		size := 0
+		for i, p := range window {
+			truncatePadInto(data[i*w.PacketLength:(i+1)*w.PacketLength], p.Data, from, pad)
+			size += len(p.Data)
+		}
+		pad.fill(data, len(window)*w.PacketLength) // Packets missing from a short window
+		row := window[0]
+		row.Data = data
+		row.OriginalSize = size
+		row.DecodeFailed = slices.ContainsFunc(window, func(p PacketResult) bool { return p.DecodeFailed })
+		rows = append(rows, row)
+		if end == len(packets) {
+			break
+		}
+	}
+	return rows
+}
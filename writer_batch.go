@@ -1,52 +1,67 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
 	"encoding/binary"
 	"encoding/csv"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"reflect"
-	"strconv"
-	"strings"
-
-	"github.com/parquet-go/parquet-go"
 )
 
 // writeCSVOptimized writes packets to CSV with optimizations.
 // Packets are expected to be already standardized by the parser.
 // For variable-length packets (outputLength==0), all packets are padded to max size for consistent columns.
-func writeCSVOptimized(filename string, packets []PacketResult, outputLength int) error {
+// featureNames lists optional feature columns placed between the bytes and the class,
+// followed by the source columns of wopts.Columns.
+func writeCSVOptimized(filename string, packets []PacketResult, outputLength int, featureNames []string, pad Padding, wopts WriterOptions) error {
 	if len(packets) == 0 {
 		return fmt.Errorf("no packets to write")
 	}
 
-	file, err := os.Create(filename)
+	file, err := createCSVOutput(filename, wopts)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
-	defer file.Close()
 
 	// Use buffered writer for better I/O performance.
 	bufWriter := bufio.NewWriterSize(file, 1024*1024) // 1MB buffer
-	defer bufWriter.Flush()
-
 	writer := csv.NewWriter(bufWriter)
-	defer writer.Flush()
+	if err := writeCSVRows(writer, packets, outputLength, featureNames, pad, wopts); err != nil {
+		file.abort()
+		return err
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.abort()
+		return fmt.Errorf("csv flush error: %w", err)
+	}
+	if err := bufWriter.Flush(); err != nil {
+		file.abort()
+		return fmt.Errorf("buffer flush error: %w", err)
+	}
+	return file.Close()
+}
+
+// writeCSVRows writes the header and rows of writeCSVOptimized.
+func writeCSVRows(writer *csv.Writer, packets []PacketResult, outputLength int, featureNames []string, pad Padding, wopts WriterOptions) error {
 
 	// Determine if we have class labels.
 	hasClassLabels := packets[0].Class != ""
 
 	// For variable-length packets (outputLength==0), pad all to max size for consistent CSV columns.
 	if outputLength == 0 {
-		packets = padToMaxSize(packets)
+		packets = padToMaxSize(packets, pad)
 	}
 
 	// Determine packet size (all packets should now be same size).
 	packetSize := len(packets[0].Data)
 
-	// Write header - Format: Byte_0, Byte_1, ..., Byte_N, Class (if present).
-	headerSize := packetSize
+	// Write header - Format: Byte_0, Byte_1, ..., Byte_N, features..., Class (if present).
+	headerSize := packetSize + len(featureNames) + len(wopts.Columns)
 	if hasClassLabels {
 		headerSize++
 	}
@@ -55,8 +70,10 @@ func writeCSVOptimized(filename string, packets []PacketResult, outputLength int
 	for i := 0; i < packetSize; i++ {
 		header[i] = fmt.Sprintf("Byte_%d", i)
 	}
+	copy(header[packetSize:], featureNames)
+	copy(header[packetSize+len(featureNames):], wopts.Columns)
 	if hasClassLabels {
-		header[packetSize] = "Class"
+		header[headerSize-1] = "Class"
 	}
 
 	if err := writer.Write(header); err != nil {
@@ -64,8 +81,9 @@ func writeCSVOptimized(filename string, packets []PacketResult, outputLength int
 	}
 
 	// Write data rows.
+	byteStrings := csvByteTable(wopts.ByteRepr)
 	for _, p := range packets {
-		rowSize := len(p.Data)
+		rowSize := len(p.Data) + len(featureNames) + len(wopts.Columns)
 		if hasClassLabels {
 			rowSize++
 		}
@@ -73,12 +91,22 @@ func writeCSVOptimized(filename string, packets []PacketResult, outputLength int
 
 		// Convert bytes to strings.
 		for i, b := range p.Data {
-			row[i] = strconv.Itoa(int(b))
+			row[i] = byteStrings[b]
+		}
+
+		// Add feature values.
+		for i := range featureNames {
+			row[len(p.Data)+i] = formatFeature(p.Features, i)
+		}
+
+		// Add source columns.
+		for i, column := range wopts.Columns {
+			row[len(p.Data)+len(featureNames)+i] = metadataValue(p, column)
 		}
 
 		// Add class label if present.
 		if hasClassLabels {
-			row[len(p.Data)] = p.Class
+			row[rowSize-1] = p.Class
 		}
 
 		if err := writer.Write(row); err != nil {
@@ -92,62 +120,131 @@ func writeCSVOptimized(filename string, packets []PacketResult, outputLength int
 // writeNumpy writes packets to NumPy format (batch mode, in-memory).
 // Creates separate files for data and labels (if hasClass).
 // Packets are expected to be already standardized by the parser.
-func writeNumpy(filename string, packets []PacketResult, outputLength int) error {
+// If featureNames is non-empty, also writes <basename>_features.npy (float64) and <basename>_features.json.
+// With wopts.NPZ the arrays go into one deflate-compressed <base>.npz instead.
+func writeNumpy(filename string, packets []PacketResult, outputLength int, featureNames []string, classIDs map[string]byte, pad Padding, wopts WriterOptions) error {
 	if len(packets) == 0 {
 		return fmt.Errorf("no packets to write")
 	}
 
 	// Remove extension and get base filename.
-	baseFilename := strings.TrimSuffix(filename, ".npy")
-	baseFilename = strings.TrimSuffix(baseFilename, ".npz")
-
-	// Determine if we have class labels.
-	hasClassLabels := packets[0].Class != ""
+	baseFilename := numpyBaseName(filename)
 
 	// For variable-length packets (outputLength==0), pad all to max size for consistent array shape.
 	if outputLength == 0 {
-		packets = padToMaxSize(packets)
+		packets = padToMaxSize(packets, pad)
 	}
 
+	// The files are written under partial names and renamed once all are done
+	var partial partialFiles
+	var npzFile *os.File
+	var archive *zip.Writer
+	if wopts.NPZ {
+		file, err := partial.create(baseFilename + ".npz")
+		if err != nil {
+			return err
+		}
+		npzFile = file
+		archive = zip.NewWriter(file)
+	}
+	err := writeNumpyArrays(&partial, archive, baseFilename, packets, featureNames, classIDs, wopts)
+	if archive != nil {
+		if err == nil {
+			err = archive.Close()
+		}
+		if closeErr := npzFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return partial.finish(err)
+}
+
+// writeNumpyArrays writes the arrays of writeNumpy, as files or archive entries.
+func writeNumpyArrays(partial *partialFiles, archive *zip.Writer, baseFilename string, packets []PacketResult, featureNames []string, classIDs map[string]byte, wopts WriterOptions) error {
+	// Determine if we have class labels.
+	hasClassLabels := packets[0].Class != ""
+
 	// Determine packet size (all packets should now be same size).
 	packetSize := len(packets[0].Data)
 	numPackets := len(packets)
 
-	// Write data array.
-	dataFilename := baseFilename + "_data.npy"
-	if err := writeNumpyArray2D(dataFilename, packets, packetSize, numPackets); err != nil {
-		return fmt.Errorf("error writing data array: %w", err)
+	// Write data array (none when --scale turned the bytes into feature columns).
+	if packetSize > 0 {
+		err := writeNumpyArray(partial, archive, baseFilename, "data", func(w *bufio.Writer) error {
+			return writeNumpyArray2D(w, packets, packetSize, numPackets, wopts.numpyData(), wopts.numpyFortran())
+		})
+		if err != nil {
+			return fmt.Errorf("error writing data array: %w", err)
+		}
 	}
 
 	// Write labels array if present.
 	if hasClassLabels {
-		labelsFilename := baseFilename + "_labels.npy"
 		classesFilename := baseFilename + "_classes.json"
-		if err := writeNumpyLabels(labelsFilename, classesFilename, packets); err != nil {
+		err := writeNumpyArray(partial, archive, baseFilename, "labels", func(w *bufio.Writer) error {
+			return writeNumpyLabels(w, classesFilename, packets, classIDs)
+		})
+		if err != nil {
 			return fmt.Errorf("error writing labels array: %w", err)
 		}
 	}
 
+	// Write features array if present.
+	if len(featureNames) > 0 {
+		err := writeNumpyArray(partial, archive, baseFilename, "features", func(w *bufio.Writer) error {
+			return writeNumpyFeatures(w, packets, len(featureNames), wopts.numpyFortran())
+		})
+		if err != nil {
+			return fmt.Errorf("error writing features array: %w", err)
+		}
+		if err := writeFeatureNamesFile(baseFilename+"_features.json", featureNames); err != nil {
+			return fmt.Errorf("error writing feature names: %w", err)
+		}
+	}
 	return nil
 }
 
-// writeNumpyArray2D writes a 2D uint8 array in NumPy .npy format.
-func writeNumpyArray2D(filename string, packets []PacketResult, cols, rows int) error {
-	file, err := os.Create(filename)
+// writeNumpyArray writes one array as <base>_<name>.npy, created under its
+// partial name, or as the <name>.npy entry of archive (so
+// np.load(...)["<name>"] returns it).
+func writeNumpyArray(partial *partialFiles, archive *zip.Writer, baseFilename, name string, write func(w *bufio.Writer) error) error {
+	if archive != nil {
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: zip.Deflate})
+		if err != nil {
+			return err
+		}
+		return writeBuffered(entry, write)
+	}
+
+	file, err := partial.create(baseFilename + "_" + name + ".npy")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	err = writeBuffered(file, write)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-	bufWriter := bufio.NewWriterSize(file, 4*1024*1024)
-	defer bufWriter.Flush()
+// writeBuffered runs write on a buffer over out and flushes it.
+func writeBuffered(out io.Writer, write func(w *bufio.Writer) error) error {
+	bufWriter := bufio.NewWriterSize(out, 4*1024*1024)
+	if err := write(bufWriter); err != nil {
+		return err
+	}
+	return bufWriter.Flush()
+}
 
+// writeNumpyArray2D writes the packet bytes as a 2D array of dataType in NumPy .npy format,
+// column by column if fortran is set.
+func writeNumpyArray2D(bufWriter *bufio.Writer, packets []PacketResult, cols, rows int, dataType numpyDataType, fortran bool) error {
 	if err := writeNumpyMagic(bufWriter); err != nil {
 		return err
 	}
 
 	// Create header.
-	headerStr := createNumpyHeader(int64(rows), cols)
+	headerStr := createNumpyHeaderOrder(dataType.descr, int64(rows), cols, fortran)
 
 	// Write header length (uint16 for v1.0).
 	headerLen := uint16(len(headerStr))
@@ -160,9 +257,29 @@ func writeNumpyArray2D(filename string, packets []PacketResult, cols, rows int)
 		return err
 	}
 
-	// Write all packet data as raw bytes.
+	// Fortran order: the j-th byte of every packet, for each column j
+	var row []byte
+	if fortran {
+		for j := range cols {
+			row = row[:0]
+			for _, p := range packets {
+				row = dataType.appendRow(row, p.Data[j:j+1])
+			}
+			if _, err := bufWriter.Write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Write all packet data as raw bytes (or converted elements).
 	for _, p := range packets {
-		if _, err := bufWriter.Write(p.Data); err != nil {
+		data := p.Data
+		if dataType.descr != numpyDescrUint8 {
+			row = dataType.appendRow(row[:0], p.Data)
+			data = row
+		}
+		if _, err := bufWriter.Write(data); err != nil {
 			return err
 		}
 	}
@@ -170,11 +287,65 @@ func writeNumpyArray2D(filename string, packets []PacketResult, cols, rows int)
 	return nil
 }
 
-// writeNumpyLabels writes a 1D uint8 array for class labels.
-func writeNumpyLabels(labelsFilename, classesFilename string, packets []PacketResult) error {
+// writeNumpyFeatures writes a 2D float64 array of per-packet features, column
+// by column if fortran is set.
+func writeNumpyFeatures(bufWriter *bufio.Writer, packets []PacketResult, cols int, fortran bool) error {
+	if err := writeNumpyMagic(bufWriter); err != nil {
+		return err
+	}
+
+	// Create header.
+	headerStr := createNumpyHeaderOrder(numpyDescrFloat64, int64(len(packets)), cols, fortran)
+
+	// Write header length (uint16 for v1.0).
+	headerLen := uint16(len(headerStr))
+	if err := binary.Write(bufWriter, binary.LittleEndian, headerLen); err != nil {
+		return err
+	}
+
+	// Write header.
+	if _, err := bufWriter.Write([]byte(headerStr)); err != nil {
+		return err
+	}
+
+	// Write features row by row.
+	if fortran {
+		column := make([]byte, 0, len(packets)*8)
+		for j := range cols {
+			column = column[:0]
+			for _, p := range packets {
+				column = appendFeatureRow(column, p.Features[min(j, len(p.Features)):], 1)
+			}
+			if _, err := bufWriter.Write(column); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	row := make([]byte, 0, cols*8)
+	for _, p := range packets {
+		row = appendFeatureRow(row[:0], p.Features, cols)
+		if _, err := bufWriter.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeNumpyLabels writes a 1D uint8 array for class labels. Classes missing
+// from classIDs are numbered after them in order of appearance.
+func writeNumpyLabels(bufWriter *bufio.Writer, classesFilename string, packets []PacketResult, classIDs map[string]byte) error {
 	// Build class name to ID mapping.
 	classToInt := make(map[string]byte)
 	nextClassID := byte(0)
+	for class, id := range classIDs {
+		classToInt[class] = id
+		if id >= nextClassID {
+			nextClassID = id + 1
+		}
+	}
 
 	// First pass: collect unique classes.
 	for _, p := range packets {
@@ -186,16 +357,6 @@ func writeNumpyLabels(labelsFilename, classesFilename string, packets []PacketRe
 		}
 	}
 
-	// Create labels file.
-	file, err := os.Create(labelsFilename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	bufWriter := bufio.NewWriterSize(file, 1*1024*1024)
-	defer bufWriter.Flush()
-
 	if err := writeNumpyMagic(bufWriter); err != nil {
 		return err
 	}
@@ -225,98 +386,36 @@ func writeNumpyLabels(labelsFilename, classesFilename string, packets []PacketRe
 	// Write class mapping file.
 	if err := writeClassMappingFile(classesFilename, classToInt); err != nil {
 		// Non-fatal, just warn.
-		fmt.Printf("Warning: failed to write class mapping: %v\n", err)
+		slog.Warn("failed to write class mapping", "error", err)
 	}
 
 	return nil
 }
 
-// writeParquet writes packets to Parquet format with the same schema as CSV.
-// Packets are expected to be already standardized by the parser.
-// For variable-length packets (outputLength==0), all packets are padded to max size for consistent schema.
-func writeParquet(filename string, packets []PacketResult, outputLength int) error {
+// writeParquet writes packets to Parquet with the streaming writer, so a run
+// has the same schema with or without --streaming. Packets are expected to be
+// already standardized by the parser. In the wide layout, variable-length
+// packets (outputLength==0) are padded to the longest for a fixed set of
+// byte columns.
+func writeParquet(filename string, packets []PacketResult, outputLength int, featureNames []string, classIDs map[string]byte, pad Padding, wopts WriterOptions) error {
 	if len(packets) == 0 {
 		return fmt.Errorf("no packets to write")
 	}
-
-	// Determine if we have class labels.
-	hasClassLabels := packets[0].Class != ""
-
-	// For variable-length packets (outputLength==0), pad all to max size for consistent schema.
-	if outputLength == 0 {
-		packets = padToMaxSize(packets)
-	}
-
-	// Determine packet size (all packets should now be same size).
-	packetSize := len(packets[0].Data)
-
-	// Build dynamic struct type with byte columns and optional class column.
-	fields := make([]reflect.StructField, 0, packetSize+1)
-
-	// Add byte columns.
-	for i := 0; i < packetSize; i++ {
-		fields = append(fields, reflect.StructField{
-			Name: fmt.Sprintf("Byte_%d", i),
-			Type: reflect.TypeOf(int32(0)),
-			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"Byte_%d"`, i)),
-		})
-	}
-
-	// Add class column if present.
-	if hasClassLabels {
-		fields = append(fields, reflect.StructField{
-			Name: "Class",
-			Type: reflect.TypeOf(""),
-			Tag:  `parquet:"Class"`,
-		})
-	}
-
-	// Create the dynamic struct type.
-	structType := reflect.StructOf(fields)
-
-	// Convert packets to dynamic structs.
-	rowValues := make([]interface{}, len(packets))
-	for idx, p := range packets {
-		rowPtr := reflect.New(structType)
-		row := rowPtr.Elem()
-
-		// Set byte values (packets are already padded to consistent size).
-		for i := 0; i < packetSize; i++ {
-			if i < len(p.Data) {
-				row.Field(i).SetInt(int64(p.Data[i]))
-			} else {
-				row.Field(i).SetInt(0) // Safety padding
-			}
-		}
-
-		// Set class value if present.
-		if hasClassLabels {
-			row.Field(packetSize).SetString(p.Class)
-		}
-
-		rowValues[idx] = rowPtr.Interface()
+	if outputLength == 0 && wopts.ParquetLayout == ParquetLayoutWide {
+		packets = padToMaxSize(packets, pad)
 	}
 
-	// Create output file.
-	file, err := os.Create(filename)
+	writer, err := NewParquetStreamWriter(filename, len(packets[0].Data), packets[0].Class != "", featureNames, wopts)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return err
 	}
-	defer file.Close()
-
-	// Get schema from dynamic struct.
-	schema := parquet.SchemaOf(rowValues[0])
-
-	// Create writer using reflection to handle dynamic type.
-	writer := parquet.NewWriter(file, schema, parquet.Compression(&parquet.Zstd))
-	defer writer.Close()
-
-	// Write rows using reflection.
-	for _, rowPtr := range rowValues {
-		if err := writer.Write(rowPtr); err != nil {
-			return fmt.Errorf("error writing row: %w", err)
+	writer.setClassIDs(classIDs)
+	// Batches of a streaming run, so row groups are flushed at the same sizes
+	for start := 0; start < len(packets); start += packetBatchSize {
+		if err := writer.WriteBatch(packets[start:min(start+packetBatchSize, len(packets))]); err != nil {
+			writer.Close()
+			return fmt.Errorf("error writing rows: %w", err)
 		}
 	}
-
-	return nil
+	return writer.Close()
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// testPackets returns fixed-length rows of two classes with one feature.
+func testPackets(length int) []PacketResult {
+	packets := make([]PacketResult, 6)
+	for i := range packets {
+		data := make([]byte, length)
+		for j := range data {
+			data[j] = byte(i*length + j)
+		}
+		class := "web"
+		if i%2 == 1 {
+			class = "dns"
+		}
+		packets[i] = PacketResult{Data: data, Class: class, Features: []float64{float64(i) / 2}}
+	}
+	return packets
+}
+
+// readParquetFile returns the schema and the rows of a Parquet file.
+func readParquetFile(t *testing.T, filename string) (string, []parquet.Row) {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := parquet.NewReader(pf)
+	defer reader.Close()
+	rows := make([]parquet.Row, pf.NumRows())
+	n, err := reader.ReadRows(rows)
+	if err != nil && n != len(rows) {
+		t.Fatal(err)
+	}
+	return pf.Schema().String(), rows[:n]
+}
+
+// TestParquetLayoutsMatchAcrossModes checks that in-memory runs (writeParquet)
+// and streaming runs (ParquetStreamWriter) write the same schema and rows in
+// every layout, so loading code does not depend on --streaming.
+func TestParquetLayoutsMatchAcrossModes(t *testing.T) {
+	const length = 16
+	features := []string{"feature"}
+	classIDs := map[string]byte{"dns": 0, "web": 1}
+	for _, layout := range []string{ParquetLayoutBinary, ParquetLayoutWide, ParquetLayoutHF} {
+		t.Run(layout, func(t *testing.T) {
+			dir := t.TempDir()
+			wopts := WriterOptions{ParquetLayout: layout}
+			packets := testPackets(length)
+
+			batch := filepath.Join(dir, "batch.parquet")
+			if err := writeParquet(batch, packets, length, features, classIDs, Padding{Mode: PadZero}, wopts); err != nil {
+				t.Fatal(err)
+			}
+
+			streaming := filepath.Join(dir, "streaming.parquet")
+			writer, err := NewParquetStreamWriter(streaming, length, true, features, wopts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer.setClassIDs(classIDs)
+			if err := writer.WriteBatch(packets); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			batchSchema, batchRows := readParquetFile(t, batch)
+			streamingSchema, streamingRows := readParquetFile(t, streaming)
+			if batchSchema != streamingSchema {
+				t.Fatalf("schemas differ:\nin-memory: %s\nstreaming: %s", batchSchema, streamingSchema)
+			}
+			if len(batchRows) != len(packets) || len(streamingRows) != len(packets) {
+				t.Fatalf("got %d in-memory and %d streaming rows, want %d", len(batchRows), len(streamingRows), len(packets))
+			}
+			for i := range batchRows {
+				if !batchRows[i].Equal(streamingRows[i]) {
+					t.Fatalf("row %d differs:\nin-memory: %v\nstreaming: %v", i, batchRows[i], streamingRows[i])
+				}
+			}
+		})
+	}
+}
+
+// TestWideParquetPadsVariableLength checks that in-memory wide outputs of
+// variable-length rows get a byte column for every byte of the longest row.
+func TestWideParquetPadsVariableLength(t *testing.T) {
+	packets := testPackets(8)
+	packets[2].Data = append(packets[2].Data, 1, 2, 3, 4)
+	filename := filepath.Join(t.TempDir(), "wide.parquet")
+	if err := writeParquet(filename, packets, 0, nil, nil, Padding{Mode: PadZero}, WriterOptions{ParquetLayout: ParquetLayoutWide}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, rows := readParquetFile(t, filename)
+	for i, row := range rows {
+		// 12 byte columns and the class
+		if len(row) != 13 {
+			t.Fatalf("row %d has %d columns, want 13", i, len(row))
+		}
+	}
+	if got := rows[0][11].Int32(); got != 0 {
+		t.Errorf("padding of row 0 is %d, want 0", got)
+	}
+	if got := rows[2][11].Int32(); got != 4 {
+		t.Errorf("last byte of row 2 is %d, want 4", got)
+	}
+}
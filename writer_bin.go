@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// binSidecar is the <basename>.json file describing a --format bin output, so
+// it can be loaded with np.memmap or torch.from_file without parsing headers.
+type binSidecar struct {
+	Rows     int64             `json:"rows"`
+	Cols     int               `json:"cols"`
+	Dtype    string            `json:"dtype"`
+	Data     string            `json:"data,omitempty"` // File names relative to the sidecar
+	Labels   string            `json:"labels,omitempty"`
+	Classes  map[string]string `json:"classes,omitempty"` // Label ID to class name
+	Features *binFeatures      `json:"features,omitempty"`
+}
+
+// binFeatures describes the float64 feature array of a --format bin output.
+type binFeatures struct {
+	File  string   `json:"file"`
+	Cols  int      `json:"cols"`
+	Dtype string   `json:"dtype"`
+	Names []string `json:"names"`
+}
+
+// binBaseName strips the .bin extension from an output name.
+// Bin outputs are written as <base>.bin, <base>_labels.bin, <base>_features.bin and <base>.json.
+func binBaseName(filename string) string {
+	return strings.TrimSuffix(filename, ".bin")
+}
+
+// BinStreamWriter writes rows as flat, headerless arrays: a row-major uint8
+// rows x cols data file, uint8 label IDs and little-endian float64 features.
+// The shapes and dtypes go to a JSON sidecar written on Close.
+type BinStreamWriter struct {
+	dataFile     *os.File      // Main data file (nil without byte columns)
+	dataBuf      *bufio.Writer // Buffer for data
+	labelsFile   *os.File      // Separate file for labels (if hasClass)
+	labelsBuf    *bufio.Writer // Buffer for labels
+	featuresFile *os.File      // Separate float64 file for feature columns (if any)
+	featuresBuf  *bufio.Writer // Buffer for features
+	featureNames []string
+	featureRow   []byte // Reusable encoding buffer for one feature row
+	cols         int
+	hasClass     bool
+	rowCount     int64
+	flushCounter int
+	mutex        sync.Mutex
+	classToInt   map[string]byte // Map class names to integers
+	nextClassID  byte            // Next available class ID
+	baseFilename string          // Base filename without extension
+	partial      partialFiles    // The .bin files, renamed on Close
+}
+
+// NewBinStreamWriter creates a streaming raw binary writer. Every row must have
+// exactly cols bytes; with cols 0 (--scale, BPE tokens) there is no data file.
+func NewBinStreamWriter(filename string, cols int, hasClass bool, featureNames []string) (*BinStreamWriter, error) {
+	w := &BinStreamWriter{
+		cols:         cols,
+		hasClass:     hasClass,
+		featureNames: featureNames,
+		classToInt:   make(map[string]byte),
+		baseFilename: binBaseName(filename),
+	}
+
+	if cols > 0 {
+		file, err := w.partial.create(w.baseFilename + ".bin")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create data file: %w", err)
+		}
+		w.dataFile = file
+		w.dataBuf = bufio.NewWriterSize(file, 4*1024*1024) // 4MB buffer
+	}
+
+	if hasClass {
+		file, err := w.partial.create(w.baseFilename + "_labels.bin")
+		if err != nil {
+			w.closeFiles()
+			return nil, fmt.Errorf("failed to create labels file: %w", err)
+		}
+		w.labelsFile = file
+		w.labelsBuf = bufio.NewWriterSize(file, 1*1024*1024) // 1MB buffer
+	}
+
+	if len(featureNames) > 0 {
+		file, err := w.partial.create(w.baseFilename + "_features.bin")
+		if err != nil {
+			w.closeFiles()
+			return nil, fmt.Errorf("failed to create features file: %w", err)
+		}
+		w.featuresFile = file
+		w.featuresBuf = bufio.NewWriterSize(file, 1*1024*1024) // 1MB buffer
+	}
+
+	return w, nil
+}
+
+// closeFiles closes and removes every file opened so far.
+func (w *BinStreamWriter) closeFiles() {
+	for _, file := range []*os.File{w.dataFile, w.labelsFile, w.featuresFile} {
+		if file != nil {
+			file.Close()
+		}
+	}
+	w.partial.discard()
+}
+
+func (w *BinStreamWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch writes several rows under one lock.
+func (w *BinStreamWriter) WriteBatch(packets []PacketResult) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, p := range packets {
+		if err := w.writeRow(p); err != nil {
+			return err
+		}
+	}
+	w.flushCounter += len(packets)
+
+	if w.flushCounter >= 50000 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		w.flushCounter = 0
+
+		// Force garbage collection to free memory.
+		runtime.GC()
+		debug.FreeOSMemory()
+	}
+
+	return nil
+}
+
+// writeRow appends one row to the data, labels and features files. The caller holds the mutex.
+func (w *BinStreamWriter) writeRow(p PacketResult) error {
+	if w.dataBuf != nil {
+		// Without a header the shape is only right if every row has the same width
+		if len(p.Data) != w.cols {
+			return fmt.Errorf("row of %d bytes in a %d-column bin output", len(p.Data), w.cols)
+		}
+		if _, err := w.dataBuf.Write(p.Data); err != nil {
+			return fmt.Errorf("error writing data: %w", err)
+		}
+	}
+
+	if w.hasClass {
+		classID, exists := w.classToInt[p.Class]
+		if !exists {
+			classID = w.nextClassID
+			w.classToInt[p.Class] = classID
+			w.nextClassID++
+		}
+		if err := w.labelsBuf.WriteByte(classID); err != nil {
+			return fmt.Errorf("error writing label: %w", err)
+		}
+	}
+
+	if w.featuresBuf != nil {
+		w.featureRow = appendFeatureRow(w.featureRow[:0], p.Features, len(w.featureNames))
+		if _, err := w.featuresBuf.Write(w.featureRow); err != nil {
+			return fmt.Errorf("error writing features: %w", err)
+		}
+	}
+
+	w.rowCount++
+	return nil
+}
+
+// flush writes out the buffers of all files.
+func (w *BinStreamWriter) flush() error {
+	for _, buf := range []*bufio.Writer{w.dataBuf, w.labelsBuf, w.featuresBuf} {
+		if buf != nil {
+			if err := buf.Flush(); err != nil {
+				return fmt.Errorf("flush error: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close flushes the arrays and writes the sidecar with the final row count.
+// The arrays get their final names only if all of them were written.
+func (w *BinStreamWriter) Close() error {
+	err := w.flush()
+	for _, file := range []*os.File{w.dataFile, w.labelsFile, w.featuresFile} {
+		if file != nil {
+			if closeErr := file.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err := w.partial.finish(err); err != nil {
+		return err
+	}
+	return w.writeSidecar()
+}
+
+// writeSidecar writes <basename>.json with the shape and dtype of every array.
+func (w *BinStreamWriter) writeSidecar() error {
+	var classToInt map[string]byte
+	if w.hasClass {
+		classToInt = w.classToInt
+	}
+	return writeBinSidecar(w.baseFilename, w.rowCount, w.cols, w.dataFile != nil, classToInt, w.featureNames)
+}
+
+// writeBinSidecar writes the <base>.json sidecar of a bin output with rows
+// rows: a data file if hasData, labels if classToInt is not nil and features
+// if there are feature names.
+func writeBinSidecar(baseFilename string, rows int64, cols int, hasData bool, classToInt map[string]byte, featureNames []string) error {
+	sidecar := binSidecar{Rows: rows, Cols: cols, Dtype: "uint8"}
+	if hasData {
+		sidecar.Data = filepath.Base(baseFilename) + ".bin"
+	}
+	if classToInt != nil {
+		sidecar.Labels = filepath.Base(baseFilename) + "_labels.bin"
+		sidecar.Classes = make(map[string]string, len(classToInt))
+		for class, id := range classToInt {
+			sidecar.Classes[strconv.Itoa(int(id))] = class
+		}
+	}
+	if len(featureNames) > 0 {
+		sidecar.Features = &binFeatures{
+			File:  filepath.Base(baseFilename) + "_features.bin",
+			Cols:  len(featureNames),
+			Dtype: "float64",
+			Names: featureNames,
+		}
+	}
+
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(baseFilename+".json", append(data, '\n'), 0644)
+}
+
+// setClassIDs makes the writer use a fixed class numbering instead of numbering
+// classes in order of appearance. It must be called before the first write.
+func (w *BinStreamWriter) setClassIDs(ids map[string]byte) {
+	for class, id := range ids {
+		w.classToInt[class] = id
+		if id >= w.nextClassID {
+			w.nextClassID = id + 1
+		}
+	}
+}
+
+// writeBin writes in-memory rows as a bin output.
+func writeBin(filename string, packets []PacketResult, featureNames []string, classIDs map[string]byte) error {
+	if len(packets) == 0 {
+		return fmt.Errorf("no packets to write")
+	}
+	w, err := NewBinStreamWriter(filename, len(packets[0].Data), packets[0].Class != "", featureNames)
+	if err != nil {
+		return err
+	}
+	w.setClassIDs(classIDs)
+	if err := w.WriteBatch(packets); err != nil {
+		w.closeFiles()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapOutputSnapLen is the snapshot length in the header of --format pcap
+// outputs, the longest frame gopacket reads; rows cut by --length are
+// recorded as truncated packets instead.
+const pcapOutputSnapLen = 262144
+
+// PcapStreamWriter writes rows back out as the packets of a classic pcap file
+// with nanosecond timestamps, after masking, anonymization and filtering, so
+// sanitized captures can be shared with tools that read pcap. Rows hold the
+// IP packet (LINKTYPE_RAW), or the Ethernet frame with --include-l2; their
+// padding is dropped and truncated rows keep their original length as the
+// wire length. Features, source columns and classes are not written.
+type PcapStreamWriter struct {
+	file    *os.File
+	buffer  *bufio.Writer
+	writer  *pcapgo.Writer
+	partial partialFiles // The file, renamed on Close
+	mutex   sync.Mutex
+}
+
+// NewPcapStreamWriter creates a pcap writer; l2 says the rows start with an
+// Ethernet header.
+func NewPcapStreamWriter(filename string, l2 bool) (*PcapStreamWriter, error) {
+	w := &PcapStreamWriter{}
+	file, err := w.partial.create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	w.file = file
+	w.buffer = bufio.NewWriterSize(file, 4*1024*1024)
+	w.writer = pcapgo.NewWriterNanos(w.buffer)
+
+	linkType := layers.LinkTypeRaw
+	if l2 {
+		linkType = layers.LinkTypeEthernet
+	}
+	if err := w.writer.WriteFileHeader(pcapOutputSnapLen, linkType); err != nil {
+		file.Close()
+		w.partial.discard()
+		return nil, fmt.Errorf("failed to write pcap header: %w", err)
+	}
+	return w, nil
+}
+
+// pcapBaseName strips the .pcap extension from an output name.
+func pcapBaseName(filename string) string {
+	return strings.TrimSuffix(filename, ".pcap")
+}
+
+func (w *PcapStreamWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch writes several packets under one lock.
+func (w *PcapStreamWriter) WriteBatch(packets []PacketResult) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, p := range packets {
+		data := p.Data
+		length := max(p.OriginalSize, len(data))
+		if p.OriginalSize > 0 && p.OriginalSize < len(data) {
+			data = data[:p.OriginalSize] // Padding, not packet bytes
+			length = p.OriginalSize
+		}
+		info := gopacket.CaptureInfo{
+			Timestamp:     p.Timestamp,
+			CaptureLength: len(data),
+			Length:        length,
+		}
+		if err := w.writer.WritePacket(info, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes the packets and gives the file its final name.
+func (w *PcapStreamWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	err := w.buffer.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return w.partial.finish(err)
+}
+
+// writePcap writes the packets of an in-memory run as a pcap file.
+func writePcap(filename string, packets []PacketResult, l2 bool) error {
+	w, err := NewPcapStreamWriter(filename, l2)
+	if err != nil {
+		return err
+	}
+	if err := w.WriteBatch(packets); err != nil {
+		w.file.Close()
+		w.partial.discard()
+		return err
+	}
+	return w.Close()
+}
@@ -5,37 +5,181 @@ import (
 	"encoding/binary"
 	"encoding/csv"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"os"
+	"reflect"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/parquet-go/parquet-go/compress/zstd"
 )
 
+// StreamWriter writes rows incrementally. WriteBatch writes several rows under a
+// single lock and does the periodic flush bookkeeping once per batch.
 type StreamWriter interface {
 	WritePacket(p PacketResult) error
+	WriteBatch(packets []PacketResult) error
 	Close() error
 }
 
+// WriterOptions are output encoding settings of the file writers.
+type WriterOptions struct {
+	ParquetCodec compress.Codec // Parquet page compression (nil = zstd)
+	Columns      []string       // --with-columns source columns of CSV and Parquet rows
+	ByteRepr     string         // How CSV renders byte cells, ByteReprDec (default), ByteReprHex or ByteReprFloat
+
+	ParquetLayout   string // ParquetLayoutBinary (default), ParquetLayoutWide or ParquetLayoutHF
+	SeparateLabels  bool   // CSV and Parquet rows go to <base>_data, their class IDs to <base>_labels
+	ParquetEncoders int    // Parquet row groups encoded concurrently (0 or 1 = one encoder)
+	ParquetByClass  bool   // Every Parquet row group holds the rows of one class (--parquet-class-groups)
+	NPZ             bool   // In-memory NumPy arrays go into one deflate-compressed <base>.npz
+	NumpyMmap       bool   // Streaming NumPy rows are copied into memory-mapped files (NumpyMmapWriter)
+	CSVCompression  string // CSVCompressionNone (default) or CSVCompressionZstd, which appends csvZstdExt
+
+	NumpyData  numpyDataType // Element type of NumPy data arrays (--npy-dtype, zero = uint8)
+	NumpyOrder string        // Memory layout of 2D NumPy arrays (--npy-order): NpyOrderC (default) or NpyOrderF
+	IncludeL2  bool          // Rows start with an Ethernet header, the link type of pcap outputs
+	TokenWord  int           // Bytes per token of tokens outputs (--token-word, 0 = one byte)
+
+	Store *ObjectStore // Uploads CSV and Parquet outputs named by object URLs (--output s3://...), nil = local files
+
+	Provenance *Provenance // Embedded in Parquet outputs; nil = none
+}
+
+// numpyData returns the element type of NumPy data arrays, uint8 by default.
+func (o WriterOptions) numpyData() numpyDataType {
+	if o.NumpyData.descr == "" {
+		return numpyDataType{descr: numpyDescrUint8, size: 1}
+	}
+	return o.NumpyData
+}
+
+// numpyFortran reports whether 2D NumPy arrays are written in Fortran order.
+func (o WriterOptions) numpyFortran() bool {
+	return o.NumpyOrder == NpyOrderF
+}
+
+// parquetCodec returns the Parquet compression codec, zstd by default.
+func (o WriterOptions) parquetCodec() compress.Codec {
+	if o.ParquetCodec == nil {
+		return &parquet.Zstd
+	}
+	return o.ParquetCodec
+}
+
+// parseParquetCompression returns the codec of --parquet-compression. level is
+// the zstd level from 1 (fastest) to 22 (smallest), 0 for the default (3).
+func parseParquetCompression(name string, level int) (compress.Codec, error) {
+	if level < 0 || level > 22 {
+		return nil, fmt.Errorf("zstd level %d is out of range (1-22)", level)
+	}
+	if level != 0 && name != "zstd" {
+		return nil, fmt.Errorf("a zstd level needs zstd compression, not %q", name)
+	}
+	switch name {
+	case "zstd":
+		if level == 0 {
+			return &parquet.Zstd, nil
+		}
+		// The encoder has four speeds; levels map to them like zstd.EncoderLevelFromZstd
+		codec := &zstd.Codec{Level: zstd.SpeedBestCompression}
+		switch {
+		case level < 3:
+			codec.Level = zstd.SpeedFastest
+		case level < 6:
+			codec.Level = zstd.SpeedDefault
+		case level < 10:
+			codec.Level = zstd.SpeedBetterCompression
+		}
+		return codec, nil
+	case "snappy":
+		return &parquet.Snappy, nil
+	case "gzip":
+		return &parquet.Gzip, nil
+	case "lz4":
+		return &parquet.Lz4Raw, nil
+	case "none":
+		return &parquet.Uncompressed, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q (use zstd, snappy, gzip, lz4 or none)", name)
+}
+
+// classNumberedWriter is a StreamWriter that writes classes as integer IDs
+// (numpy, bin, the huggingface Parquet layout), whose numbering can be fixed
+// across outputs.
+type classNumberedWriter interface {
+	setClassIDs(ids map[string]byte)
+}
+
+// NewStreamWriter creates the streaming writer for an output format (csv, parquet,
+// numpy, bin, pcap or tokens), or a TeeStreamWriter for a comma-separated list of formats.
+func NewStreamWriter(format, filename string, maxPacketSize int, hasClass bool, featureNames []string, wopts WriterOptions) (StreamWriter, error) {
+	if outputs := formatOutputs(format, filename); len(outputs) > 1 {
+		return NewTeeStreamWriter(outputs, maxPacketSize, hasClass, featureNames, wopts)
+	}
+	if wopts.SeparateLabels && (format == "csv" || format == "parquet") {
+		return NewSeparateLabelsWriter(format, filename, maxPacketSize, hasClass, featureNames, wopts)
+	}
+	switch format {
+	case "bin":
+		return NewBinStreamWriter(filename, maxPacketSize, hasClass, featureNames)
+	case "pcap":
+		return NewPcapStreamWriter(filename, wopts.IncludeL2)
+	case "tokens":
+		return NewTokensStreamWriter(filename, hasClass, wopts)
+	case "parquet":
+		return NewParquetStreamWriter(filename, maxPacketSize, hasClass, featureNames, wopts)
+	case "numpy":
+		if wopts.NumpyMmap {
+			return NewNumpyMmapWriter(filename, maxPacketSize, hasClass, featureNames, wopts.numpyData(), wopts.numpyFortran())
+		}
+		return NewNumpyStreamWriter(filename, maxPacketSize, hasClass, featureNames, wopts.numpyData(), wopts.numpyFortran())
+	}
+	return NewCSVStreamWriter(filename, maxPacketSize, hasClass, featureNames, wopts)
+}
+
+// stdoutOutput is the --output name that writes CSV rows to stdout.
+const stdoutOutput = "-"
+
+// removeOutput deletes the files a stream writer created for an output,
+// finished or still under their partial names.
+func removeOutput(format, filename string) {
+	for _, path := range outputArtifacts(format, filename) {
+		os.Remove(path)
+		os.Remove(path + partialSuffix)
+	}
+}
+
 // CSVStreamWriter writes packets to CSV incrementally.
 type CSVStreamWriter struct {
-	file          *os.File
+	file          *csvOutput
 	bufWriter     *bufio.Writer
 	csvWriter     *csv.Writer
 	maxPacketSize int
 	hasClass      bool
+	featureNames  []string // Optional feature columns written after the byte columns
+	columns       []string // --with-columns source columns written after the features
+	byteStrings   *[256]string
 	headerWritten bool
-	flushCounter  int      // Track writes for periodic flushing
-	rowBuffer     []string // Reusable row buffer to reduce allocations
+	flushCounter  int       // Track writes for periodic flushing
+	rowBuffer     []string  // Reusable row buffer to reduce allocations
+	longRow       sync.Once // Warns of the first row longer than the header
 	mutex         sync.Mutex
 }
 
 // NewCSVStreamWriter creates a new streaming CSV writer.
-func NewCSVStreamWriter(filename string, maxPacketSize int, hasClass bool) (*CSVStreamWriter, error) {
-	file, err := os.Create(filename)
+// featureNames lists optional feature columns placed between the bytes and the class,
+// followed by the source columns of wopts.Columns. With --csv-compression zstd
+// the file is compressed and named with csvZstdExt.
+func NewCSVStreamWriter(filename string, maxPacketSize int, hasClass bool, featureNames []string, wopts WriterOptions) (*CSVStreamWriter, error) {
+	file, err := createCSVOutput(filename, wopts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file: %w", err)
 	}
@@ -45,7 +189,7 @@ func NewCSVStreamWriter(filename string, maxPacketSize int, hasClass bool) (*CSV
 	csvWriter := csv.NewWriter(bufWriter)
 
 	// Pre-allocate reusable row buffer.
-	rowSize := maxPacketSize
+	rowSize := maxPacketSize + len(featureNames) + len(wopts.Columns)
 	if hasClass {
 		rowSize++
 	}
@@ -56,6 +200,9 @@ func NewCSVStreamWriter(filename string, maxPacketSize int, hasClass bool) (*CSV
 		csvWriter:     csvWriter,
 		maxPacketSize: maxPacketSize,
 		hasClass:      hasClass,
+		featureNames:  featureNames,
+		columns:       wopts.Columns,
+		byteStrings:   csvByteTable(wopts.ByteRepr),
 		headerWritten: false,
 		flushCounter:  0,
 		rowBuffer:     make([]string, rowSize),
@@ -71,7 +218,7 @@ func NewCSVStreamWriter(filename string, maxPacketSize int, hasClass bool) (*CSV
 }
 
 func (w *CSVStreamWriter) writeHeader() error {
-	headerSize := w.maxPacketSize
+	headerSize := w.maxPacketSize + len(w.featureNames) + len(w.columns)
 	if w.hasClass {
 		headerSize += 1
 	}
@@ -80,8 +227,10 @@ func (w *CSVStreamWriter) writeHeader() error {
 	for i := 0; i < w.maxPacketSize; i++ {
 		header[i] = fmt.Sprintf("Byte_%d", i)
 	}
+	copy(header[w.maxPacketSize:], w.featureNames)
+	copy(header[w.maxPacketSize+len(w.featureNames):], w.columns)
 	if w.hasClass {
-		header[w.maxPacketSize] = "Class"
+		header[headerSize-1] = "Class"
 	}
 
 	w.headerWritten = true
@@ -89,76 +238,173 @@ func (w *CSVStreamWriter) writeHeader() error {
 }
 
 func (w *CSVStreamWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch writes several packets to CSV under one lock.
+func (w *CSVStreamWriter) WriteBatch(packets []PacketResult) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, p := range packets {
+		if err := w.csvWriter.Write(w.fillRow(w.rowBuffer, p)); err != nil {
+			return err
+		}
+	}
+	return w.countRows(len(packets))
+}
+
+// WriteEncoded writes rows produced by encodeRow, so the number formatting
+// happens outside the writer lock (in the packet workers).
+func (w *CSVStreamWriter) WriteEncoded(rows [][]string) error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
+	for _, row := range rows {
+		if err := w.csvWriter.Write(row); err != nil {
+			return err
+		}
+	}
+	return w.countRows(len(rows))
+}
+
+// countRows does the periodic flush bookkeeping. The caller holds the mutex.
+func (w *CSVStreamWriter) countRows(n int) error {
+	w.flushCounter += n
+
+	if w.flushCounter >= 10000 {
+		w.csvWriter.Flush()
+		if err := w.csvWriter.Error(); err != nil {
+			return fmt.Errorf("csv flush error: %w", err)
+		}
+		w.bufWriter.Flush()
+		if err := w.file.Flush(); err != nil {
+			return fmt.Errorf("zstd flush error: %w", err)
+		}
+		w.flushCounter = 0
+
+		runtime.GC()
+		debug.FreeOSMemory()
+	}
+
+	return nil
+}
+
+// encodeRow converts a packet to a new CSV row. It only reads fields fixed at
+// construction, so it is safe to call from packet workers without the mutex.
+func (w *CSVStreamWriter) encodeRow(p PacketResult) []string {
+	return w.fillRow(nil, p)
+}
+
+// fillRow converts a packet to a CSV row, reusing buf if it has the right size.
+func (w *CSVStreamWriter) fillRow(buf []string, p PacketResult) []string {
 	data := p.Data
+	if len(data) > w.maxPacketSize {
+		w.longRow.Do(func() {
+			slog.Warn("rows are longer than the byte columns of the CSV header, so their later columns are shifted; set --length, --assume-max-len or --scan-length", "row_bytes", len(data), "columns", w.maxPacketSize)
+		})
+	}
 
-	rowSize := len(data)
+	rowSize := len(data) + len(w.featureNames) + len(w.columns)
 	if w.hasClass {
 		rowSize++
 	}
 
 	// Use pre-allocated buffer if size matches, otherwise create new one.
 	var row []string
-	if rowSize == len(w.rowBuffer) {
-		row = w.rowBuffer
+	if rowSize == len(buf) {
+		row = buf
 	} else {
 		row = make([]string, rowSize)
 	}
 
 	// Convert bytes to strings.
 	for i, b := range data {
-		row[i] = strconv.Itoa(int(b))
+		row[i] = w.byteStrings[b]
 	}
 
-	// Add class label if present.
-	if w.hasClass {
-		row[len(data)] = p.Class
+	// Add feature values.
+	for i := range w.featureNames {
+		row[len(data)+i] = formatFeature(p.Features, i)
 	}
 
-	if err := w.csvWriter.Write(row); err != nil {
-		return err
+	// Add source columns.
+	for i, column := range w.columns {
+		row[len(data)+len(w.featureNames)+i] = metadataValue(p, column)
 	}
 
-	w.flushCounter++
+	// Add class label if present.
+	if w.hasClass {
+		row[rowSize-1] = p.Class
+	}
 
-	if w.flushCounter >= 10000 {
-		w.csvWriter.Flush()
-		if err := w.csvWriter.Error(); err != nil {
-			return fmt.Errorf("csv flush error: %w", err)
-		}
-		w.bufWriter.Flush()
-		w.flushCounter = 0
+	return row
+}
 
-		runtime.GC()
-		debug.FreeOSMemory()
+// Renderings of byte cells in CSV (--byte-repr).
+const (
+	ByteReprDec   = "dec"   // Decimal integer, 0 to 255 (default)
+	ByteReprHex   = "hex"   // Two lower-case hex digits, 00 to ff
+	ByteReprFloat = "float" // Value divided by 255, 0 to 1
+)
+
+// csvByteStrings holds the text of every byte value per rendering, so encoding
+// a row needs no number formatting or string allocations.
+var csvByteStrings = func() map[string]*[256]string {
+	tables := map[string]*[256]string{ByteReprDec: {}, ByteReprHex: {}, ByteReprFloat: {}}
+	for i := 0; i < 256; i++ {
+		tables[ByteReprDec][i] = strconv.Itoa(i)
+		tables[ByteReprHex][i] = fmt.Sprintf("%02x", i)
+		tables[ByteReprFloat][i] = strconv.FormatFloat(float64(i)/255, 'g', -1, 64)
 	}
+	return tables
+}()
 
-	return nil
+// csvByteTable returns the byte cell texts of a --byte-repr, decimal by default.
+func csvByteTable(repr string) *[256]string {
+	if table, ok := csvByteStrings[repr]; ok {
+		return table
+	}
+	return csvByteStrings[ByteReprDec]
 }
 
 func (w *CSVStreamWriter) Close() error {
 	// Final flush before closing.
 	w.csvWriter.Flush()
 	if err := w.csvWriter.Error(); err != nil {
-		w.file.Close()
+		w.file.abort()
 		return fmt.Errorf("csv final flush error: %w", err)
 	}
 	if err := w.bufWriter.Flush(); err != nil {
-		w.file.Close()
+		w.file.abort()
 		return fmt.Errorf("buffer final flush error: %w", err)
 	}
 	return w.file.Close()
 }
 
+// formatFeature renders feature i for CSV, or "0" if the packet has no value for it.
+func formatFeature(features []float64, i int) string {
+	if i >= len(features) {
+		return "0"
+	}
+	return strconv.FormatFloat(features[i], 'g', -1, 64)
+}
+
 // NumpyStreamWriter writes packets to NumPy .npy format incrementally.
 // Outputs uint8 array matching CSV schema with optional class labels.
 type NumpyStreamWriter struct {
-	dataFile        *os.File      // Main data file
+	dataFile        *os.File      // Main data file (nil without byte columns)
 	dataBufWriter   *bufio.Writer // Buffer for data
 	labelsFile      *os.File      // Separate file for labels (if hasClass)
 	labelsBufWriter *bufio.Writer // Buffer for labels
+	featuresFile    *os.File      // Separate float64 file for feature columns (if any)
+	featuresBuf     *bufio.Writer // Buffer for features
+	featureNames    []string
+	featureRow      []byte // Reusable encoding buffer for one feature row
+	dataType        numpyDataType
+	dataRow         []byte // Reusable encoding buffer for one data row (not uint8)
+	fortran         bool   // 2D arrays are transposed to Fortran order on Close
+	padding         []byte // Zeros that pad shorter rows to maxPacketSize
 	maxPacketSize   int
 	hasClass        bool
 	packetCount     int64
@@ -167,27 +413,20 @@ type NumpyStreamWriter struct {
 	classToInt      map[string]byte // Map class names to integers
 	nextClassID     byte            // Next available class ID
 	baseFilename    string          // Base filename without extension
+	partial         partialFiles    // The .npy files, renamed on Close
 }
 
 // NewNumpyStreamWriter creates a new streaming NumPy writer.
 // If hasClass is true, creates two files: <basename>_data.npy and <basename>_labels.npy.
-func NewNumpyStreamWriter(filename string, maxPacketSize int, hasClass bool) (*NumpyStreamWriter, error) {
+// If featureNames is non-empty, also creates <basename>_features.npy (float64) and <basename>_features.json.
+// With maxPacketSize 0 (--scale) there are no byte columns and no data file.
+// The bytes are written as dataType elements, and with fortran the 2D arrays
+// are transposed to Fortran order when they are complete.
+func NewNumpyStreamWriter(filename string, maxPacketSize int, hasClass bool, featureNames []string, dataType numpyDataType, fortran bool) (*NumpyStreamWriter, error) {
 	// Remove extension if present and store base filename.
-	baseFilename := strings.TrimSuffix(filename, ".npy")
-	baseFilename = strings.TrimSuffix(baseFilename, ".npz")
-
-	// Create main data file.
-	dataFilename := baseFilename + "_data.npy"
-	dataFile, err := os.Create(dataFilename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create data file: %w", err)
-	}
-
-	dataBufWriter := bufio.NewWriterSize(dataFile, 4*1024*1024) // 4MB buffer
+	baseFilename := numpyBaseName(filename)
 
 	w := &NumpyStreamWriter{
-		dataFile:      dataFile,
-		dataBufWriter: dataBufWriter,
 		maxPacketSize: maxPacketSize,
 		hasClass:      hasClass,
 		packetCount:   0,
@@ -195,20 +434,35 @@ func NewNumpyStreamWriter(filename string, maxPacketSize int, hasClass bool) (*N
 		classToInt:    make(map[string]byte),
 		nextClassID:   0,
 		baseFilename:  baseFilename,
+		featureNames:  featureNames,
+		dataType:      dataType,
+		padding:       make([]byte, maxPacketSize*dataType.size),
+		fortran:       fortran,
 	}
 
-	// Write placeholder header for data file.
-	if err := w.writePlaceholderHeader(dataBufWriter, maxPacketSize); err != nil {
-		dataFile.Close()
-		return nil, err
+	// Create main data file.
+	if maxPacketSize > 0 {
+		dataFilename := baseFilename + "_data.npy"
+		dataFile, err := w.partial.create(dataFilename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create data file: %w", err)
+		}
+		w.dataFile = dataFile
+		w.dataBufWriter = bufio.NewWriterSize(dataFile, 4*1024*1024) // 4MB buffer
+
+		// Write placeholder header for data file.
+		if err := w.writePlaceholderHeader(w.dataBufWriter, dataType.descr, maxPacketSize); err != nil {
+			w.closeFiles()
+			return nil, err
+		}
 	}
 
 	// Create labels file if needed.
 	if hasClass {
 		labelsFilename := baseFilename + "_labels.npy"
-		labelsFile, err := os.Create(labelsFilename)
+		labelsFile, err := w.partial.create(labelsFilename)
 		if err != nil {
-			dataFile.Close()
+			w.closeFiles()
 			return nil, fmt.Errorf("failed to create labels file: %w", err)
 		}
 		labelsBufWriter := bufio.NewWriterSize(labelsFile, 1*1024*1024) // 1MB buffer
@@ -217,26 +471,59 @@ func NewNumpyStreamWriter(filename string, maxPacketSize int, hasClass bool) (*N
 		w.labelsBufWriter = labelsBufWriter
 
 		// Write placeholder header for labels file (1D array of uint8).
-		err = w.writePlaceholderHeader(labelsBufWriter, 0) // 0 = 1D array
+		err = w.writePlaceholderHeader(labelsBufWriter, numpyDescrUint8, 0) // 0 = 1D array
 		if err != nil {
-			dataFile.Close()
-			labelsFile.Close()
+			w.closeFiles()
 			return nil, err
 		}
 	}
 
+	// Create features file if needed.
+	if len(featureNames) > 0 {
+		featuresFile, err := w.partial.create(baseFilename + "_features.npy")
+		if err != nil {
+			w.closeFiles()
+			return nil, fmt.Errorf("failed to create features file: %w", err)
+		}
+		w.featuresFile = featuresFile
+		w.featuresBuf = bufio.NewWriterSize(featuresFile, 1*1024*1024) // 1MB buffer
+
+		if err := w.writePlaceholderHeader(w.featuresBuf, numpyDescrFloat64, len(featureNames)); err != nil {
+			w.closeFiles()
+			return nil, err
+		}
+		if err := writeFeatureNamesFile(baseFilename+"_features.json", featureNames); err != nil {
+			w.closeFiles()
+			return nil, fmt.Errorf("failed to write feature names: %w", err)
+		}
+	}
+
 	return w, nil
 }
 
+// closeFiles closes and removes every file opened so far (used on construction errors).
+func (w *NumpyStreamWriter) closeFiles() {
+	if w.dataFile != nil {
+		w.dataFile.Close()
+	}
+	if w.labelsFile != nil {
+		w.labelsFile.Close()
+	}
+	if w.featuresFile != nil {
+		w.featuresFile.Close()
+	}
+	w.partial.discard()
+}
+
 // writePlaceholderHeader writes a NumPy header with shape (0, cols) that will be updated later.
 // If cols is 0, writes a 1D array header for labels.
-func (w *NumpyStreamWriter) writePlaceholderHeader(writer *bufio.Writer, cols int) error {
+func (w *NumpyStreamWriter) writePlaceholderHeader(writer *bufio.Writer, descr string, cols int) error {
 	if err := writeNumpyMagic(writer); err != nil {
 		return err
 	}
 
 	// Create header with rows=0 as placeholder.
-	headerStr := createNumpyHeader(0, cols)
+	headerStr := createNumpyHeaderOrder(descr, 0, cols, w.fortran)
 
 	// Write header length as uint16 little-endian (2 bytes for version 1.0).
 	headerLen := uint16(len(headerStr))
@@ -253,12 +540,60 @@ func (w *NumpyStreamWriter) writePlaceholderHeader(writer *bufio.Writer, cols in
 
 // WritePacket writes a packet to NumPy format (raw binary for data, integer for class).
 func (w *NumpyStreamWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch writes several packets to NumPy format under one lock.
+func (w *NumpyStreamWriter) WriteBatch(packets []PacketResult) error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
+	for _, p := range packets {
+		if err := w.writeRow(p); err != nil {
+			return err
+		}
+	}
+	w.flushCounter += len(packets)
+
+	if w.flushCounter >= 50000 {
+		if w.dataBufWriter != nil {
+			w.dataBufWriter.Flush()
+		}
+		if w.hasClass {
+			w.labelsBufWriter.Flush()
+		}
+		if w.featuresBuf != nil {
+			w.featuresBuf.Flush()
+		}
+		w.flushCounter = 0
+
+		// Force garbage collection to free memory.
+		runtime.GC()
+		debug.FreeOSMemory()
+	}
+
+	return nil
+}
+
+// writeRow appends one packet to the data, labels and features files. The caller holds the mutex.
+func (w *NumpyStreamWriter) writeRow(p PacketResult) error {
 	// Write packet data as raw uint8 bytes (NO string conversion!).
-	if _, err := w.dataBufWriter.Write(p.Data); err != nil {
-		return fmt.Errorf("error writing data: %w", err)
+	if w.dataBufWriter != nil {
+		if len(p.Data) > w.maxPacketSize {
+			return fmt.Errorf("row of %d bytes does not fit the %d columns of the data array, set --length, --assume-max-len or --scan-length", len(p.Data), w.maxPacketSize)
+		}
+		data := p.Data
+		if w.dataType.descr != numpyDescrUint8 {
+			w.dataRow = w.dataType.appendRow(w.dataRow[:0], p.Data)
+			data = w.dataRow
+		}
+		if _, err := w.dataBufWriter.Write(data); err != nil {
+			return fmt.Errorf("error writing data: %w", err)
+		}
+		// Variable-length rows (--length 0) are zero-padded to the array's columns
+		if _, err := w.dataBufWriter.Write(w.padding[:(w.maxPacketSize-len(p.Data))*w.dataType.size]); err != nil {
+			return fmt.Errorf("error writing data: %w", err)
+		}
 	}
 
 	// Write class label if present.
@@ -277,75 +612,72 @@ func (w *NumpyStreamWriter) WritePacket(p PacketResult) error {
 		}
 	}
 
-	w.packetCount++
-	w.flushCounter++
-
-	if w.flushCounter >= 50000 {
-		w.dataBufWriter.Flush()
-		if w.hasClass {
-			w.labelsBufWriter.Flush()
+	// Write feature row if present.
+	if w.featuresBuf != nil {
+		w.featureRow = appendFeatureRow(w.featureRow[:0], p.Features, len(w.featureNames))
+		if _, err := w.featuresBuf.Write(w.featureRow); err != nil {
+			return fmt.Errorf("error writing features: %w", err)
 		}
-		w.flushCounter = 0
-
-		// Force garbage collection to free memory.
-		runtime.GC()
-		debug.FreeOSMemory()
 	}
 
+	w.packetCount++
 	return nil
 }
 
-// Close finalizes the NumPy file by updating the header with actual packet count.
+// Close finalizes the NumPy files by updating their headers with the actual
+// packet count. Every file is closed even if another fails; the files get
+// their final names only if all of them were finished.
 func (w *NumpyStreamWriter) Close() error {
-	// Final flush of all buffers.
-	if err := w.dataBufWriter.Flush(); err != nil {
-		return fmt.Errorf("error flushing data buffer: %w", err)
-	}
-	if w.hasClass {
-		if err := w.labelsBufWriter.Flush(); err != nil {
-			return fmt.Errorf("error flushing labels buffer: %w", err)
+	var err error
+	if w.dataFile != nil {
+		if finishErr := w.finishFile(w.dataFile, w.dataBufWriter, w.dataType.descr, w.maxPacketSize, w.dataType.size); finishErr != nil {
+			err = fmt.Errorf("error finishing data array: %w", finishErr)
 		}
 	}
-
-	// Update data file header with actual packet count.
-	if err := w.updateHeader(w.dataFile, w.maxPacketSize, w.packetCount); err != nil {
-		w.dataFile.Close()
-		if w.hasClass {
-			w.labelsFile.Close()
+	if w.hasClass {
+		if finishErr := w.finishFile(w.labelsFile, w.labelsBufWriter, numpyDescrUint8, 0, 1); finishErr != nil && err == nil {
+			err = fmt.Errorf("error finishing labels array: %w", finishErr)
 		}
-		return fmt.Errorf("error updating data header: %w", err)
 	}
-
-	// Update labels file header if present.
-	if w.hasClass {
-		if err := w.updateHeader(w.labelsFile, 0, w.packetCount); err != nil {
-			w.dataFile.Close()
-			w.labelsFile.Close()
-			return fmt.Errorf("error updating labels header: %w", err)
+	if w.featuresFile != nil {
+		if finishErr := w.finishFile(w.featuresFile, w.featuresBuf, numpyDescrFloat64, len(w.featureNames), 8); finishErr != nil && err == nil {
+			err = fmt.Errorf("error finishing features array: %w", finishErr)
 		}
 	}
-
-	// Close files.
-	if err := w.dataFile.Close(); err != nil {
+	if err := w.partial.finish(err); err != nil {
 		return err
 	}
-	if w.hasClass {
-		if err := w.labelsFile.Close(); err != nil {
-			return err
-		}
 
+	if w.hasClass {
 		// Write class mapping to a JSON file for reference.
 		if err := w.writeClassMapping(); err != nil {
 			// Non-fatal error, just log it.
-			fmt.Printf("Warning: failed to write class mapping: %v\n", err)
+			slog.Warn("failed to write class mapping", "error", err)
 		}
 	}
-
 	return nil
 }
 
+// finishFile flushes one array, writes its header with the packet count,
+// transposes a 2D array of itemSize-byte elements to Fortran order if asked
+// and closes it, closing it even if flushing or the header fails.
+func (w *NumpyStreamWriter) finishFile(file *os.File, buf *bufio.Writer, descr string, cols, itemSize int) error {
+	err := buf.Flush()
+	if err == nil {
+		err = w.updateHeader(file, descr, cols, w.packetCount)
+	}
+	if err == nil && w.fortran && cols > 0 {
+		header := int64(len(numpyMagicV10) + 2 + len(createNumpyHeaderOrder(descr, w.packetCount, cols, true)))
+		err = transposeNumpyData(file, header, w.packetCount, cols, itemSize)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 // updateHeader seeks back to the file header and updates it with the actual row count.
-func (w *NumpyStreamWriter) updateHeader(file *os.File, cols int, rows int64) error {
+func (w *NumpyStreamWriter) updateHeader(file *os.File, descr string, cols int, rows int64) error {
 	// Seek to position after magic+version (8 bytes) and before header_len (2 bytes for v1.0).
 	// Format: \x93NUMPY (6) + \x01\x00 (2) = 8 bytes.
 	if _, err := file.Seek(8, 0); err != nil {
@@ -353,7 +685,7 @@ func (w *NumpyStreamWriter) updateHeader(file *os.File, cols int, rows int64) er
 	}
 
 	// Create header with actual row count.
-	headerStr := createNumpyHeader(rows, cols)
+	headerStr := createNumpyHeaderOrder(descr, rows, cols, w.fortran)
 
 	// Write updated header length (uint16 for v1.0).
 	headerLen := uint16(len(headerStr))
@@ -369,12 +701,31 @@ func (w *NumpyStreamWriter) updateHeader(file *os.File, cols int, rows int64) er
 	return nil
 }
 
+// setClassIDs makes the writer use a fixed class numbering instead of numbering
+// classes in order of appearance. It must be called before the first write.
+func (w *NumpyStreamWriter) setClassIDs(ids map[string]byte) {
+	for class, id := range ids {
+		w.classToInt[class] = id
+		if id >= w.nextClassID {
+			w.nextClassID = id + 1
+		}
+	}
+}
+
 // writeClassMapping writes the class name to integer mapping as a JSON file.
 func (w *NumpyStreamWriter) writeClassMapping() error {
 	mappingFile := w.baseFilename + "_classes.json"
 	return writeClassMappingFile(mappingFile, w.classToInt)
 }
 
+// Parquet row layouts of --parquet-layout, the same in streaming and in-memory runs.
+const (
+	ParquetLayoutBinary = "binary"      // One binary data column (default)
+	ParquetLayoutWide   = "wide"        // One UINT_8 Byte_N column per byte and a Class column, like CSV
+	ParquetLayoutHF     = "huggingface" // A list<uint8> data column, a label ID column and datasets features metadata
+	ParquetLayoutFlows  = "flows"       // One row per session with a list of its packets (--session-bytes)
+)
+
 // ParquetPacket is a simple struct for Parquet without reflection overhead.
 type ParquetPacket struct {
 	Data  []byte `parquet:"data"`
@@ -383,52 +734,239 @@ type ParquetPacket struct {
 
 // ParquetStreamWriter writes packets to Parquet incrementally.
 type ParquetStreamWriter struct {
-	file         *os.File
+	file         io.WriteCloser
+	partial      partialFiles // The file, renamed or uploaded on Close
 	writer       *parquet.Writer
-	flushCounter int // Track writes for periodic flushing
+	featureNames []string
+	columns      []string     // --with-columns source columns
+	rowType      reflect.Type // Row struct with feature and source columns (nil if neither)
+	width        int          // Byte columns of the wide layout (0 = binary layout)
+	huggingFace  bool         // huggingface layout, with class IDs as labels
+	flows        bool         // flows layout, with the packets of each session row
+	hasClass     bool
+	provenance   *Provenance // Written into the footer metadata
+	flushCounter int         // Track writes for periodic flushing
 	mutex        sync.Mutex
+
+	// Label IDs of the huggingface layout, numbered in order of appearance
+	// unless fixed by setClassIDs.
+	classMutex  sync.Mutex
+	classToInt  map[string]byte
+	nextClassID byte
+
+	// With --parquet-encoders > 1, batches go to a pool of row group encoders
+	// that encode and compress in parallel; only appending a finished row group
+	// to the file is serialized.
+	schema      *parquet.Schema
+	shards      chan *parquetShard // Idle encoders (nil = single encoder under mutex)
+	allShards   []*parquetShard
+	commitMutex sync.Mutex
+
+	// With --parquet-class-groups, rows wait in a group per class (under
+	// mutex) until the group fills a row group of its own.
+	groups map[string][]parquet.Row
 }
 
-// NewParquetStreamWriter creates a new streaming Parquet writer.
-func NewParquetStreamWriter(filename string, maxPacketSize int, hasClass bool) (*ParquetStreamWriter, error) {
-	_ = maxPacketSize
-	_ = hasClass
+// parquetShard is one row group encoder of a ParquetStreamWriter.
+type parquetShard struct {
+	rowGroup *parquet.ConcurrentRowGroupWriter
+	count    int // Rows in the open row group
+}
 
-	file, err := os.Create(filename)
+// NewParquetStreamWriter creates a new streaming Parquet writer.
+// If featureNames is non-empty, each feature becomes a float64 column between data and class.
+// The wide layout has maxPacketSize byte columns, and a class column only if hasClass.
+func NewParquetStreamWriter(filename string, maxPacketSize int, hasClass bool, featureNames []string, wopts WriterOptions) (*ParquetStreamWriter, error) {
+	w := &ParquetStreamWriter{
+		featureNames: featureNames,
+		columns:      wopts.Columns,
+		hasClass:     hasClass,
+		provenance:   wopts.Provenance,
+		flushCounter: 0,
+	}
+	file, err := w.partial.createOutput(filename, wopts.Store)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file: %w", err)
 	}
+	w.file = file
 
 	// Create simple schema-based writer (no reflection per packet!).
-	schema := parquet.SchemaOf(ParquetPacket{})
-	writer := parquet.NewWriter(file, schema,
-		parquet.Compression(&parquet.Zstd),
+	// Feature and source columns need a dynamic row struct, built once here.
+	var schema *parquet.Schema
+	var options []parquet.WriterOption
+	switch {
+	case wopts.ParquetLayout == ParquetLayoutWide:
+		w.width = maxPacketSize
+		w.rowType = parquetWideRowType(maxPacketSize, featureNames, wopts.Columns, hasClass)
+		schema = parquet.SchemaOf(reflect.New(w.rowType).Interface())
+		options = parquetClassIndexOptions("Class")
+	case wopts.ParquetLayout == ParquetLayoutFlows:
+		w.flows = true
+		w.rowType = parquetFlowRowType(featureNames, wopts.Columns)
+		schema = parquet.SchemaOf(reflect.New(w.rowType).Interface())
+		options = append(parquetClassIndexOptions("class"), parquet.SkipPageBounds("packets", "list", "element", "bytes"))
+	case wopts.ParquetLayout == ParquetLayoutHF:
+		w.huggingFace = true
+		w.classToInt = make(map[string]byte)
+		w.rowType = parquetHuggingFaceRowType(featureNames, wopts.Columns, hasClass)
+		schema = parquet.SchemaOf(reflect.New(w.rowType).Interface())
+		options = parquetClassIndexOptions("label")
+	case len(featureNames) > 0 || len(wopts.Columns) > 0:
+		w.rowType = parquetFeatureRowType(featureNames, wopts.Columns)
+		schema = parquet.SchemaOf(reflect.New(w.rowType).Interface())
+		options = parquetClassIndexOptions("class")
+	default:
+		schema = parquet.SchemaOf(ParquetPacket{})
+		options = parquetClassIndexOptions("class")
+	}
+	options = append(options,
+		schema,
+		parquet.Compression(wopts.parquetCodec()),
 		parquet.PageBufferSize(256*1024),
 	)
+	if w.width == 0 && !w.huggingFace && !w.flows {
+		options = append(options, parquet.SkipPageBounds("data")) // Min/max of whole packets is useless and large
+	}
+	w.writer = parquet.NewWriter(file, options...)
+	w.schema = schema
+	if wopts.ParquetByClass {
+		w.groups = make(map[string][]parquet.Row)
+	}
 
-	return &ParquetStreamWriter{
-		file:         file,
-		writer:       writer,
-		flushCounter: 0,
-	}, nil
+	if wopts.ParquetEncoders > 1 {
+		w.shards = make(chan *parquetShard, wopts.ParquetEncoders)
+		for i := 0; i < wopts.ParquetEncoders; i++ {
+			shard := &parquetShard{rowGroup: w.writer.BeginRowGroup()}
+			w.allShards = append(w.allShards, shard)
+			w.shards <- shard
+		}
+	}
+
+	return w, nil
 }
 
-func (w *ParquetStreamWriter) WritePacket(p PacketResult) error {
-	w.mutex.Lock()
-	defer w.mutex.Unlock()
+// parquetClassIndexOptions enables page statistics and a bloom filter on the class
+// column, so query engines (DuckDB, Spark) can skip row groups and pages that cannot
+// contain the requested class. Row group statistics are always written.
+func parquetClassIndexOptions(classColumn string) []parquet.WriterOption {
+	return []parquet.WriterOption{
+		parquet.DataPageStatistics(true),
+		parquet.BloomFilters(parquet.SplitBlockFilter(10, classColumn)), // ~1% false positives
+	}
+}
 
-	// Packets are already standardized by parser - write as-is.
-	// No length modification needed here.
-	packet := ParquetPacket{
-		Data:  p.Data,
-		Class: p.Class,
+// parquetFeatureRowType builds a row struct: data []byte, one float64 per feature,
+// the source columns, class string.
+func parquetFeatureRowType(featureNames, columns []string) reflect.Type {
+	fields := make([]reflect.StructField, 0, len(featureNames)+len(columns)+2)
+	fields = append(fields, reflect.StructField{
+		Name: "Data",
+		Type: reflect.TypeOf([]byte{}),
+		Tag:  `parquet:"data"`,
+	})
+	for i, name := range featureNames {
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("Feature_%d", i),
+			Type: reflect.TypeOf(float64(0)),
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, name)),
+		})
 	}
+	fields = append(fields, metadataFields(columns)...)
+	fields = append(fields, reflect.StructField{
+		Name: "Class",
+		Type: reflect.TypeOf(""),
+		Tag:  `parquet:"class,optional"`,
+	})
+	return reflect.StructOf(fields)
+}
 
-	if err := w.writer.Write(packet); err != nil {
-		return err
+// parquetFlowPacket is a packet in the packets list of a flows layout row.
+type parquetFlowPacket struct {
+	Bytes     []byte `parquet:"bytes"`
+	Timestamp int64  `parquet:"timestamp,timestamp(nanosecond)"`
+	Direction uint8  `parquet:"direction"` // 0 = like the flow's first packet, 1 = the other way
+}
+
+// parquetFlowRowType builds the row struct of the flows layout: the session's
+// packets as a LIST of parquetFlowPacket (Spark's array<struct>), one float64
+// per feature, the source columns, class string.
+func parquetFlowRowType(featureNames, columns []string) reflect.Type {
+	fields := make([]reflect.StructField, 0, len(featureNames)+len(columns)+2)
+	fields = append(fields, reflect.StructField{
+		Name: "Packets",
+		Type: reflect.TypeOf([]parquetFlowPacket{}),
+		Tag:  `parquet:"packets,list"`,
+	})
+	for i, name := range featureNames {
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("Feature_%d", i),
+			Type: reflect.TypeOf(float64(0)),
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, name)),
+		})
+	}
+	fields = append(fields, metadataFields(columns)...)
+	fields = append(fields, reflect.StructField{
+		Name: "Class",
+		Type: reflect.TypeOf(""),
+		Tag:  `parquet:"class,optional"`,
+	})
+	return reflect.StructOf(fields)
+}
+
+// parquetWideRowType builds the row struct of the wide layout: width UINT_8
+// byte columns, dictionary encoded so each value takes at most 8 bits rather
+// than a plain int32, one float64 per feature, the source columns and, if
+// hasClass, the class.
+func parquetWideRowType(width int, featureNames, columns []string, hasClass bool) reflect.Type {
+	fields := make([]reflect.StructField, 0, width+len(featureNames)+len(columns)+1)
+	for i := 0; i < width; i++ {
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("Byte_%d", i),
+			Type: reflect.TypeOf(uint8(0)),
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"Byte_%d,dict"`, i)),
+		})
+	}
+	for i, name := range featureNames {
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("Feature_%d", i),
+			Type: reflect.TypeOf(float64(0)),
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, name)),
+		})
+	}
+	fields = append(fields, metadataFields(columns)...)
+	if hasClass {
+		fields = append(fields, reflect.StructField{
+			Name: "Class",
+			Type: reflect.TypeOf(""),
+			Tag:  `parquet:"Class"`,
+		})
 	}
+	return reflect.StructOf(fields)
+}
 
-	w.flushCounter++
+func (w *ParquetStreamWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch writes several packets to Parquet under one lock, or to an idle
+// row group encoder with --parquet-encoders.
+func (w *ParquetStreamWriter) WriteBatch(packets []PacketResult) error {
+	if w.groups != nil {
+		return w.writeGrouped(packets)
+	}
+	if w.shards != nil {
+		return w.writeShard(packets)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, p := range packets {
+		if err := w.writeRow(p); err != nil {
+			return err
+		}
+	}
+	w.flushCounter += len(packets)
 
 	if w.flushCounter >= 50000 {
 		// Flush parquet buffer to disk.
@@ -445,15 +983,247 @@ func (w *ParquetStreamWriter) WritePacket(p PacketResult) error {
 	return nil
 }
 
+// writeShard writes packets to an idle row group encoder and commits its row
+// group once it holds 50000 rows.
+func (w *ParquetStreamWriter) writeShard(packets []PacketResult) error {
+	shard := <-w.shards
+	defer func() { w.shards <- shard }()
+
+	rows := make([]parquet.Row, len(packets))
+	for i, p := range packets {
+		rows[i] = w.schema.Deconstruct(nil, w.parquetRow(p))
+	}
+	if _, err := shard.rowGroup.WriteRows(rows); err != nil {
+		return err
+	}
+	shard.count += len(rows)
+
+	if shard.count >= 50000 {
+		return w.commitShard(shard)
+	}
+	return nil
+}
+
+// writeGrouped adds packets to the groups of their classes and writes each
+// group that reaches 50000 rows as a row group. Rows are copied, since the
+// bytes of streamed batches are recycled once the batch is written.
+func (w *ParquetStreamWriter) writeGrouped(packets []PacketResult) error {
+	var full [][]parquet.Row
+	w.mutex.Lock()
+	for _, p := range packets {
+		group := append(w.groups[p.Class], w.schema.Deconstruct(nil, w.parquetRow(p)).Clone())
+		if len(group) >= 50000 {
+			full = append(full, group)
+			group = nil
+		}
+		w.groups[p.Class] = group
+	}
+	w.mutex.Unlock()
+
+	for _, group := range full {
+		if err := w.writeRowGroup(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRowGroup writes rows as one row group of their own, with an idle
+// encoder with --parquet-encoders.
+func (w *ParquetStreamWriter) writeRowGroup(rows []parquet.Row) error {
+	if w.shards != nil {
+		shard := <-w.shards
+		defer func() { w.shards <- shard }()
+		if _, err := shard.rowGroup.WriteRows(rows); err != nil {
+			return err
+		}
+		return w.commitShard(shard)
+	}
+
+	w.commitMutex.Lock()
+	defer w.commitMutex.Unlock()
+	if _, err := w.writer.WriteRows(rows); err != nil {
+		return err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("flush error: %w", err)
+	}
+	return nil
+}
+
+// commitShard compresses the shard's pending pages, then appends its row group
+// to the file. Row groups land in the order they are committed.
+func (w *ParquetStreamWriter) commitShard(shard *parquetShard) error {
+	if err := shard.rowGroup.Flush(); err != nil {
+		return fmt.Errorf("flush error: %w", err)
+	}
+
+	w.commitMutex.Lock()
+	defer w.commitMutex.Unlock()
+	if _, err := shard.rowGroup.Commit(); err != nil {
+		return fmt.Errorf("row group commit error: %w", err)
+	}
+	shard.count = 0
+	return nil
+}
+
+// writeRow writes one packet as a Parquet row. The caller holds the mutex.
+func (w *ParquetStreamWriter) writeRow(p PacketResult) error {
+	return w.writer.Write(w.parquetRow(p))
+}
+
+// parquetRow returns the row struct of a packet.
+func (w *ParquetStreamWriter) parquetRow(p PacketResult) interface{} {
+	// Packets are already standardized by parser - write as-is.
+	// No length modification needed here.
+	var row interface{}
+	if w.width > 0 {
+		// Bytes past the end of a shorter row stay zero
+		v := reflect.New(w.rowType).Elem()
+		for i := 0; i < min(w.width, len(p.Data)); i++ {
+			v.Field(i).SetUint(uint64(p.Data[i]))
+		}
+		for i := range w.featureNames {
+			if i < len(p.Features) {
+				v.Field(w.width + i).SetFloat(p.Features[i])
+			}
+		}
+		setMetadataFields(v, w.width+len(w.featureNames), p, w.columns)
+		if w.hasClass {
+			v.Field(w.width + len(w.featureNames) + len(w.columns)).SetString(p.Class)
+		}
+		row = v.Addr().Interface()
+	} else if w.flows {
+		v := reflect.New(w.rowType).Elem()
+		packets := make([]parquetFlowPacket, len(p.Packets))
+		for i, fp := range p.Packets {
+			packets[i] = parquetFlowPacket{Bytes: fp.Data, Timestamp: fp.Timestamp.UnixNano(), Direction: fp.Direction}
+		}
+		v.Field(0).Set(reflect.ValueOf(packets))
+		for i := range w.featureNames {
+			if i < len(p.Features) {
+				v.Field(1 + i).SetFloat(p.Features[i])
+			}
+		}
+		setMetadataFields(v, 1+len(w.featureNames), p, w.columns)
+		v.Field(1 + len(w.featureNames) + len(w.columns)).SetString(p.Class)
+		row = v.Addr().Interface()
+	} else if w.huggingFace {
+		v := reflect.New(w.rowType).Elem()
+		v.Field(0).SetBytes(p.Data)
+		for i := range w.featureNames {
+			if i < len(p.Features) {
+				v.Field(1 + i).SetFloat(p.Features[i])
+			}
+		}
+		setMetadataFields(v, 1+len(w.featureNames), p, w.columns)
+		if w.hasClass {
+			v.Field(1 + len(w.featureNames) + len(w.columns)).SetInt(int64(w.classID(p.Class)))
+		}
+		row = v.Addr().Interface()
+	} else if w.rowType != nil {
+		v := reflect.New(w.rowType).Elem()
+		v.Field(0).SetBytes(p.Data)
+		for i := range w.featureNames {
+			if i < len(p.Features) {
+				v.Field(1 + i).SetFloat(p.Features[i])
+			}
+		}
+		setMetadataFields(v, 1+len(w.featureNames), p, w.columns)
+		v.Field(1 + len(w.featureNames) + len(w.columns)).SetString(p.Class)
+		row = v.Addr().Interface()
+	} else {
+		row = ParquetPacket{
+			Data:  p.Data,
+			Class: p.Class,
+		}
+	}
+	return row
+}
+
+// classID returns the label ID of a class in the huggingface layout.
+func (w *ParquetStreamWriter) classID(class string) byte {
+	w.classMutex.Lock()
+	defer w.classMutex.Unlock()
+	id, exists := w.classToInt[class]
+	if !exists {
+		id = w.nextClassID
+		w.classToInt[class] = id
+		w.nextClassID++
+	}
+	return id
+}
+
+// setClassIDs makes the labels of the huggingface layout use a fixed class
+// numbering. It must be called before the first write.
+func (w *ParquetStreamWriter) setClassIDs(ids map[string]byte) {
+	if !w.huggingFace {
+		return
+	}
+	for class, id := range ids {
+		w.classToInt[class] = id
+		if id >= w.nextClassID {
+			w.nextClassID = id + 1
+		}
+	}
+}
+
+// Close finishes and closes the file, closing it even if finishing fails. The
+// file gets its final name only once its footer is written.
 func (w *ParquetStreamWriter) Close() error {
+	err := w.finish()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return w.partial.finish(err)
+}
+
+// finish commits the pending rows and writes the footer.
+func (w *ParquetStreamWriter) finish() error {
+	// The groups that did not fill a row group, by class name
+	classes := slices.Sorted(maps.Keys(w.groups))
+	for _, class := range classes {
+		if group := w.groups[class]; len(group) > 0 {
+			if err := w.writeRowGroup(group); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Commit the partial row groups of all encoders (idle once writing is done).
+	for _, shard := range w.allShards {
+		if err := w.commitShard(shard); err != nil {
+			return err
+		}
+	}
+
+	// The datasets features, with the label names known once all rows are written
+	if w.huggingFace {
+		var classNames []string
+		if w.hasClass {
+			classNames = classNamesByID(w.classToInt)
+		}
+		info, err := huggingFaceInfo(huggingFaceFeatures(w.featureNames, w.columns, classNames))
+		if err != nil {
+			return err
+		}
+		w.writer.SetKeyValueMetadata(huggingFaceMetadataKey, info)
+	}
+	if w.provenance != nil {
+		record := w.provenance
+		if w.huggingFace && w.hasClass {
+			record = record.withClasses(w.classToInt)
+		}
+		data, err := record.marshal(false)
+		if err != nil {
+			return err
+		}
+		w.writer.SetKeyValueMetadata(provenanceMetadataKey, string(data))
+	}
+
 	// Final flush before closing.
 	if err := w.writer.Flush(); err != nil {
-		w.file.Close()
-		return err
-	}
-	if err := w.writer.Close(); err != nil {
-		w.file.Close()
 		return err
 	}
-	return w.file.Close()
+	return w.writer.Close()
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// parseFormats parses a comma-separated --format list such as "csv,parquet,npy".
+// "npy" is accepted as an alias of numpy so --format matches the file extension.
+func parseFormats(spec string) ([]string, error) {
+	var formats []string
+	for _, part := range strings.Split(spec, ",") {
+		format := strings.TrimSpace(part)
+		switch format {
+		case "npy":
+			format = "numpy"
+		case "csv", "parquet", "numpy", "bin", "pcap", "tokens":
+		default:
+			return nil, fmt.Errorf("unknown format %q (use csv, parquet, numpy, bin, pcap or tokens)", format)
+		}
+		if slices.Contains(formats, format) {
+			return nil, fmt.Errorf("format %q is listed twice", format)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// formatOutput is one file of a run's output.
+type formatOutput struct {
+	format   string
+	filename string
+}
+
+// formatOutputs returns the output of each format of a --format list. A single
+// format writes to filename as given; with several, each format replaces the
+// extension of filename with its own (out.parquet -> out.csv, out.parquet, out.npy).
+func formatOutputs(format, filename string) []formatOutput {
+	formats := strings.Split(format, ",")
+	if len(formats) == 1 {
+		return []formatOutput{{format, filename}}
+	}
+	base := filename
+	switch filepath.Ext(filename) {
+	case ".csv", ".parquet", ".npy", ".bin", ".pcap", ".txt":
+		base = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	outputs := make([]formatOutput, len(formats))
+	for i, f := range formats {
+		outputs[i] = formatOutput{f, base + "." + formatExtension(f)}
+	}
+	return outputs
+}
+
+// TeeStreamWriter feeds every row to several writers, so one parse of the
+// captures produces all the formats of a --format list.
+type TeeStreamWriter struct {
+	writers []StreamWriter
+}
+
+// NewTeeStreamWriter creates a writer per output of a --format list.
+func NewTeeStreamWriter(outputs []formatOutput, maxPacketSize int, hasClass bool, featureNames []string, wopts WriterOptions) (*TeeStreamWriter, error) {
+	w := &TeeStreamWriter{}
+	for _, output := range outputs {
+		writer, err := NewStreamWriter(output.format, output.filename, maxPacketSize, hasClass, featureNames, wopts)
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("%s output: %w", output.format, err)
+		}
+		w.writers = append(w.writers, writer)
+	}
+	return w, nil
+}
+
+func (w *TeeStreamWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch writes the batch to every writer in turn. Writers copy row bytes,
+// so the rows can be shared.
+func (w *TeeStreamWriter) WriteBatch(packets []PacketResult) error {
+	for _, writer := range w.writers {
+		if err := writer.WriteBatch(packets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setClassIDs fixes the class numbering of the NumPy and bin writers.
+func (w *TeeStreamWriter) setClassIDs(ids map[string]byte) {
+	for _, writer := range w.writers {
+		if numbered, ok := writer.(classNumberedWriter); ok {
+			numbered.setClassIDs(ids)
+		}
+	}
+}
+
+func (w *TeeStreamWriter) Close() error {
+	var firstErr error
+	for _, writer := range w.writers {
+		if err := writer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
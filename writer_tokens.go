@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// tokensLabelPrefix starts the label of a token line, as fastText expects.
+const tokensLabelPrefix = "__label__"
+
+// TokensStreamWriter writes rows as lines of text for NLP-style sequence
+// models and fastText baselines: the class as __label__<class>, then the
+// bytes of the row as space-separated tokens. A token is one byte, rendered
+// as --byte-repr (dec or hex), or with --token-word N a hex word of N bytes.
+// Padding is dropped, so lines are as long as their packets; features,
+// source columns and class IDs are not written.
+type TokensStreamWriter struct {
+	file     *os.File
+	buffer   *bufio.Writer
+	partial  partialFiles // The file, renamed on Close
+	hasClass bool
+	word     int          // Bytes per token
+	table    *[256]string // Single-byte tokens
+	line     []byte
+	mutex    sync.Mutex
+}
+
+// NewTokensStreamWriter creates a token writer.
+func NewTokensStreamWriter(filename string, hasClass bool, wopts WriterOptions) (*TokensStreamWriter, error) {
+	w := &TokensStreamWriter{
+		hasClass: hasClass,
+		word:     max(wopts.TokenWord, 1),
+		table:    csvByteTable(wopts.ByteRepr),
+	}
+	file, err := w.partial.create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	w.file = file
+	w.buffer = bufio.NewWriterSize(file, 4*1024*1024)
+	return w, nil
+}
+
+// tokensBaseName strips the .txt extension from an output name.
+func tokensBaseName(filename string) string {
+	return strings.TrimSuffix(filename, ".txt")
+}
+
+// tokensLabel returns the label of a class, with whitespace, which would end
+// the label, replaced by underscores.
+func tokensLabel(class string) string {
+	return strings.Join(strings.Fields(class), "_")
+}
+
+func (w *TokensStreamWriter) WritePacket(p PacketResult) error {
+	return w.WriteBatch([]PacketResult{p})
+}
+
+// WriteBatch writes several packets under one lock.
+func (w *TokensStreamWriter) WriteBatch(packets []PacketResult) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, p := range packets {
+		data := p.Data
+		if p.OriginalSize > 0 && p.OriginalSize < len(data) {
+			data = data[:p.OriginalSize] // Padding, not packet bytes
+		}
+		line := w.line[:0]
+		if w.hasClass {
+			line = append(line, tokensLabelPrefix...)
+			line = append(line, tokensLabel(p.Class)...)
+		}
+		for i := 0; i < len(data); i += w.word {
+			if len(line) > 0 {
+				line = append(line, ' ')
+			}
+			if w.word == 1 {
+				line = append(line, w.table[data[i]]...)
+			} else {
+				line = hex.AppendEncode(line, data[i:min(i+w.word, len(data))])
+			}
+		}
+		line = append(line, '\n')
+		w.line = line
+		if _, err := w.buffer.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes the lines and gives the file its final name.
+func (w *TokensStreamWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	err := w.buffer.Flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return w.partial.finish(err)
+}
+
+// writeTokens writes the packets of an in-memory run as token lines.
+func writeTokens(filename string, packets []PacketResult, wopts WriterOptions) error {
+	hasClass := len(packets) > 0 && packets[0].Class != ""
+	w, err := NewTokensStreamWriter(filename, hasClass, wopts)
+	if err != nil {
+		return err
+	}
+	if err := w.WriteBatch(packets); err != nil {
+		w.file.Close()
+		w.partial.discard()
+		return err
+	}
+	return w.Close()
+}
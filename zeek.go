@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Zeek labels of packets without a connection and of unset fields.
+const (
+	zeekUnmatched = "unmatched"
+	zeekUnset     = "-"
+)
+
+// zeekTimeSlack is how far a packet may lie outside its connection's time span
+// and still match, for logs written by another sensor with a slightly off clock.
+const zeekTimeSlack = time.Second
+
+// zeekHistoryLetters are the conn.log history letters in the order of their
+// bits in zeek_history (upper case: originator, lower case: responder).
+const zeekHistoryLetters = "ShADadFfRrCcGgIiQqTtWw^"
+
+// zeekFeatureNames are the feature columns of --zeek-features.
+var zeekFeatureNames = []string{
+	"zeek_matched",  // 1 if the packet matched a connection, else 0 (the other columns are -1)
+	"zeek_orig",     // 1 if the packet was sent by the connection originator
+	"zeek_duration", // Seconds
+	"zeek_orig_pkts",
+	"zeek_resp_pkts",
+	"zeek_orig_bytes", // Payload bytes
+	"zeek_resp_bytes",
+	"zeek_history", // Bit i set if history has letter i of zeekHistoryLetters
+}
+
+// zeekConn is one conn.log connection.
+type zeekConn struct {
+	orig       netip.AddrPort
+	start, end time.Time
+	label      string
+	features   []float64 // zeekFeatureNames values after zeek_matched and zeek_orig
+}
+
+// ZeekIndex matches packets to the connections of a Zeek log directory
+// (--zeek-logs) by 5-tuple and time, for Zeek field labels (--label-by zeek)
+// and --zeek-features. It is safe for concurrent use by readers.
+type ZeekIndex struct {
+	conns    map[endpointKey][]*zeekConn // Sorted by start time
+	classes  map[string]byte             // Label values in sorted order
+	features bool
+
+	matched   atomic.Int64
+	unmatched atomic.Int64
+}
+
+// NewZeekIndex loads conn.log from dir. labelField names the field rows are
+// labeled with ("" = no labels): a conn.log field such as service, uid,
+// history or conn_state, or a dns.log/ssl.log field such as dns.query or
+// ssl.server_name, joined by uid.
+func NewZeekIndex(dir, labelField string, features bool) (*ZeekIndex, error) {
+	connField := labelField
+	var joined map[string]string
+	if log, field, ok := strings.Cut(labelField, "."); ok && (log == "dns" || log == "ssl") {
+		var err error
+		joined, err = readZeekJoin(dir, log, field)
+		if err != nil {
+			return nil, err
+		}
+		connField = ""
+	}
+
+	files, err := zeekLogFiles(dir, "conn")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no conn.log in %s", dir)
+	}
+
+	idx := &ZeekIndex{
+		conns:    make(map[endpointKey][]*zeekConn),
+		classes:  make(map[string]byte),
+		features: features,
+	}
+	labels := map[string]bool{}
+	count := 0
+	for _, file := range files {
+		err := readZeekLog(file, func(record zeekRecord) error {
+			conn, key, err := record.conn()
+			if err != nil {
+				return err
+			}
+			switch {
+			case joined != nil:
+				conn.label = joined[record.get("uid")]
+				if conn.label == "" {
+					conn.label = zeekUnset
+				}
+			case connField != "":
+				conn.label = record.get(connField)
+			}
+			if labelField != "" {
+				labels[conn.label] = true
+			}
+			if features {
+				conn.features = record.features(conn)
+			}
+			idx.conns[key] = append(idx.conns[key], conn)
+			count++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, conns := range idx.conns {
+		sort.Slice(conns, func(i, j int) bool {
+			return conns[i].start.Before(conns[j].start)
+		})
+	}
+
+	if labelField != "" {
+		labels[zeekUnmatched] = true
+		names := make([]string, 0, len(labels))
+		for label := range labels {
+			names = append(names, label)
+		}
+		sort.Strings(names)
+		for i, label := range names {
+			idx.classes[label] = byte(i)
+		}
+	}
+
+	slog.Info("loaded Zeek connections", "dir", dir, "files", len(files), "connections", count, "labels", len(labels))
+	return idx, nil
+}
+
+// forPass returns an index with the same connections but its own match
+// counters, so a first pass over the inputs does not count packets twice.
+func (z *ZeekIndex) forPass() *ZeekIndex {
+	if z == nil {
+		return nil
+	}
+	return &ZeekIndex{conns: z.conns, classes: z.classes, features: z.features}
+}
+
+// classCount returns the number of distinct labels, unmatched packets included.
+func (z *ZeekIndex) classCount() int {
+	return len(z.classes)
+}
+
+// classIDs numbers the labels in sorted order.
+func (z *ZeekIndex) classIDs() map[string]byte {
+	return z.classes
+}
+
+// match returns the connection of a packet and whether the packet was sent by
+// its originator, or nil if no connection matches. Of the connections of the
+// 5-tuple that span the packet's time, the one started last wins.
+func (z *ZeekIndex) match(packet gopacket.Packet) (*zeekConn, bool) {
+	src, dst, proto, ok := packetEndpoints(packet)
+	if !ok {
+		z.unmatched.Add(1)
+		return nil, false
+	}
+	conns := z.conns[newEndpointKey(src, dst, proto)]
+	ts := packet.Metadata().Timestamp
+	i := sort.Search(len(conns), func(i int) bool {
+		return conns[i].start.After(ts.Add(zeekTimeSlack))
+	})
+	for i--; i >= 0; i-- {
+		if !ts.After(conns[i].end.Add(zeekTimeSlack)) {
+			z.matched.Add(1)
+			conn := conns[i]
+			return conn, src == conn.orig || (proto == "icmp" && src.Addr() == conn.orig.Addr())
+		}
+	}
+	z.unmatched.Add(1)
+	return nil, false
+}
+
+// label returns the label of a packet's connection.
+func (z *ZeekIndex) label(conn *zeekConn) string {
+	if conn == nil {
+		return zeekUnmatched
+	}
+	return conn.label
+}
+
+// featureValues returns the zeekFeatureNames values of a packet's connection.
+func (z *ZeekIndex) featureValues(conn *zeekConn, orig bool) []float64 {
+	if conn == nil {
+		values := make([]float64, len(zeekFeatureNames))
+		for i := 1; i < len(values); i++ {
+			values[i] = -1
+		}
+		return values
+	}
+	values := make([]float64, 0, len(zeekFeatureNames))
+	values = append(values, 1, boolFeature(orig))
+	return append(values, conn.features...)
+}
+
+// boolFeature returns 1 for true and 0 for false.
+func boolFeature(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// logMatches logs how many packets matched a connection, warning when none
+// did (usually a clock offset or logs of another capture).
+func (z *ZeekIndex) logMatches() {
+	matched, unmatched := z.matched.Load(), z.unmatched.Load()
+	if matched == 0 && unmatched > 0 {
+		slog.Warn("no packet matched a Zeek connection, check that the logs belong to the captures", "packets", unmatched)
+		return
+	}
+	slog.Info("matched packets to Zeek connections", "matched", matched, "unmatched", unmatched)
+}
+
+// zeekRecord is one log line, field name to value. Unset and empty fields
+// read as zeekUnset.
+type zeekRecord map[string]string
+
+// get returns a field, or zeekUnset if the log has no such field.
+func (r zeekRecord) get(field string) string {
+	if v, ok := r[field]; ok && v != "" {
+		return v
+	}
+	return zeekUnset
+}
+
+// number returns a numeric field, or -1 if it is unset.
+func (r zeekRecord) number(field string) float64 {
+	v, err := strconv.ParseFloat(r.get(field), 64)
+	if err != nil {
+		return -1
+	}
+	return v
+}
+
+// conn parses the endpoints and time span of a conn.log record.
+func (r zeekRecord) conn() (*zeekConn, endpointKey, error) {
+	start, err := parseZeekTime(r.get("ts"))
+	if err != nil {
+		return nil, endpointKey{}, fmt.Errorf("conn.log record %s: %w", r.get("uid"), err)
+	}
+	orig, err := r.endpoint("id.orig_h", "id.orig_p")
+	if err != nil {
+		return nil, endpointKey{}, err
+	}
+	resp, err := r.endpoint("id.resp_h", "id.resp_p")
+	if err != nil {
+		return nil, endpointKey{}, err
+	}
+
+	conn := &zeekConn{orig: orig, start: start, end: start}
+	if d := r.number("duration"); d > 0 {
+		conn.end = start.Add(time.Duration(d * float64(time.Second)))
+	}
+	return conn, newEndpointKey(orig, resp, r.get("proto")), nil
+}
+
+// endpoint parses an address and port field pair.
+func (r zeekRecord) endpoint(hostField, portField string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(r.get(hostField))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("conn.log record %s: invalid %s: %w", r.get("uid"), hostField, err)
+	}
+	port, err := strconv.ParseUint(r.get(portField), 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("conn.log record %s: invalid %s: %w", r.get("uid"), portField, err)
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// features returns the connection columns of --zeek-features.
+func (r zeekRecord) features(conn *zeekConn) []float64 {
+	history := -1.0
+	if h := r.get("history"); h != zeekUnset {
+		var bits uint32
+		for _, c := range h {
+			if i := strings.IndexRune(zeekHistoryLetters, c); i >= 0 {
+				bits |= 1 << i
+			}
+		}
+		history = float64(bits)
+	}
+	return []float64{
+		r.number("duration"),
+		r.number("orig_pkts"),
+		r.number("resp_pkts"),
+		r.number("orig_bytes"),
+		r.number("resp_bytes"),
+		history,
+	}
+}
+
+// parseZeekTime parses a Zeek timestamp: epoch seconds, or ISO 8601 in JSON
+// logs written with json_timestamps set to JSON::TS_ISO8601.
+func parseZeekTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(math.Round(frac*1e6))*1e3), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return t, nil
+}
+
+// zeekLogFiles returns the logs of a stream in dir: the current log
+// (conn.log) and rotated ones (conn.00:00:00-01:00:00.log), gzipped or not.
+func zeekLogFiles(dir, stream string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{stream + ".log", stream + ".*.log", stream + ".log.gz", stream + ".*.log.gz"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readZeekJoin maps the uids of a dns.log or ssl.log to one of its fields,
+// keeping the first record of each connection.
+func readZeekJoin(dir, stream, field string) (map[string]string, error) {
+	files, err := zeekLogFiles(dir, stream)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no %s.log in %s", stream, dir)
+	}
+	values := make(map[string]string)
+	for _, file := range files {
+		err := readZeekLog(file, func(record zeekRecord) error {
+			uid := record.get("uid")
+			if _, seen := values[uid]; !seen {
+				values[uid] = record.get(field)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// readZeekLog passes every record of a log file to fn. Both of Zeek's formats
+// are read: tab-separated with #fields headers, and JSON lines.
+func readZeekLog(filename string, fn func(zeekRecord) error) error {
+	r, err := openLogFile(filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	separator := "\t"
+	unset, empty := zeekUnset, "(empty)"
+	var fields []string
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		switch {
+		case text == "":
+			continue
+		case strings.HasPrefix(text, "{"):
+			record, err := parseZeekJSON(text)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, line, err)
+			}
+			if err := fn(record); err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, line, err)
+			}
+		case strings.HasPrefix(text, "#"):
+			directive, value, _ := strings.Cut(text[1:], separator)
+			switch {
+			case strings.HasPrefix(text, "#separator "):
+				separator = unescapeZeek(strings.TrimPrefix(text, "#separator "))
+			case directive == "fields":
+				fields = strings.Split(value, separator)
+			case directive == "unset_field":
+				unset = value
+			case directive == "empty_field":
+				empty = value
+			}
+		default:
+			if fields == nil {
+				return fmt.Errorf("%s:%d: record before the #fields header", filename, line)
+			}
+			values := strings.Split(text, separator)
+			record := make(zeekRecord, len(fields))
+			for i, field := range fields {
+				if i < len(values) && values[i] != unset && values[i] != empty {
+					record[field] = values[i]
+				}
+			}
+			if err := fn(record); err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, line, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// parseZeekJSON parses a JSON log line. Sets and vectors become
+// comma-separated strings like in tab-separated logs.
+func parseZeekJSON(text string) (zeekRecord, error) {
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(text), &raw); err != nil {
+		return nil, err
+	}
+	record := make(zeekRecord, len(raw))
+	for field, value := range raw {
+		record[field] = zeekJSONValue(value)
+	}
+	return record, nil
+}
+
+// zeekJSONValue renders a JSON value as it appears in tab-separated logs.
+func zeekJSONValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "T"
+		}
+		return "F"
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = zeekJSONValue(item)
+		}
+		return strings.Join(parts, ",")
+	}
+	return ""
+}
+
+// unescapeZeek decodes the \xNN escapes of a #separator header.
+func unescapeZeek(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if n, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}